@@ -0,0 +1,438 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+// AccountDataChangeHandler is called when an account data event changes. The room ID is empty for global account data.
+// The previous event is nil if there was no cached value before.
+type AccountDataChangeHandler func(ctx context.Context, roomID id.RoomID, prev, evt *event.Event)
+
+// IgnoredUsersChangeHandler is called when the m.ignored_user_list account data changes.
+type IgnoredUsersChangeHandler func(ctx context.Context, added, removed []id.UserID)
+
+// DirectChatsMutation modifies the m.direct account data. Mutations may be applied multiple times
+// (e.g. when a sync response arrives while the write is in progress), so they must be idempotent.
+type DirectChatsMutation func(content event.DirectChatsEventContent)
+
+type pendingDirectMutation struct {
+	fn DirectChatsMutation
+}
+
+// AccountDataCache keeps the latest global and per-room account data in memory.
+//
+// The cache is filled by registering it to a syncer (see [AccountDataCache.Register]),
+// and can also be filled manually using [AccountDataCache.Fetch] and [AccountDataCache.FetchRoom].
+type AccountDataCache struct {
+	Client *Client
+
+	global map[event.Type]*event.Event
+	rooms  map[id.RoomID]map[event.Type]*event.Event
+	lock   sync.RWMutex
+
+	serverDirect   event.DirectChatsEventContent
+	pendingDirect  []*pendingDirectMutation
+	directWriteMu  sync.Mutex
+	changeHandlers map[event.Type][]AccountDataChangeHandler
+	ignoreHandlers []IgnoredUsersChangeHandler
+	handlerLock    sync.RWMutex
+}
+
+// NewAccountDataCache creates a new empty account data cache for the given client.
+func NewAccountDataCache(cli *Client) *AccountDataCache {
+	return &AccountDataCache{
+		Client:         cli,
+		global:         make(map[event.Type]*event.Event),
+		rooms:          make(map[id.RoomID]map[event.Type]*event.Event),
+		changeHandlers: make(map[event.Type][]AccountDataChangeHandler),
+	}
+}
+
+// Register adds the cache's event handler to the given syncer.
+func (adc *AccountDataCache) Register(syncer ExtensibleSyncer) {
+	syncer.OnEvent(adc.HandleEvent)
+}
+
+// OnChange registers a handler that is called whenever the account data of the given type changes.
+// The handler is called for both global and room account data.
+func (adc *AccountDataCache) OnChange(evtType event.Type, handler AccountDataChangeHandler) {
+	evtType.Class = event.AccountDataEventType
+	adc.handlerLock.Lock()
+	adc.changeHandlers[evtType] = append(adc.changeHandlers[evtType], handler)
+	adc.handlerLock.Unlock()
+}
+
+// OnIgnoredUsersChange registers a handler that is called with the users that were added to or removed from
+// the ignored user list.
+func (adc *AccountDataCache) OnIgnoredUsersChange(handler IgnoredUsersChangeHandler) {
+	adc.handlerLock.Lock()
+	adc.ignoreHandlers = append(adc.ignoreHandlers, handler)
+	adc.handlerLock.Unlock()
+}
+
+// HandleEvent updates the cache with an account data event from sync. Events of other classes are ignored.
+func (adc *AccountDataCache) HandleEvent(ctx context.Context, evt *event.Event) {
+	if !evt.Type.IsAccountData() {
+		return
+	}
+	if evt.Content.Parsed == nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	if evt.RoomID == "" && evt.Type.Type == event.AccountDataDirectChats.Type {
+		adc.lock.Lock()
+		adc.serverDirect = cloneDirectChats(*evt.Content.AsDirectChats())
+		prev, newEvt := adc.recomputeDirectChats()
+		adc.lock.Unlock()
+		adc.notifyChange(ctx, "", prev, newEvt)
+		return
+	}
+	prev := adc.put(evt.RoomID, evt)
+	adc.notifyChange(ctx, evt.RoomID, prev, evt)
+}
+
+func (adc *AccountDataCache) put(roomID id.RoomID, evt *event.Event) (prev *event.Event) {
+	adc.lock.Lock()
+	defer adc.lock.Unlock()
+	return adc.putLocked(roomID, evt)
+}
+
+func (adc *AccountDataCache) putLocked(roomID id.RoomID, evt *event.Event) (prev *event.Event) {
+	if roomID == "" {
+		prev = adc.global[evt.Type]
+		adc.global[evt.Type] = evt
+	} else {
+		roomData, ok := adc.rooms[roomID]
+		if !ok {
+			roomData = make(map[event.Type]*event.Event)
+			adc.rooms[roomID] = roomData
+		}
+		prev = roomData[evt.Type]
+		roomData[evt.Type] = evt
+	}
+	return
+}
+
+func (adc *AccountDataCache) notifyChange(ctx context.Context, roomID id.RoomID, prev, evt *event.Event) {
+	if prev != nil && bytes.Equal(prev.Content.VeryRaw, evt.Content.VeryRaw) {
+		return
+	}
+	adc.handlerLock.RLock()
+	handlers := adc.changeHandlers[evt.Type]
+	ignoreHandlers := adc.ignoreHandlers
+	adc.handlerLock.RUnlock()
+	for _, handler := range handlers {
+		handler(ctx, roomID, prev, evt)
+	}
+	if roomID == "" && evt.Type.Type == event.AccountDataIgnoredUserList.Type && len(ignoreHandlers) > 0 {
+		var prevIgnored map[id.UserID]event.IgnoredUser
+		if prev != nil {
+			prevIgnored = prev.Content.AsIgnoredUserList().IgnoredUsers
+		}
+		newIgnored := evt.Content.AsIgnoredUserList().IgnoredUsers
+		var added, removed []id.UserID
+		for userID := range newIgnored {
+			if _, ok := prevIgnored[userID]; !ok {
+				added = append(added, userID)
+			}
+		}
+		for userID := range prevIgnored {
+			if _, ok := newIgnored[userID]; !ok {
+				removed = append(removed, userID)
+			}
+		}
+		if len(added) == 0 && len(removed) == 0 {
+			return
+		}
+		for _, handler := range ignoreHandlers {
+			handler(ctx, added, removed)
+		}
+	}
+}
+
+func makeAccountDataEvent(roomID id.RoomID, evtType event.Type, content any) (*event.Event, error) {
+	evtType.Class = event.AccountDataEventType
+	var raw json.RawMessage
+	var err error
+	switch typedContent := content.(type) {
+	case json.RawMessage:
+		raw = typedContent
+	case *event.Content:
+		raw, err = typedContent.MarshalJSON()
+	default:
+		raw, err = json.Marshal(content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal content: %w", err)
+	}
+	evt := &event.Event{
+		Type:    evtType,
+		RoomID:  roomID,
+		Content: event.Content{VeryRaw: raw},
+	}
+	_ = evt.Content.ParseRaw(evtType)
+	return evt, nil
+}
+
+// GetGlobal returns the cached global account data event of the given type, or nil if it's not cached.
+func (adc *AccountDataCache) GetGlobal(evtType event.Type) *event.Event {
+	evtType.Class = event.AccountDataEventType
+	adc.lock.RLock()
+	defer adc.lock.RUnlock()
+	return adc.global[evtType]
+}
+
+// GetRoom returns the cached room account data event of the given type, or nil if it's not cached.
+func (adc *AccountDataCache) GetRoom(roomID id.RoomID, evtType event.Type) *event.Event {
+	evtType.Class = event.AccountDataEventType
+	adc.lock.RLock()
+	defer adc.lock.RUnlock()
+	return adc.rooms[roomID][evtType]
+}
+
+// Fetch gets the global account data of the given type from the server and stores it in the cache.
+// If the account data doesn't exist, the cache is left unchanged and nil is returned.
+func (adc *AccountDataCache) Fetch(ctx context.Context, evtType event.Type) (*event.Event, error) {
+	return adc.fetch(ctx, "", evtType)
+}
+
+// FetchRoom gets the room account data of the given type from the server and stores it in the cache.
+// If the account data doesn't exist, the cache is left unchanged and nil is returned.
+func (adc *AccountDataCache) FetchRoom(ctx context.Context, roomID id.RoomID, evtType event.Type) (*event.Event, error) {
+	return adc.fetch(ctx, roomID, evtType)
+}
+
+func (adc *AccountDataCache) fetch(ctx context.Context, roomID id.RoomID, evtType event.Type) (*event.Event, error) {
+	var raw json.RawMessage
+	var err error
+	if roomID == "" {
+		err = adc.Client.GetAccountData(ctx, evtType.Type, &raw)
+	} else {
+		err = adc.Client.GetRoomAccountData(ctx, roomID, evtType.Type, &raw)
+	}
+	if errors.Is(err, MNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	evt, err := makeAccountDataEvent(roomID, evtType, raw)
+	if err != nil {
+		return nil, err
+	}
+	adc.HandleEvent(ctx, evt)
+	return evt, nil
+}
+
+// SetGlobal writes global account data and updates the cache optimistically.
+// If the write fails, the previous cached value is restored.
+func (adc *AccountDataCache) SetGlobal(ctx context.Context, evtType event.Type, content any) error {
+	return adc.set(ctx, "", evtType, content)
+}
+
+// SetRoom writes room account data and updates the cache optimistically.
+// If the write fails, the previous cached value is restored.
+func (adc *AccountDataCache) SetRoom(ctx context.Context, roomID id.RoomID, evtType event.Type, content any) error {
+	return adc.set(ctx, roomID, evtType, content)
+}
+
+func (adc *AccountDataCache) set(ctx context.Context, roomID id.RoomID, evtType event.Type, content any) error {
+	if roomID == "" && evtType.Type == event.AccountDataDirectChats.Type {
+		return fmt.Errorf("use UpdateDirectChats to change %s", evtType.Type)
+	}
+	evt, err := makeAccountDataEvent(roomID, evtType, content)
+	if err != nil {
+		return err
+	}
+	prev := adc.put(roomID, evt)
+	if roomID == "" {
+		err = adc.Client.SetAccountData(ctx, evtType.Type, evt.Content.VeryRaw)
+	} else {
+		err = adc.Client.SetRoomAccountData(ctx, roomID, evtType.Type, evt.Content.VeryRaw)
+	}
+	if err != nil {
+		adc.lock.Lock()
+		// Only revert if nothing else has replaced the value in the meantime
+		if adc.getLocked(roomID, evt.Type) == evt {
+			if prev != nil {
+				adc.putLocked(roomID, prev)
+			} else if roomID == "" {
+				delete(adc.global, evt.Type)
+			} else {
+				delete(adc.rooms[roomID], evt.Type)
+			}
+		}
+		adc.lock.Unlock()
+		return err
+	}
+	adc.notifyChange(ctx, roomID, prev, evt)
+	return nil
+}
+
+func (adc *AccountDataCache) getLocked(roomID id.RoomID, evtType event.Type) *event.Event {
+	if roomID == "" {
+		return adc.global[evtType]
+	}
+	return adc.rooms[roomID][evtType]
+}
+
+func cloneDirectChats(content event.DirectChatsEventContent) event.DirectChatsEventContent {
+	clone := make(event.DirectChatsEventContent, len(content))
+	for userID, rooms := range content {
+		clone[userID] = slices.Clone(rooms)
+	}
+	return clone
+}
+
+func (adc *AccountDataCache) recomputeDirectChats() (prev, evt *event.Event) {
+	content := cloneDirectChats(adc.serverDirect)
+	for _, mutation := range adc.pendingDirect {
+		mutation.fn(content)
+	}
+	// The content is a map, so marshaling can't fail
+	evt, _ = makeAccountDataEvent("", event.AccountDataDirectChats, content)
+	prev = adc.putLocked("", evt)
+	return
+}
+
+// UpdateDirectChats changes the m.direct account data using the given mutation.
+//
+// The mutation is applied to the cache immediately, and then to the latest m.direct content
+// fetched from the server before writing it back, so concurrent changes from other clients aren't overwritten.
+// Until the write is complete, the mutation is also re-applied on top of any m.direct updates received from sync.
+func (adc *AccountDataCache) UpdateDirectChats(ctx context.Context, mutation DirectChatsMutation) error {
+	pending := &pendingDirectMutation{fn: mutation}
+	adc.lock.Lock()
+	adc.pendingDirect = append(adc.pendingDirect, pending)
+	prev, evt := adc.recomputeDirectChats()
+	adc.lock.Unlock()
+	adc.notifyChange(ctx, "", prev, evt)
+
+	adc.directWriteMu.Lock()
+	defer adc.directWriteMu.Unlock()
+	var latest event.DirectChatsEventContent
+	err := adc.Client.GetAccountData(ctx, event.AccountDataDirectChats.Type, &latest)
+	if err != nil && !errors.Is(err, MNotFound) {
+		adc.finishDirectMutation(ctx, pending, nil)
+		return fmt.Errorf("failed to get latest direct chats: %w", err)
+	} else if latest == nil {
+		latest = make(event.DirectChatsEventContent)
+	}
+	mutation(latest)
+	err = adc.Client.SetAccountData(ctx, event.AccountDataDirectChats.Type, latest)
+	if err != nil {
+		adc.finishDirectMutation(ctx, pending, nil)
+		return fmt.Errorf("failed to set direct chats: %w", err)
+	}
+	adc.finishDirectMutation(ctx, pending, latest)
+	return nil
+}
+
+func (adc *AccountDataCache) finishDirectMutation(ctx context.Context, pending *pendingDirectMutation, newServerValue event.DirectChatsEventContent) {
+	adc.lock.Lock()
+	adc.pendingDirect = slices.DeleteFunc(adc.pendingDirect, func(item *pendingDirectMutation) bool {
+		return item == pending
+	})
+	if newServerValue != nil {
+		adc.serverDirect = newServerValue
+	}
+	prev, evt := adc.recomputeDirectChats()
+	adc.lock.Unlock()
+	adc.notifyChange(ctx, "", prev, evt)
+}
+
+// AddDirectChat marks the given room as a direct chat with the given user.
+func (adc *AccountDataCache) AddDirectChat(ctx context.Context, userID id.UserID, roomID id.RoomID) error {
+	return adc.UpdateDirectChats(ctx, func(content event.DirectChatsEventContent) {
+		if !slices.Contains(content[userID], roomID) {
+			content[userID] = append(content[userID], roomID)
+		}
+	})
+}
+
+// RemoveDirectChat removes the given room from the direct chats of all users.
+func (adc *AccountDataCache) RemoveDirectChat(ctx context.Context, roomID id.RoomID) error {
+	return adc.UpdateDirectChats(ctx, func(content event.DirectChatsEventContent) {
+		for userID, rooms := range content {
+			rooms = slices.DeleteFunc(rooms, func(item id.RoomID) bool {
+				return item == roomID
+			})
+			if len(rooms) == 0 {
+				delete(content, userID)
+			} else {
+				content[userID] = rooms
+			}
+		}
+	})
+}
+
+// DirectChats returns a copy of the cached m.direct account data.
+func (adc *AccountDataCache) DirectChats() event.DirectChatsEventContent {
+	evt := adc.GetGlobal(event.AccountDataDirectChats)
+	if evt == nil {
+		return event.DirectChatsEventContent{}
+	}
+	return cloneDirectChats(*evt.Content.AsDirectChats())
+}
+
+// IgnoredUsers returns a copy of the cached m.ignored_user_list account data.
+func (adc *AccountDataCache) IgnoredUsers() map[id.UserID]event.IgnoredUser {
+	evt := adc.GetGlobal(event.AccountDataIgnoredUserList)
+	if evt == nil {
+		return map[id.UserID]event.IgnoredUser{}
+	}
+	return maps.Clone(evt.Content.AsIgnoredUserList().IgnoredUsers)
+}
+
+// IsIgnored checks if the given user is in the cached ignored user list.
+func (adc *AccountDataCache) IsIgnored(userID id.UserID) bool {
+	evt := adc.GetGlobal(event.AccountDataIgnoredUserList)
+	if evt == nil {
+		return false
+	}
+	_, ignored := evt.Content.AsIgnoredUserList().IgnoredUsers[userID]
+	return ignored
+}
+
+// RoomTags returns a copy of the cached m.tag account data of the given room.
+func (adc *AccountDataCache) RoomTags(roomID id.RoomID) event.Tags {
+	evt := adc.GetRoom(roomID, event.AccountDataRoomTags)
+	if evt == nil {
+		return event.Tags{}
+	}
+	return maps.Clone(evt.Content.AsTag().Tags)
+}
+
+// FullyRead returns the cached m.fully_read marker of the given room.
+func (adc *AccountDataCache) FullyRead(roomID id.RoomID) id.EventID {
+	evt := adc.GetRoom(roomID, event.AccountDataFullyRead)
+	if evt == nil {
+		return ""
+	}
+	return evt.Content.AsFullyRead().EventID
+}
+
+// PushRules returns the cached m.push_rules account data, or nil if it's not cached.
+func (adc *AccountDataCache) PushRules() *pushrules.PushRuleset {
+	evt := adc.GetGlobal(event.AccountDataPushRules)
+	if evt == nil {
+		return nil
+	}
+	ruleset, _ := pushrules.EventToPushRules(evt)
+	return ruleset
+}
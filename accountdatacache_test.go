@@ -0,0 +1,113 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func accountDataSyncEvent(t *testing.T, roomID id.RoomID, evtType event.Type, content any) *event.Event {
+	evt, err := makeAccountDataEvent(roomID, evtType, content)
+	require.NoError(t, err)
+	return evt
+}
+
+func TestAccountDataCache_DirectChatsMerge(t *testing.T) {
+	var lock sync.Mutex
+	serverData := map[string]json.RawMessage{
+		"m.direct": json.RawMessage(`{"@alice:example.com":["!a:example.com"],"@bob:example.com":["!b:example.com"]}`),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		const prefix = "/_matrix/client/v3/user/@me:example.com/account_data/"
+		require.Contains(t, r.URL.Path, prefix)
+		name := r.URL.Path[len(prefix):]
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := serverData[name]
+			if !ok {
+				MNotFound.Write(w)
+				return
+			}
+			_, _ = w.Write(data)
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			serverData[name] = data
+			_, _ = w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	cli := newTestClient(t, server.URL)
+	cli.UserID = "@me:example.com"
+
+	ctx := context.Background()
+	cache := NewAccountDataCache(cli)
+	// The cache only knows about alice's room, bob's room was added by another client
+	cache.HandleEvent(ctx, accountDataSyncEvent(t, "", event.AccountDataDirectChats, event.DirectChatsEventContent{
+		"@alice:example.com": {"!a:example.com"},
+	}))
+	var changes int
+	cache.OnChange(event.AccountDataDirectChats, func(ctx context.Context, roomID id.RoomID, prev, evt *event.Event) {
+		changes++
+	})
+
+	require.NoError(t, cache.AddDirectChat(ctx, "@carol:example.com", "!c:example.com"))
+	expected := event.DirectChatsEventContent{
+		"@alice:example.com": {"!a:example.com"},
+		"@bob:example.com":   {"!b:example.com"},
+		"@carol:example.com": {"!c:example.com"},
+	}
+	assert.Equal(t, expected, cache.DirectChats())
+	var onServer event.DirectChatsEventContent
+	require.NoError(t, json.Unmarshal(serverData["m.direct"], &onServer))
+	assert.Equal(t, expected, onServer)
+	assert.Equal(t, 2, changes)
+
+	require.NoError(t, cache.RemoveDirectChat(ctx, "!a:example.com"))
+	assert.NotContains(t, cache.DirectChats(), id.UserID("@alice:example.com"))
+}
+
+func TestAccountDataCache_IgnoredUsers(t *testing.T) {
+	ctx := context.Background()
+	cache := NewAccountDataCache(&Client{UserID: "@me:example.com"})
+	var added, removed []id.UserID
+	cache.OnIgnoredUsersChange(func(ctx context.Context, a, r []id.UserID) {
+		added = append(added, a...)
+		removed = append(removed, r...)
+	})
+	cache.HandleEvent(ctx, accountDataSyncEvent(t, "", event.AccountDataIgnoredUserList, &event.IgnoredUserListEventContent{
+		IgnoredUsers: map[id.UserID]event.IgnoredUser{"@spam:example.com": {}},
+	}))
+	assert.True(t, cache.IsIgnored("@spam:example.com"))
+	assert.Equal(t, []id.UserID{"@spam:example.com"}, added)
+
+	cache.HandleEvent(ctx, accountDataSyncEvent(t, "", event.AccountDataIgnoredUserList, &event.IgnoredUserListEventContent{
+		IgnoredUsers: map[id.UserID]event.IgnoredUser{"@spam2:example.com": {}},
+	}))
+	assert.False(t, cache.IsIgnored("@spam:example.com"))
+	assert.Equal(t, []id.UserID{"@spam:example.com", "@spam2:example.com"}, added)
+	assert.Equal(t, []id.UserID{"@spam:example.com"}, removed)
+
+	cache.HandleEvent(ctx, accountDataSyncEvent(t, "!room:example.com", event.AccountDataRoomTags, &event.TagEventContent{
+		Tags: event.Tags{event.RoomTagFavourite: {}},
+	}))
+	assert.Contains(t, cache.RoomTags("!room:example.com"), event.RoomTagFavourite)
+}
@@ -45,9 +45,13 @@ func Create() *AppService {
 		Router:     http.NewServeMux(),
 		UserAgent:  mautrix.DefaultUserAgent,
 		txnIDC:     NewTransactionIDCache(128),
-		Live:       true,
-		Ready:      false,
-		ProcessID:  getDefaultProcessID(),
+		inbox: transactionInbox{
+			events:       make(map[*event.Event]inboxEvent),
+			transactions: make(map[string]*inboxTransaction),
+		},
+		Live:      true,
+		Ready:     false,
+		ProcessID: getDefaultProcessID(),
 
 		Events:         make(chan *event.Event, EventChannelSize),
 		ToDeviceEvents: make(chan *event.Event, EventChannelSize),
@@ -151,6 +155,9 @@ type AppService struct {
 	Log          zerolog.Logger
 
 	txnIDC *TransactionIDCache
+	inbox  transactionInbox
+	// TransactionStore is an optional durable inbox for transactions. See [TransactionStore] for more info.
+	TransactionStore TransactionStore
 
 	Events         chan *event.Event
 	ToDeviceEvents chan *event.Event
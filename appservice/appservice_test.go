@@ -2,14 +2,22 @@ package appservice
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 func TestClient_UnixSocket(t *testing.T) {
@@ -40,3 +48,169 @@ func TestClient_UnixSocket(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "@joe:example.org", string(resp.UserID))
 }
+
+type memoryTxnStore struct {
+	lock    sync.Mutex
+	txns    map[string]*PendingTransaction
+	order   []string
+	txnDone map[string]bool
+	getErr  error
+}
+
+func (m *memoryTxnStore) PutTransaction(ctx context.Context, txnID string, txn *Transaction) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, exists := m.txns[txnID]; exists {
+		return false, nil
+	}
+	m.txns[txnID] = &PendingTransaction{TxnID: txnID, Transaction: txn, DoneEvents: make(map[int]struct{})}
+	m.order = append(m.order, txnID)
+	return true, nil
+}
+
+func (m *memoryTxnStore) MarkEventDone(ctx context.Context, txnID string, index int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.txns[txnID].DoneEvents[index] = struct{}{}
+	return nil
+}
+
+func (m *memoryTxnStore) MarkTransactionDone(ctx context.Context, txnID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.txnDone[txnID] = true
+	return nil
+}
+
+func (m *memoryTxnStore) GetPendingTransactions(ctx context.Context) (pending []*PendingTransaction, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.getErr != nil {
+		return nil, m.getErr
+	}
+	for _, txnID := range m.order {
+		if !m.txnDone[txnID] {
+			pending = append(pending, m.txns[txnID])
+		}
+	}
+	return
+}
+
+func TestAppService_TransactionReplay(t *testing.T) {
+	store := &memoryTxnStore{txns: make(map[string]*PendingTransaction), txnDone: make(map[string]bool)}
+	txn := &Transaction{Events: []*event.Event{
+		{ID: "$a", Type: event.EventMessage, RoomID: "!room:example.com", Content: event.Content{VeryRaw: []byte(`{}`)}},
+		{ID: "$b", Type: event.EventMessage, RoomID: "!room:example.com", Content: event.Content{VeryRaw: []byte(`{}`)}},
+	}}
+	_, err := store.PutTransaction(context.Background(), "txn1", txn)
+	require.NoError(t, err)
+	require.NoError(t, store.MarkEventDone(context.Background(), "txn1", 0))
+
+	as := Create()
+	as.Registration = &Registration{}
+	as.TransactionStore = store
+	ep := NewEventProcessor(as)
+	ep.ExecMode = Sync
+	handled := make(chan id.EventID, 2)
+	ep.On(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+		handled <- evt.ID
+	})
+	ep.Start(context.Background())
+	defer ep.Stop()
+
+	require.NoError(t, as.replayTransactions(context.Background()))
+	select {
+	case evtID := <-handled:
+		assert.Equal(t, id.EventID("$b"), evtID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Replayed event wasn't handled")
+	}
+	assert.Eventually(t, func() bool {
+		pending, _ := store.GetPendingTransactions(context.Background())
+		return len(pending) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, handled)
+}
+
+func TestAppService_TransactionReplayBeforeNewTransactions(t *testing.T) {
+	store := &memoryTxnStore{txns: make(map[string]*PendingTransaction), txnDone: make(map[string]bool)}
+	_, err := store.PutTransaction(context.Background(), "txn1", &Transaction{Events: []*event.Event{
+		{ID: "$old", Type: event.EventMessage, RoomID: "!room:example.com", Content: event.Content{VeryRaw: []byte(`{}`)}},
+	}})
+	require.NoError(t, err)
+
+	as := Create()
+	as.Registration = &Registration{ServerToken: "hs_token"}
+	as.TransactionStore = store
+	ep := NewEventProcessor(as)
+	ep.ExecMode = Sync
+	handled := make(chan id.EventID, 2)
+	ep.On(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+		handled <- evt.ID
+	})
+	ep.Start(context.Background())
+	defer ep.Stop()
+
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn2", strings.NewReader(
+		`{"events": [{"event_id": "$new", "type": "m.room.message", "room_id": "!room:example.com", "content": {}}]}`,
+	))
+	req.Header.Set("Authorization", "Bearer hs_token")
+	resp := httptest.NewRecorder()
+	as.Router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	for _, expected := range []id.EventID{"$old", "$new"} {
+		select {
+		case evtID := <-handled:
+			assert.Equal(t, expected, evtID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %s wasn't handled", expected)
+		}
+	}
+}
+
+func TestAppService_TransactionReplayRetry(t *testing.T) {
+	store := &memoryTxnStore{txns: make(map[string]*PendingTransaction), txnDone: make(map[string]bool)}
+	_, err := store.PutTransaction(context.Background(), "txn1", &Transaction{Events: []*event.Event{
+		{ID: "$old", Type: event.EventMessage, RoomID: "!room:example.com", Content: event.Content{VeryRaw: []byte(`{}`)}},
+	}})
+	require.NoError(t, err)
+	store.getErr = errors.New("database is down")
+
+	as := Create()
+	as.Registration = &Registration{ServerToken: "hs_token"}
+	as.TransactionStore = store
+	ep := NewEventProcessor(as)
+	ep.ExecMode = Sync
+	handled := make(chan id.EventID, 2)
+	ep.On(event.EventMessage, func(ctx context.Context, evt *event.Event) {
+		handled <- evt.ID
+	})
+	ep.Start(context.Background())
+	defer ep.Stop()
+
+	putTxn := func() int {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn2", strings.NewReader(
+			`{"events": [{"event_id": "$new", "type": "m.room.message", "room_id": "!room:example.com", "content": {}}]}`,
+		))
+		req.Header.Set("Authorization", "Bearer hs_token")
+		resp := httptest.NewRecorder()
+		as.Router.ServeHTTP(resp, req)
+		return resp.Code
+	}
+	require.Equal(t, http.StatusInternalServerError, putTxn(), "transactions must be rejected until replaying succeeds")
+	assert.Empty(t, handled)
+
+	store.lock.Lock()
+	store.getErr = nil
+	store.lock.Unlock()
+	require.Equal(t, http.StatusOK, putTxn())
+	for _, expected := range []id.EventID{"$old", "$new"} {
+		select {
+		case evtID := <-handled:
+			assert.Equal(t, expected, evtID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %s wasn't handled", expected)
+		}
+	}
+}
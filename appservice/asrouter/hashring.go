@@ -0,0 +1,69 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package asrouter
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points each worker gets on the hash ring by default.
+const DefaultVirtualNodes = 128
+
+// HashRing is an immutable consistent hash ring. Adding or removing a worker only moves
+// the keys that were (or will be) owned by that worker.
+type HashRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint64
+	workerID string
+}
+
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// NewHashRing creates a hash ring with the given worker IDs.
+func NewHashRing(virtualNodes int, workerIDs ...string) *HashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	ring := &HashRing{points: make([]ringPoint, 0, len(workerIDs)*virtualNodes)}
+	for _, workerID := range workerIDs {
+		for i := 0; i < virtualNodes; i++ {
+			ring.points = append(ring.points, ringPoint{
+				hash:     hashKey(workerID + "#" + strconv.Itoa(i)),
+				workerID: workerID,
+			})
+		}
+	}
+	slices.SortFunc(ring.points, func(a, b ringPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return ring
+}
+
+// Get returns the ID of the worker that owns the given key, or an empty string if the ring has no workers.
+func (ring *HashRing) Get(key string) string {
+	if ring == nil || len(ring.points) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	idx, _ := slices.BinarySearchFunc(ring.points, hash, func(point ringPoint, target uint64) int {
+		return cmp.Compare(point.hash, target)
+	})
+	if idx == len(ring.points) {
+		idx = 0
+	}
+	return ring.points[idx].workerID
+}
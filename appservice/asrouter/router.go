@@ -0,0 +1,393 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package asrouter contains a transaction router for running multiple appservice workers behind one registration.
+//
+// The router receives transactions from the homeserver, partitions them by room ID using a consistent
+// hash ring and delivers each part to the worker that owns the room, either over the standard
+// appservice HTTP API or the websocket protocol used by [appservice.AppService.StartWebsocket].
+// Events that don't belong to a room (to-device events, device list changes, OTK counts) are sent
+// to the primary worker.
+package asrouter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exhttp"
+	"go.mau.fi/util/exstrings"
+	"golang.org/x/sync/errgroup"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrNoHealthyWorkers = errors.New("no healthy workers available")
+
+// Router partitions appservice transactions between workers.
+type Router struct {
+	Log          zerolog.Logger
+	Registration *appservice.Registration
+	Mux          *http.ServeMux
+
+	// VirtualNodes is the number of points each worker gets on the hash ring.
+	VirtualNodes int
+	// PrimaryWorkerID is the worker that receives events that aren't in any room.
+	// If unset or unhealthy, the primary worker is chosen using the hash ring.
+	PrimaryWorkerID string
+	// HealthCheckInterval is how often workers' health is checked.
+	HealthCheckInterval time.Duration
+	// SendRetries is the number of times delivering a transaction to a worker is retried
+	// before the worker is marked as unhealthy and its rooms are moved to other workers.
+	SendRetries int
+
+	workers map[string]*workerState
+	ring    *HashRing
+	lock    sync.RWMutex
+	stop    chan struct{}
+}
+
+type workerState struct {
+	Worker
+	healthy  bool
+	sendLock sync.Mutex
+}
+
+// NewRouter creates a new router with the given registration. The router must be given the same registration
+// as the homeserver, but the URL in the homeserver's copy should point at the router.
+func NewRouter(registration *appservice.Registration, log zerolog.Logger) *Router {
+	r := &Router{
+		Log:                 log,
+		Registration:        registration,
+		Mux:                 http.NewServeMux(),
+		VirtualNodes:        DefaultVirtualNodes,
+		HealthCheckInterval: 15 * time.Second,
+		SendRetries:         2,
+
+		workers: make(map[string]*workerState),
+	}
+	r.Mux.HandleFunc("PUT /_matrix/app/v1/transactions/{txnID}", r.PutTransaction)
+	r.Mux.HandleFunc("POST /_matrix/app/v1/ping", r.PostPing)
+	r.Mux.HandleFunc("GET /_matrix/mau/live", r.GetLive)
+	r.Mux.HandleFunc("GET /_matrix/mau/ready", r.GetReady)
+	r.Mux.HandleFunc("GET /_matrix/client/unstable/fi.mau.as_sync", r.ServeWebsocket)
+	return r
+}
+
+// AddWorker adds a worker to the router, replacing any existing worker with the same ID.
+// New workers are assumed to be healthy until the next health check.
+func (r *Router) AddWorker(worker Worker) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.workers[worker.ID()] = &workerState{Worker: worker, healthy: true}
+	r.rebuildRing()
+}
+
+// RemoveWorker removes the given worker from the router. If the worker has already been replaced
+// by another worker with the same ID, this is a no-op.
+func (r *Router) RemoveWorker(worker Worker) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	existing, ok := r.workers[worker.ID()]
+	if ok && existing.Worker == worker {
+		delete(r.workers, worker.ID())
+		r.rebuildRing()
+	}
+}
+
+// rebuildRing must be called with the lock held.
+func (r *Router) rebuildRing() {
+	healthy := make([]string, 0, len(r.workers))
+	for workerID, state := range r.workers {
+		if state.healthy {
+			healthy = append(healthy, workerID)
+		}
+	}
+	r.ring = NewHashRing(r.VirtualNodes, healthy...)
+	r.Log.Debug().Strs("healthy_workers", healthy).Msg("Rebuilt worker hash ring")
+}
+
+func (r *Router) setHealthy(workerID string, healthy bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state, ok := r.workers[workerID]
+	if !ok || state.healthy == healthy {
+		return
+	}
+	state.healthy = healthy
+	r.Log.Info().Str("worker_id", workerID).Bool("healthy", healthy).Msg("Worker health changed")
+	r.rebuildRing()
+}
+
+// WorkerForRoom returns the ID of the worker that currently handles the given room.
+func (r *Router) WorkerForRoom(roomID id.RoomID) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.ring.Get(string(roomID))
+}
+
+// Start starts checking the health of workers in the background.
+func (r *Router) Start(ctx context.Context) {
+	r.stop = make(chan struct{})
+	go r.healthCheckLoop(ctx, r.stop)
+}
+
+// Stop stops the background health checks.
+func (r *Router) Stop() {
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+func (r *Router) healthCheckLoop(ctx context.Context, stop <-chan struct{}) {
+	ticker := time.NewTicker(r.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		r.CheckHealth(ctx)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CheckHealth checks the health of all workers once and updates the hash ring if necessary.
+func (r *Router) CheckHealth(ctx context.Context) {
+	r.lock.RLock()
+	workers := slices.Collect(maps.Values(r.workers))
+	r.lock.RUnlock()
+	var wg sync.WaitGroup
+	for _, worker := range workers {
+		wg.Go(func() {
+			checkCtx, cancel := context.WithTimeout(ctx, r.HealthCheckInterval)
+			defer cancel()
+			err := worker.CheckHealth(checkCtx)
+			if err != nil {
+				r.Log.Debug().Err(err).Str("worker_id", worker.ID()).Msg("Worker health check failed")
+			}
+			r.setHealthy(worker.ID(), err == nil)
+		})
+	}
+	wg.Wait()
+}
+
+func (r *Router) primaryWorker(ring *HashRing) string {
+	r.lock.RLock()
+	primary, ok := r.workers[r.PrimaryWorkerID]
+	r.lock.RUnlock()
+	if ok && primary.healthy {
+		return r.PrimaryWorkerID
+	}
+	return ring.Get("")
+}
+
+// Partition splits a transaction into per-worker transactions using the given hash ring.
+// Events in the same room always go to the same worker and keep their relative order.
+func (r *Router) Partition(ring *HashRing, txn *appservice.Transaction) map[string]*appservice.Transaction {
+	primary := r.primaryWorker(ring)
+	parts := make(map[string]*appservice.Transaction)
+	get := func(workerID string) *appservice.Transaction {
+		part, ok := parts[workerID]
+		if !ok {
+			part = &appservice.Transaction{Events: []*event.Event{}}
+			parts[workerID] = part
+		}
+		return part
+	}
+	byRoom := func(evt *event.Event) *appservice.Transaction {
+		if evt.RoomID == "" {
+			return get(primary)
+		}
+		return get(ring.Get(string(evt.RoomID)))
+	}
+	for _, evt := range txn.Events {
+		part := byRoom(evt)
+		part.Events = append(part.Events, evt)
+	}
+	for _, evt := range txn.EphemeralEvents {
+		part := byRoom(evt)
+		part.EphemeralEvents = append(part.EphemeralEvents, evt)
+	}
+	for _, evt := range txn.MSC2409EphemeralEvents {
+		part := byRoom(evt)
+		part.MSC2409EphemeralEvents = append(part.MSC2409EphemeralEvents, evt)
+	}
+	if len(txn.ToDeviceEvents) > 0 || len(txn.MSC2409ToDeviceEvents) > 0 || txn.DeviceLists != nil ||
+		txn.MSC3202DeviceLists != nil || txn.DeviceOTKCount != nil || txn.MSC3202DeviceOTKCount != nil ||
+		txn.FallbackKeys != nil || txn.MSC3202FallbackKeys != nil {
+		part := get(primary)
+		part.ToDeviceEvents = txn.ToDeviceEvents
+		part.MSC2409ToDeviceEvents = txn.MSC2409ToDeviceEvents
+		part.DeviceLists = txn.DeviceLists
+		part.MSC3202DeviceLists = txn.MSC3202DeviceLists
+		part.DeviceOTKCount = txn.DeviceOTKCount
+		part.MSC3202DeviceOTKCount = txn.MSC3202DeviceOTKCount
+		part.FallbackKeys = txn.FallbackKeys
+		part.MSC3202FallbackKeys = txn.MSC3202FallbackKeys
+	}
+	return parts
+}
+
+// Route partitions the transaction and delivers each part to the responsible worker.
+// It only returns once all parts have been acknowledged by workers.
+//
+// If a worker fails to accept its part, the worker is marked as unhealthy and
+// the part is partitioned again between the remaining workers.
+func (r *Router) Route(ctx context.Context, txnID string, txn *appservice.Transaction) error {
+	return r.route(ctx, txnID, txn)
+}
+
+// partTransactionID returns the transaction ID to send to a worker for a part of a transaction.
+// The ID includes a hash of the part's content, so that a worker never ignores a rerouted part
+// as a duplicate of a different part it has already received, while exact retries keep the same ID.
+func partTransactionID(txnID string, part *appservice.Transaction) (string, error) {
+	data, err := json.Marshal(part)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal transaction part: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("%s.%s", txnID, base64.RawURLEncoding.EncodeToString(hash[:12])), nil
+}
+
+func (r *Router) route(ctx context.Context, txnID string, txn *appservice.Transaction) error {
+	r.lock.RLock()
+	ring := r.ring
+	r.lock.RUnlock()
+	if ring.Get("") == "" {
+		return ErrNoHealthyWorkers
+	}
+	parts := r.Partition(ring, txn)
+	var eg errgroup.Group
+	for workerID, part := range parts {
+		eg.Go(func() error {
+			partTxnID, err := partTransactionID(txnID, part)
+			if err != nil {
+				return err
+			}
+			err = r.deliver(ctx, workerID, partTxnID, part)
+			if err == nil {
+				return nil
+			} else if ctx.Err() != nil {
+				return err
+			}
+			r.Log.Warn().Err(err).
+				Str("worker_id", workerID).
+				Str("transaction_id", txnID).
+				Msg("Failed to deliver transaction to worker, rerouting")
+			r.setHealthy(workerID, false)
+			return r.route(ctx, txnID, part)
+		})
+	}
+	return eg.Wait()
+}
+
+func (r *Router) deliver(ctx context.Context, workerID, txnID string, txn *appservice.Transaction) (err error) {
+	r.lock.RLock()
+	worker, ok := r.workers[workerID]
+	r.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("worker %s not found", workerID)
+	}
+	// Only send one transaction to each worker at a time to keep events in order.
+	worker.sendLock.Lock()
+	defer worker.sendLock.Unlock()
+	for attempt := 0; attempt <= r.SendRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		err = worker.SendTransaction(ctx, txnID, txn)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *Router) checkServerToken(w http.ResponseWriter, req *http.Request) bool {
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		mautrix.MMissingToken.WithMessage("Missing access token").Write(w)
+		return false
+	} else if !exstrings.ConstantTimeEqual(authHeader[len("Bearer "):], r.Registration.ServerToken) {
+		mautrix.MUnknownToken.WithMessage("Invalid access token").Write(w)
+		return false
+	}
+	return true
+}
+
+// PutTransaction handles a /transactions PUT call from the homeserver.
+//
+// The transaction is only acknowledged after all workers have accepted their parts,
+// so the homeserver will retry it if delivery fails.
+func (r *Router) PutTransaction(w http.ResponseWriter, req *http.Request) {
+	if !r.checkServerToken(w, req) {
+		return
+	}
+	txnID := req.PathValue("txnID")
+	body, err := io.ReadAll(req.Body)
+	if err != nil || len(body) == 0 {
+		mautrix.MNotJSON.WithMessage("Failed to read request body").Write(w)
+		return
+	}
+	var txn appservice.Transaction
+	if err = json.Unmarshal(body, &txn); err != nil {
+		mautrix.MBadJSON.WithMessage("Failed to parse transaction content").Write(w)
+		return
+	}
+	log := r.Log.With().Str("transaction_id", txnID).Logger()
+	err = r.Route(log.WithContext(req.Context()), txnID, &txn)
+	if err != nil {
+		log.Err(err).Msg("Failed to route transaction")
+		mautrix.MUnknown.WithMessage("Failed to deliver transaction to workers").Write(w)
+		return
+	}
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func (r *Router) PostPing(w http.ResponseWriter, req *http.Request) {
+	if !r.checkServerToken(w, req) {
+		return
+	}
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+func (r *Router) GetLive(w http.ResponseWriter, req *http.Request) {
+	exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+}
+
+// GetReady returns OK if at least one worker is healthy.
+func (r *Router) GetReady(w http.ResponseWriter, req *http.Request) {
+	r.lock.RLock()
+	ready := r.ring.Get("") != ""
+	r.lock.RUnlock()
+	if ready {
+		exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+	} else {
+		exhttp.WriteEmptyJSONResponse(w, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package asrouter_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/appservice/asrouter"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestHashRing_MinimalMovement(t *testing.T) {
+	before := asrouter.NewHashRing(0, "a", "b", "c")
+	after := asrouter.NewHashRing(0, "a", "b", "c", "d")
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("!room%d:example.com", i)
+		oldOwner, newOwner := before.Get(key), after.Get(key)
+		if oldOwner != newOwner {
+			assert.Equal(t, "d", newOwner, "keys should only move to the new worker")
+			moved++
+		}
+	}
+	assert.Greater(t, moved, 100)
+	assert.Less(t, moved, 400)
+}
+
+type fakeWorker struct {
+	lock    sync.Mutex
+	events  []id.EventID
+	txnIDs  map[string]struct{}
+	healthy bool
+	server  *httptest.Server
+}
+
+func newFakeWorker(t *testing.T) *fakeWorker {
+	fw := &fakeWorker{healthy: true, txnIDs: make(map[string]struct{})}
+	fw.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fw.lock.Lock()
+		defer fw.lock.Unlock()
+		if !fw.healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodPut {
+			// Ignore duplicate transactions like a real appservice
+			txnID := path.Base(r.URL.Path)
+			if _, seen := fw.txnIDs[txnID]; seen {
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte("{}"))
+				return
+			}
+			fw.txnIDs[txnID] = struct{}{}
+			var txn appservice.Transaction
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&txn))
+			for _, evt := range txn.Events {
+				fw.events = append(fw.events, evt.ID)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(fw.server.Close)
+	return fw
+}
+
+func (fw *fakeWorker) setHealthy(healthy bool) {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	fw.healthy = healthy
+}
+
+func (fw *fakeWorker) getEvents() []id.EventID {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	return slices.Clone(fw.events)
+}
+
+func newTestRouter(t *testing.T, workerIDs ...string) (*asrouter.Router, map[string]*fakeWorker) {
+	router := asrouter.NewRouter(&appservice.Registration{ServerToken: "hs"}, zerolog.Nop())
+	router.SendRetries = 0
+	workers := make(map[string]*fakeWorker, len(workerIDs))
+	for _, workerID := range workerIDs {
+		fw := newFakeWorker(t)
+		workers[workerID] = fw
+		worker, err := asrouter.NewHTTPWorker(workerID, fw.server.URL, "hs")
+		require.NoError(t, err)
+		router.AddWorker(worker)
+	}
+	return router, workers
+}
+
+func testEvents(count, rooms int) []*event.Event {
+	evts := make([]*event.Event, count)
+	for i := range evts {
+		evts[i] = &event.Event{
+			ID:     id.EventID(fmt.Sprintf("$evt%d", i)),
+			RoomID: id.RoomID(fmt.Sprintf("!room%d:example.com", i%rooms)),
+			Type:   event.EventMessage,
+		}
+	}
+	return evts
+}
+
+func TestRouter_RouteAndFailover(t *testing.T) {
+	router, workers := newTestRouter(t, "w1", "w2")
+	evts := testEvents(20, 5)
+	require.NoError(t, router.Route(context.Background(), "txn1", &appservice.Transaction{Events: evts}))
+	for _, evt := range evts {
+		owner := workers[router.WorkerForRoom(evt.RoomID)]
+		assert.Contains(t, owner.getEvents(), evt.ID)
+	}
+
+	workers["w1"].setHealthy(false)
+	require.NoError(t, router.Route(context.Background(), "txn2", &appservice.Transaction{Events: evts}))
+	assert.Equal(t, "w2", router.WorkerForRoom(evts[0].RoomID))
+	assert.Len(t, workers["w2"].getEvents(), 20+len(evts)-len(workers["w1"].getEvents()))
+}
+
+func TestRouter_SimultaneousFailover(t *testing.T) {
+	router, workers := newTestRouter(t, "w1", "w2", "w3")
+	workers["w1"].setHealthy(false)
+	workers["w2"].setHealthy(false)
+	evts := testEvents(30, 10)
+	require.NoError(t, router.Route(context.Background(), "txn1", &appservice.Transaction{Events: evts}))
+	// Both failed workers' rooms are rerouted to w3, and neither part may be dropped as a duplicate
+	received := workers["w3"].getEvents()
+	assert.Len(t, received, len(evts))
+	for _, evt := range evts {
+		assert.Contains(t, received, evt.ID)
+	}
+
+}
+
+func TestRouter_RetriedTransactionAfterFailover(t *testing.T) {
+	router, workers := newTestRouter(t, "w1", "w2", "w3")
+	evts := testEvents(30, 10)
+	require.NoError(t, router.Route(context.Background(), "txn1", &appservice.Transaction{Events: evts}))
+	var movedEvents []id.EventID
+	for _, evt := range evts {
+		if router.WorkerForRoom(evt.RoomID) == "w3" {
+			movedEvents = append(movedEvents, evt.ID)
+		}
+	}
+	require.NotEmpty(t, movedEvents)
+
+	// If the homeserver retries the whole transaction after a worker failed, the surviving workers
+	// must not ignore the rooms that were moved to them as a duplicate of the part they already received
+	workers["w3"].setHealthy(false)
+	router.CheckHealth(context.Background())
+	require.Zero(t, countOwnedBy(router, evts, "w3"))
+	require.NoError(t, router.Route(context.Background(), "txn1", &appservice.Transaction{Events: evts}))
+	received := append(workers["w1"].getEvents(), workers["w2"].getEvents()...)
+	for _, evtID := range movedEvents {
+		assert.Contains(t, received, evtID)
+	}
+}
+
+func countOwnedBy(router *asrouter.Router, evts []*event.Event, workerID string) int {
+	count := 0
+	for _, evt := range evts {
+		if router.WorkerForRoom(evt.RoomID) == workerID {
+			count++
+		}
+	}
+	return count
+}
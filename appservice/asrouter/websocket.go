@@ -0,0 +1,197 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package asrouter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coder/websocket"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exstrings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+)
+
+// WebsocketWorker is a worker connected to the router using the appservice websocket protocol
+// (i.e. the worker called [appservice.AppService.StartWebsocket] with the router's URL).
+//
+// The worker ID is taken from the X-Mautrix-Process-ID header, so workers should set
+// [appservice.AppService.ProcessID] to a value that stays the same across restarts.
+type WebsocketWorker struct {
+	workerID string
+	conn     *websocket.Conn
+	log      zerolog.Logger
+
+	reqID      atomic.Int32
+	waiters    map[int]chan *appservice.WebsocketCommand
+	waitersMu  sync.Mutex
+	writeMu    sync.Mutex
+	closed     chan struct{}
+	closedOnce sync.Once
+}
+
+var _ Worker = (*WebsocketWorker)(nil)
+
+var ErrWorkerDisconnected = errors.New("worker websocket disconnected")
+
+type websocketTransactionRequest struct {
+	appservice.WebsocketTransaction
+	ReqID   int    `json:"id"`
+	Command string `json:"command"`
+}
+
+func (ww *WebsocketWorker) ID() string {
+	return ww.workerID
+}
+
+func (ww *WebsocketWorker) send(ctx context.Context, data any) error {
+	ww.writeMu.Lock()
+	defer ww.writeMu.Unlock()
+	wr, err := ww.conn.Writer(ctx, websocket.MessageText)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(wr).Encode(data)
+	if err != nil {
+		_ = wr.Close()
+		return err
+	}
+	return wr.Close()
+}
+
+func (ww *WebsocketWorker) SendTransaction(ctx context.Context, txnID string, txn *appservice.Transaction) error {
+	reqID := int(ww.reqID.Add(1))
+	respChan := make(chan *appservice.WebsocketCommand, 1)
+	ww.waitersMu.Lock()
+	ww.waiters[reqID] = respChan
+	ww.waitersMu.Unlock()
+	defer func() {
+		ww.waitersMu.Lock()
+		delete(ww.waiters, reqID)
+		ww.waitersMu.Unlock()
+	}()
+	err := ww.send(ctx, &websocketTransactionRequest{
+		WebsocketTransaction: appservice.WebsocketTransaction{
+			Status:      "ok",
+			TxnID:       txnID,
+			Transaction: *txn,
+		},
+		ReqID:   reqID,
+		Command: "transaction",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send transaction: %w", err)
+	}
+	select {
+	case resp := <-respChan:
+		if resp.Command == "error" {
+			var respErr appservice.ErrorResponse
+			_ = json.Unmarshal(resp.Data, &respErr)
+			return fmt.Errorf("worker returned error: %w", &respErr)
+		}
+		return nil
+	case <-ww.closed:
+		return ErrWorkerDisconnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ww *WebsocketWorker) CheckHealth(ctx context.Context) error {
+	select {
+	case <-ww.closed:
+		return ErrWorkerDisconnected
+	default:
+		return nil
+	}
+}
+
+func (ww *WebsocketWorker) close() {
+	ww.closedOnce.Do(func() {
+		close(ww.closed)
+	})
+}
+
+func (ww *WebsocketWorker) consume(ctx context.Context) error {
+	defer ww.close()
+	for {
+		var msg appservice.WebsocketCommand
+		msgType, data, err := ww.conn.Read(ctx)
+		if err != nil {
+			return err
+		} else if msgType != websocket.MessageText {
+			continue
+		} else if err = json.Unmarshal(data, &msg); err != nil {
+			ww.log.Debug().Err(err).Msg("Failed to parse message from worker")
+			continue
+		}
+		switch msg.Command {
+		case "response", "error":
+			ww.waitersMu.Lock()
+			waiter, ok := ww.waiters[msg.ReqID]
+			// Remove the waiter before sending so that duplicate responses can't block on the full channel
+			delete(ww.waiters, msg.ReqID)
+			ww.waitersMu.Unlock()
+			if ok {
+				waiter <- &msg
+			} else {
+				ww.log.Warn().Int("req_id", msg.ReqID).Msg("Dropping response to unknown request ID")
+			}
+		default:
+			resp := msg.MakeResponse(false, fmt.Errorf("unsupported command %q", msg.Command))
+			if resp != nil {
+				err = ww.send(ctx, resp)
+				if err != nil {
+					ww.log.Warn().Err(err).Msg("Failed to send error response to worker")
+				}
+			}
+		}
+	}
+}
+
+// ServeWebsocket accepts websocket connections from workers. It's registered at the same path that
+// [appservice.AppService.StartWebsocket] connects to, so workers can use the router URL as the websocket base URL.
+func (r *Router) ServeWebsocket(w http.ResponseWriter, req *http.Request) {
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") ||
+		!exstrings.ConstantTimeEqual(authHeader[len("Bearer "):], r.Registration.AppToken) {
+		mautrix.MUnknownToken.WithMessage("Invalid access token").Write(w)
+		return
+	}
+	workerID := req.Header.Get("X-Mautrix-Process-ID")
+	if workerID == "" {
+		mautrix.MInvalidParam.WithMessage("Missing X-Mautrix-Process-ID header").Write(w)
+		return
+	}
+	conn, err := websocket.Accept(w, req, nil)
+	if err != nil {
+		r.Log.Warn().Err(err).Str("worker_id", workerID).Msg("Failed to accept worker websocket")
+		return
+	}
+	conn.SetReadLimit(50 * 1024 * 1024)
+	worker := &WebsocketWorker{
+		workerID: workerID,
+		conn:     conn,
+		log:      r.Log.With().Str("worker_id", workerID).Logger(),
+		waiters:  make(map[int]chan *appservice.WebsocketCommand),
+		closed:   make(chan struct{}),
+	}
+	worker.log.Info().Msg("Worker connected via websocket")
+	r.AddWorker(worker)
+	err = worker.consume(context.WithoutCancel(req.Context()))
+	worker.log.Info().Err(err).Msg("Worker websocket disconnected")
+	r.RemoveWorker(worker)
+	_ = conn.Close(websocket.StatusGoingAway, "")
+}
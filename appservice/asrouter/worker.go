@@ -0,0 +1,106 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package asrouter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+// Worker is a single appservice process that the router delivers transactions to.
+type Worker interface {
+	// ID returns a stable identifier for the worker. It's used as the key on the hash ring,
+	// so changing it will move rooms to different workers.
+	ID() string
+	// SendTransaction delivers a transaction to the worker and returns once the worker has acknowledged it.
+	SendTransaction(ctx context.Context, txnID string, txn *appservice.Transaction) error
+	// CheckHealth returns an error if the worker is not able to handle transactions.
+	CheckHealth(ctx context.Context) error
+}
+
+// HTTPWorker is a worker that receives transactions over the standard appservice HTTP API.
+//
+// The worker is expected to be a normal [appservice.AppService] using the same registration as the router.
+type HTTPWorker struct {
+	WorkerID string
+	// URL is the base URL of the worker's appservice HTTP server.
+	URL *url.URL
+	// HSToken is sent as the authorization header, i.e. the hs_token from the registration.
+	HSToken string
+	Client  *http.Client
+}
+
+var _ Worker = (*HTTPWorker)(nil)
+
+// NewHTTPWorker creates a new HTTP worker with the given ID and base URL.
+func NewHTTPWorker(workerID, baseURL, hsToken string) (*HTTPWorker, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse worker URL: %w", err)
+	}
+	return &HTTPWorker{
+		WorkerID: workerID,
+		URL:      parsed,
+		HSToken:  hsToken,
+		Client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (hw *HTTPWorker) ID() string {
+	return hw.WorkerID
+}
+
+func (hw *HTTPWorker) do(ctx context.Context, method string, path []string, body any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, hw.URL.JoinPath(path...).String(), reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+hw.HSToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := hw.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (hw *HTTPWorker) SendTransaction(ctx context.Context, txnID string, txn *appservice.Transaction) error {
+	return hw.do(ctx, http.MethodPut, []string{"_matrix", "app", "v1", "transactions", txnID}, txn)
+}
+
+// CheckHealth checks the live and ready endpoints of the worker's appservice HTTP server
+// (see [appservice.AppService.GetLive] and [appservice.AppService.GetReady]).
+func (hw *HTTPWorker) CheckHealth(ctx context.Context) error {
+	if err := hw.do(ctx, http.MethodGet, []string{"_matrix", "mau", "live"}, nil); err != nil {
+		return fmt.Errorf("live check failed: %w", err)
+	} else if err = hw.do(ctx, http.MethodGet, []string{"_matrix", "mau", "ready"}, nil); err != nil {
+		return fmt.Errorf("ready check failed: %w", err)
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"context"
 	"encoding/json"
 	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -128,31 +129,37 @@ func (ep *EventProcessor) DispatchDeviceList(ctx context.Context, dl *mautrix.De
 func (ep *EventProcessor) Dispatch(ctx context.Context, evt *event.Event) {
 	handlers, ok := ep.handlers[evt.Type]
 	if !ok {
+		ep.as.MarkEventDone(ctx, evt)
 		return
 	}
 	switch ep.ExecMode {
 	case AsyncHandlers:
+		if ep.as.TransactionStore == nil {
+			for _, handler := range handlers {
+				go ep.callHandler(ctx, handler, evt)
+			}
+			return
+		}
+		var wg sync.WaitGroup
 		for _, handler := range handlers {
-			go ep.callHandler(ctx, handler, evt)
+			wg.Go(func() {
+				ep.callHandler(ctx, handler, evt)
+			})
 		}
-	case AsyncLoop:
 		go func() {
-			for _, handler := range handlers {
-				ep.callHandler(ctx, handler, evt)
-			}
+			wg.Wait()
+			ep.as.MarkEventDone(ctx, evt)
 		}()
+	case AsyncLoop:
+		go ep.callHandlers(ctx, handlers, evt)
 	case Sync:
 		if ep.ExecSyncWarnTime == 0 && ep.ExecSyncTimeout == 0 {
-			for _, handler := range handlers {
-				ep.callHandler(ctx, handler, evt)
-			}
+			ep.callHandlers(ctx, handlers, evt)
 			return
 		}
 		doneChan := make(chan struct{})
 		go func() {
-			for _, handler := range handlers {
-				ep.callHandler(ctx, handler, evt)
-			}
+			ep.callHandlers(ctx, handlers, evt)
 			close(doneChan)
 		}()
 		select {
@@ -173,6 +180,14 @@ func (ep *EventProcessor) Dispatch(ctx context.Context, evt *event.Event) {
 		}
 	}
 }
+
+func (ep *EventProcessor) callHandlers(ctx context.Context, handlers []EventHandler, evt *event.Event) {
+	for _, handler := range handlers {
+		ep.callHandler(ctx, handler, evt)
+	}
+	ep.as.MarkEventDone(ctx, evt)
+}
+
 func (ep *EventProcessor) startEvents(ctx context.Context) {
 	for {
 		select {
@@ -28,10 +28,15 @@ import (
 
 // Start starts the HTTP server that listens for calls from the Matrix homeserver.
 func (as *AppService) Start() {
+	// Replay before listening, so that new transactions aren't handled before old ones
+	err := as.replayTransactionsOnce()
+	if err != nil {
+		// The transaction handler will retry and reject transactions until replaying succeeds
+		as.Log.Err(err).Msg("Failed to replay unfinished transactions")
+	}
 	as.server = &http.Server{
 		Handler: as.Router,
 	}
-	var err error
 	if as.Host.IsUnixSocket() {
 		err = as.listenUnix()
 	} else {
@@ -116,33 +121,67 @@ func (as *AppService) PutTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Make sure old transactions are handled first if the router is used without calling Start
+	err = as.replayTransactionsOnce()
+	if err != nil {
+		log.Err(err).Msg("Failed to replay unfinished transactions")
+		mautrix.MUnknown.WithMessage("Failed to replay unfinished transactions").Write(w)
+		return
+	}
 	var txn Transaction
 	err = json.Unmarshal(body, &txn)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to parse transaction content")
 		mautrix.MBadJSON.WithMessage("Failed to parse transaction content").Write(w)
+	} else if as.TransactionStore == nil {
+		as.handleTransaction(ctx, txnID, &txn, nil)
+		exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+	} else if _, isNew, err := as.persistTransaction(ctx, txnID, &txn); err != nil {
+		log.Err(err).Msg("Failed to store transaction")
+		mautrix.MUnknown.WithMessage("Failed to store transaction").Write(w)
+	} else if !isNew {
+		exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+		log.Debug().Msg("Ignoring duplicate transaction that is already stored")
 	} else {
-		as.handleTransaction(ctx, txnID, &txn)
 		exhttp.WriteEmptyJSONResponse(w, http.StatusOK)
+		as.trackTransaction(ctx, txnID, &txn, nil)
+		as.handleTransaction(ctx, txnID, &txn, nil)
 	}
 }
 
-func (as *AppService) handleTransaction(ctx context.Context, id string, txn *Transaction) {
+// handleTransaction dispatches the events in the given transaction.
+// Events whose indexes (see transactionEvents) are in the done map are skipped.
+func (as *AppService) handleTransaction(ctx context.Context, id string, txn *Transaction, done map[int]struct{}) {
 	log := zerolog.Ctx(ctx)
 	log.Debug().Object("content", txn).Msg("Starting handling of transaction")
+	var offset int
+	notDone := func(evts []*event.Event) []*event.Event {
+		start := offset
+		offset += len(evts)
+		if len(done) == 0 {
+			return evts
+		}
+		filtered := make([]*event.Event, 0, len(evts))
+		for i, evt := range evts {
+			if _, isDone := done[start+i]; !isDone {
+				filtered = append(filtered, evt)
+			}
+		}
+		return filtered
+	}
 	if as.Registration.EphemeralEvents {
 		if txn.EphemeralEvents != nil {
-			as.handleEvents(ctx, txn.EphemeralEvents, event.EphemeralEventType)
+			as.handleEvents(ctx, notDone(txn.EphemeralEvents), event.EphemeralEventType)
 		} else if txn.MSC2409EphemeralEvents != nil {
-			as.handleEvents(ctx, txn.MSC2409EphemeralEvents, event.EphemeralEventType)
+			as.handleEvents(ctx, notDone(txn.MSC2409EphemeralEvents), event.EphemeralEventType)
 		}
 		if txn.ToDeviceEvents != nil {
-			as.handleEvents(ctx, txn.ToDeviceEvents, event.ToDeviceEventType)
+			as.handleEvents(ctx, notDone(txn.ToDeviceEvents), event.ToDeviceEventType)
 		} else if txn.MSC2409ToDeviceEvents != nil {
-			as.handleEvents(ctx, txn.MSC2409ToDeviceEvents, event.ToDeviceEventType)
+			as.handleEvents(ctx, notDone(txn.MSC2409ToDeviceEvents), event.ToDeviceEventType)
 		}
 	}
-	as.handleEvents(ctx, txn.Events, event.UnknownEventType)
+	as.handleEvents(ctx, notDone(txn.Events), event.UnknownEventType)
 	if txn.DeviceLists != nil {
 		as.handleDeviceLists(ctx, txn.DeviceLists)
 	} else if txn.MSC3202DeviceLists != nil {
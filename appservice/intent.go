@@ -409,6 +409,23 @@ func (intent *IntentAPI) PowerLevels(ctx context.Context, roomID id.RoomID) (pl
 	return
 }
 
+// UpgradeRoom upgrades the given room to a new room version after making sure the intent is in the room.
+func (intent *IntentAPI) UpgradeRoom(ctx context.Context, roomID id.RoomID, req *mautrix.ReqUpgradeRoom) (*mautrix.RespUpgradeRoom, error) {
+	if err := intent.EnsureJoined(ctx, roomID); err != nil {
+		return nil, err
+	}
+	return intent.Client.UpgradeRoom(ctx, roomID, req)
+}
+
+// NewRoomUpgradeFollower creates a [mautrix.RoomUpgradeFollower] that joins replacement rooms using [IntentAPI.EnsureJoined].
+func (intent *IntentAPI) NewRoomUpgradeFollower() *mautrix.RoomUpgradeFollower {
+	follower := mautrix.NewRoomUpgradeFollower(intent.Client)
+	follower.JoinRoom = func(ctx context.Context, roomID id.RoomID, via []string) error {
+		return intent.EnsureJoined(ctx, roomID, EnsureJoinedParams{Via: via})
+	}
+	return follower
+}
+
 func (intent *IntentAPI) SetPowerLevels(ctx context.Context, roomID id.RoomID, levels *event.PowerLevelsEventContent) (resp *mautrix.RespSendEvent, err error) {
 	return intent.SendStateEvent(ctx, roomID, event.StatePowerLevels, "", &levels)
 }
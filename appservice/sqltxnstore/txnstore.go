@@ -0,0 +1,130 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sqltxnstore contains a SQL implementation of [appservice.TransactionStore].
+package sqltxnstore
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix/appservice"
+)
+
+//go:embed *.sql
+var rawUpgrades embed.FS
+
+var UpgradeTable = dbutil.BuildUpgradeTable().
+	WithFS(rawUpgrades).
+	Finish()
+
+const VersionTableName = "mx_as_transaction_version"
+
+// SQLTransactionStore is a durable inbox for appservice transactions.
+type SQLTransactionStore struct {
+	*dbutil.Database
+
+	// DoneRetention is how long handled transactions are kept to deduplicate retries from the homeserver.
+	DoneRetention time.Duration
+}
+
+var _ appservice.TransactionStore = (*SQLTransactionStore)(nil)
+
+func NewSQLTransactionStore(db *dbutil.Database, log dbutil.DatabaseLogger) *SQLTransactionStore {
+	return &SQLTransactionStore{
+		Database:      db.Child(VersionTableName, UpgradeTable, log),
+		DoneRetention: 24 * time.Hour,
+	}
+}
+
+const (
+	putTransactionQuery = `
+		INSERT INTO mx_as_transaction (txn_id, data, received_at) VALUES ($1, $2, $3)
+		ON CONFLICT (txn_id) DO NOTHING
+	`
+	markEventDoneQuery = `
+		INSERT INTO mx_as_transaction_event (txn_id, event_index) VALUES ($1, $2)
+		ON CONFLICT (txn_id, event_index) DO NOTHING
+	`
+	markTransactionDoneQuery  = "UPDATE mx_as_transaction SET done=true WHERE txn_id=$1"
+	deleteDoneEventsQuery     = "DELETE FROM mx_as_transaction_event WHERE txn_id=$1"
+	getPendingQuery           = "SELECT txn_id, data FROM mx_as_transaction WHERE done=false ORDER BY received_at, txn_id"
+	getDoneEventsQuery        = "SELECT event_index FROM mx_as_transaction_event WHERE txn_id=$1"
+	pruneDoneTransactionQuery = "DELETE FROM mx_as_transaction WHERE done=true AND received_at<$1"
+)
+
+func (store *SQLTransactionStore) PutTransaction(ctx context.Context, txnID string, txn *appservice.Transaction) (bool, error) {
+	res, err := store.Exec(ctx, putTransactionQuery, txnID, dbutil.JSON{Data: txn}, time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (store *SQLTransactionStore) MarkEventDone(ctx context.Context, txnID string, index int) error {
+	_, err := store.Exec(ctx, markEventDoneQuery, txnID, index)
+	return err
+}
+
+func (store *SQLTransactionStore) MarkTransactionDone(ctx context.Context, txnID string) error {
+	return store.DoTxn(ctx, nil, func(ctx context.Context) error {
+		_, err := store.Exec(ctx, markTransactionDoneQuery, txnID)
+		if err != nil {
+			return err
+		}
+		_, err = store.Exec(ctx, deleteDoneEventsQuery, txnID)
+		return err
+	})
+}
+
+type pendingRow struct {
+	TxnID string
+	Txn   *appservice.Transaction
+}
+
+func (store *SQLTransactionStore) GetPendingTransactions(ctx context.Context) ([]*appservice.PendingTransaction, error) {
+	err := store.Prune(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune old transactions: %w", err)
+	}
+	rows, err := store.Query(ctx, getPendingQuery)
+	pending, err := dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (ret pendingRow, err error) {
+		err = row.Scan(&ret.TxnID, &dbutil.JSON{Data: &ret.Txn})
+		return
+	}, err).AsList()
+	if err != nil {
+		return nil, err
+	}
+	output := make([]*appservice.PendingTransaction, len(pending))
+	for i, row := range pending {
+		done := make(map[int]struct{})
+		rows, err := store.Query(ctx, getDoneEventsQuery, row.TxnID)
+		err = dbutil.NewRowIterWithError(rows, dbutil.ScanSingleColumn[int], err).Iter(func(index int) (bool, error) {
+			done[index] = struct{}{}
+			return true, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get handled events of %s: %w", row.TxnID, err)
+		}
+		output[i] = &appservice.PendingTransaction{
+			TxnID:       row.TxnID,
+			Transaction: row.Txn,
+			DoneEvents:  done,
+		}
+	}
+	return output, nil
+}
+
+// Prune deletes handled transactions that are older than DoneRetention.
+func (store *SQLTransactionStore) Prune(ctx context.Context) error {
+	_, err := store.Exec(ctx, pruneDoneTransactionQuery, time.Now().Add(-store.DoneRetention).UnixMilli())
+	return err
+}
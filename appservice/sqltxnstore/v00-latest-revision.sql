@@ -0,0 +1,19 @@
+-- v0 -> v1: Latest revision
+
+CREATE TABLE mx_as_transaction (
+	txn_id      TEXT    PRIMARY KEY,
+	data        jsonb   NOT NULL,
+	received_at BIGINT  NOT NULL,
+	done        BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX mx_as_transaction_pending_idx ON mx_as_transaction (done, received_at);
+
+CREATE TABLE mx_as_transaction_event (
+	txn_id      TEXT    NOT NULL,
+	event_index INTEGER NOT NULL,
+
+	PRIMARY KEY (txn_id, event_index),
+	CONSTRAINT mx_as_transaction_event_txn_fkey FOREIGN KEY (txn_id)
+		REFERENCES mx_as_transaction (txn_id) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,200 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package appservice
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// TransactionStore is a durable inbox for appservice transactions.
+//
+// When a store is set in [AppService.TransactionStore], transactions are written to the store before
+// they're acknowledged to the homeserver, each event is marked as done after the [EventProcessor]
+// (or the caller of [AppService.MarkEventDone]) has handled it, and transactions that weren't fully
+// handled are replayed when the appservice is started again.
+type TransactionStore interface {
+	// PutTransaction stores a received transaction. If a transaction with the same ID has already been stored,
+	// this must return false without modifying the existing transaction.
+	PutTransaction(ctx context.Context, txnID string, txn *Transaction) (isNew bool, err error)
+	// MarkEventDone marks a single event in a transaction as handled.
+	MarkEventDone(ctx context.Context, txnID string, index int) error
+	// MarkTransactionDone marks the whole transaction as handled.
+	MarkTransactionDone(ctx context.Context, txnID string) error
+	// GetPendingTransactions returns all transactions that haven't been marked as done, in the order they were received.
+	GetPendingTransactions(ctx context.Context) ([]*PendingTransaction, error)
+}
+
+// PendingTransaction is a transaction that was stored in a [TransactionStore], but not fully handled.
+type PendingTransaction struct {
+	TxnID       string
+	Transaction *Transaction
+	// DoneEvents contains the indexes of events that have already been handled.
+	DoneEvents map[int]struct{}
+}
+
+type inboxEvent struct {
+	txnID string
+	index int
+}
+
+type inboxTransaction struct {
+	remaining int
+}
+
+type transactionInbox struct {
+	events       map[*event.Event]inboxEvent
+	transactions map[string]*inboxTransaction
+	lock         sync.Mutex
+	replayLock   sync.Mutex
+	replayed     bool
+}
+
+// persistTransaction stores the transaction in the durable inbox if one is configured.
+// If there's no store, the transaction is always considered new.
+func (as *AppService) persistTransaction(ctx context.Context, txnID string, txn *Transaction) (string, bool, error) {
+	if as.TransactionStore == nil {
+		return txnID, true, nil
+	} else if txnID == "" {
+		txnID = "local-" + xid.New().String()
+	}
+	isNew, err := as.TransactionStore.PutTransaction(ctx, txnID, txn)
+	if err != nil {
+		return txnID, false, fmt.Errorf("failed to store transaction: %w", err)
+	}
+	return txnID, isNew, nil
+}
+
+// trackTransaction registers the events of a stored transaction, so that they can be marked as done once handled.
+func (as *AppService) trackTransaction(ctx context.Context, txnID string, txn *Transaction, done map[int]struct{}) {
+	if as.TransactionStore == nil {
+		return
+	}
+	evts := as.transactionEvents(txn)
+	as.inbox.lock.Lock()
+	remaining := 0
+	for i, evt := range evts {
+		if _, isDone := done[i]; !isDone {
+			as.inbox.events[evt] = inboxEvent{txnID: txnID, index: i}
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		as.inbox.transactions[txnID] = &inboxTransaction{remaining: remaining}
+	}
+	as.inbox.lock.Unlock()
+	if remaining == 0 {
+		err := as.TransactionStore.MarkTransactionDone(ctx, txnID)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to mark transaction as done")
+		}
+	}
+}
+
+// MarkEventDone marks an event from a transaction as handled in the [TransactionStore].
+//
+// This is called automatically by [EventProcessor], and only needs to be called manually
+// if events are read directly from the Events and ToDeviceEvents channels.
+func (as *AppService) MarkEventDone(ctx context.Context, evt *event.Event) {
+	if as.TransactionStore == nil {
+		return
+	}
+	as.inbox.lock.Lock()
+	ref, ok := as.inbox.events[evt]
+	if !ok {
+		as.inbox.lock.Unlock()
+		return
+	}
+	delete(as.inbox.events, evt)
+	txn := as.inbox.transactions[ref.txnID]
+	txn.remaining--
+	txnDone := txn.remaining <= 0
+	if txnDone {
+		delete(as.inbox.transactions, ref.txnID)
+	}
+	as.inbox.lock.Unlock()
+
+	log := zerolog.Ctx(ctx).With().
+		Str("transaction_id", ref.txnID).
+		Int("event_index", ref.index).
+		Logger()
+	var err error
+	if txnDone {
+		err = as.TransactionStore.MarkTransactionDone(ctx, ref.txnID)
+	} else {
+		err = as.TransactionStore.MarkEventDone(ctx, ref.txnID, ref.index)
+	}
+	if err != nil {
+		log.Err(err).Bool("transaction_done", txnDone).Msg("Failed to mark event as done")
+	}
+}
+
+// transactionEvents returns all the events in the transaction that will be dispatched in handleTransaction.
+// The indexes of the returned slice are used as event indexes in the TransactionStore.
+func (as *AppService) transactionEvents(txn *Transaction) []*event.Event {
+	var evts []*event.Event
+	if as.Registration.EphemeralEvents {
+		if txn.EphemeralEvents != nil {
+			evts = append(evts, txn.EphemeralEvents...)
+		} else if txn.MSC2409EphemeralEvents != nil {
+			evts = append(evts, txn.MSC2409EphemeralEvents...)
+		}
+		if txn.ToDeviceEvents != nil {
+			evts = append(evts, txn.ToDeviceEvents...)
+		} else if txn.MSC2409ToDeviceEvents != nil {
+			evts = append(evts, txn.MSC2409ToDeviceEvents...)
+		}
+	}
+	return append(evts, txn.Events...)
+}
+
+// replayTransactionsOnce replays unfinished transactions and blocks until they've been dispatched.
+// It must be called before new transactions are accepted, as replayed events would otherwise be handled out of order.
+// Once the replay succeeds, further calls are no-ops. If it fails, the next call will try again.
+func (as *AppService) replayTransactionsOnce() error {
+	if as.TransactionStore == nil {
+		return nil
+	}
+	as.inbox.replayLock.Lock()
+	defer as.inbox.replayLock.Unlock()
+	if as.inbox.replayed {
+		return nil
+	}
+	err := as.replayTransactions(as.Log.WithContext(context.Background()))
+	if err != nil {
+		return err
+	}
+	as.inbox.replayed = true
+	return nil
+}
+
+// replayTransactions dispatches all transactions that were stored in the TransactionStore,
+// but not fully handled, e.g. due to the process crashing.
+func (as *AppService) replayTransactions(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+	txns, err := as.TransactionStore.GetPendingTransactions(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get pending transactions: %w", err)
+	} else if len(txns) == 0 {
+		return nil
+	}
+	log.Info().Int("transaction_count", len(txns)).Msg("Replaying unfinished transactions")
+	for _, pending := range txns {
+		txnLog := log.With().Str("transaction_id", pending.TxnID).Logger()
+		as.txnIDC.MarkProcessed(pending.TxnID)
+		as.trackTransaction(txnLog.WithContext(ctx), pending.TxnID, pending.Transaction, pending.DoneEvents)
+		as.handleTransaction(txnLog.WithContext(ctx), pending.TxnID, pending.Transaction, pending.DoneEvents)
+	}
+	log.Info().Msg("Finished replaying unfinished transactions")
+	return nil
+}
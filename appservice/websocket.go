@@ -271,8 +271,26 @@ func (as *AppService) SetWebsocketCommandHandler(cmd string, handler WebsocketHa
 type WebsocketTransactionHandler func(ctx context.Context, msg WebsocketMessage) (bool, any)
 
 func (as *AppService) defaultHandleWebsocketTransaction(ctx context.Context, msg WebsocketMessage) (bool, any) {
-	if msg.TxnID == "" || !as.txnIDC.IsProcessed(msg.TxnID) {
-		as.handleTransaction(ctx, msg.TxnID, &msg.Transaction)
+	if as.TransactionStore != nil {
+		err := as.replayTransactionsOnce()
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to replay unfinished transactions")
+			return false, err
+		}
+		txnID, isNew, err := as.persistTransaction(ctx, msg.TxnID, &msg.Transaction)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to store transaction")
+			return false, err
+		} else if isNew {
+			as.trackTransaction(ctx, txnID, &msg.Transaction, nil)
+			as.handleTransaction(ctx, txnID, &msg.Transaction, nil)
+		} else {
+			zerolog.Ctx(ctx).Debug().
+				Object("content", &msg.Transaction).
+				Msg("Ignoring duplicate transaction that is already stored")
+		}
+	} else if msg.TxnID == "" || !as.txnIDC.IsProcessed(msg.TxnID) {
+		as.handleTransaction(ctx, msg.TxnID, &msg.Transaction, nil)
 	} else {
 		zerolog.Ctx(ctx).Debug().
 			Object("content", &msg.Transaction).
@@ -380,6 +398,10 @@ func (as *AppService) StartWebsocket(ctx context.Context, baseURL string, onConn
 	} else if parsed.Scheme == "https" {
 		parsed.Scheme = "wss"
 	}
+	// Replay before connecting, so that new transactions aren't handled before old ones
+	if err := as.replayTransactionsOnce(); err != nil {
+		return fmt.Errorf("failed to replay unfinished transactions: %w", err)
+	}
 	ws, resp, err := websocket.Dial(ctx, parsed.String(), &websocket.DialOptions{
 		HTTPClient: as.HTTPClient,
 		HTTPHeader: http.Header{
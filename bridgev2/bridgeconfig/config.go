@@ -103,6 +103,7 @@ type MatrixConfig struct {
 	FederateRooms         bool  `yaml:"federate_rooms"`
 	UploadFileThreshold   int64 `yaml:"upload_file_threshold"`
 	GhostExtraProfileInfo bool  `yaml:"ghost_extra_profile_info"`
+	LocalURLPreviews      bool  `yaml:"local_url_previews"`
 }
 
 type AnalyticsConfig struct {
@@ -41,6 +41,11 @@ type EncryptionConfig struct {
 	} `yaml:"verification_levels"`
 	AllowKeySharing bool `yaml:"allow_key_sharing"`
 
+	UndecryptableEvents struct {
+		Track      bool `yaml:"track"`
+		MaxAgeDays int  `yaml:"max_age_days"`
+	} `yaml:"undecryptable_events"`
+
 	Rotation struct {
 		EnableCustom bool  `yaml:"enable_custom"`
 		Milliseconds int64 `yaml:"milliseconds"`
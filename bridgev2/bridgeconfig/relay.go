@@ -111,7 +111,8 @@ func (rc *RelayConfig) FormatMessage(content *event.MessageEventContent, sender
 	if err != nil {
 		return nil, err
 	}
-	content.FormattedBody = output.String()
+	// The sender name and message come from remote users, so make sure they can't inject arbitrary HTML
+	content.FormattedBody = format.SanitizeHTML(output.String())
 	content.Body = format.HTMLToText(content.FormattedBody)
 	return content, nil
 }
@@ -112,6 +112,7 @@ func doUpgrade(helper up.Helper) {
 	helper.Copy(up.Bool, "matrix", "federate_rooms")
 	helper.Copy(up.Int, "matrix", "upload_file_threshold")
 	helper.Copy(up.Bool, "matrix", "ghost_extra_profile_info")
+	helper.Copy(up.Bool, "matrix", "local_url_previews")
 
 	helper.Copy(up.Str|up.Null, "analytics", "token")
 	helper.Copy(up.Str|up.Null, "analytics", "url")
@@ -135,6 +136,9 @@ func doUpgrade(helper up.Helper) {
 	helper.Copy(up.Str, "direct_media", "server_name")
 	helper.Copy(up.Str|up.Null, "direct_media", "well_known_response")
 	helper.Copy(up.Bool, "direct_media", "allow_proxy")
+	helper.Copy(up.Bool, "direct_media", "generate_thumbnails")
+	helper.Copy(up.Str|up.Null, "direct_media", "cache_dir")
+	helper.Copy(up.Int, "direct_media", "cache_max_size_mb")
 	if serverKey, ok := helper.Get(up.Str, "direct_media", "server_key"); !ok || serverKey == "generate" {
 		serverKey = federation.GenerateSigningKey().SynapseString()
 		helper.Set(up.Str, serverKey, "direct_media", "server_key")
@@ -198,6 +202,8 @@ func doUpgrade(helper up.Helper) {
 	helper.Copy(up.Str, "encryption", "verification_levels", "receive")
 	helper.Copy(up.Str, "encryption", "verification_levels", "send")
 	helper.Copy(up.Str, "encryption", "verification_levels", "share")
+	helper.Copy(up.Bool, "encryption", "undecryptable_events", "track")
+	helper.Copy(up.Int, "encryption", "undecryptable_events", "max_age_days")
 	helper.Copy(up.Bool, "encryption", "rotation", "enable_custom")
 	helper.Copy(up.Int, "encryption", "rotation", "milliseconds")
 	helper.Copy(up.Int, "encryption", "rotation", "messages")
@@ -48,6 +48,7 @@ type Crypto interface {
 	Decrypt(context.Context, *event.Event) (*event.Event, error)
 	Encrypt(context.Context, id.RoomID, event.Type, *event.Content) error
 	WaitForSession(context.Context, id.RoomID, id.SenderKey, id.SessionID, time.Duration) bool
+	TrackUTD(context.Context, *event.Event, error)
 	RequestSession(context.Context, id.RoomID, id.SenderKey, id.SessionID, id.UserID, id.DeviceID)
 	ResetSession(context.Context, id.RoomID)
 	Init(ctx context.Context) error
@@ -70,6 +71,7 @@ type Connector struct {
 	Provisioning *ProvisioningAPI
 	DoublePuppet *doublePuppetUtil
 	MediaProxy   *mediaproxy.MediaProxy
+	URLPreviewer *mediaproxy.URLPreviewer
 
 	uploadSema     *semaphore.Weighted
 	dmaSigKey      [32]byte
@@ -181,6 +183,7 @@ func (br *Connector) Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	br.initURLPreviews()
 	needsStateResync := br.Config.Encryption.Default &&
 		br.Bridge.DB.KV.Get(ctx, database.KeyEncryptionStateResynced) != "true"
 	if needsStateResync {
@@ -781,6 +784,25 @@ func (br *Connector) HandleNewlyBridgedRoom(ctx context.Context, roomID id.RoomI
 	return nil
 }
 
+func (br *Connector) initURLPreviews() {
+	if !br.Config.Matrix.LocalURLPreviews {
+		return
+	}
+	br.URLPreviewer = mediaproxy.NewURLPreviewer(br.Bridge.GetHTTPClientSettings())
+	br.URLPreviewer.UploadImage = br.uploadURLPreviewImage
+}
+
+func (br *Connector) uploadURLPreviewImage(ctx context.Context, data []byte, fileName, mimeType string) (id.ContentURIString, *event.EncryptedFileInfo, error) {
+	resp, err := br.Bot.UploadBytesWithName(ctx, data, mimeType, fileName)
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.ContentURI.CUString(), nil, nil
+}
+
 func (br *Connector) GetURLPreview(ctx context.Context, url string) (*event.LinkPreview, error) {
+	if br.URLPreviewer != nil {
+		return br.URLPreviewer.GetPreview(ctx, url)
+	}
 	return br.Bot.GetURLPreview(ctx, url)
 }
@@ -114,6 +114,12 @@ func (helper *CryptoHelper) Init(ctx context.Context) error {
 	helper.mach.DeletePreviousKeysOnReceive = encryptionConfig.DeleteKeys.DeletePrevOnNewSession
 	helper.mach.DeleteKeysOnDeviceDelete = encryptionConfig.DeleteKeys.DeleteOnDeviceDelete
 	helper.mach.DisableDeviceChangeKeyRotation = encryptionConfig.Rotation.DisableDeviceChangeKeyRotation
+	if encryptionConfig.UndecryptableEvents.Track {
+		helper.mach.UTDTracker = crypto.NewUTDTracker(helper.mach)
+		helper.mach.UTDTracker.MinTrust = encryptionConfig.VerificationLevels.Send
+		helper.mach.UTDTracker.MaxAge = time.Duration(encryptionConfig.UndecryptableEvents.MaxAgeDays) * 24 * time.Hour
+		helper.mach.UTDTracker.OnLateDecrypt = helper.handleLateDecrypt
+	}
 	if encryptionConfig.DeleteKeys.PeriodicallyDeleteExpired {
 		ctx, cancel := context.WithCancel(context.Background())
 		helper.cancelPeriodicDeleteLoop = cancel
@@ -492,6 +498,28 @@ func (helper *CryptoHelper) Encrypt(ctx context.Context, roomID id.RoomID, evtTy
 	return
 }
 
+// TrackUTD records an event that failed to decrypt, so that it can be decrypted and bridged later if the keys arrive.
+// Does nothing if undecryptable event tracking is disabled in the config.
+func (helper *CryptoHelper) TrackUTD(ctx context.Context, evt *event.Event, err error) {
+	if helper.mach.UTDTracker == nil {
+		return
+	} else if errors.Is(err, errDeviceNotTrusted) {
+		err = fmt.Errorf("%w: %w", crypto.ErrUnverifiedSender, err)
+	}
+	_, trackErr := helper.mach.UTDTracker.Record(ctx, evt, err)
+	if trackErr != nil {
+		zerolog.Ctx(ctx).Err(trackErr).Msg("Failed to record undecryptable event")
+	}
+}
+
+func (helper *CryptoHelper) handleLateDecrypt(ctx context.Context, utd *crypto.UndecryptableEvent, decrypted *event.Event) {
+	zerolog.Ctx(ctx).Info().
+		Stringer("event_id", utd.EventID).
+		Str("prev_utd_reason", string(utd.Reason)).
+		Msg("Received keys for previously undecryptable event, bridging it now")
+	helper.bridge.postDecrypt(ctx, utd.Event, decrypted, utd.Attempts, nil, time.Since(utd.FirstSeen))
+}
+
 func (helper *CryptoHelper) WaitForSession(ctx context.Context, roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, timeout time.Duration) bool {
 	helper.lock.RLock()
 	defer helper.lock.RUnlock()
@@ -405,6 +405,8 @@ func (as *ASIntent) UploadMediaStream(
 		ContentLength: size,
 		ContentType:   res.MimeType,
 		FileName:      res.FileName,
+
+		ResumableChunkSize: mautrix.DefaultResumableChunkSize,
 	}
 	if as.Connector.Config.Homeserver.AsyncMedia {
 		req.DoneCallback = func() {
@@ -128,6 +128,7 @@ func (br *Connector) handleEncryptedEvent(ctx context.Context, evt *event.Event)
 	if err != nil {
 		log.Warn().Err(err).Msg("Failed to decrypt event")
 		go br.sendCryptoStatusError(ctx, evt, err, nil, decryptionRetryCount, true)
+		br.Crypto.TrackUTD(ctx, evt, err)
 		return
 	}
 	br.postDecrypt(ctx, evt, decrypted, decryptionRetryCount, &errorEventID, time.Since(decryptionStart))
@@ -147,6 +148,7 @@ func (br *Connector) waitLongerForSession(ctx context.Context, evt *event.Event,
 	if !br.Crypto.WaitForSession(ctx, evt.RoomID, content.SenderKey, content.SessionID, extendedSessionWaitTimeout) {
 		log.Debug().Msg("Didn't get session, giving up trying to decrypt event")
 		go br.sendCryptoStatusError(ctx, evt, errNoDecryptionKeys, errorEventID, 2, true)
+		br.Crypto.TrackUTD(ctx, evt, NoSessionFound)
 		return
 	}
 
@@ -155,6 +157,7 @@ func (br *Connector) waitLongerForSession(ctx context.Context, evt *event.Event,
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to decrypt event")
 		go br.sendCryptoStatusError(ctx, evt, err, errorEventID, 2, true)
+		br.Crypto.TrackUTD(ctx, evt, err)
 		return
 	}
 
@@ -237,6 +240,7 @@ func (br *Connector) postDecrypt(ctx context.Context, original, decrypted *event
 		logEvt.Msg("Dropping event due to insufficient verification level")
 		err := deviceUnverifiedErrorWithExplanation(decrypted.Mautrix.TrustState)
 		go br.sendCryptoStatusError(ctx, decrypted, err, errorEventID, retryCount, true)
+		br.Crypto.TrackUTD(ctx, original, err)
 		return
 	}
 	copySomeKeys(original, decrypted)
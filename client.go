@@ -102,6 +102,9 @@ type Client struct {
 	longTokenLifetime bool
 	refreshLock       sync.RWMutex
 	SaveNewToken      func(ctx context.Context, refreshToken, accessToken string, expiry time.Time) error
+	// OAuthTokenStore is used to persist OAuth tokens after logging in with [Client.OAuthLogin]
+	// and after they're refreshed automatically.
+	OAuthTokenStore oauth.TokenStore
 
 	Log zerolog.Logger
 
@@ -123,6 +126,10 @@ type Client struct {
 	// Maximum time to wait between HTTP retries, defaults to 10 minutes.
 	// This applies to both the exponential backoff from gateway/network errors and to 429 errors.
 	MaxHTTPBackoff time.Duration
+	// Number of consecutive failures without progress allowed in resumable uploads (see [Client.ContinueResumableUpload]).
+	// Defaults to DefaultResumableUploadRetries. Unlike DefaultHTTPRetries, this can't be disabled,
+	// as the point of resumable uploads is to survive connection failures.
+	ResumableUploadRetries int
 	// Set to true to disable automatically sleeping on 429 errors.
 	IgnoreRateLimit bool
 
@@ -1253,6 +1260,15 @@ func (cli *Client) JoinRoom(ctx context.Context, roomIDorAlias string, req *ReqJ
 	return
 }
 
+// UpgradeRoom upgrades a room to a new room version. The server creates a new room, sends a tombstone
+// to the old room and returns the ID of the replacement room.
+// See https://spec.matrix.org/v1.15/client-server-api/#post_matrixclientv3roomsroomidupgrade
+func (cli *Client) UpgradeRoom(ctx context.Context, roomID id.RoomID, req *ReqUpgradeRoom) (resp *RespUpgradeRoom, err error) {
+	urlPath := cli.BuildClientURL("v3", "rooms", roomID, "upgrade")
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
+	return
+}
+
 // KnockRoom requests to join a room ID or alias. See https://spec.matrix.org/v1.13/client-server-api/#post_matrixclientv3knockroomidoralias
 //
 // The last parameter contains optional extra fields and can be left nil.
@@ -1819,9 +1835,11 @@ func (cli *Client) updateStoreWithOutgoingEvent(ctx context.Context, roomID id.R
 		return
 	}
 	fakeEvt := &event.Event{
-		StateKey: &stateKey,
-		Type:     eventType,
-		RoomID:   roomID,
+		StateKey:  &stateKey,
+		Sender:    cli.UserID,
+		Type:      eventType,
+		RoomID:    roomID,
+		Timestamp: time.Now().UnixMilli(),
 	}
 	var err error
 	fakeEvt.Content.VeryRaw, err = json.Marshal(contentJSON)
@@ -2167,6 +2185,10 @@ type ReqUploadMedia struct {
 	// UnstableUploadURL specifies the URL to upload the content to. MXC must also be set.
 	// see https://github.com/matrix-org/matrix-spec-proposals/pull/3870 for more info
 	UnstableUploadURL string
+
+	// ResumableChunkSize enables chunked resumable uploads if the server supports them (see FeatureResumableUploads).
+	// The content length must be known. Up to one chunk is buffered in memory at a time.
+	ResumableChunkSize int64
 }
 
 func (cli *Client) tryUploadMediaToURL(ctx context.Context, url, contentType string, content io.Reader, contentLength int64) (*http.Response, error) {
@@ -2279,6 +2301,9 @@ func (cli *Client) UploadMedia(ctx context.Context, data ReqUploadMedia) (*RespM
 		}
 		return cli.uploadMediaToURL(ctx, data)
 	}
+	if data.ResumableChunkSize > 0 && (data.ContentBytes != nil || data.ContentLength > 0) && cli.SpecVersions.Supports(FeatureResumableUploads) {
+		return cli.uploadMediaResumable(ctx, data)
+	}
 	u, _ := url.Parse(cli.BuildURL(MediaURLPath{"v3", "upload"}))
 	method := http.MethodPost
 	if !data.MXC.IsEmpty() {
@@ -2516,6 +2541,22 @@ func (cli *Client) GetRelations(ctx context.Context, roomID id.RoomID, eventID i
 	return
 }
 
+// Threads lists the threads in a room, ordered by the most recent activity.
+//
+// See https://spec.matrix.org/v1.15/client-server-api/#get_matrixclientv1roomsroomidthreads
+func (cli *Client) Threads(ctx context.Context, roomID id.RoomID, include ThreadListInclude, from string) (resp *RespThreads, err error) {
+	query := map[string]string{}
+	if include != "" {
+		query["include"] = string(include)
+	}
+	if from != "" {
+		query["from"] = from
+	}
+	urlPath := cli.BuildURLWithQuery(ClientURLPath{"v1", "rooms", roomID, "threads"}, query)
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
 func (cli *Client) MarkRead(ctx context.Context, roomID id.RoomID, eventID id.EventID) (err error) {
 	return cli.SendReceipt(ctx, roomID, eventID, event.ReceiptTypeRead, nil)
 }
@@ -2636,6 +2677,34 @@ func (cli *Client) UploadKeys(ctx context.Context, req *ReqUploadKeys) (resp *Re
 	return
 }
 
+// PutDehydratedDevice uploads a new dehydrated device, replacing any existing one (MSC3814).
+func (cli *Client) PutDehydratedDevice(ctx context.Context, req *ReqPutDehydratedDevice) (resp *RespDehydratedDevice, err error) {
+	urlPath := cli.BuildClientURL("unstable", "org.matrix.msc3814.v1", "dehydrated_device")
+	_, err = cli.MakeRequest(ctx, http.MethodPut, urlPath, req, &resp)
+	return
+}
+
+// GetDehydratedDevice gets the current dehydrated device (MSC3814).
+func (cli *Client) GetDehydratedDevice(ctx context.Context) (resp *RespDehydratedDevice, err error) {
+	urlPath := cli.BuildClientURL("unstable", "org.matrix.msc3814.v1", "dehydrated_device")
+	_, err = cli.MakeRequest(ctx, http.MethodGet, urlPath, nil, &resp)
+	return
+}
+
+// DeleteDehydratedDevice deletes the current dehydrated device (MSC3814).
+func (cli *Client) DeleteDehydratedDevice(ctx context.Context) (resp *RespDehydratedDevice, err error) {
+	urlPath := cli.BuildClientURL("unstable", "org.matrix.msc3814.v1", "dehydrated_device")
+	_, err = cli.MakeRequest(ctx, http.MethodDelete, urlPath, nil, &resp)
+	return
+}
+
+// GetDehydratedDeviceEvents fetches a batch of to-device events sent to the given dehydrated device (MSC3814).
+func (cli *Client) GetDehydratedDeviceEvents(ctx context.Context, deviceID id.DeviceID, nextBatch string) (resp *RespDehydratedDeviceEvents, err error) {
+	urlPath := cli.BuildClientURL("unstable", "org.matrix.msc3814.v1", "dehydrated_device", deviceID, "events")
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, &ReqDehydratedDeviceEvents{NextBatch: nextBatch}, &resp)
+	return
+}
+
 func (cli *Client) QueryKeys(ctx context.Context, req *ReqQueryKeys) (resp *RespQueryKeys, err error) {
 	urlPath := cli.BuildClientURL("v3", "keys", "query")
 	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, &resp)
@@ -63,6 +63,9 @@ func (mach *OlmMachine) SignUser(ctx context.Context, userID id.UserID, masterKe
 	if err := mach.CryptoStore.PutSignature(ctx, userID, masterKey, mach.Client.UserID, mach.CrossSigningKeys.UserSigningKey.PublicKey(), signature); err != nil {
 		return fmt.Errorf("error storing signature in crypto store: %w", err)
 	}
+	if _, err := mach.UpdateIdentityState(ctx, userID); err != nil {
+		return fmt.Errorf("error updating identity state: %w", err)
+	}
 
 	return nil
 }
@@ -19,6 +19,7 @@ import (
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -186,3 +187,90 @@ func TestTrustOtherDevice(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, id.TrustStateCrossSignedUntrusted, trustState)
 }
+
+func TestIdentityState(t *testing.T) {
+	ctx := context.TODO()
+	m := getOlmMachine(t)
+	otherUser := id.UserID("@anotheruser")
+	type stateChange struct {
+		prev, new IdentityState
+	}
+	var changes []stateChange
+	m.OnIdentityStateChange = func(ctx context.Context, userID id.UserID, prevState, newState IdentityState) {
+		assert.Equal(t, otherUser, userID)
+		changes = append(changes, stateChange{prevState, newState})
+	}
+	updateState := func(expected IdentityState) {
+		state, err := m.UpdateIdentityState(ctx, otherUser)
+		require.NoError(t, err)
+		assert.Equal(t, expected, state)
+	}
+
+	updateState(IdentityStateUnpinned)
+	firstKey, _ := olm.NewPKSigning()
+	m.CryptoStore.PutCrossSigningKey(ctx, otherUser, id.XSUsageMaster, firstKey.PublicKey())
+	updateState(IdentityStatePinned)
+
+	// Unverified identity change
+	secondKey, _ := olm.NewPKSigning()
+	m.CryptoStore.PutCrossSigningKey(ctx, otherUser, id.XSUsageMaster, secondKey.PublicKey())
+	updateState(IdentityStatePinViolation)
+	require.NoError(t, m.PinIdentity(ctx, otherUser))
+	updateState(IdentityStatePinned)
+
+	// Verified identity change
+	m.CryptoStore.PutSignature(ctx, otherUser, secondKey.PublicKey(), m.Client.UserID, m.CrossSigningKeys.UserSigningKey.PublicKey(), "sig1")
+	updateState(IdentityStateVerified)
+	thirdKey, _ := olm.NewPKSigning()
+	m.CryptoStore.PutCrossSigningKey(ctx, otherUser, id.XSUsageMaster, thirdKey.PublicKey())
+	updateState(IdentityStateVerificationViolation)
+	// The violation stays until it's acknowledged
+	updateState(IdentityStateVerificationViolation)
+
+	m.WithholdKeysOnVerificationViolation = true
+	assert.True(t, m.isWithheldForIdentity(ctx, otherUser))
+	session, err := NewOutboundGroupSession("!room:example.com", nil, nil)
+	require.NoError(t, err)
+	device := &id.Device{UserID: otherUser, DeviceID: "THEIRDEVICE", IdentityKey: "identity", SigningKey: "signing"}
+	withheld := make(map[id.DeviceID]*event.Content)
+	m.findOlmSessionsForUser(ctx, session, otherUser, map[id.DeviceID]*id.Device{device.DeviceID: device}, make(map[id.DeviceID]deviceSessionWrapper), withheld, nil, make(map[UserDevice]*SessionRecipient))
+	require.Contains(t, withheld, device.DeviceID)
+	assert.Equal(t, event.RoomKeyWithheldUnverified, withheld[device.DeviceID].AsRoomKeyWithheld().Code)
+
+	require.NoError(t, m.PinIdentity(ctx, otherUser))
+	state, err := m.GetIdentityState(ctx, otherUser)
+	require.NoError(t, err)
+	assert.Equal(t, IdentityStatePinned, state)
+	assert.False(t, m.isWithheldForIdentity(ctx, otherUser))
+
+	assert.Equal(t, []stateChange{
+		{"", IdentityStateUnpinned},
+		{IdentityStateUnpinned, IdentityStatePinned},
+		{IdentityStatePinned, IdentityStatePinViolation},
+		{IdentityStatePinViolation, IdentityStatePinned},
+		{IdentityStatePinned, IdentityStateVerified},
+		{IdentityStateVerified, IdentityStateVerificationViolation},
+		{IdentityStateVerificationViolation, IdentityStatePinned},
+	}, changes)
+}
+
+func TestIdentityState_VerifiedWithoutStoredState(t *testing.T) {
+	ctx := context.TODO()
+	m := getOlmMachine(t)
+	otherUser := id.UserID("@anotheruser")
+	// The user was verified before identity states were stored, so there's no stored state
+	firstKey, _ := olm.NewPKSigning()
+	m.CryptoStore.PutCrossSigningKey(ctx, otherUser, id.XSUsageMaster, firstKey.PublicKey())
+	m.CryptoStore.PutSignature(ctx, otherUser, firstKey.PublicKey(), m.Client.UserID, m.CrossSigningKeys.UserSigningKey.PublicKey(), "sig1")
+	secondKey, _ := olm.NewPKSigning()
+	m.CryptoStore.PutCrossSigningKey(ctx, otherUser, id.XSUsageMaster, secondKey.PublicKey())
+	stored, err := m.CryptoStore.GetIdentityState(ctx, otherUser)
+	require.NoError(t, err)
+	require.Empty(t, stored)
+
+	m.WithholdKeysOnVerificationViolation = true
+	assert.True(t, m.isWithheldForIdentity(ctx, otherUser))
+	state, err := m.UpdateIdentityState(ctx, otherUser)
+	require.NoError(t, err)
+	assert.Equal(t, IdentityStateVerificationViolation, state)
+}
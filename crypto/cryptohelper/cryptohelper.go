@@ -36,6 +36,9 @@ type CryptoHelper struct {
 	dbForManagedStores   *dbutil.Database
 
 	DecryptErrorCallback func(*event.Event, error)
+	// TrackUTDs enables recording undecryptable events in the crypto store using [crypto.UTDTracker].
+	// Recorded events that are decrypted later when keys arrive are dispatched like normal events.
+	TrackUTDs bool
 
 	MSC4190 bool
 	LoginAs *mautrix.ReqLogin
@@ -208,6 +211,12 @@ func (helper *CryptoHelper) Init(ctx context.Context) error {
 	} else if err = helper.verifyDeviceKeysOnServer(ctx); err != nil {
 		return err
 	}
+	if helper.TrackUTDs {
+		helper.mach.UTDTracker = crypto.NewUTDTracker(helper.mach)
+		helper.mach.UTDTracker.OnLateDecrypt = func(ctx context.Context, _ *crypto.UndecryptableEvent, decrypted *event.Event) {
+			helper.postDecrypt(ctx, decrypted)
+		}
+	}
 
 	if syncer != nil {
 		syncer.OnSync(helper.mach.ProcessSyncResponse)
@@ -304,12 +313,22 @@ func (helper *CryptoHelper) HandleEncrypted(ctx context.Context, evt *event.Even
 		go helper.waitForSession(ctx, evt)
 	} else if err != nil {
 		log.Warn().Err(err).Msg("Failed to decrypt event")
-		helper.DecryptErrorCallback(evt, err)
+		helper.decryptFailed(ctx, evt, err)
 	} else {
 		helper.postDecrypt(ctx, decrypted)
 	}
 }
 
+func (helper *CryptoHelper) decryptFailed(ctx context.Context, evt *event.Event, err error) {
+	if helper.mach.UTDTracker != nil {
+		_, trackErr := helper.mach.UTDTracker.Record(ctx, evt, err)
+		if trackErr != nil {
+			zerolog.Ctx(ctx).Err(trackErr).Msg("Failed to record undecryptable event")
+		}
+	}
+	helper.DecryptErrorCallback(evt, err)
+}
+
 func (helper *CryptoHelper) postDecrypt(ctx context.Context, decrypted *event.Event) {
 	decrypted.Mautrix.EventSource |= event.SourceDecrypted
 	if helper.CustomPostDecrypt != nil {
@@ -360,7 +379,7 @@ func (helper *CryptoHelper) waitForSession(ctx context.Context, evt *event.Event
 		decrypted, err := helper.Decrypt(ctx, evt)
 		if err != nil {
 			log.Warn().Err(err).Msg("Failed to decrypt event")
-			helper.DecryptErrorCallback(evt, err)
+			helper.decryptFailed(ctx, evt, err)
 		} else {
 			helper.postDecrypt(ctx, decrypted)
 		}
@@ -379,7 +398,7 @@ func (helper *CryptoHelper) waitLongerForSession(ctx context.Context, evt *event
 
 	if !helper.mach.WaitForSession(ctx, evt.RoomID, content.SenderKey, content.SessionID, extendedSessionWaitTimeout) {
 		log.Debug().Msg("Didn't get session, giving up")
-		helper.DecryptErrorCallback(evt, NoSessionFound)
+		helper.decryptFailed(ctx, evt, NoSessionFound)
 		return
 	}
 
@@ -387,7 +406,7 @@ func (helper *CryptoHelper) waitLongerForSession(ctx context.Context, evt *event
 	decrypted, err := helper.Decrypt(ctx, evt)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to decrypt event")
-		helper.DecryptErrorCallback(evt, err)
+		helper.decryptFailed(ctx, evt, err)
 		return
 	}
 
@@ -0,0 +1,245 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mau.fi/util/random"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/crypto/signatures"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// DehydratedDeviceAlgorithmV1 is the dehydrated device algorithm where the device data is an Olm account pickle
+// encrypted with a 32-byte key.
+const DehydratedDeviceAlgorithmV1 = "org.matrix.msc3814.v1.olm"
+
+// DehydratedDeviceDisplayName is the display name used for new dehydrated devices.
+const DehydratedDeviceDisplayName = "Dehydrated device"
+
+var (
+	ErrNoDehydratedDevice          = errors.New("no dehydrated device found")
+	ErrUnsupportedDehydratedDevice = errors.New("unsupported dehydrated device algorithm")
+	ErrInvalidDehydrationKeyLength = errors.New("dehydrated device key must be 32 bytes")
+)
+
+// GetOrCreateDehydratedDeviceKey gets the key used to encrypt dehydrated devices from secret storage.
+// If there's no key in secret storage, a new random key is generated and stored there.
+// The key is also saved in the crypto store, so that it can be reused without the SSSS key.
+func (mach *OlmMachine) GetOrCreateDehydratedDeviceKey(ctx context.Context, key *ssss.Key) ([]byte, error) {
+	pickleKey, err := mach.SSSS.GetDecryptedAccountData(ctx, event.AccountDataDehydratedDeviceKey, key)
+	if errors.Is(err, mautrix.MNotFound) {
+		pickleKey = random.Bytes(32)
+		err = mach.SSSS.SetEncryptedAccountData(ctx, event.AccountDataDehydratedDeviceKey, pickleKey, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store new dehydrated device key in secret storage: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get dehydrated device key from secret storage: %w", err)
+	}
+	if len(pickleKey) != 32 {
+		return nil, ErrInvalidDehydrationKeyLength
+	}
+	err = mach.CryptoStore.PutSecret(ctx, id.SecretDehydratedDevice, base64.RawStdEncoding.EncodeToString(pickleKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to save dehydrated device key: %w", err)
+	}
+	return pickleKey, nil
+}
+
+// GetStoredDehydratedDeviceKey gets the dehydrated device key from the crypto store, if it has been saved there
+// previously by [OlmMachine.GetOrCreateDehydratedDeviceKey] or received via secret sharing.
+func (mach *OlmMachine) GetStoredDehydratedDeviceKey(ctx context.Context) ([]byte, error) {
+	secret, err := mach.CryptoStore.GetSecret(ctx, id.SecretDehydratedDevice)
+	if err != nil {
+		return nil, err
+	} else if secret == "" {
+		return nil, nil
+	}
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+func (account *OlmAccount) getDehydratedDeviceKeys(userID id.UserID, deviceID id.DeviceID) (*mautrix.DeviceKeys, error) {
+	deviceKeys := &mautrix.DeviceKeys{
+		UserID:     userID,
+		DeviceID:   deviceID,
+		Algorithms: []id.Algorithm{id.AlgorithmMegolmV1, id.AlgorithmOlmV1},
+		Keys: map[id.DeviceKeyID]string{
+			id.NewDeviceKeyID(id.KeyAlgorithmCurve25519, deviceID): string(account.IdentityKey()),
+			id.NewDeviceKeyID(id.KeyAlgorithmEd25519, deviceID):    string(account.SigningKey()),
+		},
+		Dehydrated: true,
+	}
+	signature, err := account.SignJSON(deviceKeys)
+	if err != nil {
+		return nil, err
+	}
+	deviceKeys.Signatures = signatures.NewSingleSignature(userID, id.KeyAlgorithmEd25519, deviceID.String(), signature)
+	return deviceKeys, nil
+}
+
+// CreateDehydratedDevice creates a new dehydrated device encrypted with the given key and uploads it,
+// replacing any existing dehydrated device. If the machine has the self-signing key, the new device
+// is also cross-signed, so that other users will send room keys to it.
+func (mach *OlmMachine) CreateDehydratedDevice(ctx context.Context, pickleKey []byte) (id.DeviceID, error) {
+	if len(pickleKey) != 32 {
+		return "", ErrInvalidDehydrationKeyLength
+	}
+	log := mach.machOrContextLog(ctx)
+	account := NewOlmAccount()
+	deviceID := id.DeviceID(strings.ToUpper(random.String(10)))
+	deviceKeys, err := account.getDehydratedDeviceKeys(mach.Client.UserID, deviceID)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign dehydrated device keys: %w", err)
+	}
+	oneTimeKeys := account.getOneTimeKeys(mach.Client.UserID, deviceID, 0)
+	account.Internal.MarkKeysAsPublished()
+	pickled, err := account.Internal.Pickle(pickleKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to pickle dehydrated device: %w", err)
+	}
+	resp, err := mach.Client.PutDehydratedDevice(ctx, &mautrix.ReqPutDehydratedDevice{
+		DeviceID: deviceID,
+		DeviceData: mautrix.DehydratedDeviceData{
+			Algorithm:    DehydratedDeviceAlgorithmV1,
+			DevicePickle: string(pickled),
+		},
+		InitialDeviceDisplayName: DehydratedDeviceDisplayName,
+		DeviceKeys:               deviceKeys,
+		OneTimeKeys:              oneTimeKeys,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload dehydrated device: %w", err)
+	}
+	if resp.DeviceID != "" {
+		deviceID = resp.DeviceID
+	}
+	log.Debug().Stringer("device_id", deviceID).Msg("Uploaded new dehydrated device")
+	if mach.CrossSigningKeys != nil {
+		err = mach.SignOwnDevice(ctx, &id.Device{
+			UserID:      mach.Client.UserID,
+			DeviceID:    deviceID,
+			IdentityKey: account.IdentityKey(),
+			SigningKey:  account.SigningKey(),
+		})
+		if err != nil {
+			log.Warn().Err(err).Stringer("device_id", deviceID).Msg("Failed to cross-sign dehydrated device")
+		}
+	}
+	return deviceID, nil
+}
+
+// dehydratedDeviceStore is the crypto store used while processing events of a dehydrated device.
+// Olm sessions and device identities are kept in memory, while Megolm sessions go to the main store.
+type dehydratedDeviceStore struct {
+	*MemoryStore
+	mach     *OlmMachine
+	received int
+}
+
+func (dds *dehydratedDeviceStore) PutGroupSession(ctx context.Context, igs *InboundGroupSession) error {
+	err := dds.mach.CryptoStore.PutGroupSession(ctx, igs)
+	if err == nil {
+		dds.received++
+		dds.mach.MarkSessionReceived(ctx, igs.RoomID, igs.ID(), igs.Internal.FirstKnownIndex())
+	}
+	return err
+}
+
+func (dds *dehydratedDeviceStore) GetGroupSession(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) (*InboundGroupSession, error) {
+	return dds.mach.CryptoStore.GetGroupSession(ctx, roomID, sessionID)
+}
+
+func (dds *dehydratedDeviceStore) PutWithheldGroupSession(ctx context.Context, content event.RoomKeyWithheldEventContent) error {
+	return dds.mach.CryptoStore.PutWithheldGroupSession(ctx, content)
+}
+
+func (dds *dehydratedDeviceStore) GetWithheldGroupSession(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) (*event.RoomKeyWithheldEventContent, error) {
+	return dds.mach.CryptoStore.GetWithheldGroupSession(ctx, roomID, sessionID)
+}
+
+// RehydrateDevice claims the current dehydrated device and processes all to-device events that were sent to it
+// using [OlmMachine.HandleToDeviceEvent] on a temporary machine that uses the dehydrated account.
+// Room keys received this way are stored in this machine's crypto store.
+//
+// The returned count is the number of Megolm sessions that were stored.
+func (mach *OlmMachine) RehydrateDevice(ctx context.Context, pickleKey []byte) (int, error) {
+	if len(pickleKey) != 32 {
+		return 0, ErrInvalidDehydrationKeyLength
+	}
+	resp, err := mach.Client.GetDehydratedDevice(ctx)
+	if errors.Is(err, mautrix.MNotFound) {
+		return 0, ErrNoDehydratedDevice
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get dehydrated device: %w", err)
+	} else if resp.DeviceData.Algorithm != DehydratedDeviceAlgorithmV1 {
+		return 0, fmt.Errorf("%w %q", ErrUnsupportedDehydratedDevice, resp.DeviceData.Algorithm)
+	}
+	internal, err := olm.AccountFromPickled([]byte(resp.DeviceData.DevicePickle), pickleKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to unpickle dehydrated device: %w", err)
+	}
+	log := mach.machOrContextLog(ctx).With().
+		Str("action", "rehydrate device").
+		Stringer("dehydrated_device_id", resp.DeviceID).
+		Logger()
+	ctx = log.WithContext(ctx)
+	store := &dehydratedDeviceStore{MemoryStore: NewMemoryStore(nil), mach: mach}
+	dehydratedMach := NewOlmMachine(mach.Client, &log, store, mach.StateStore)
+	dehydratedMach.account = &OlmAccount{Internal: internal, Shared: true}
+	dehydratedMach.megolmDecryptLock = mach.megolmDecryptLock
+	defer dehydratedMach.Destroy()
+
+	var nextBatch string
+	eventCount := 0
+	for {
+		events, err := mach.Client.GetDehydratedDeviceEvents(ctx, resp.DeviceID, nextBatch)
+		if err != nil {
+			return store.received, fmt.Errorf("failed to get dehydrated device events: %w", err)
+		} else if len(events.Events) == 0 {
+			break
+		}
+		for _, evt := range events.Events {
+			evt.Type.Class = event.ToDeviceEventType
+			if err = evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+				log.Warn().Err(err).Str("event_type", evt.Type.Type).Msg("Failed to parse dehydrated device event")
+				continue
+			}
+			dehydratedMach.HandleToDeviceEvent(ctx, evt)
+		}
+		eventCount += len(events.Events)
+		if events.NextBatch == "" || events.NextBatch == nextBatch {
+			break
+		}
+		nextBatch = events.NextBatch
+	}
+	log.Info().
+		Int("event_count", eventCount).
+		Int("session_count", store.received).
+		Msg("Finished processing dehydrated device events")
+	return store.received, nil
+}
+
+// RotateDehydratedDevice rehydrates the current dehydrated device (if any) to receive the keys sent to it,
+// and then replaces it with a new dehydrated device. This should be called after logging in and periodically
+// afterwards, so that the dehydrated device doesn't accumulate too many events.
+func (mach *OlmMachine) RotateDehydratedDevice(ctx context.Context, pickleKey []byte) (id.DeviceID, error) {
+	_, err := mach.RehydrateDevice(ctx, pickleKey)
+	if err != nil && !errors.Is(err, ErrNoDehydratedDevice) {
+		return "", err
+	}
+	return mach.CreateDehydratedDevice(ctx, pickleKey)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/random"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/signatures"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestOlmMachine_DehydratedDevice(t *testing.T) {
+	ctx := context.Background()
+	machineOut := newMachine(t, "@user1:example.com")
+	senderKeys := machineOut.account.getInitialKeys("@user1:example.com", "device1")
+
+	var lock sync.Mutex
+	var uploaded *mautrix.ReqPutDehydratedDevice
+	var pendingEvents []json.RawMessage
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, data any) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(data)
+	}
+	mux.HandleFunc("PUT /_matrix/client/unstable/org.matrix.msc3814.v1/dehydrated_device", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&uploaded))
+		writeJSON(w, map[string]any{"device_id": uploaded.DeviceID})
+	})
+	mux.HandleFunc("GET /_matrix/client/unstable/org.matrix.msc3814.v1/dehydrated_device", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		writeJSON(w, map[string]any{"device_id": uploaded.DeviceID, "device_data": uploaded.DeviceData})
+	})
+	mux.HandleFunc("POST /_matrix/client/unstable/org.matrix.msc3814.v1/dehydrated_device/{deviceID}/events", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		assert.Equal(t, uploaded.DeviceID.String(), r.PathValue("deviceID"))
+		events := pendingEvents
+		pendingEvents = nil
+		writeJSON(w, map[string]any{"events": events, "next_batch": random.String(8)})
+	})
+	mux.HandleFunc("POST /_matrix/client/v3/keys/query", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"device_keys": map[id.UserID]any{
+			"@user1:example.com": map[id.DeviceID]any{"device1": senderKeys},
+		}})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	machineIn := newMachine(t, "@user2:example.com")
+	machineIn.Client.HomeserverURL, _ = machineIn.Client.HomeserverURL.Parse(server.URL)
+	pickleKey := random.Bytes(32)
+	deviceID, err := machineIn.CreateDehydratedDevice(ctx, pickleKey)
+	require.NoError(t, err)
+	require.NotNil(t, uploaded)
+	assert.Equal(t, deviceID, uploaded.DeviceID)
+	assert.Equal(t, DehydratedDeviceAlgorithmV1, uploaded.DeviceData.Algorithm)
+	assert.True(t, uploaded.DeviceKeys.Dehydrated)
+	assert.NotEmpty(t, uploaded.OneTimeKeys)
+	identityKey := id.IdentityKey(uploaded.DeviceKeys.Keys.GetCurve25519(deviceID))
+	signingKey := uploaded.DeviceKeys.Keys.GetEd25519(deviceID)
+	ok, err := signatures.VerifySignatureJSON(uploaded.DeviceKeys, "@user2:example.com", deviceID.String(), signingKey)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// Send a room key to the dehydrated device while it's "offline"
+	var otk mautrix.OneTimeKey
+	for _, otk = range uploaded.OneTimeKeys {
+		break
+	}
+	olmSession, err := machineOut.account.Internal.NewOutboundSession(identityKey, otk.Key)
+	require.NoError(t, err)
+	megolmOutSession, err := machineOut.newOutboundGroupSession(ctx, "!room:example.com")
+	require.NoError(t, err)
+	encrypted := machineOut.encryptOlmEvent(ctx, wrapSession(olmSession), &id.Device{
+		UserID:      "@user2:example.com",
+		DeviceID:    deviceID,
+		IdentityKey: identityKey,
+		SigningKey:  signingKey,
+	}, event.ToDeviceRoomKey, megolmOutSession.ShareContent())
+	evtJSON, err := json.Marshal(map[string]any{
+		"type":    event.ToDeviceEncrypted.Type,
+		"sender":  "@user1:example.com",
+		"content": encrypted,
+	})
+	require.NoError(t, err)
+	pendingEvents = []json.RawMessage{evtJSON}
+
+	_, err = machineIn.RehydrateDevice(ctx, random.Bytes(32))
+	assert.Error(t, err, "rehydrating with the wrong key should fail")
+	count, err := machineIn.RehydrateDevice(ctx, pickleKey)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	igs, err := machineIn.CryptoStore.GetGroupSession(ctx, "!room:example.com", megolmOutSession.ID())
+	require.NoError(t, err)
+	require.NotNil(t, igs)
+	assert.Equal(t, machineOut.account.IdentityKey(), igs.SenderKey)
+}
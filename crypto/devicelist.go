@@ -301,6 +301,14 @@ func (mach *OlmMachine) FetchKeys(ctx context.Context, users []id.UserID, includ
 	mach.storeCrossSigningKeys(ctx, resp.SelfSigningKeys, resp.DeviceKeys)
 	mach.storeCrossSigningKeys(ctx, resp.UserSigningKeys, resp.DeviceKeys)
 
+	for userID := range resp.MasterKeys {
+		if userID == mach.Client.UserID {
+			continue
+		} else if _, err = mach.UpdateIdentityState(ctx, userID); err != nil {
+			log.Err(err).Stringer("user_id", userID).Msg("Failed to update identity state of user")
+		}
+	}
+
 	return data, nil
 }
 
@@ -324,13 +332,7 @@ func (mach *OlmMachine) OnDevicesChanged(ctx context.Context, userID id.UserID)
 			Str("user_id", userID.String()).
 			Str("room_id", roomID.String()).
 			Msg("Invalidating group session in room due to device change notification")
-		err = mach.CryptoStore.RemoveOutboundGroupSession(ctx, roomID)
-		if err != nil {
-			mach.machOrContextLog(ctx).Err(err).
-				Str("user_id", userID.String()).
-				Str("room_id", roomID.String()).
-				Msg("Failed to invalidate outbound group session")
-		}
+		_ = mach.RotateRoomSession(ctx, roomID, RotationReasonDeviceListChange)
 	}
 }
 
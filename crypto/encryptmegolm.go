@@ -13,6 +13,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
 
 	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
@@ -128,7 +130,7 @@ func (mach *OlmMachine) EncryptMegolmEventWithStateKey(ctx context.Context, room
 	session, err := mach.CryptoStore.GetOutboundGroupSession(ctx, roomID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get outbound group session: %w", err)
-	} else if session == nil {
+	} else if session == nil || mach.checkRotationPolicy(ctx, session) {
 		return nil, ErrNoGroupSession
 	}
 	plaintext, err := json.Marshal(&rawMegolmEvent{
@@ -207,6 +209,9 @@ func (mach *OlmMachine) newOutboundGroupSession(ctx context.Context, roomID id.R
 	if err != nil {
 		return nil, err
 	}
+	if mach.RotationPolicy != nil {
+		mach.RotationPolicy.ConfigureSession(ctx, mach, session)
+	}
 	if !mach.DontStoreOutboundKeys {
 		signingKey, idKey := mach.account.Keys()
 		err = mach.createGroupSession(
@@ -234,6 +239,8 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 	session, err := mach.CryptoStore.GetOutboundGroupSession(ctx, roomID)
 	if err != nil {
 		return fmt.Errorf("failed to get previous outbound group session: %w", err)
+	} else if mach.checkRotationPolicy(ctx, session) {
+		session = nil
 	} else if session != nil && session.Shared && !session.Expired() {
 		mach.machOrContextLog(ctx).Debug().Stringer("room_id", roomID).Msg("Not re-sharing group session, already shared")
 		return nil
@@ -257,6 +264,7 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 	olmSessions := make(map[id.UserID]map[id.DeviceID]deviceSessionWrapper)
 	missingSessions := make(map[id.UserID]map[id.DeviceID]*id.Device)
 	missingUserSessions := make(map[id.DeviceID]*id.Device)
+	recipients := make(map[UserDevice]*SessionRecipient)
 	var fetchKeysForUsers []id.UserID
 
 	// TODO check crypto_tracked_users to see if any device lists are outdated
@@ -275,7 +283,7 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 			log.Trace().Msg("Trying to find olm session to encrypt megolm session for user")
 			toDeviceWithheld.Messages[userID] = make(map[id.DeviceID]*event.Content)
 			olmSessions[userID] = make(map[id.DeviceID]deviceSessionWrapper)
-			mach.findOlmSessionsForUser(ctx, session, userID, devices, olmSessions[userID], toDeviceWithheld.Messages[userID], missingUserSessions)
+			mach.findOlmSessionsForUser(ctx, session, userID, devices, olmSessions[userID], toDeviceWithheld.Messages[userID], missingUserSessions, recipients)
 			log.Debug().
 				Int("olm_session_count", len(olmSessions[userID])).
 				Int("withheld_count", len(toDeviceWithheld.Messages[userID])).
@@ -335,7 +343,7 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 
 		log := log.With().Stringer("target_user_id", userID).Logger()
 		log.Trace().Msg("Trying to find olm session to encrypt megolm session for user (post-fetch retry)")
-		mach.findOlmSessionsForUser(ctx, session, userID, devices, output, withheld, nil)
+		mach.findOlmSessionsForUser(ctx, session, userID, devices, output, withheld, nil, recipients)
 		log.Debug().
 			Int("olm_session_count", len(output)).
 			Int("withheld_count", len(withheld)).
@@ -350,6 +358,7 @@ func (mach *OlmMachine) ShareGroupSession(ctx context.Context, roomID id.RoomID,
 	if err != nil {
 		return fmt.Errorf("failed to share group session: %w", err)
 	}
+	mach.storeSessionRecipients(ctx, slices.Collect(maps.Values(recipients))...)
 
 	if len(toDeviceWithheld.Messages) > 0 {
 		log.Debug().
@@ -417,7 +426,8 @@ func (mach *OlmMachine) encryptAndSendGroupSession(ctx context.Context, session
 	return err
 }
 
-func (mach *OlmMachine) findOlmSessionsForUser(ctx context.Context, session *OutboundGroupSession, userID id.UserID, devices map[id.DeviceID]*id.Device, output map[id.DeviceID]deviceSessionWrapper, withheld map[id.DeviceID]*event.Content, missingOutput map[id.DeviceID]*id.Device) {
+func (mach *OlmMachine) findOlmSessionsForUser(ctx context.Context, session *OutboundGroupSession, userID id.UserID, devices map[id.DeviceID]*id.Device, output map[id.DeviceID]deviceSessionWrapper, withheld map[id.DeviceID]*event.Content, missingOutput map[id.DeviceID]*id.Device, recipients map[UserDevice]*SessionRecipient) {
+	withholdForIdentity := mach.isWithheldForIdentity(ctx, userID)
 	for deviceID, device := range devices {
 		log := zerolog.Ctx(ctx).With().
 			Stringer("target_user_id", userID).
@@ -440,6 +450,20 @@ func (mach *OlmMachine) findOlmSessionsForUser(ctx context.Context, session *Out
 				Reason:    "Device is blacklisted",
 			}}
 			session.Users[userKey] = OGSIgnored
+			recipients[userKey] = newWithheldRecipient(session.RoomID, session.ID(), device, device.Trust, withheld[deviceID].AsRoomKeyWithheld())
+		} else if withholdForIdentity {
+			log.Debug().Msg("Not encrypting group session for device: user's verified identity has changed")
+			withheld[deviceID] = &event.Content{Parsed: &event.RoomKeyWithheldEventContent{
+				RoomID:    session.RoomID,
+				Algorithm: id.AlgorithmMegolmV1,
+				SessionID: session.ID(),
+				SenderKey: mach.account.IdentityKey(),
+				Code:      event.RoomKeyWithheldUnverified,
+				Reason:    "The identity of this user has changed since they were verified",
+			}}
+			session.Users[userKey] = OGSIgnored
+			trustState, _ := mach.ResolveTrustContext(ctx, device)
+			recipients[userKey] = newWithheldRecipient(session.RoomID, session.ID(), device, trustState, withheld[deviceID].AsRoomKeyWithheld())
 		} else if trustState, _ := mach.ResolveTrustContext(ctx, device); trustState < mach.SendKeysMinTrust {
 			log.Debug().
 				Str("min_trust", mach.SendKeysMinTrust.String()).
@@ -454,12 +478,18 @@ func (mach *OlmMachine) findOlmSessionsForUser(ctx context.Context, session *Out
 				Reason:    "This device does not encrypt messages for unverified devices",
 			}}
 			session.Users[userKey] = OGSIgnored
+			recipients[userKey] = newWithheldRecipient(session.RoomID, session.ID(), device, trustState, withheld[deviceID].AsRoomKeyWithheld())
 		} else if deviceSession, err := mach.CryptoStore.GetLatestSession(ctx, device.IdentityKey); err != nil {
 			log.Error().Err(err).Msg("Failed to get olm session to encrypt group session")
 		} else if deviceSession == nil {
 			log.Warn().Err(err).Msg("Didn't find olm session to encrypt group session")
 			if missingOutput != nil {
 				missingOutput[deviceID] = device
+			} else {
+				recipients[userKey] = newWithheldRecipient(session.RoomID, session.ID(), device, trustState, &event.RoomKeyWithheldEventContent{
+					Code:   event.RoomKeyWithheldNoOlmSession,
+					Reason: "Failed to establish an olm session",
+				})
 			}
 		} else {
 			output[deviceID] = deviceSessionWrapper{
@@ -467,6 +497,7 @@ func (mach *OlmMachine) findOlmSessionsForUser(ctx context.Context, session *Out
 				identity: device,
 			}
 			session.Users[userKey] = OGSAlreadyShared
+			recipients[userKey] = newSharedRecipient(session.RoomID, session.ID(), device, trustState, uint32(session.Internal.MessageIndex()))
 		}
 	}
 }
@@ -0,0 +1,187 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"fmt"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// IdentityState describes the state of another user's cross-signing identity (i.e. their master key).
+type IdentityState string
+
+const (
+	// IdentityStateUnpinned means the user doesn't have a known master key.
+	IdentityStateUnpinned IdentityState = "unpinned"
+	// IdentityStatePinned means the user's master key is the first one that was seen (trust on first use).
+	IdentityStatePinned IdentityState = "pinned"
+	// IdentityStatePinViolation means the user's master key has changed since it was pinned,
+	// but the previous key was never verified. Clients should show a warning until the change
+	// is acknowledged with [OlmMachine.PinIdentity].
+	IdentityStatePinViolation IdentityState = "pin_violation"
+	// IdentityStateVerified means the user's current master key is signed by our user-signing key.
+	IdentityStateVerified IdentityState = "verified"
+	// IdentityStateVerificationViolation means the user was verified, but their master key has changed since then.
+	// The state stays until the user is verified again or the change is acknowledged with [OlmMachine.PinIdentity].
+	IdentityStateVerificationViolation IdentityState = "verification_violation"
+)
+
+// IsViolation returns true if the state requires the user to acknowledge an identity change.
+func (state IdentityState) IsViolation() bool {
+	return state == IdentityStatePinViolation || state == IdentityStateVerificationViolation
+}
+
+// GetIdentityState returns the identity state of the given user. The stored state is used if there is one,
+// otherwise it's resolved from the stored cross-signing keys.
+func (mach *OlmMachine) GetIdentityState(ctx context.Context, userID id.UserID) (IdentityState, error) {
+	state, err := mach.CryptoStore.GetIdentityState(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get stored identity state: %w", err)
+	} else if state != "" {
+		return state, nil
+	}
+	return mach.resolveIdentityState(ctx, userID, "")
+}
+
+func (mach *OlmMachine) resolveIdentityState(ctx context.Context, userID id.UserID, prevState IdentityState) (IdentityState, error) {
+	keys, err := mach.CryptoStore.GetCrossSigningKeys(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get cross-signing keys: %w", err)
+	}
+	masterKey, ok := keys[id.XSUsageMaster]
+	if !ok || masterKey.Key == "" {
+		return IdentityStateUnpinned, nil
+	}
+	if trusted, err := mach.IsUserTrusted(ctx, userID); err != nil {
+		return "", fmt.Errorf("failed to check if user is trusted: %w", err)
+	} else if trusted {
+		return IdentityStateVerified, nil
+	} else if masterKey.Key == masterKey.First {
+		return IdentityStatePinned, nil
+	} else if prevState == IdentityStateVerified || prevState == IdentityStateVerificationViolation {
+		return IdentityStateVerificationViolation, nil
+	} else if prevState == "" {
+		// There's no stored state for users who were verified before identity states were tracked,
+		// so check whether the pinned key was verified instead.
+		if pinnedVerified, err := mach.isPinnedMasterKeyVerified(ctx, userID, masterKey.First); err != nil {
+			return "", err
+		} else if pinnedVerified {
+			return IdentityStateVerificationViolation, nil
+		}
+	}
+	return IdentityStatePinViolation, nil
+}
+
+func (mach *OlmMachine) isPinnedMasterKeyVerified(ctx context.Context, userID id.UserID, pinnedKey id.Ed25519) (bool, error) {
+	if pinnedKey == "" {
+		return false, nil
+	}
+	csPubkeys, err := mach.GetOwnCrossSigningPublicKeys(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get own cross-signing public keys: %w", err)
+	} else if csPubkeys == nil {
+		return false, nil
+	}
+	signed, err := mach.CryptoStore.IsKeySignedBy(ctx, userID, pinnedKey, mach.Client.UserID, csPubkeys.UserSigningKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to check signature of pinned master key: %w", err)
+	}
+	return signed, nil
+}
+
+// UpdateIdentityState resolves the identity state of the given user and stores it.
+// [OlmMachine.OnIdentityStateChange] is called if the state changed.
+//
+// This is called automatically after fetching keys and after signing users, so it usually doesn't need to be called manually.
+func (mach *OlmMachine) UpdateIdentityState(ctx context.Context, userID id.UserID) (IdentityState, error) {
+	prevState, err := mach.CryptoStore.GetIdentityState(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get stored identity state: %w", err)
+	}
+	newState, err := mach.resolveIdentityState(ctx, userID, prevState)
+	if err != nil {
+		return "", err
+	}
+	if newState == IdentityStateVerified {
+		// Pin the verified key, so that the next change is detected as a violation
+		keys, _ := mach.CryptoStore.GetCrossSigningKeys(ctx, userID)
+		if masterKey := keys[id.XSUsageMaster]; masterKey.Key != masterKey.First {
+			err = mach.CryptoStore.ResetMasterKeyTOFU(ctx, userID, masterKey.Key)
+			if err != nil {
+				return "", fmt.Errorf("failed to pin verified master key: %w", err)
+			}
+		}
+	}
+	return newState, mach.setIdentityState(ctx, userID, prevState, newState)
+}
+
+func (mach *OlmMachine) setIdentityState(ctx context.Context, userID id.UserID, prevState, newState IdentityState) error {
+	if newState == prevState {
+		return nil
+	}
+	err := mach.CryptoStore.PutIdentityState(ctx, userID, newState)
+	if err != nil {
+		return fmt.Errorf("failed to store identity state: %w", err)
+	}
+	log := mach.machOrContextLog(ctx).With().
+		Stringer("user_id", userID).
+		Str("prev_identity_state", string(prevState)).
+		Str("identity_state", string(newState)).
+		Logger()
+	if newState.IsViolation() {
+		log.Warn().Msg("Identity of user changed")
+	} else {
+		log.Debug().Msg("Identity state of user changed")
+	}
+	if mach.OnIdentityStateChange != nil {
+		mach.OnIdentityStateChange(ctx, userID, prevState, newState)
+	}
+	return nil
+}
+
+// PinIdentity acknowledges a change in the given user's identity by pinning their current master key.
+// If the user was verified before the change, this withdraws the verification.
+func (mach *OlmMachine) PinIdentity(ctx context.Context, userID id.UserID) error {
+	keys, err := mach.CryptoStore.GetCrossSigningKeys(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get cross-signing keys: %w", err)
+	}
+	masterKey, ok := keys[id.XSUsageMaster]
+	if !ok {
+		return ErrCrossSigningMasterKeyNotFound
+	}
+	if masterKey.Key != masterKey.First {
+		err = mach.CryptoStore.ResetMasterKeyTOFU(ctx, userID, masterKey.Key)
+		if err != nil {
+			return fmt.Errorf("failed to pin master key: %w", err)
+		}
+	}
+	prevState, err := mach.CryptoStore.GetIdentityState(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get stored identity state: %w", err)
+	}
+	// Resolve without the previous state, so that a verification violation doesn't stick
+	newState, err := mach.resolveIdentityState(ctx, userID, "")
+	if err != nil {
+		return err
+	}
+	return mach.setIdentityState(ctx, userID, prevState, newState)
+}
+
+func (mach *OlmMachine) isWithheldForIdentity(ctx context.Context, userID id.UserID) bool {
+	if !mach.WithholdKeysOnVerificationViolation || userID == mach.Client.UserID {
+		return false
+	}
+	state, err := mach.GetIdentityState(ctx, userID)
+	if err != nil {
+		mach.machOrContextLog(ctx).Err(err).Stringer("user_id", userID).Msg("Failed to get identity state of user")
+		return false
+	}
+	return state == IdentityStateVerificationViolation
+}
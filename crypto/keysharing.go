@@ -212,6 +212,13 @@ func (mach *OlmMachine) rejectKeyRequest(ctx context.Context, rejection KeyShare
 		Code:      rejection.Code,
 		Reason:    rejection.Reason,
 	}
+	if mach.TrackSessionRecipients {
+		// Only record rejections for sessions we actually have, so that arbitrary requests can't fill the store
+		if igs, err := mach.CryptoStore.GetGroupSession(ctx, request.RoomID, request.SessionID); err == nil && igs != nil {
+			trustState, _ := mach.ResolveTrustContext(ctx, device)
+			mach.storeSessionRecipients(ctx, newWithheldRecipient(request.RoomID, request.SessionID, device, trustState, &content))
+		}
+	}
 	err := mach.sendToOneDevice(ctx, device.UserID, device.DeviceID, event.ToDeviceRoomKeyWithheld, &content)
 	if err != nil {
 		mach.Log.Warn().Err(err).
@@ -370,6 +377,12 @@ func (mach *OlmMachine) HandleRoomKeyRequest(ctx context.Context, sender id.User
 		log.Error().Err(err).Msg("Failed to encrypt and send group session")
 	} else {
 		log.Debug().Msg("Successfully sent forwarded group session")
+		if mach.TrackSessionRecipients {
+			trustState, _ := mach.ResolveTrustContext(ctx, device)
+			recipient := newSharedRecipient(igs.RoomID, igs.ID(), device, trustState, firstKnownIndex)
+			recipient.Forwarded = true
+			mach.storeSessionRecipients(ctx, recipient)
+		}
 	}
 }
 
@@ -55,6 +55,12 @@ type OlmMachine struct {
 
 	SendKeysMinTrust  id.TrustState
 	ShareKeysMinTrust id.TrustState
+	// If true, group sessions are not shared with users whose identity is in [IdentityStateVerificationViolation]
+	// until the change is acknowledged with [OlmMachine.PinIdentity] or the user is verified again.
+	WithholdKeysOnVerificationViolation bool
+	// If true, the devices that Megolm sessions are shared with or withheld from are recorded in the crypto store.
+	// See [OlmMachine.SessionRecipients] and [OlmMachine.EventReadableBy].
+	TrackSessionRecipients bool
 
 	account *OlmAccount
 
@@ -70,6 +76,10 @@ type OlmMachine struct {
 	OnRoomKeyBundle func(context.Context, *event.RoomKeyBundleEventContent)
 	// Callback for MSC4385 secret pushes from other devices of our own user. Secret pushes are ignored if unset.
 	SecretPushReceiver func(context.Context, *DecryptedOlmEvent, *event.SecretPushEventContent)
+	// Optional callback which is called when the identity state of another user changes. See [IdentityState].
+	OnIdentityStateChange func(ctx context.Context, userID id.UserID, prevState, newState IdentityState)
+	// Callback for MatrixRTC media keys received from other devices. See [RTCKeyManager.HandleEncryptionKeys].
+	RTCKeyReceiver func(context.Context, *DecryptedOlmEvent, *event.CallEncryptionKeysEventContent)
 
 	devicesToUnwedge     map[id.IdentityKey]bool
 	devicesToUnwedgeLock sync.Mutex
@@ -102,6 +112,10 @@ type OlmMachine struct {
 	DisableRatchetTracking       bool
 
 	DisableDeviceChangeKeyRotation bool
+	// RotationPolicy can be set to customize when outbound group sessions are rotated.
+	RotationPolicy SessionRotationPolicy
+	// UTDTracker can be set to record undecryptable events and retry them when keys arrive. See [NewUTDTracker].
+	UTDTracker *UTDTracker
 
 	secretLock      sync.Mutex
 	secretListeners map[string]chan<- string
@@ -407,10 +421,7 @@ func (mach *OlmMachine) HandleMemberEvent(ctx context.Context, evt *event.Event)
 		Str("prev_membership", string(prevContent.Membership)).
 		Str("new_membership", string(content.Membership)).
 		Msg("Got membership state change, invalidating group session in room")
-	err := mach.CryptoStore.RemoveOutboundGroupSession(ctx, evt.RoomID)
-	if err != nil {
-		mach.Log.Warn().Stringer("room_id", evt.RoomID).Msg("Failed to invalidate outbound group session")
-	}
+	_ = mach.RotateRoomSession(ctx, evt.RoomID, RotationReasonMembershipChange)
 }
 
 func (mach *OlmMachine) HandleHistoryVisibility(ctx context.Context, evt *event.Event) {
@@ -432,10 +443,7 @@ func (mach *OlmMachine) HandleHistoryVisibility(ctx context.Context, evt *event.
 			Any("prev_shared_history", outboundSession.SharedHistory).
 			Stringer("new_history_visibility", vis.HistoryVisibility).
 			Msg("History visibility changed, invalidating outbound group session")
-		err = mach.CryptoStore.RemoveOutboundGroupSession(ctx, evt.RoomID)
-		if err != nil {
-			log.Err(err).Msg("Failed to invalidate outbound group session on history visibility change")
-		}
+		_ = mach.RotateRoomSession(ctx, evt.RoomID, RotationReasonHistoryVisibility)
 	}
 }
 
@@ -485,6 +493,9 @@ func (mach *OlmMachine) HandleEncryptedEvent(ctx context.Context, evt *event.Eve
 	case *event.SecretPushEventContent:
 		mach.receiveSecretPush(ctx, decryptedEvt, decryptedContent)
 		log.Trace().Msg("Handled secret push event")
+	case *event.CallEncryptionKeysEventContent:
+		mach.receiveCallEncryptionKeys(ctx, decryptedEvt, decryptedContent)
+		log.Trace().Msg("Handled call encryption keys event")
 	default:
 		log.Debug().Msg("Unhandled encrypted to-device event")
 		return decryptedEvt
@@ -731,6 +742,9 @@ func (mach *OlmMachine) MarkSessionReceived(ctx context.Context, roomID id.RoomI
 	if mach.SessionReceived != nil {
 		mach.SessionReceived(ctx, roomID, id, firstKnownIndex)
 	}
+	if mach.UTDTracker != nil {
+		mach.UTDTracker.QueueRetry(mach.backgroundCtx, roomID, id)
+	}
 
 	mach.keyWaitersLock.Lock()
 	ch, ok := mach.keyWaiters[id]
@@ -831,6 +845,9 @@ func (mach *OlmMachine) HandleRoomKeyWithheld(ctx context.Context, content *even
 	err := mach.CryptoStore.PutWithheldGroupSession(ctx, *content)
 	if err != nil {
 		zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to save room key withheld event")
+	} else if mach.UTDTracker != nil {
+		// Retrying will update the reason of any recorded events to withheld
+		mach.UTDTracker.QueueRetry(mach.backgroundCtx, content.RoomID, content.SessionID)
 	}
 }
 
@@ -0,0 +1,240 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package qrlogin
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	ErrInvalidChannelMessage = errors.New("invalid secure channel message")
+	ErrUnexpectedHandshake   = errors.New("unexpected secure channel handshake message")
+)
+
+const (
+	ecdhInfoPrefix      = "MATRIX_QR_CODE_LOGIN_ECIES_V1|"
+	checkCodeInfoPrefix = "MATRIX_QR_CODE_LOGIN_CHECKCODE|"
+
+	handshakeInitiate = "MATRIX_QR_CODE_LOGIN_INITIATE"
+	handshakeOK       = "MATRIX_QR_CODE_LOGIN_OK"
+)
+
+// SecureChannel is an end-to-end encrypted channel on top of a [RendezvousSession].
+//
+// The channel uses ECIES: the device that generated the QR code has a static X25519 key that is included
+// in the QR code, and the device that scanned the code generates an ephemeral key and sends its public key
+// in the first message. Both directions use ChaCha20-Poly1305 with separate keys derived using HKDF-SHA256.
+type SecureChannel struct {
+	Session *RendezvousSession
+
+	ourKey    *ecdh.PrivateKey
+	theirKey  *ecdh.PublicKey
+	send      cipher.AEAD
+	recv      cipher.AEAD
+	sendNonce uint64
+	recvNonce uint64
+	checkCode uint8
+}
+
+// PendingChannel is the QR code generating side of a secure channel before the other side has connected.
+type PendingChannel struct {
+	Session *RendezvousSession
+	QRCode  *QRCode
+
+	key *ecdh.PrivateKey
+}
+
+// NewPendingChannel generates a new key for a secure channel on the given rendezvous session.
+// The returned channel's QR code should be displayed to the user, and then [PendingChannel.Accept]
+// should be called to wait for the other device to scan it.
+func NewPendingChannel(session *RendezvousSession, intent QRCodeIntent, serverName string) (*PendingChannel, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate channel key: %w", err)
+	}
+	return &PendingChannel{
+		Session: session,
+		QRCode: &QRCode{
+			Intent:        intent,
+			PublicKey:     key.PublicKey(),
+			RendezvousURL: session.URL,
+			ServerName:    serverName,
+		},
+		key: key,
+	}, nil
+}
+
+// Accept waits for the other device to scan the QR code and completes the handshake.
+func (pc *PendingChannel) Accept(ctx context.Context) (*SecureChannel, error) {
+	data, err := pc.Session.Receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.RawStdEncoding.DecodeString(string(data))
+	if err != nil || len(decoded) < 32 {
+		return nil, fmt.Errorf("%w: malformed initial message", ErrInvalidChannelMessage)
+	}
+	theirKey, err := ecdh.X25519().NewPublicKey(decoded[:32])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid public key: %w", ErrInvalidChannelMessage, err)
+	}
+	sc, err := newSecureChannel(pc.Session, pc.key, theirKey, false)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := sc.decrypt(decoded[32:])
+	if err != nil {
+		return nil, err
+	} else if string(plaintext) != handshakeInitiate {
+		return nil, ErrUnexpectedHandshake
+	}
+	if err = sc.sendRaw(ctx, []byte(handshakeOK)); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Connect connects to the secure channel advertised in a scanned QR code and completes the handshake.
+func Connect(ctx context.Context, session *RendezvousSession, qr *QRCode) (*SecureChannel, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate channel key: %w", err)
+	}
+	sc, err := newSecureChannel(session, key, qr.PublicKey, true)
+	if err != nil {
+		return nil, err
+	}
+	initial := append(key.PublicKey().Bytes(), sc.encrypt([]byte(handshakeInitiate))...)
+	if err = session.Send(ctx, []byte(base64.RawStdEncoding.EncodeToString(initial))); err != nil {
+		return nil, err
+	}
+	plaintext, err := sc.receiveRaw(ctx)
+	if err != nil {
+		return nil, err
+	} else if string(plaintext) != handshakeOK {
+		return nil, ErrUnexpectedHandshake
+	}
+	return sc, nil
+}
+
+func newSecureChannel(session *RendezvousSession, ourKey *ecdh.PrivateKey, theirKey *ecdh.PublicKey, weScanned bool) (*SecureChannel, error) {
+	shared, err := ourKey.ECDH(theirKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	generatorKey, scannerKey := ourKey.PublicKey().Bytes(), theirKey.Bytes()
+	if weScanned {
+		generatorKey, scannerKey = scannerKey, generatorKey
+	}
+	keyInfo := ecdhInfoPrefix + string(generatorKey) + string(scannerKey)
+	keys, err := hkdf.Key(sha256.New, shared, nil, keyInfo, 2*chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive channel keys: %w", err)
+	}
+	checkCodeInfo := checkCodeInfoPrefix + string(generatorKey) + string(scannerKey)
+	checkCodeBytes, err := hkdf.Key(sha256.New, shared, nil, checkCodeInfo, 2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive check code: %w", err)
+	}
+	scannerToGenerator, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	generatorToScanner, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, err
+	}
+	sc := &SecureChannel{
+		Session:   session,
+		ourKey:    ourKey,
+		theirKey:  theirKey,
+		send:      generatorToScanner,
+		recv:      scannerToGenerator,
+		checkCode: (checkCodeBytes[0]%10)*10 + checkCodeBytes[1]%10,
+	}
+	if weScanned {
+		sc.send, sc.recv = sc.recv, sc.send
+	}
+	return sc, nil
+}
+
+// CheckCode returns the two-digit code derived from the shared secret. One device displays it and the user
+// enters it on the other device, which protects against the QR code being scanned by an attacker.
+func (sc *SecureChannel) CheckCode() string {
+	return fmt.Sprintf("%02d", sc.checkCode)
+}
+
+func makeNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], counter)
+	return nonce
+}
+
+func (sc *SecureChannel) encrypt(plaintext []byte) []byte {
+	ciphertext := sc.send.Seal(nil, makeNonce(sc.sendNonce), plaintext, nil)
+	sc.sendNonce++
+	return ciphertext
+}
+
+func (sc *SecureChannel) decrypt(ciphertext []byte) ([]byte, error) {
+	plaintext, err := sc.recv.Open(nil, makeNonce(sc.recvNonce), ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt: %w", ErrInvalidChannelMessage, err)
+	}
+	sc.recvNonce++
+	return plaintext, nil
+}
+
+func (sc *SecureChannel) sendRaw(ctx context.Context, plaintext []byte) error {
+	return sc.Session.Send(ctx, []byte(base64.RawStdEncoding.EncodeToString(sc.encrypt(plaintext))))
+}
+
+func (sc *SecureChannel) receiveRaw(ctx context.Context) ([]byte, error) {
+	data, err := sc.Session.Receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidChannelMessage, err)
+	}
+	return sc.decrypt(ciphertext)
+}
+
+// Send encrypts the given message and writes it to the rendezvous session.
+func (sc *SecureChannel) Send(ctx context.Context, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return sc.sendRaw(ctx, data)
+}
+
+// Receive waits for the next message from the other device and decrypts it.
+func (sc *SecureChannel) Receive(ctx context.Context) (*Message, error) {
+	data, err := sc.receiveRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err = json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse message: %w", ErrInvalidChannelMessage, err)
+	}
+	return &msg, nil
+}
@@ -0,0 +1,345 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package qrlogin implements signing in new devices by scanning a QR code from an existing device,
+// as specified in MSC4108.
+package qrlogin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/random"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/oauth"
+)
+
+var (
+	ErrUnsupportedProtocol  = errors.New("other device doesn't support any known login protocol")
+	ErrUnexpectedMessage    = errors.New("unexpected message received from other device")
+	ErrDeviceAlreadyExists  = errors.New("new device ID is already in use")
+	ErrDeviceNotFound       = errors.New("new device didn't upload device keys in time")
+	ErrCheckCodeMismatch    = errors.New("check code doesn't match")
+	ErrAuthorizationExpired = errors.New("device authorization grant expired before it was approved")
+	ErrWrongQRCodeIntent    = errors.New("QR code was generated by the wrong kind of device")
+)
+
+// DefaultDeviceWaitTimeout is the default time the existing device waits for the new device's keys to appear.
+const DefaultDeviceWaitTimeout = 30 * time.Second
+
+// defaultDeviceCodeInterval is the polling interval for device codes if the server doesn't specify one (RFC 8628 section 3.2).
+const defaultDeviceCodeInterval = 5 * time.Second
+
+func sendFailure(ctx context.Context, channel *SecureChannel, reason FailureReason, err error) error {
+	sendErr := channel.Send(ctx, &Message{Type: MessageTypeFailure, Reason: reason})
+	if sendErr != nil {
+		zerolog.Ctx(ctx).Warn().Err(sendErr).Str("reason", string(reason)).Msg("Failed to send failure message to other device")
+	}
+	return err
+}
+
+// receiveExpected waits for a message of the given type. Failure and decline messages are converted into errors,
+// and any other unexpected message makes the login fail.
+func receiveExpected(ctx context.Context, channel *SecureChannel, expected MessageType) (*Message, error) {
+	msg, err := channel.Receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch msg.Type {
+	case expected:
+		return msg, nil
+	case MessageTypeFailure:
+		return nil, FailureError{Reason: msg.Reason}
+	case MessageTypeDeclined:
+		return nil, ErrLoginDeclined
+	default:
+		return nil, sendFailure(ctx, channel, FailureUnexpectedMessageReceived, fmt.Errorf("%w: expected %s, got %s", ErrUnexpectedMessage, expected, msg.Type))
+	}
+}
+
+// NewDeviceLogin is the new device side of a QR code login. The new device receives an OAuth access token
+// using the device authorization grant, which the user approves on the existing device.
+type NewDeviceLogin struct {
+	// Client is the client that will be logged in. It doesn't need to have a homeserver URL
+	// if the login is started by scanning a code from the existing device.
+	Client *mautrix.Client
+	// ClientID is the registered OAuth client ID of this client.
+	ClientID string
+	// DeviceID is the device ID to request. A random one is generated if empty.
+	DeviceID id.DeviceID
+
+	// OnCheckCode is called with the check code the user needs to enter on the existing device.
+	OnCheckCode func(code string)
+	// BeforeSuccess is called after the client has been logged in, but before the existing device is notified.
+	// It should upload the device keys, so that the existing device can cross-sign the new device.
+	BeforeSuccess func(ctx context.Context) error
+}
+
+// GenerateQRCode creates a rendezvous session on the homeserver and prepares a secure channel.
+// The QR code in the returned pending channel should be shown to the user and then
+// [PendingChannel.Accept] should be called to wait for the existing device to scan it.
+func (ndl *NewDeviceLogin) GenerateQRCode(ctx context.Context) (*PendingChannel, error) {
+	session, err := CreateRendezvousSession(ctx, ndl.Client)
+	if err != nil {
+		return nil, err
+	}
+	return NewPendingChannel(session, QRCodeIntentLogin, "")
+}
+
+// ScanQRCode connects to the secure channel from a QR code displayed by an existing device.
+func (ndl *NewDeviceLogin) ScanQRCode(ctx context.Context, qr *QRCode) (*SecureChannel, error) {
+	if qr.Intent != QRCodeIntentReciprocate {
+		return nil, ErrWrongQRCodeIntent
+	} else if err := validateRendezvousURL(qr.RendezvousURL); err != nil {
+		return nil, err
+	}
+	return Connect(ctx, NewRendezvousSession(ndl.Client.Client, qr.RendezvousURL), qr)
+}
+
+// Login performs the login over an established secure channel. After the login succeeds, the client will have
+// an access token, and the returned secrets can be imported into the new device's crypto machine
+// using [Secrets.Import].
+func (ndl *NewDeviceLogin) Login(ctx context.Context, channel *SecureChannel) (*Secrets, error) {
+	if ndl.OnCheckCode != nil {
+		ndl.OnCheckCode(channel.CheckCode())
+	}
+	msg, err := receiveExpected(ctx, channel, MessageTypeProtocols)
+	if err != nil {
+		return nil, err
+	} else if !slices.Contains(msg.Protocols, ProtocolDeviceAuthorizationGrant) {
+		return nil, sendFailure(ctx, channel, FailureUnsupportedProtocol, ErrUnsupportedProtocol)
+	}
+	if ndl.Client.HomeserverURL == nil || ndl.Client.HomeserverURL.Scheme == "" {
+		if ndl.Client.HomeserverURL, err = url.Parse(msg.Homeserver); err != nil {
+			return nil, fmt.Errorf("invalid homeserver URL from other device: %w", err)
+		}
+	}
+
+	if ndl.DeviceID == "" {
+		ndl.DeviceID = id.DeviceID(strings.ToUpper(random.String(10)))
+	}
+	deviceCode, err := ndl.Client.OAuthGenerateDeviceCode(ctx, oauth.GenerateDeviceCodeParams{
+		Scopes:   oauth.ScopeList{oauth.ScopeOpenID, oauth.ScopeClientAPI, oauth.ScopeDevice(ndl.DeviceID)},
+		ClientID: ndl.ClientID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate device code: %w", err)
+	}
+	err = channel.Send(ctx, &Message{
+		Type:     MessageTypeProtocol,
+		Protocol: ProtocolDeviceAuthorizationGrant,
+		DeviceAuthorizationGrant: &DeviceAuthorizationGrant{
+			VerificationURI:         deviceCode.VerificationURI,
+			VerificationURIComplete: deviceCode.VerificationURIComplete,
+		},
+		DeviceID: ndl.DeviceID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = receiveExpected(ctx, channel, MessageTypeProtocolAccepted); err != nil {
+		return nil, err
+	}
+
+	if err = ndl.pollDeviceCode(ctx, deviceCode); errors.Is(err, ErrAuthorizationExpired) {
+		return nil, sendFailure(ctx, channel, FailureAuthorizationExpired, err)
+	} else if err != nil {
+		return nil, err
+	}
+	ndl.Client.DeviceID = ndl.DeviceID
+	whoami, err := ndl.Client.Whoami(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get own user ID: %w", err)
+	}
+	ndl.Client.UserID = whoami.UserID
+	if ndl.BeforeSuccess != nil {
+		if err = ndl.BeforeSuccess(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err = channel.Send(ctx, &Message{Type: MessageTypeSuccess}); err != nil {
+		return nil, err
+	}
+
+	msg, err = receiveExpected(ctx, channel, MessageTypeSecrets)
+	if err != nil {
+		return nil, err
+	} else if msg.Secrets == nil {
+		return &Secrets{}, nil
+	}
+	return msg.Secrets, nil
+}
+
+func (ndl *NewDeviceLogin) pollDeviceCode(ctx context.Context, deviceCode *oauth.DeviceCodeResponse) error {
+	interval := deviceCode.Interval.Duration
+	if interval <= 0 {
+		interval = defaultDeviceCodeInterval
+	}
+	var deadline <-chan time.Time
+	if deviceCode.ExpiresIn.Duration > 0 {
+		deadline = time.After(deviceCode.ExpiresIn.Duration)
+	}
+	for {
+		_, err := ndl.Client.OAuthPollDeviceCode(ctx, oauth.PollDeviceCodeParams{
+			DeviceCode:       deviceCode.DeviceCode,
+			ClientID:         ndl.ClientID,
+			StoreCredentials: true,
+		})
+		if errors.Is(err, mautrix.ErrOAuthSlowDown) {
+			interval += defaultDeviceCodeInterval
+		} else if errors.Is(err, mautrix.ErrOAuthExpiredToken) {
+			return ErrAuthorizationExpired
+		} else if !errors.Is(err, mautrix.ErrOAuthAuthorizationPending) {
+			return err
+		}
+		select {
+		case <-time.After(interval):
+		case <-deadline:
+			return ErrAuthorizationExpired
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// LoginGrant is the existing device side of a QR code login.
+type LoginGrant struct {
+	// Client is the logged-in client of the existing device.
+	Client *mautrix.Client
+	// Machine is used to cross-sign the new device and to export secrets for it. If nil, the new device
+	// isn't cross-signed and an empty set of secrets is sent.
+	Machine *crypto.OlmMachine
+
+	// GetCheckCode asks the user to enter the check code shown on the new device.
+	// If nil, the check code isn't verified.
+	GetCheckCode func(ctx context.Context) (string, error)
+	// OpenVerificationURI is called with the URI where the user approves the new device's login.
+	// It should open the URI in a browser. Returning an error cancels the login.
+	OpenVerificationURI func(ctx context.Context, deviceID id.DeviceID, uri string) error
+	// DeviceWaitTimeout is how long to wait for the new device's keys to appear after it reports success.
+	DeviceWaitTimeout time.Duration
+}
+
+// GenerateQRCode creates a rendezvous session and prepares a secure channel for a new device to scan.
+func (lg *LoginGrant) GenerateQRCode(ctx context.Context) (*PendingChannel, error) {
+	session, err := CreateRendezvousSession(ctx, lg.Client)
+	if err != nil {
+		return nil, err
+	}
+	return NewPendingChannel(session, QRCodeIntentReciprocate, lg.Client.UserID.Homeserver())
+}
+
+// ScanQRCode connects to the secure channel from a QR code displayed by a new device.
+func (lg *LoginGrant) ScanQRCode(ctx context.Context, qr *QRCode) (*SecureChannel, error) {
+	if qr.Intent != QRCodeIntentLogin {
+		return nil, ErrWrongQRCodeIntent
+	} else if err := validateRendezvousURL(qr.RendezvousURL); err != nil {
+		return nil, err
+	}
+	return Connect(ctx, NewRendezvousSession(lg.Client.Client, qr.RendezvousURL), qr)
+}
+
+// Grant signs in the new device on the other end of an established secure channel.
+func (lg *LoginGrant) Grant(ctx context.Context, channel *SecureChannel) error {
+	log := zerolog.Ctx(ctx)
+	if lg.GetCheckCode != nil {
+		code, err := lg.GetCheckCode(ctx)
+		if err != nil {
+			return sendFailure(ctx, channel, FailureUserCancelled, err)
+		} else if code != channel.CheckCode() {
+			return sendFailure(ctx, channel, FailureUserCancelled, ErrCheckCodeMismatch)
+		}
+	}
+	err := channel.Send(ctx, &Message{
+		Type:       MessageTypeProtocols,
+		Protocols:  []Protocol{ProtocolDeviceAuthorizationGrant},
+		Homeserver: lg.Client.HomeserverURL.String(),
+	})
+	if err != nil {
+		return err
+	}
+	msg, err := receiveExpected(ctx, channel, MessageTypeProtocol)
+	if err != nil {
+		return err
+	} else if msg.Protocol != ProtocolDeviceAuthorizationGrant || msg.DeviceAuthorizationGrant == nil || msg.DeviceID == "" {
+		return sendFailure(ctx, channel, FailureUnsupportedProtocol, ErrUnsupportedProtocol)
+	}
+	deviceID := msg.DeviceID
+	if _, err = lg.Client.GetDeviceInfo(ctx, deviceID); err == nil {
+		return sendFailure(ctx, channel, FailureDeviceAlreadyExists, ErrDeviceAlreadyExists)
+	} else if !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to check if device exists: %w", err)
+	}
+	if err = channel.Send(ctx, &Message{Type: MessageTypeProtocolAccepted}); err != nil {
+		return err
+	}
+	verificationURI := msg.DeviceAuthorizationGrant.VerificationURIComplete
+	if verificationURI == "" {
+		verificationURI = msg.DeviceAuthorizationGrant.VerificationURI
+	}
+	if lg.OpenVerificationURI != nil {
+		if err = lg.OpenVerificationURI(ctx, deviceID, verificationURI); err != nil {
+			return sendFailure(ctx, channel, FailureUserCancelled, err)
+		}
+	}
+	if _, err = receiveExpected(ctx, channel, MessageTypeSuccess); err != nil {
+		return err
+	}
+
+	if err = lg.waitForDevice(ctx, deviceID); err != nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			return sendFailure(ctx, channel, FailureDeviceNotFound, err)
+		}
+		return err
+	}
+	secrets := &Secrets{}
+	if lg.Machine != nil {
+		device, err := lg.Machine.GetOrFetchDevice(ctx, lg.Client.UserID, deviceID)
+		if err != nil {
+			return fmt.Errorf("failed to get new device: %w", err)
+		} else if err = lg.Machine.SignOwnDevice(ctx, device); err != nil {
+			log.Warn().Err(err).Stringer("device_id", deviceID).Msg("Failed to cross-sign new device")
+		}
+		if secrets, err = ExportSecrets(ctx, lg.Machine); err != nil {
+			return err
+		}
+	}
+	return channel.Send(ctx, &Message{Type: MessageTypeSecrets, Secrets: secrets})
+}
+
+func (lg *LoginGrant) waitForDevice(ctx context.Context, deviceID id.DeviceID) error {
+	timeout := lg.DeviceWaitTimeout
+	if timeout <= 0 {
+		timeout = DefaultDeviceWaitTimeout
+	}
+	deadline := time.After(timeout)
+	for {
+		resp, err := lg.Client.QueryKeys(ctx, &mautrix.ReqQueryKeys{
+			DeviceKeys: mautrix.DeviceKeysRequest{lg.Client.UserID: mautrix.DeviceIDList{deviceID}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to query new device keys: %w", err)
+		} else if _, ok := resp.DeviceKeys[lg.Client.UserID][deviceID]; ok {
+			return nil
+		}
+		select {
+		case <-time.After(DefaultRendezvousPollInterval):
+		case <-deadline:
+			return ErrDeviceNotFound
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
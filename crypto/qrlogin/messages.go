@@ -0,0 +1,167 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package qrlogin
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
+)
+
+// MessageType is the type of a message sent over a [SecureChannel].
+type MessageType string
+
+const (
+	MessageTypeProtocols        MessageType = "m.login.protocols"
+	MessageTypeProtocol         MessageType = "m.login.protocol"
+	MessageTypeProtocolAccepted MessageType = "m.login.protocol_accepted"
+	MessageTypeSuccess          MessageType = "m.login.success"
+	MessageTypeDeclined         MessageType = "m.login.declined"
+	MessageTypeFailure          MessageType = "m.login.failure"
+	MessageTypeSecrets          MessageType = "m.login.secrets"
+)
+
+// Protocol is a login protocol that can be used to sign in the new device.
+type Protocol string
+
+const (
+	ProtocolDeviceAuthorizationGrant Protocol = "device_authorization_grant"
+)
+
+// FailureReason is the reason included in m.login.failure messages.
+type FailureReason string
+
+const (
+	FailureAuthorizationExpired      FailureReason = "authorization_expired"
+	FailureDeviceAlreadyExists       FailureReason = "device_already_exists"
+	FailureDeviceNotFound            FailureReason = "device_not_found"
+	FailureUnexpectedMessageReceived FailureReason = "unexpected_message_received"
+	FailureUnsupportedProtocol       FailureReason = "unsupported_protocol"
+	FailureUserCancelled             FailureReason = "user_cancelled"
+)
+
+// DeviceAuthorizationGrant contains the URIs the user needs to visit to approve an OAuth device authorization grant.
+type DeviceAuthorizationGrant struct {
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+}
+
+// Message is a message sent over a [SecureChannel]. Which fields are set depends on the type.
+type Message struct {
+	Type MessageType `json:"type"`
+
+	// Fields for m.login.protocols
+	Protocols  []Protocol `json:"protocols,omitempty"`
+	Homeserver string     `json:"homeserver,omitempty"`
+
+	// Fields for m.login.protocol
+	Protocol                 Protocol                  `json:"protocol,omitempty"`
+	DeviceAuthorizationGrant *DeviceAuthorizationGrant `json:"device_authorization_grant,omitempty"`
+	DeviceID                 id.DeviceID               `json:"device_id,omitempty"`
+
+	// Fields for m.login.failure
+	Reason FailureReason `json:"reason,omitempty"`
+
+	// Fields for m.login.secrets
+	*Secrets
+}
+
+// FailureError is returned when the other device sends a m.login.failure message.
+type FailureError struct {
+	Reason FailureReason
+}
+
+func (fe FailureError) Error() string {
+	return fmt.Sprintf("other device reported failure: %s", fe.Reason)
+}
+
+var ErrLoginDeclined = errors.New("login was declined on the other device")
+
+// CrossSigningSecrets contains the private cross-signing keys as unpadded base64.
+type CrossSigningSecrets struct {
+	MasterKey      string `json:"master_key"`
+	SelfSigningKey string `json:"self_signing_key"`
+	UserSigningKey string `json:"user_signing_key"`
+}
+
+// BackupSecret contains the key backup decryption key as unpadded base64.
+type BackupSecret struct {
+	Algorithm     id.KeyBackupAlgorithm `json:"algorithm"`
+	Key           string                `json:"key"`
+	BackupVersion id.KeyBackupVersion   `json:"backup_version"`
+}
+
+// Secrets are the secrets transferred from the existing device to the new device after a successful login.
+type Secrets struct {
+	CrossSigning *CrossSigningSecrets `json:"cross_signing,omitempty"`
+	Backup       *BackupSecret        `json:"backup,omitempty"`
+}
+
+// ExportSecrets collects the cross-signing keys and key backup key of the given machine for transferring
+// to a new device. Secrets that the machine doesn't have are omitted.
+func ExportSecrets(ctx context.Context, mach *crypto.OlmMachine) (*Secrets, error) {
+	var secrets Secrets
+	if mach.CrossSigningKeys != nil {
+		seeds := mach.ExportCrossSigningKeys()
+		secrets.CrossSigning = &CrossSigningSecrets{
+			MasterKey:      base64.RawStdEncoding.EncodeToString(seeds.MasterKey),
+			SelfSigningKey: base64.RawStdEncoding.EncodeToString(seeds.SelfSigningKey),
+			UserSigningKey: base64.RawStdEncoding.EncodeToString(seeds.UserSigningKey),
+		}
+	}
+	backupKey, err := mach.CryptoStore.GetSecret(ctx, id.SecretMegolmBackupV1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key backup secret: %w", err)
+	} else if backupKey != "" {
+		versionInfo, err := mach.Client.GetKeyBackupLatestVersion(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get latest key backup version: %w", err)
+		}
+		secrets.Backup = &BackupSecret{
+			Algorithm:     versionInfo.Algorithm,
+			Key:           backupKey,
+			BackupVersion: versionInfo.Version,
+		}
+	}
+	return &secrets, nil
+}
+
+// Import imports the secrets into the given machine and stores them in its crypto store.
+func (s *Secrets) Import(ctx context.Context, mach *crypto.OlmMachine) error {
+	if s.CrossSigning != nil {
+		var seeds crypto.CrossSigningSeeds
+		var err error
+		if seeds.MasterKey, err = base64.RawStdEncoding.DecodeString(s.CrossSigning.MasterKey); err != nil {
+			return fmt.Errorf("failed to decode master key: %w", err)
+		} else if seeds.SelfSigningKey, err = base64.RawStdEncoding.DecodeString(s.CrossSigning.SelfSigningKey); err != nil {
+			return fmt.Errorf("failed to decode self-signing key: %w", err)
+		} else if seeds.UserSigningKey, err = base64.RawStdEncoding.DecodeString(s.CrossSigning.UserSigningKey); err != nil {
+			return fmt.Errorf("failed to decode user-signing key: %w", err)
+		} else if err = mach.ImportCrossSigningKeys(seeds); err != nil {
+			return fmt.Errorf("failed to import cross-signing keys: %w", err)
+		}
+		for name, value := range map[id.Secret]string{
+			id.SecretXSMaster:      s.CrossSigning.MasterKey,
+			id.SecretXSSelfSigning: s.CrossSigning.SelfSigningKey,
+			id.SecretXSUserSigning: s.CrossSigning.UserSigningKey,
+		} {
+			if err = mach.CryptoStore.PutSecret(ctx, name, value); err != nil {
+				return fmt.Errorf("failed to store %s: %w", name, err)
+			}
+		}
+	}
+	if s.Backup != nil {
+		if err := mach.CryptoStore.PutSecret(ctx, id.SecretMegolmBackupV1, s.Backup.Key); err != nil {
+			return fmt.Errorf("failed to store key backup secret: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package qrlogin
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidQRCodeHeader  = errors.New("invalid QR code header")
+	ErrUnknownQRCodeVersion = errors.New("unknown QR code version")
+	ErrInvalidQRCodeIntent  = errors.New("invalid QR code intent")
+	ErrInvalidQRCodeLength  = errors.New("QR data too short")
+)
+
+// QRCodeIntent specifies which side of the login generated the QR code.
+type QRCodeIntent byte
+
+const (
+	// QRCodeIntentLogin means the QR code is displayed by the new device that wants to log in.
+	QRCodeIntentLogin QRCodeIntent = 0x00
+	// QRCodeIntentReciprocate means the QR code is displayed by an existing device that is already logged in.
+	QRCodeIntentReciprocate QRCodeIntent = 0x01
+)
+
+const qrHeaderString = "MATRIX"
+const qrVersion = 0x02
+
+var qrHeader = []byte(qrHeaderString)
+
+// QRCode is the data encoded in a MSC4108 login QR code.
+type QRCode struct {
+	Intent QRCodeIntent
+	// PublicKey is the X25519 key of the device that generated the QR code.
+	PublicKey *ecdh.PublicKey
+	// RendezvousURL is the URL of the rendezvous session used to exchange messages.
+	RendezvousURL string
+	// ServerName is the server name of the existing device's homeserver.
+	// It's only included in QR codes with [QRCodeIntentReciprocate].
+	ServerName string
+}
+
+func readLengthPrefixed(data []byte, what string) (value, rest []byte, err error) {
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("%w: missing length of %s", ErrInvalidQRCodeLength, what)
+	}
+	length := int(binary.BigEndian.Uint16(data[:2]))
+	if len(data) < 2+length {
+		return nil, nil, fmt.Errorf("%w: expected %d bytes for %s, got %d", ErrInvalidQRCodeLength, length, what, len(data)-2)
+	}
+	return data[2 : 2+length], data[2+length:], nil
+}
+
+// ParseQRCode parses the bytes from a login QR code scan.
+func ParseQRCode(data []byte) (*QRCode, error) {
+	if !bytes.HasPrefix(data, qrHeader) {
+		return nil, ErrInvalidQRCodeHeader
+	}
+	data = data[len(qrHeader):]
+	if len(data) < 2+32 {
+		return nil, fmt.Errorf("%w: expected at least %d bytes, got %d", ErrInvalidQRCodeLength, len(qrHeader)+2+32, len(qrHeader)+len(data))
+	} else if data[0] != qrVersion {
+		return nil, ErrUnknownQRCodeVersion
+	}
+	qr := &QRCode{Intent: QRCodeIntent(data[1])}
+	if qr.Intent != QRCodeIntentLogin && qr.Intent != QRCodeIntentReciprocate {
+		return nil, ErrInvalidQRCodeIntent
+	}
+	var err error
+	qr.PublicKey, err = ecdh.X25519().NewPublicKey(data[2:34])
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in QR code: %w", err)
+	}
+	rendezvousURL, rest, err := readLengthPrefixed(data[34:], "rendezvous URL")
+	if err != nil {
+		return nil, err
+	}
+	qr.RendezvousURL = string(rendezvousURL)
+	if qr.Intent == QRCodeIntentReciprocate {
+		serverName, _, err := readLengthPrefixed(rest, "server name")
+		if err != nil {
+			return nil, err
+		}
+		qr.ServerName = string(serverName)
+	}
+	return qr, nil
+}
+
+// Bytes returns the bytes that need to be encoded in the QR code.
+func (qr *QRCode) Bytes() []byte {
+	if qr == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Write(qrHeader)
+	buf.WriteByte(qrVersion)
+	buf.WriteByte(byte(qr.Intent))
+	buf.Write(qr.PublicKey.Bytes())
+	buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(qr.RendezvousURL))))
+	buf.WriteString(qr.RendezvousURL)
+	if qr.Intent == QRCodeIntentReciprocate {
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(qr.ServerName))))
+		buf.WriteString(qr.ServerName)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package qrlogin_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/qrlogin"
+	"maunium.net/go/mautrix/id"
+)
+
+const testUserID = id.UserID("@alice:example.com")
+
+// fakeServer is a minimal stand-in for a homeserver with a rendezvous endpoint and an OAuth device authorization grant.
+type fakeServer struct {
+	*httptest.Server
+	lock          sync.Mutex
+	sessions      map[string]*fakeRendezvous
+	approved      bool
+	loggedIn      id.DeviceID
+	existingDevID id.DeviceID
+}
+
+type fakeRendezvous struct {
+	data []byte
+	etag int
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	fs := &fakeServer{sessions: make(map[string]*fakeRendezvous), existingDevID: "EXISTING"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /_matrix/client/unstable/org.matrix.msc4108/rendezvous", func(w http.ResponseWriter, r *http.Request) {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		sessionID := strconv.Itoa(len(fs.sessions))
+		fs.sessions[sessionID] = &fakeRendezvous{}
+		w.Header().Set("Location", "/rendezvous/"+sessionID)
+		w.Header().Set("ETag", `"0"`)
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/rendezvous/{id}", func(w http.ResponseWriter, r *http.Request) {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		session, ok := fs.sessions[r.PathValue("id")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		etag := fmt.Sprintf(`"%d"`, session.etag)
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			_, _ = w.Write(session.data)
+		case http.MethodPut:
+			if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != etag {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			session.data, _ = io.ReadAll(r.Body)
+			session.etag++
+			w.Header().Set("ETag", fmt.Sprintf(`"%d"`, session.etag))
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodDelete:
+			delete(fs.sessions, r.PathValue("id"))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("GET /_matrix/client/v1/auth_metadata", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"issuer":                        fs.URL,
+			"device_authorization_endpoint": fs.URL + "/oauth/device",
+			"token_endpoint":                fs.URL + "/oauth/token",
+		})
+	})
+	mux.HandleFunc("POST /oauth/device", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Contains(t, r.PostForm.Get("scope"), "urn:matrix:client:device:")
+		writeJSON(w, http.StatusOK, map[string]any{
+			"device_code":               "devicecode",
+			"user_code":                 "ABCD",
+			"verification_uri":          "https://auth.example.com/device",
+			"verification_uri_complete": "https://auth.example.com/device?code=ABCD",
+			"expires_in":                60,
+			"interval":                  1,
+		})
+	})
+	mux.HandleFunc("POST /oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		if !fs.approved {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "authorization_pending"})
+			return
+		}
+		fs.loggedIn = "NEWDEVICE"
+		writeJSON(w, http.StatusOK, map[string]any{"access_token": "newtoken", "token_type": "Bearer", "expires_in": 3600})
+	})
+	mux.HandleFunc("GET /_matrix/client/v3/account/whoami", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"user_id": testUserID})
+	})
+	mux.HandleFunc("GET /_matrix/client/v3/devices/{deviceID}", func(w http.ResponseWriter, r *http.Request) {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		if deviceID := id.DeviceID(r.PathValue("deviceID")); deviceID == fs.existingDevID || deviceID == fs.loggedIn {
+			writeJSON(w, http.StatusOK, map[string]any{"device_id": deviceID})
+		} else {
+			writeJSON(w, http.StatusNotFound, map[string]any{"errcode": "M_NOT_FOUND", "error": "Device not found"})
+		}
+	})
+	mux.HandleFunc("POST /_matrix/client/v3/keys/query", func(w http.ResponseWriter, r *http.Request) {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		devices := map[id.DeviceID]any{}
+		if fs.loggedIn != "" {
+			devices[fs.loggedIn] = map[string]any{"user_id": testUserID, "device_id": fs.loggedIn}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"device_keys": map[id.UserID]any{testUserID: devices}})
+	})
+	fs.Server = httptest.NewServer(mux)
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+func TestQRCode_RoundTrip(t *testing.T) {
+	session := qrlogin.NewRendezvousSession(nil, "https://example.com/rendezvous/abc")
+	pending, err := qrlogin.NewPendingChannel(session, qrlogin.QRCodeIntentReciprocate, "example.com")
+	require.NoError(t, err)
+	parsed, err := qrlogin.ParseQRCode(pending.QRCode.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, qrlogin.QRCodeIntentReciprocate, parsed.Intent)
+	assert.Equal(t, "https://example.com/rendezvous/abc", parsed.RendezvousURL)
+	assert.Equal(t, "example.com", parsed.ServerName)
+	assert.True(t, pending.QRCode.PublicKey.Equal(parsed.PublicKey))
+
+	_, err = qrlogin.ParseQRCode(pending.QRCode.Bytes()[:40])
+	assert.ErrorIs(t, err, qrlogin.ErrInvalidQRCodeLength)
+	_, err = qrlogin.ParseQRCode([]byte("NOTMATRIX"))
+	assert.ErrorIs(t, err, qrlogin.ErrInvalidQRCodeHeader)
+}
+
+func setupLogin(t *testing.T, fs *fakeServer) (*qrlogin.NewDeviceLogin, *qrlogin.LoginGrant, *qrlogin.PendingChannel, *qrlogin.RendezvousSession) {
+	newCli, err := mautrix.NewClient(fs.URL, "", "")
+	require.NoError(t, err)
+	existingCli, err := mautrix.NewClient(fs.URL, testUserID, "existingtoken")
+	require.NoError(t, err)
+	existingCli.DeviceID = fs.existingDevID
+
+	newDevice := &qrlogin.NewDeviceLogin{Client: newCli, ClientID: "client", DeviceID: "NEWDEVICE"}
+	grant := &qrlogin.LoginGrant{Client: existingCli, DeviceWaitTimeout: 5 * time.Second}
+	pending, err := newDevice.GenerateQRCode(context.Background())
+	require.NoError(t, err)
+	pending.Session.PollInterval = 10 * time.Millisecond
+	scanned, err := qrlogin.ParseQRCode(pending.QRCode.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, qrlogin.QRCodeIntentLogin, scanned.Intent)
+	scannerSession := qrlogin.NewRendezvousSession(nil, scanned.RendezvousURL)
+	scannerSession.PollInterval = 10 * time.Millisecond
+	return newDevice, grant, pending, scannerSession
+}
+
+func TestLogin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fs := newFakeServer(t)
+	newDevice, grant, pending, scannerSession := setupLogin(t, fs)
+
+	checkCode := make(chan string, 1)
+	newDevice.OnCheckCode = func(code string) {
+		checkCode <- code
+	}
+	grant.GetCheckCode = func(ctx context.Context) (string, error) {
+		return <-checkCode, nil
+	}
+	grant.OpenVerificationURI = func(ctx context.Context, deviceID id.DeviceID, uri string) error {
+		assert.Equal(t, id.DeviceID("NEWDEVICE"), deviceID)
+		assert.Equal(t, "https://auth.example.com/device?code=ABCD", uri)
+		fs.lock.Lock()
+		fs.approved = true
+		fs.lock.Unlock()
+		return nil
+	}
+
+	grantErr := make(chan error, 1)
+	go func() {
+		qr, err := qrlogin.ParseQRCode(pending.QRCode.Bytes())
+		if err != nil {
+			grantErr <- err
+			return
+		}
+		channel, err := qrlogin.Connect(ctx, scannerSession, qr)
+		if err != nil {
+			grantErr <- err
+			return
+		}
+		grantErr <- grant.Grant(ctx, channel)
+	}()
+
+	channel, err := pending.Accept(ctx)
+	require.NoError(t, err)
+	secrets, err := newDevice.Login(ctx, channel)
+	require.NoError(t, err)
+	require.NoError(t, <-grantErr)
+	assert.NotNil(t, secrets)
+	assert.Equal(t, "newtoken", newDevice.Client.AccessToken)
+	assert.Equal(t, testUserID, newDevice.Client.UserID)
+	assert.Equal(t, id.DeviceID("NEWDEVICE"), newDevice.Client.DeviceID)
+
+	require.NoError(t, pending.Session.Close(ctx))
+	_, err = scannerSession.Receive(ctx)
+	assert.ErrorIs(t, err, qrlogin.ErrRendezvousNotFound)
+}
+
+func TestLogin_DeviceAlreadyExists(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fs := newFakeServer(t)
+	newDevice, grant, pending, scannerSession := setupLogin(t, fs)
+	newDevice.DeviceID = fs.existingDevID
+
+	grantErr := make(chan error, 1)
+	go func() {
+		qr, _ := qrlogin.ParseQRCode(pending.QRCode.Bytes())
+		channel, err := qrlogin.Connect(ctx, scannerSession, qr)
+		if err != nil {
+			grantErr <- err
+			return
+		}
+		grantErr <- grant.Grant(ctx, channel)
+	}()
+
+	channel, err := pending.Accept(ctx)
+	require.NoError(t, err)
+	_, err = newDevice.Login(ctx, channel)
+	assert.Equal(t, qrlogin.FailureError{Reason: qrlogin.FailureDeviceAlreadyExists}, err)
+	assert.ErrorIs(t, <-grantErr, qrlogin.ErrDeviceAlreadyExists)
+}
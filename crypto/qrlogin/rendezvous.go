@@ -0,0 +1,198 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package qrlogin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+var (
+	ErrRendezvousNotFound = errors.New("rendezvous session not found or expired")
+	ErrRendezvousConflict = errors.New("rendezvous session was modified concurrently")
+	ErrNoRendezvousURL    = errors.New("rendezvous session creation response didn't include a location")
+)
+
+// DefaultRendezvousPollInterval is the default interval for polling the rendezvous session for new data.
+const DefaultRendezvousPollInterval = 1 * time.Second
+
+// maxRendezvousPayloadSize is the maximum size of a single rendezvous payload that will be read.
+const maxRendezvousPayloadSize = 64 * 1024
+
+// RendezvousSession is a MSC4108 rendezvous session, which is a single mutable blob stored on the server
+// that the two sides of a login take turns writing to. Changes are detected using ETags.
+type RendezvousSession struct {
+	URL          string
+	HTTPClient   *http.Client
+	PollInterval time.Duration
+	// Expires is the expiry time of the session as reported by the server, if known.
+	Expires time.Time
+
+	etag string
+}
+
+// NewRendezvousSession creates a handle to an existing rendezvous session, e.g. one from a scanned QR code.
+func NewRendezvousSession(httpClient *http.Client, sessionURL string) *RendezvousSession {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &RendezvousSession{
+		URL:          sessionURL,
+		HTTPClient:   httpClient,
+		PollInterval: DefaultRendezvousPollInterval,
+	}
+}
+
+// CreateRendezvousSession creates a new rendezvous session on the given client's homeserver.
+// The client doesn't need to be logged in.
+func CreateRendezvousSession(ctx context.Context, cli *mautrix.Client) (*RendezvousSession, error) {
+	createURL := cli.BuildClientURL("unstable", "org.matrix.msc4108", "rendezvous")
+	rs := NewRendezvousSession(cli.Client, "")
+	resp, err := rs.do(ctx, http.MethodPost, createURL, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rendezvous session: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to create rendezvous session: unexpected status code %d", resp.StatusCode)
+	}
+	location, err := resp.Location()
+	if errors.Is(err, http.ErrNoLocation) {
+		return nil, ErrNoRendezvousURL
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to parse rendezvous session location: %w", err)
+	}
+	rs.URL = location.String()
+	rs.updateFromResponse(resp)
+	return rs, nil
+}
+
+func (rs *RendezvousSession) do(ctx context.Context, method, reqURL string, body []byte, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	return rs.HTTPClient.Do(req)
+}
+
+func (rs *RendezvousSession) updateFromResponse(resp *http.Response) {
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		rs.etag = etag
+	}
+	if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		rs.Expires = expires
+	}
+}
+
+// Send replaces the data in the rendezvous session. The write is conditional on the session not having
+// been modified since it was last read, so that the other side's messages are never overwritten unseen.
+func (rs *RendezvousSession) Send(ctx context.Context, data []byte) error {
+	headers := http.Header{}
+	if rs.etag != "" {
+		headers.Set("If-Match", rs.etag)
+	}
+	resp, err := rs.do(ctx, http.MethodPut, rs.URL, data, headers)
+	if err != nil {
+		return fmt.Errorf("failed to send rendezvous data: %w", err)
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent:
+		rs.updateFromResponse(resp)
+		return nil
+	case http.StatusPreconditionFailed:
+		return ErrRendezvousConflict
+	case http.StatusNotFound, http.StatusGone:
+		return ErrRendezvousNotFound
+	default:
+		return fmt.Errorf("failed to send rendezvous data: unexpected status code %d", resp.StatusCode)
+	}
+}
+
+// Receive waits until the other side writes new data to the rendezvous session and returns it.
+func (rs *RendezvousSession) Receive(ctx context.Context) ([]byte, error) {
+	for {
+		data, err := rs.poll(ctx)
+		if err != nil || data != nil {
+			return data, err
+		}
+		select {
+		case <-time.After(rs.PollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (rs *RendezvousSession) poll(ctx context.Context) ([]byte, error) {
+	headers := http.Header{}
+	if rs.etag != "" {
+		headers.Set("If-None-Match", rs.etag)
+	}
+	resp, err := rs.do(ctx, http.MethodGet, rs.URL, nil, headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to poll rendezvous session: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxRendezvousPayloadSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rendezvous data: %w", err)
+		}
+		rs.updateFromResponse(resp)
+		if len(data) == 0 {
+			// The session was created but nothing has been written yet
+			return nil, nil
+		}
+		return data, nil
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusNotFound, http.StatusGone:
+		return nil, ErrRendezvousNotFound
+	default:
+		return nil, fmt.Errorf("failed to poll rendezvous session: unexpected status code %d", resp.StatusCode)
+	}
+}
+
+// Close deletes the rendezvous session from the server.
+func (rs *RendezvousSession) Close(ctx context.Context) error {
+	resp, err := rs.do(ctx, http.MethodDelete, rs.URL, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete rendezvous session: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete rendezvous session: unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// validateRendezvousURL makes sure the URL from a QR code is an absolute HTTP(S) URL.
+func validateRendezvousURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid rendezvous URL: %w", err)
+	} else if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return fmt.Errorf("invalid rendezvous URL: unsupported scheme %q", parsed.Scheme)
+	}
+	return nil
+}
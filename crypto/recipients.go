@@ -0,0 +1,135 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrEventNotEncrypted = errors.New("event is not encrypted")
+
+// SessionRecipient is a record of a device that a Megolm session was shared with or withheld from.
+type SessionRecipient struct {
+	RoomID      id.RoomID
+	SessionID   id.SessionID
+	UserID      id.UserID
+	DeviceID    id.DeviceID
+	IdentityKey id.IdentityKey
+	// TrustState is the trust state of the device at the time the session was shared or withheld.
+	TrustState id.TrustState
+	// Shared is true if the session was sent to the device.
+	// If false, WithheldCode and WithheldReason contain the reason why it wasn't.
+	Shared bool
+	// Forwarded is true if the session was sent in response to a key request rather than when sending a message.
+	Forwarded bool
+	// FirstIndex is the first message index that the device can decrypt. Only set if Shared is true.
+	FirstIndex     uint32
+	WithheldCode   event.RoomKeyWithheldCode
+	WithheldReason string
+	Timestamp      time.Time
+}
+
+// CanRead returns true if the device received the session at or before the given message index.
+func (rec *SessionRecipient) CanRead(messageIndex uint32) bool {
+	return rec.Shared && rec.FirstIndex <= messageIndex
+}
+
+func newSharedRecipient(roomID id.RoomID, sessionID id.SessionID, device *id.Device, trust id.TrustState, firstIndex uint32) *SessionRecipient {
+	return &SessionRecipient{
+		RoomID:      roomID,
+		SessionID:   sessionID,
+		UserID:      device.UserID,
+		DeviceID:    device.DeviceID,
+		IdentityKey: device.IdentityKey,
+		TrustState:  trust,
+		Shared:      true,
+		FirstIndex:  firstIndex,
+		Timestamp:   time.Now(),
+	}
+}
+
+func newWithheldRecipient(roomID id.RoomID, sessionID id.SessionID, device *id.Device, trust id.TrustState, content *event.RoomKeyWithheldEventContent) *SessionRecipient {
+	return &SessionRecipient{
+		RoomID:         roomID,
+		SessionID:      sessionID,
+		UserID:         device.UserID,
+		DeviceID:       device.DeviceID,
+		IdentityKey:    device.IdentityKey,
+		TrustState:     trust,
+		WithheldCode:   content.Code,
+		WithheldReason: content.Reason,
+		Timestamp:      time.Now(),
+	}
+}
+
+func (mach *OlmMachine) storeSessionRecipients(ctx context.Context, recipients ...*SessionRecipient) {
+	if !mach.TrackSessionRecipients || len(recipients) == 0 {
+		return
+	}
+	err := mach.CryptoStore.PutSessionRecipients(ctx, recipients)
+	if err != nil {
+		mach.machOrContextLog(ctx).Err(err).
+			Stringer("session_id", recipients[0].SessionID).
+			Int("recipient_count", len(recipients)).
+			Msg("Failed to store session recipients")
+	}
+}
+
+// SessionRecipients returns the devices that the given Megolm session was shared with or withheld from.
+// Recipients are only recorded if [OlmMachine.TrackSessionRecipients] is enabled.
+func (mach *OlmMachine) SessionRecipients(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) ([]*SessionRecipient, error) {
+	return mach.CryptoStore.GetSessionRecipients(ctx, roomID, sessionID)
+}
+
+// EventReadableBy returns the devices that received the keys needed to decrypt the given event.
+// The event is fetched from the server to find the session and message index.
+// Recipients are only recorded if [OlmMachine.TrackSessionRecipients] is enabled.
+func (mach *OlmMachine) EventReadableBy(ctx context.Context, roomID id.RoomID, eventID id.EventID) ([]*SessionRecipient, error) {
+	evt, err := mach.Client.GetEvent(ctx, roomID, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get event: %w", err)
+	}
+	return mach.EventReadableByDevices(ctx, evt)
+}
+
+// EventReadableByDevices is like [OlmMachine.EventReadableBy], but takes an already fetched encrypted event.
+func (mach *OlmMachine) EventReadableByDevices(ctx context.Context, evt *event.Event) ([]*SessionRecipient, error) {
+	if evt.Type != event.EventEncrypted {
+		return nil, ErrEventNotEncrypted
+	} else if evt.Content.Parsed == nil {
+		if err := evt.Content.ParseRaw(evt.Type); err != nil {
+			return nil, fmt.Errorf("failed to parse event content: %w", err)
+		}
+	}
+	content, ok := evt.Content.Parsed.(*event.EncryptedEventContent)
+	if !ok {
+		return nil, ErrIncorrectEncryptedContentType
+	} else if content.Algorithm != id.AlgorithmMegolmV1 {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	messageIndex, err := ParseMegolmMessageIndex(content.MegolmCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message index: %w", err)
+	}
+	recipients, err := mach.CryptoStore.GetSessionRecipients(ctx, evt.RoomID, content.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	readers := recipients[:0]
+	for _, rec := range recipients {
+		if rec.CanRead(uint32(messageIndex)) {
+			readers = append(readers, rec)
+		}
+	}
+	return readers, nil
+}
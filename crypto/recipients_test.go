@@ -0,0 +1,114 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSessionRecipients(t *testing.T) {
+	ctx := context.Background()
+	machineOut := newMachine(t, "user1")
+	machineIn := newMachine(t, "user2")
+	machineOut.TrackSessionRecipients = true
+
+	var servedEvent *event.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/event/") {
+			_ = json.NewEncoder(w).Encode(servedEvent)
+		} else {
+			_, _ = w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	machineOut.Client.HomeserverURL, _ = url.Parse(server.URL)
+
+	otks := machineIn.account.getOneTimeKeys("user2", "device2", 0)
+	var otk mautrix.OneTimeKey
+	for _, otkTmp := range otks {
+		otk = otkTmp
+		break
+	}
+	olmSession, err := machineOut.account.Internal.NewOutboundSession(machineIn.account.IdentityKey(), otk.Key)
+	require.NoError(t, err)
+	require.NoError(t, machineOut.CryptoStore.AddSession(ctx, machineIn.account.IdentityKey(), wrapSession(olmSession)))
+	blacklisted := NewOlmAccount()
+	require.NoError(t, machineOut.CryptoStore.PutDevices(ctx, "user2", map[id.DeviceID]*id.Device{
+		"device2": {
+			UserID:      "user2",
+			DeviceID:    "device2",
+			IdentityKey: machineIn.account.IdentityKey(),
+			SigningKey:  machineIn.account.SigningKey(),
+		},
+		"device3": {
+			UserID:      "user2",
+			DeviceID:    "device3",
+			IdentityKey: blacklisted.IdentityKey(),
+			SigningKey:  blacklisted.SigningKey(),
+			Trust:       id.TrustStateBlacklisted,
+		},
+	}))
+
+	require.NoError(t, machineOut.ShareGroupSession(ctx, "room1", []id.UserID{"user2"}))
+	content, err := machineOut.EncryptMegolmEvent(ctx, "room1", event.EventMessage, map[string]string{"body": "hello"})
+	require.NoError(t, err)
+
+	recipients, err := machineOut.SessionRecipients(ctx, "room1", content.SessionID)
+	require.NoError(t, err)
+	require.Len(t, recipients, 2)
+	assert.Equal(t, id.DeviceID("device2"), recipients[0].DeviceID)
+	assert.True(t, recipients[0].Shared)
+	assert.Equal(t, uint32(0), recipients[0].FirstIndex)
+	assert.Equal(t, id.DeviceID("device3"), recipients[1].DeviceID)
+	assert.False(t, recipients[1].Shared)
+	assert.Equal(t, id.TrustStateBlacklisted, recipients[1].TrustState)
+	assert.Equal(t, event.RoomKeyWithheldBlacklisted, recipients[1].WithheldCode)
+
+	servedEvent = &event.Event{
+		Type:    event.EventEncrypted,
+		ID:      "$event1",
+		RoomID:  "room1",
+		Sender:  "user1",
+		Content: event.Content{Parsed: content},
+	}
+	readers, err := machineOut.EventReadableBy(ctx, "room1", "$event1")
+	require.NoError(t, err)
+	require.Len(t, readers, 1)
+	assert.Equal(t, id.UserID("user2"), readers[0].UserID)
+	assert.Equal(t, id.DeviceID("device2"), readers[0].DeviceID)
+
+	requester := &id.Device{UserID: "user3", DeviceID: "device4", IdentityKey: "identity4", SigningKey: "signing4"}
+	// Rejections for unknown sessions and silent rejections aren't recorded
+	machineOut.rejectKeyRequest(ctx, KeyShareRejectUnavailable, requester, event.RequestedKeyInfo{RoomID: "room1", SessionID: "unknown"})
+	unknownRecipients, err := machineOut.SessionRecipients(ctx, "room1", "unknown")
+	require.NoError(t, err)
+	assert.Empty(t, unknownRecipients)
+	machineOut.rejectKeyRequest(ctx, KeyShareRejectNoResponse, requester, event.RequestedKeyInfo{RoomID: "room1", SessionID: content.SessionID})
+	recipients, err = machineOut.SessionRecipients(ctx, "room1", content.SessionID)
+	require.NoError(t, err)
+	assert.Len(t, recipients, 2)
+	machineOut.rejectKeyRequest(ctx, KeyShareRejectOtherUser, requester, event.RequestedKeyInfo{RoomID: "room1", SessionID: content.SessionID})
+	recipients, err = machineOut.SessionRecipients(ctx, "room1", content.SessionID)
+	require.NoError(t, err)
+	require.Len(t, recipients, 3)
+	assert.Equal(t, id.UserID("user3"), recipients[2].UserID)
+	assert.Equal(t, KeyShareRejectOtherUser.Code, recipients[2].WithheldCode)
+}
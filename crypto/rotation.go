@@ -0,0 +1,240 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// RotationReason describes why an outbound group session was rotated.
+type RotationReason string
+
+const (
+	RotationReasonManual            RotationReason = "manual"
+	RotationReasonMembershipChange  RotationReason = "membership_change"
+	RotationReasonHistoryVisibility RotationReason = "history_visibility_change"
+	RotationReasonDeviceListChange  RotationReason = "device_list_change"
+	RotationReasonUntrustedDevice   RotationReason = "untrusted_device"
+	RotationReasonPolicy            RotationReason = "policy"
+)
+
+// SessionRotationPolicy can be used to customize when outbound group sessions are rotated,
+// in addition to the built-in rotation on membership, history visibility and device list changes.
+type SessionRotationPolicy interface {
+	// ConfigureSession is called for every new outbound group session before it's shared.
+	// It can be used to change the session's MaxAge and MaxMessages.
+	ConfigureSession(ctx context.Context, mach *OlmMachine, session *OutboundGroupSession)
+	// ShouldRotate is called before an existing outbound group session is used to share or encrypt.
+	// If it returns true, the session is discarded and a new one is shared on the next send.
+	ShouldRotate(ctx context.Context, mach *OlmMachine, session *OutboundGroupSession) (bool, RotationReason)
+}
+
+// RotationLimits contains limits for outbound group session lifetimes.
+// Zero values mean the limit is not set.
+type RotationLimits struct {
+	MaxAge      time.Duration
+	MaxMessages int
+}
+
+// StricterLimitsPolicy is a rotation policy that applies stricter session lifetimes than the
+// room's m.room.encryption event. Limits can only make rotation more frequent, never less.
+type StricterLimitsPolicy struct {
+	Default RotationLimits
+	PerRoom map[id.RoomID]RotationLimits
+}
+
+var _ SessionRotationPolicy = (*StricterLimitsPolicy)(nil)
+
+func (slp *StricterLimitsPolicy) ConfigureSession(_ context.Context, _ *OlmMachine, session *OutboundGroupSession) {
+	limits, ok := slp.PerRoom[session.RoomID]
+	if !ok {
+		limits = slp.Default
+	}
+	if limits.MaxAge > 0 && limits.MaxAge < session.MaxAge {
+		session.MaxAge = limits.MaxAge
+	}
+	if limits.MaxMessages > 0 && limits.MaxMessages < session.MaxMessages {
+		session.MaxMessages = limits.MaxMessages
+	}
+}
+
+func (slp *StricterLimitsPolicy) ShouldRotate(_ context.Context, _ *OlmMachine, _ *OutboundGroupSession) (bool, RotationReason) {
+	return false, ""
+}
+
+// DefaultRecipientRecheckInterval is the default value for [UntrustedRecipientPolicy.RecheckInterval].
+const DefaultRecipientRecheckInterval = 5 * time.Minute
+
+// UntrustedRecipientPolicy is a rotation policy that rotates the session if it has been shared with a device
+// whose trust state is now below MinTrust, e.g. because the device was blacklisted after the session was shared.
+//
+// The room members are read from the client's state store, so checking the policy requires looking up all
+// devices of all room members. To avoid doing that on every message, each session is only checked
+// once per RecheckInterval. Membership and device list changes rotate the session anyway,
+// so the interval only affects how quickly trust changes of existing devices are noticed.
+// [UntrustedRecipientPolicy.Invalidate] can be used to force a recheck after changing the trust of a device.
+type UntrustedRecipientPolicy struct {
+	// MinTrust is the minimum trust state recipients must have. Defaults to anything above blacklisted.
+	MinTrust id.TrustState
+	// RecheckInterval is the minimum time between checks of the same session. Defaults to DefaultRecipientRecheckInterval.
+	RecheckInterval time.Duration
+
+	lastChecked map[id.RoomID]checkedSession
+	lock        sync.Mutex
+}
+
+type checkedSession struct {
+	sessionID id.SessionID
+	checkedAt time.Time
+}
+
+var _ SessionRotationPolicy = (*UntrustedRecipientPolicy)(nil)
+
+func (urp *UntrustedRecipientPolicy) ConfigureSession(_ context.Context, _ *OlmMachine, _ *OutboundGroupSession) {
+}
+
+// Invalidate clears the cached check results, so that all sessions are checked again the next time they're used.
+func (urp *UntrustedRecipientPolicy) Invalidate() {
+	urp.lock.Lock()
+	urp.lastChecked = nil
+	urp.lock.Unlock()
+}
+
+func (urp *UntrustedRecipientPolicy) recentlyChecked(session *OutboundGroupSession) bool {
+	interval := urp.RecheckInterval
+	if interval <= 0 {
+		interval = DefaultRecipientRecheckInterval
+	}
+	urp.lock.Lock()
+	defer urp.lock.Unlock()
+	checked, ok := urp.lastChecked[session.RoomID]
+	return ok && checked.sessionID == session.ID() && time.Since(checked.checkedAt) < interval
+}
+
+func (urp *UntrustedRecipientPolicy) markChecked(session *OutboundGroupSession, rotate bool) {
+	urp.lock.Lock()
+	defer urp.lock.Unlock()
+	if rotate {
+		delete(urp.lastChecked, session.RoomID)
+		return
+	} else if urp.lastChecked == nil {
+		urp.lastChecked = make(map[id.RoomID]checkedSession)
+	}
+	urp.lastChecked[session.RoomID] = checkedSession{sessionID: session.ID(), checkedAt: time.Now()}
+}
+
+func (urp *UntrustedRecipientPolicy) ShouldRotate(ctx context.Context, mach *OlmMachine, session *OutboundGroupSession) (bool, RotationReason) {
+	if !session.Shared || mach.Client.StateStore == nil || urp.recentlyChecked(session) {
+		return false, ""
+	}
+	rotate, ok := urp.hasUntrustedRecipient(ctx, mach, session)
+	if ok {
+		urp.markChecked(session, rotate)
+	}
+	if rotate {
+		return true, RotationReasonUntrustedDevice
+	}
+	return false, ""
+}
+
+func (urp *UntrustedRecipientPolicy) hasUntrustedRecipient(ctx context.Context, mach *OlmMachine, session *OutboundGroupSession) (untrusted, ok bool) {
+	minTrust := urp.MinTrust
+	if minTrust == 0 {
+		minTrust = id.TrustStateBlacklisted + 1
+	}
+	log := mach.machOrContextLog(ctx).With().
+		Stringer("room_id", session.RoomID).
+		Stringer("session_id", session.ID()).
+		Logger()
+	members, err := mach.Client.StateStore.GetRoomJoinedOrInvitedMembers(ctx, session.RoomID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get room members to check recipient trust")
+		return false, false
+	}
+	ok = true
+	for _, userID := range members {
+		devices, err := mach.CryptoStore.GetDevices(ctx, userID)
+		if err != nil {
+			log.Err(err).Stringer("user_id", userID).Msg("Failed to get devices to check recipient trust")
+			ok = false
+			continue
+		}
+		for _, device := range devices {
+			if trust, err := mach.ResolveTrustContext(ctx, device); err != nil || trust >= minTrust {
+				continue
+			}
+			shared, err := mach.CryptoStore.IsOutboundGroupSessionShared(ctx, device.UserID, device.IdentityKey, session.ID())
+			if err != nil {
+				log.Err(err).Stringer("user_id", userID).Msg("Failed to check if session was shared with device")
+				ok = false
+			} else if shared {
+				log.Debug().
+					Stringer("user_id", device.UserID).
+					Stringer("device_id", device.DeviceID).
+					Msg("Session was shared with device that is no longer trusted")
+				return true, true
+			}
+		}
+	}
+	return false, ok
+}
+
+// CombinedRotationPolicy applies multiple rotation policies in order.
+type CombinedRotationPolicy []SessionRotationPolicy
+
+var _ SessionRotationPolicy = CombinedRotationPolicy(nil)
+
+func (crp CombinedRotationPolicy) ConfigureSession(ctx context.Context, mach *OlmMachine, session *OutboundGroupSession) {
+	for _, policy := range crp {
+		policy.ConfigureSession(ctx, mach, session)
+	}
+}
+
+func (crp CombinedRotationPolicy) ShouldRotate(ctx context.Context, mach *OlmMachine, session *OutboundGroupSession) (bool, RotationReason) {
+	for _, policy := range crp {
+		if rotate, reason := policy.ShouldRotate(ctx, mach, session); rotate {
+			return true, reason
+		}
+	}
+	return false, ""
+}
+
+// RotateRoomSession discards the current outbound group session in the given room,
+// so that a new session is created and shared on the next send.
+func (mach *OlmMachine) RotateRoomSession(ctx context.Context, roomID id.RoomID, reason RotationReason) error {
+	log := mach.machOrContextLog(ctx).With().
+		Stringer("room_id", roomID).
+		Str("reason", string(reason)).
+		Logger()
+	err := mach.CryptoStore.RemoveOutboundGroupSession(ctx, roomID)
+	if err != nil {
+		log.Err(err).Msg("Failed to invalidate outbound group session")
+		return fmt.Errorf("failed to remove outbound group session: %w", err)
+	}
+	log.Debug().Msg("Invalidated outbound group session")
+	return nil
+}
+
+func (mach *OlmMachine) checkRotationPolicy(ctx context.Context, session *OutboundGroupSession) bool {
+	if mach.RotationPolicy == nil || session == nil {
+		return false
+	}
+	rotate, reason := mach.RotationPolicy.ShouldRotate(ctx, mach, session)
+	if !rotate {
+		return false
+	}
+	if reason == "" {
+		reason = RotationReasonPolicy
+	}
+	err := mach.RotateRoomSession(ctx, session.RoomID, reason)
+	return err == nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type alwaysRotatePolicy struct {
+	StricterLimitsPolicy
+	rotate bool
+}
+
+func (arp *alwaysRotatePolicy) ShouldRotate(_ context.Context, _ *OlmMachine, _ *OutboundGroupSession) (bool, RotationReason) {
+	return arp.rotate, ""
+}
+
+func TestStricterLimitsPolicy(t *testing.T) {
+	ctx := context.Background()
+	mach := newMachine(t, "user1")
+	mach.RotationPolicy = &StricterLimitsPolicy{
+		Default: RotationLimits{MaxMessages: 2},
+		PerRoom: map[id.RoomID]RotationLimits{
+			"strict": {MaxAge: time.Hour, MaxMessages: 1},
+			// Limits looser than the defaults are ignored
+			"loose": {MaxAge: 365 * 24 * time.Hour, MaxMessages: 1000},
+		},
+	}
+	sess, err := mach.newOutboundGroupSession(ctx, "strict")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, sess.MaxAge)
+	assert.Equal(t, 1, sess.MaxMessages)
+	sess, err = mach.newOutboundGroupSession(ctx, "loose")
+	require.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, sess.MaxAge)
+	assert.Equal(t, 3, sess.MaxMessages)
+	sess, err = mach.newOutboundGroupSession(ctx, "other")
+	require.NoError(t, err)
+	assert.Equal(t, 2, sess.MaxMessages)
+}
+
+func TestOlmMachine_RotateRoomSession(t *testing.T) {
+	ctx := context.Background()
+	mach := newMachine(t, "user1")
+	policy := &alwaysRotatePolicy{}
+	mach.RotationPolicy = policy
+	addSession := func() {
+		sess, err := mach.newOutboundGroupSession(ctx, "room1")
+		require.NoError(t, err)
+		sess.Shared = true
+		require.NoError(t, mach.CryptoStore.AddOutboundGroupSession(ctx, sess))
+	}
+
+	addSession()
+	_, err := mach.EncryptMegolmEvent(ctx, "room1", event.EventMessage, map[string]string{"hello": "world"})
+	require.NoError(t, err)
+	require.NoError(t, mach.RotateRoomSession(ctx, "room1", RotationReasonManual))
+	_, err = mach.EncryptMegolmEvent(ctx, "room1", event.EventMessage, map[string]string{"hello": "world"})
+	assert.ErrorIs(t, err, ErrNoGroupSession)
+
+	// Policy-triggered rotation discards the session before encrypting
+	addSession()
+	policy.rotate = true
+	_, err = mach.EncryptMegolmEvent(ctx, "room1", event.EventMessage, map[string]string{"hello": "world"})
+	assert.ErrorIs(t, err, ErrNoGroupSession)
+	sess, err := mach.CryptoStore.GetOutboundGroupSession(ctx, "room1")
+	require.NoError(t, err)
+	assert.Nil(t, sess)
+}
+
+func TestUntrustedRecipientPolicy(t *testing.T) {
+	ctx := context.Background()
+	mach := newMachine(t, "user1")
+	mach.Client.StateStore = mautrix.NewMemoryStateStore()
+	require.NoError(t, mach.Client.StateStore.SetMembership(ctx, "room1", "user2", event.MembershipJoin))
+	device := &id.Device{UserID: "user2", DeviceID: "device2", IdentityKey: "identity2", SigningKey: "signing2"}
+	require.NoError(t, mach.CryptoStore.PutDevice(ctx, device.UserID, device))
+	sess, err := mach.newOutboundGroupSession(ctx, "room1")
+	require.NoError(t, err)
+	sess.Shared = true
+	require.NoError(t, mach.CryptoStore.MarkOutboundGroupSessionShared(ctx, device.UserID, device.IdentityKey, sess.ID()))
+
+	policy := &UntrustedRecipientPolicy{}
+	rotate, _ := policy.ShouldRotate(ctx, mach, sess)
+	assert.False(t, rotate)
+
+	blacklisted := *device
+	blacklisted.Trust = id.TrustStateBlacklisted
+	require.NoError(t, mach.CryptoStore.PutDevice(ctx, device.UserID, &blacklisted))
+	// The result for the session is cached, so the trust change isn't noticed until the cache is invalidated
+	rotate, _ = policy.ShouldRotate(ctx, mach, sess)
+	assert.False(t, rotate)
+	policy.Invalidate()
+	rotate, reason := policy.ShouldRotate(ctx, mach, sess)
+	assert.True(t, rotate)
+	assert.Equal(t, RotationReasonUntrustedDevice, reason)
+}
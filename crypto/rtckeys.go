@@ -0,0 +1,295 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mau.fi/util/jsontime"
+	"go.mau.fi/util/ptr"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RTCKeyIndexCount is the number of key indexes available for MatrixRTC media keys.
+// Indexes wrap around after this, so receivers only need to keep this many keys per participant.
+const RTCKeyIndexCount = 256
+
+// RTCMediaKeyLength is the length of generated MatrixRTC media keys in bytes.
+const RTCMediaKeyLength = 16
+
+// RTCMediaKey is a media encryption key of a single device in a MatrixRTC session.
+type RTCMediaKey struct {
+	UserID   id.UserID
+	DeviceID id.DeviceID
+	Index    int
+	Key      []byte
+	SentAt   time.Time
+}
+
+type rtcDevice struct {
+	UserID   id.UserID
+	DeviceID id.DeviceID
+}
+
+func (mach *OlmMachine) receiveCallEncryptionKeys(ctx context.Context, evt *DecryptedOlmEvent, content *event.CallEncryptionKeysEventContent) {
+	log := mach.machOrContextLog(ctx).With().
+		Str("action", "receive call encryption keys").
+		Stringer("sender", evt.Sender).
+		Stringer("sender_device", ptr.Val(evt.SenderDevice).DeviceID).
+		Stringer("room_id", content.RoomID).
+		Int("key_index", content.Keys.Index).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	if evt.SenderDevice == nil || evt.SenderDevice.DeviceID != content.Member.ClaimedDeviceID {
+		log.Warn().
+			Stringer("claimed_device_id", content.Member.ClaimedDeviceID).
+			Msg("Ignoring call encryption keys with mismatching claimed device ID")
+	} else if content.RoomID == "" || len(content.Keys.Key) == 0 {
+		log.Warn().Msg("Ignoring call encryption keys with missing room ID or key")
+	} else if content.Keys.Index < 0 || content.Keys.Index >= RTCKeyIndexCount {
+		log.Warn().Msg("Ignoring call encryption keys with invalid index")
+	} else if mach.RTCKeyReceiver == nil {
+		log.Debug().Msg("No call encryption key callback set, ignoring received key")
+	} else {
+		mach.RTCKeyReceiver(ctx, evt, content)
+	}
+}
+
+// RTCKeyManager manages the media encryption keys of the current device in one MatrixRTC session.
+//
+// It generates and distributes the device's own key to other participants over Olm, rotates it when
+// participants leave (so they can't decrypt media sent afterwards), and stores keys received from others.
+// Received keys are only collected if [RTCKeyManager.HandleEncryptionKeys] is set as the machine's
+// [OlmMachine.RTCKeyReceiver] (or called from it).
+type RTCKeyManager struct {
+	Machine     *OlmMachine
+	RoomID      id.RoomID
+	Application string
+	CallID      string
+
+	// RotateOnJoin makes the manager rotate the key when new participants join, rather than sharing the
+	// current key with them. This prevents new participants from decrypting media sent before they joined.
+	RotateOnJoin bool
+	// OnKeyReceived is called when a media key is received from another participant of the session.
+	OnKeyReceived func(ctx context.Context, key *RTCMediaKey)
+
+	lock         sync.Mutex
+	ownKey       *RTCMediaKey
+	participants map[rtcDevice]struct{}
+	received     map[rtcDevice]map[int]*RTCMediaKey
+}
+
+// NewRTCKeyManager creates a new media key manager for the given session.
+func NewRTCKeyManager(mach *OlmMachine, roomID id.RoomID, application, callID string) *RTCKeyManager {
+	return &RTCKeyManager{
+		Machine:      mach,
+		RoomID:       roomID,
+		Application:  application,
+		CallID:       callID,
+		participants: make(map[rtcDevice]struct{}),
+		received:     make(map[rtcDevice]map[int]*RTCMediaKey),
+	}
+}
+
+// CurrentKey returns the current media key of our own device, generating one if necessary.
+func (km *RTCKeyManager) CurrentKey() *RTCMediaKey {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	if km.ownKey == nil {
+		km.rotateKey()
+	}
+	return km.ownKey
+}
+
+func (km *RTCKeyManager) rotateKey() {
+	newKey := &RTCMediaKey{
+		UserID:   km.Machine.Client.UserID,
+		DeviceID: km.Machine.Client.DeviceID,
+		Key:      make([]byte, RTCMediaKeyLength),
+		SentAt:   time.Now(),
+	}
+	if km.ownKey != nil {
+		newKey.Index = (km.ownKey.Index + 1) % RTCKeyIndexCount
+	}
+	_, _ = rand.Read(newKey.Key)
+	km.ownKey = newKey
+}
+
+// RotateKey generates a new media key for our own device and sends it to all known participants.
+func (km *RTCKeyManager) RotateKey(ctx context.Context) (*RTCMediaKey, error) {
+	km.lock.Lock()
+	km.rotateKey()
+	key := km.ownKey
+	targets := make([]rtcDevice, 0, len(km.participants))
+	for device := range km.participants {
+		targets = append(targets, device)
+	}
+	km.lock.Unlock()
+	return key, km.sendKey(ctx, key, targets)
+}
+
+// UpdateParticipants updates the set of participants in the session and distributes keys accordingly.
+//
+// If any device left, the key is rotated and the new key is sent to all remaining participants.
+// Otherwise, newly joined devices receive the current key (or a rotated key if RotateOnJoin is set).
+// Received keys of devices that aren't in the session are forgotten.
+func (km *RTCKeyManager) UpdateParticipants(ctx context.Context, sess *mautrix.RTCSession) error {
+	ownDevice := rtcDevice{UserID: km.Machine.Client.UserID, DeviceID: km.Machine.Client.DeviceID}
+	newParticipants := make(map[rtcDevice]struct{}, len(sess.Memberships))
+	for _, member := range sess.Memberships {
+		device := rtcDevice{UserID: member.UserID, DeviceID: member.DeviceID}
+		if device != ownDevice {
+			newParticipants[device] = struct{}{}
+		}
+	}
+
+	km.lock.Lock()
+	var joined []rtcDevice
+	anyLeft := false
+	for device := range km.participants {
+		if _, ok := newParticipants[device]; !ok {
+			anyLeft = true
+		}
+	}
+	for device := range km.received {
+		if _, ok := newParticipants[device]; !ok {
+			delete(km.received, device)
+		}
+	}
+	for device := range newParticipants {
+		if _, ok := km.participants[device]; !ok {
+			joined = append(joined, device)
+		}
+	}
+	km.participants = newParticipants
+	targets := joined
+	if km.ownKey == nil || anyLeft || (km.RotateOnJoin && len(joined) > 0) {
+		km.rotateKey()
+		targets = make([]rtcDevice, 0, len(newParticipants))
+		for device := range newParticipants {
+			targets = append(targets, device)
+		}
+	}
+	key := km.ownKey
+	km.lock.Unlock()
+	return km.sendKey(ctx, key, targets)
+}
+
+func (km *RTCKeyManager) sendKey(ctx context.Context, key *RTCMediaKey, targets []rtcDevice) error {
+	if len(targets) == 0 {
+		return nil
+	}
+	log := km.Machine.machOrContextLog(ctx).With().
+		Str("action", "send call encryption keys").
+		Stringer("room_id", km.RoomID).
+		Int("key_index", key.Index).
+		Logger()
+	content := &event.Content{Parsed: &event.CallEncryptionKeysEventContent{
+		Keys: event.CallEncryptionKey{
+			Index: key.Index,
+			Key:   key.Key,
+		},
+		Member: event.CallEncryptionKeysMember{
+			ClaimedDeviceID: km.Machine.Client.DeviceID,
+		},
+		RoomID: km.RoomID,
+		Session: event.CallEncryptionKeysSession{
+			Application: km.Application,
+			CallID:      km.CallID,
+			Scope:       event.CallScopeRoom,
+		},
+		SentTS: jsontime.UM(time.Now()),
+	}}
+	req := &mautrix.ReqSendToDevice{Messages: make(map[id.UserID]map[id.DeviceID]*event.Content)}
+	for _, target := range targets {
+		// Make sure the device is known before encrypting, so that one broken device doesn't fail the whole batch.
+		if _, err := km.Machine.GetOrFetchDevice(ctx, target.UserID, target.DeviceID); err != nil {
+			log.Warn().Err(err).
+				Stringer("user_id", target.UserID).
+				Stringer("device_id", target.DeviceID).
+				Msg("Failed to get device to send call encryption keys to")
+			continue
+		}
+		if _, ok := req.Messages[target.UserID]; !ok {
+			req.Messages[target.UserID] = make(map[id.DeviceID]*event.Content)
+		}
+		req.Messages[target.UserID][target.DeviceID] = content
+	}
+	if len(req.Messages) == 0 {
+		return nil
+	}
+	encryptedReq, err := km.Machine.EncryptToDevices(ctx, event.ToDeviceCallEncryptionKeys, req)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt call encryption keys: %w", err)
+	}
+	if _, err = km.Machine.Client.SendToDevice(ctx, event.ToDeviceEncrypted, encryptedReq); err != nil {
+		return fmt.Errorf("failed to send call encryption keys: %w", err)
+	}
+	log.Debug().Int("device_count", len(targets)).Msg("Sent call encryption keys")
+	return nil
+}
+
+// HandleEncryptionKeys stores a media key received from another participant. Keys for other sessions are ignored.
+// The signature matches [OlmMachine.RTCKeyReceiver], so this can be used directly as the callback if there's
+// only one active session.
+func (km *RTCKeyManager) HandleEncryptionKeys(ctx context.Context, evt *DecryptedOlmEvent, content *event.CallEncryptionKeysEventContent) {
+	if content.RoomID != km.RoomID || content.Session.Application != km.Application || content.Session.CallID != km.CallID {
+		return
+	}
+	device := rtcDevice{UserID: evt.Sender, DeviceID: content.Member.ClaimedDeviceID}
+	key := &RTCMediaKey{
+		UserID:   device.UserID,
+		DeviceID: device.DeviceID,
+		Index:    content.Keys.Index,
+		Key:      content.Keys.Key,
+		SentAt:   content.SentTS.Time,
+	}
+	km.lock.Lock()
+	deviceKeys, ok := km.received[device]
+	if !ok {
+		deviceKeys = make(map[int]*RTCMediaKey)
+		km.received[device] = deviceKeys
+	}
+	if existing, ok := deviceKeys[key.Index]; ok && existing.SentAt.After(key.SentAt) {
+		// Keys can arrive out of order, don't replace a newer key that reused the same index
+		km.lock.Unlock()
+		return
+	}
+	deviceKeys[key.Index] = key
+	km.lock.Unlock()
+	if km.OnKeyReceived != nil {
+		km.OnKeyReceived(ctx, key)
+	}
+}
+
+// GetKey returns the received media key with the given index for the given device, or nil if it's not known.
+func (km *RTCKeyManager) GetKey(userID id.UserID, deviceID id.DeviceID, index int) *RTCMediaKey {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	return km.received[rtcDevice{UserID: userID, DeviceID: deviceID}][index]
+}
+
+// GetLatestKey returns the most recently sent media key of the given device, or nil if no keys have been received.
+func (km *RTCKeyManager) GetLatestKey(userID id.UserID, deviceID id.DeviceID) *RTCMediaKey {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	var latest *RTCMediaKey
+	for _, key := range km.received[rtcDevice{UserID: userID, DeviceID: deviceID}] {
+		if latest == nil || key.SentAt.After(latest.SentAt) {
+			latest = key
+		}
+	}
+	return latest
+}
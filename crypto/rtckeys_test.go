@@ -0,0 +1,87 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/jsontime"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRTCKeyManager_Rotation(t *testing.T) {
+	ctx := context.Background()
+	mach := newMachine(t, "@user1:example.com")
+	km := NewRTCKeyManager(mach, "!room:example.com", event.CallApplicationCall, "")
+
+	// Joining alone generates the first key without sending anything
+	require.NoError(t, km.UpdateParticipants(ctx, &mautrix.RTCSession{
+		Memberships: []*mautrix.RTCMembership{{UserID: "@user1:example.com", DeviceID: "device1"}},
+	}))
+	first := km.CurrentKey()
+	assert.Equal(t, 0, first.Index)
+	assert.Len(t, first.Key, RTCMediaKeyLength)
+
+	for i := 1; i < RTCKeyIndexCount; i++ {
+		_, err := km.RotateKey(ctx)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, RTCKeyIndexCount-1, km.CurrentKey().Index)
+	wrapped, err := km.RotateKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, wrapped.Index)
+	assert.NotEqual(t, first.Key, wrapped.Key)
+}
+
+func TestRTCKeyManager_ReceiveKeys(t *testing.T) {
+	ctx := context.Background()
+	mach := newMachine(t, "@user1:example.com")
+	km := NewRTCKeyManager(mach, "!room:example.com", event.CallApplicationCall, "")
+	mach.RTCKeyReceiver = km.HandleEncryptionKeys
+	var received []*RTCMediaKey
+	km.OnKeyReceived = func(ctx context.Context, key *RTCMediaKey) {
+		received = append(received, key)
+	}
+	sender := &id.Device{UserID: "@user2:example.com", DeviceID: "device2"}
+	makeContent := func(deviceID id.DeviceID, roomID id.RoomID, index int, ts time.Time) *event.CallEncryptionKeysEventContent {
+		return &event.CallEncryptionKeysEventContent{
+			Keys:    event.CallEncryptionKey{Index: index, Key: []byte("0123456789abcdef")},
+			Member:  event.CallEncryptionKeysMember{ClaimedDeviceID: deviceID},
+			RoomID:  roomID,
+			Session: event.CallEncryptionKeysSession{Application: event.CallApplicationCall},
+			SentTS:  jsontime.UM(ts),
+		}
+	}
+	evt := &DecryptedOlmEvent{Sender: sender.UserID, SenderDevice: sender}
+	now := time.Now()
+
+	mach.receiveCallEncryptionKeys(ctx, evt, makeContent("device2", "!room:example.com", 3, now))
+	// Mismatching claimed device, other room and invalid index are all ignored
+	mach.receiveCallEncryptionKeys(ctx, evt, makeContent("device3", "!room:example.com", 4, now))
+	mach.receiveCallEncryptionKeys(ctx, evt, makeContent("device2", "!other:example.com", 5, now))
+	mach.receiveCallEncryptionKeys(ctx, evt, makeContent("device2", "!room:example.com", RTCKeyIndexCount, now))
+	// Older key reusing an index doesn't replace the newer one
+	mach.receiveCallEncryptionKeys(ctx, evt, makeContent("device2", "!room:example.com", 3, now.Add(-time.Minute)))
+
+	require.Len(t, received, 1)
+	key := km.GetKey("@user2:example.com", "device2", 3)
+	require.NotNil(t, key)
+	assert.Equal(t, now.UnixMilli(), key.SentAt.UnixMilli())
+	assert.Equal(t, key, km.GetLatestKey("@user2:example.com", "device2"))
+	assert.Nil(t, km.GetKey("@user2:example.com", "device3", 4))
+
+	// Leaving the session forgets the device's keys
+	require.NoError(t, km.UpdateParticipants(ctx, &mautrix.RTCSession{}))
+	assert.Nil(t, km.GetLatestKey("@user2:example.com", "device2"))
+}
@@ -700,6 +700,65 @@ func (store *SQLCryptoStore) IsOutboundGroupSessionShared(ctx context.Context, u
 	return
 }
 
+const (
+	putSessionRecipientQuery = `
+		INSERT INTO crypto_megolm_session_recipient (
+			account_id, room_id, session_id, user_id, device_id, identity_key, trust_state,
+			shared, forwarded, first_index, withheld_code, withheld_reason, timestamp
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (account_id, session_id, user_id, device_id) DO UPDATE
+			SET identity_key=excluded.identity_key, trust_state=excluded.trust_state, shared=excluded.shared,
+				forwarded=excluded.forwarded, first_index=excluded.first_index, withheld_code=excluded.withheld_code,
+				withheld_reason=excluded.withheld_reason, timestamp=excluded.timestamp
+			WHERE NOT crypto_megolm_session_recipient.shared
+				OR (excluded.shared AND excluded.first_index < crypto_megolm_session_recipient.first_index)
+	`
+	getSessionRecipientsQuery = `
+		SELECT room_id, session_id, user_id, device_id, identity_key, trust_state,
+		       shared, forwarded, first_index, withheld_code, withheld_reason, timestamp
+		FROM crypto_megolm_session_recipient
+		WHERE account_id=$1 AND room_id=$2 AND session_id=$3
+		ORDER BY user_id, device_id
+	`
+)
+
+func scanSessionRecipient(row dbutil.Scannable) (*SessionRecipient, error) {
+	var rec SessionRecipient
+	var timestamp int64
+	err := row.Scan(
+		&rec.RoomID, &rec.SessionID, &rec.UserID, &rec.DeviceID, &rec.IdentityKey, &rec.TrustState,
+		&rec.Shared, &rec.Forwarded, &rec.FirstIndex, &rec.WithheldCode, &rec.WithheldReason, &timestamp,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rec.Timestamp = time.UnixMilli(timestamp)
+	return &rec, nil
+}
+
+// PutSessionRecipients stores records of devices that a Megolm session was shared with or withheld from.
+func (store *SQLCryptoStore) PutSessionRecipients(ctx context.Context, recipients []*SessionRecipient) error {
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, rec := range recipients {
+			_, err := store.DB.Exec(
+				ctx, putSessionRecipientQuery,
+				store.AccountID, rec.RoomID, rec.SessionID, rec.UserID, rec.DeviceID, rec.IdentityKey, rec.TrustState,
+				rec.Shared, rec.Forwarded, rec.FirstIndex, rec.WithheldCode, rec.WithheldReason, rec.Timestamp.UnixMilli(),
+			)
+			if err != nil {
+				return fmt.Errorf("failed to store recipient %s/%s: %w", rec.UserID, rec.DeviceID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetSessionRecipients returns the records stored with PutSessionRecipients for the given session.
+func (store *SQLCryptoStore) GetSessionRecipients(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) ([]*SessionRecipient, error) {
+	rows, err := store.DB.Query(ctx, getSessionRecipientsQuery, store.AccountID, roomID, sessionID)
+	return dbutil.NewRowIterWithError(rows, scanSessionRecipient, err).AsList()
+}
+
 // ValidateMessageIndex returns whether the given event information match the ones stored in the database
 // for the given sender key, session ID and index. If the index hasn't been stored, this will store it.
 func (store *SQLCryptoStore) ValidateMessageIndex(ctx context.Context, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) (bool, error) {
@@ -947,6 +1006,24 @@ func (store *SQLCryptoStore) ResetMasterKeyTOFU(ctx context.Context, userID id.U
 	return nil
 }
 
+// PutIdentityState stores the last known identity state of a user.
+func (store *SQLCryptoStore) PutIdentityState(ctx context.Context, userID id.UserID, state IdentityState) error {
+	_, err := store.DB.Exec(ctx, `
+		INSERT INTO crypto_identity_state (account_id, user_id, state) VALUES ($1, $2, $3)
+		ON CONFLICT (account_id, user_id) DO UPDATE SET state=excluded.state
+	`, store.AccountID, userID, state)
+	return err
+}
+
+// GetIdentityState returns the identity state stored with PutIdentityState, or an empty string if there isn't one.
+func (store *SQLCryptoStore) GetIdentityState(ctx context.Context, userID id.UserID) (state IdentityState, err error) {
+	err = store.DB.QueryRow(ctx, "SELECT state FROM crypto_identity_state WHERE account_id=$1 AND user_id=$2", store.AccountID, userID).Scan(&state)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
 // PutSignature stores a signature of a cross-signing or device key along with the signer's user ID and key.
 func (store *SQLCryptoStore) PutSignature(ctx context.Context, signedUserID id.UserID, signedKey id.Ed25519, signerUserID id.UserID, signerKey id.Ed25519, signature string) error {
 	_, err := store.DB.Exec(ctx, `
@@ -1027,3 +1104,84 @@ func (store *SQLCryptoStore) DeleteSecret(ctx context.Context, name id.Secret) (
 	_, err = store.DB.Exec(ctx, "DELETE FROM crypto_secrets WHERE account_id=$1 AND name=$2", store.AccountID, name)
 	return
 }
+
+const undecryptableEventColumns = "room_id, event_id, session_id, sender, reason, withheld_code, error, event, first_seen, last_attempt, attempts"
+
+func scanUndecryptableEvent(row dbutil.Scannable) (*UndecryptableEvent, error) {
+	var utd UndecryptableEvent
+	var firstSeen, lastAttempt int64
+	err := row.Scan(
+		&utd.RoomID, &utd.EventID, &utd.SessionID, &utd.Sender, &utd.Reason, &utd.WithheldCode, &utd.Error,
+		&dbutil.JSON{Data: &utd.Event}, &firstSeen, &lastAttempt, &utd.Attempts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	utd.FirstSeen = time.UnixMilli(firstSeen)
+	utd.LastAttempt = time.UnixMilli(lastAttempt)
+	if utd.Event != nil {
+		utd.Event.Type.Class = event.MessageEventType
+		if utd.Event.StateKey != nil {
+			utd.Event.Type.Class = event.StateEventType
+		}
+		err = utd.Event.Content.ParseRaw(utd.Event.Type)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse stored event content: %w", err)
+		}
+	}
+	return &utd, nil
+}
+
+func (store *SQLCryptoStore) PutUndecryptableEvent(ctx context.Context, utd *UndecryptableEvent) error {
+	_, err := store.DB.Exec(ctx, `
+		INSERT INTO crypto_undecryptable_event (
+			account_id, room_id, event_id, session_id, sender, reason, withheld_code, error, event, first_seen, last_attempt, attempts
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (account_id, room_id, event_id) DO UPDATE
+			SET reason=excluded.reason, withheld_code=excluded.withheld_code, error=excluded.error,
+			    last_attempt=excluded.last_attempt, attempts=excluded.attempts
+	`, store.AccountID, utd.RoomID, utd.EventID, utd.SessionID, utd.Sender, utd.Reason, utd.WithheldCode, utd.Error,
+		dbutil.JSON{Data: utd.Event}, utd.FirstSeen.UnixMilli(), utd.LastAttempt.UnixMilli(), utd.Attempts)
+	return err
+}
+
+func (store *SQLCryptoStore) GetUndecryptableEvents(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) ([]*UndecryptableEvent, error) {
+	rows, err := store.DB.Query(ctx, `
+		SELECT `+undecryptableEventColumns+` FROM crypto_undecryptable_event
+		WHERE account_id=$1 AND room_id=$2 AND session_id=$3
+		ORDER BY first_seen
+	`, store.AccountID, roomID, sessionID)
+	return dbutil.NewRowIterWithError(rows, scanUndecryptableEvent, err).AsList()
+}
+
+func (store *SQLCryptoStore) DeleteUndecryptableEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) error {
+	_, err := store.DB.Exec(ctx, "DELETE FROM crypto_undecryptable_event WHERE account_id=$1 AND room_id=$2 AND event_id=$3", store.AccountID, roomID, eventID)
+	return err
+}
+
+func (store *SQLCryptoStore) PruneUndecryptableEvents(ctx context.Context, olderThan time.Time) (int64, error) {
+	res, err := store.DB.Exec(ctx, "DELETE FROM crypto_undecryptable_event WHERE account_id=$1 AND first_seen<$2", store.AccountID, olderThan.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (store *SQLCryptoStore) CountUndecryptableEvents(ctx context.Context) (map[UTDReason]int, error) {
+	rows, err := store.DB.Query(ctx, "SELECT reason, COUNT(*) FROM crypto_undecryptable_event WHERE account_id=$1 GROUP BY reason", store.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[UTDReason]int)
+	for rows.Next() {
+		var reason UTDReason
+		var count int
+		err = rows.Scan(&reason, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[reason] = count
+	}
+	return counts, rows.Err()
+}
@@ -1,4 +1,4 @@
--- v0 -> v21 (compatible with v20+): Latest revision
+-- v0 -> v24 (compatible with v20+): Latest revision
 CREATE TABLE crypto_account (
 	account_id         TEXT    PRIMARY KEY,
 	device_id          TEXT    NOT NULL,
@@ -101,6 +101,24 @@ CREATE TABLE crypto_megolm_outbound_session_shared (
 	PRIMARY KEY (user_id, identity_key, session_id)
 );
 
+CREATE TABLE crypto_megolm_session_recipient (
+	account_id      TEXT     NOT NULL,
+	room_id         TEXT     NOT NULL,
+	session_id      CHAR(43) NOT NULL,
+	user_id         TEXT     NOT NULL,
+	device_id       TEXT     NOT NULL,
+	identity_key    CHAR(43) NOT NULL,
+	trust_state     SMALLINT NOT NULL,
+	shared          BOOLEAN  NOT NULL,
+	forwarded       BOOLEAN  NOT NULL,
+	first_index     BIGINT   NOT NULL,
+	withheld_code   TEXT     NOT NULL,
+	withheld_reason TEXT     NOT NULL,
+	timestamp       BIGINT   NOT NULL,
+
+	PRIMARY KEY (account_id, session_id, user_id, device_id)
+);
+
 CREATE TABLE crypto_cross_signing_keys (
 	user_id TEXT,
 	usage   TEXT,
@@ -120,6 +138,14 @@ CREATE TABLE crypto_cross_signing_signatures (
 	PRIMARY KEY (signed_user_id, signed_key, signer_user_id, signer_key)
 );
 
+CREATE TABLE crypto_identity_state (
+	account_id TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	state      TEXT NOT NULL,
+
+	PRIMARY KEY (account_id, user_id)
+);
+
 CREATE TABLE crypto_secrets (
 	account_id TEXT  NOT NULL,
 	name       TEXT  NOT NULL,
@@ -127,3 +153,21 @@ CREATE TABLE crypto_secrets (
 
 	PRIMARY KEY (account_id, name)
 );
+
+CREATE TABLE crypto_undecryptable_event (
+	account_id    TEXT    NOT NULL,
+	room_id       TEXT    NOT NULL,
+	event_id      TEXT    NOT NULL,
+	session_id    TEXT    NOT NULL,
+	sender        TEXT    NOT NULL,
+	reason        TEXT    NOT NULL,
+	withheld_code TEXT    NOT NULL,
+	error         TEXT    NOT NULL,
+	event         jsonb   NOT NULL,
+	first_seen    BIGINT  NOT NULL,
+	last_attempt  BIGINT  NOT NULL,
+	attempts      INTEGER NOT NULL,
+
+	PRIMARY KEY (account_id, room_id, event_id)
+);
+CREATE INDEX crypto_undecryptable_event_session_idx ON crypto_undecryptable_event (account_id, room_id, session_id);
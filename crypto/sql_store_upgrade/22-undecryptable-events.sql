@@ -0,0 +1,18 @@
+-- v22 (compatible with v20+): Add table for tracking undecryptable events
+CREATE TABLE crypto_undecryptable_event (
+	account_id    TEXT    NOT NULL,
+	room_id       TEXT    NOT NULL,
+	event_id      TEXT    NOT NULL,
+	session_id    TEXT    NOT NULL,
+	sender        TEXT    NOT NULL,
+	reason        TEXT    NOT NULL,
+	withheld_code TEXT    NOT NULL,
+	error         TEXT    NOT NULL,
+	event         jsonb   NOT NULL,
+	first_seen    BIGINT  NOT NULL,
+	last_attempt  BIGINT  NOT NULL,
+	attempts      INTEGER NOT NULL,
+
+	PRIMARY KEY (account_id, room_id, event_id)
+);
+CREATE INDEX crypto_undecryptable_event_session_idx ON crypto_undecryptable_event (account_id, room_id, session_id);
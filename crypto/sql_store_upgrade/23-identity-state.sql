@@ -0,0 +1,8 @@
+-- v23 (compatible with v20+): Add table for pinned identity states
+CREATE TABLE crypto_identity_state (
+	account_id TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	state      TEXT NOT NULL,
+
+	PRIMARY KEY (account_id, user_id)
+);
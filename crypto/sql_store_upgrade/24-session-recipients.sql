@@ -0,0 +1,18 @@
+-- v24 (compatible with v20+): Add table for tracking Megolm session recipients
+CREATE TABLE crypto_megolm_session_recipient (
+	account_id      TEXT     NOT NULL,
+	room_id         TEXT     NOT NULL,
+	session_id      CHAR(43) NOT NULL,
+	user_id         TEXT     NOT NULL,
+	device_id       TEXT     NOT NULL,
+	identity_key    CHAR(43) NOT NULL,
+	trust_state     SMALLINT NOT NULL,
+	shared          BOOLEAN  NOT NULL,
+	forwarded       BOOLEAN  NOT NULL,
+	first_index     BIGINT   NOT NULL,
+	withheld_code   TEXT     NOT NULL,
+	withheld_reason TEXT     NOT NULL,
+	timestamp       BIGINT   NOT NULL,
+
+	PRIMARY KEY (account_id, session_id, user_id, device_id)
+);
@@ -7,10 +7,12 @@
 package crypto
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"slices"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -107,6 +109,11 @@ type Store interface {
 	MarkOutboundGroupSessionShared(context.Context, id.UserID, id.IdentityKey, id.SessionID) error
 	// IsOutboutGroupSessionShared checks if the specified session has been shared with the device.
 	IsOutboundGroupSessionShared(context.Context, id.UserID, id.IdentityKey, id.SessionID) (bool, error)
+	// PutSessionRecipients stores records of devices that a Megolm session was shared with or withheld from.
+	// Existing records of devices that already received the session must only be replaced by records with a lower first index.
+	PutSessionRecipients(context.Context, []*SessionRecipient) error
+	// GetSessionRecipients returns the records stored with PutSessionRecipients for the given session.
+	GetSessionRecipients(context.Context, id.RoomID, id.SessionID) ([]*SessionRecipient, error)
 
 	// ValidateMessageIndex validates that the given message details aren't from a replay attack.
 	//
@@ -142,6 +149,10 @@ type Store interface {
 	GetCrossSigningKeys(context.Context, id.UserID) (map[id.CrossSigningUsage]id.CrossSigningKey, error)
 	// ResetMasterKeyTOFU marks a user's master key as trusted after it changes.
 	ResetMasterKeyTOFU(context.Context, id.UserID, id.Ed25519) error
+	// PutIdentityState stores the last known identity state of a user.
+	PutIdentityState(context.Context, id.UserID, IdentityState) error
+	// GetIdentityState returns the identity state stored with PutIdentityState, or an empty string if there isn't one.
+	GetIdentityState(context.Context, id.UserID) (IdentityState, error)
 	// PutSignature stores a signature of a cross-signing or device key along with the signer's user ID and key.
 	PutSignature(ctx context.Context, signedUser id.UserID, signedKey id.Ed25519, signerUser id.UserID, signerKey id.Ed25519, signature string) error
 	// IsKeySignedBy returns whether a cross-signing or device key is signed by the given signer.
@@ -157,6 +168,19 @@ type Store interface {
 	GetSecret(context.Context, id.Secret) (string, error)
 	// DeleteSecret removes a named secret.
 	DeleteSecret(context.Context, id.Secret) error
+
+	// PutUndecryptableEvent stores an event that failed to decrypt, replacing it if it exists already.
+	// The FirstSeen field of an existing record must not be changed.
+	PutUndecryptableEvent(context.Context, *UndecryptableEvent) error
+	// GetUndecryptableEvents returns all stored undecryptable events that were encrypted with the given session.
+	GetUndecryptableEvents(context.Context, id.RoomID, id.SessionID) ([]*UndecryptableEvent, error)
+	// DeleteUndecryptableEvent removes an event that was inserted with PutUndecryptableEvent.
+	DeleteUndecryptableEvent(context.Context, id.RoomID, id.EventID) error
+	// CountUndecryptableEvents returns the number of stored undecryptable events grouped by reason.
+	CountUndecryptableEvents(context.Context) (map[UTDReason]int, error)
+	// PruneUndecryptableEvents removes all undecryptable events that were first seen before the given time
+	// and returns the number of removed events.
+	PruneUndecryptableEvents(ctx context.Context, olderThan time.Time) (int64, error)
 }
 
 type messageIndexKey struct {
@@ -182,13 +206,16 @@ type MemoryStore struct {
 	WithheldGroupSessions map[id.RoomID]map[id.SessionID]*event.RoomKeyWithheldEventContent
 	OutGroupSessions      map[id.RoomID]*OutboundGroupSession
 	SharedGroupSessions   map[id.UserID]map[id.IdentityKey]map[id.SessionID]struct{}
+	SessionRecipients     map[id.SessionID]map[UserDevice]*SessionRecipient
 	MessageIndices        map[messageIndexKey]messageIndexValue
 	Devices               map[id.UserID]map[id.DeviceID]*id.Device
 	CrossSigningKeys      map[id.UserID]map[id.CrossSigningUsage]id.CrossSigningKey
 	KeySignatures         map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string
+	IdentityStates        map[id.UserID]IdentityState
 	OutdatedUsers         map[id.UserID]struct{}
 	Secrets               map[id.Secret]string
 	OlmHashes             *exsync.Set[[32]byte]
+	UndecryptableEvents   map[id.RoomID]map[id.EventID]*UndecryptableEvent
 }
 
 var _ Store = (*MemoryStore)(nil)
@@ -205,13 +232,16 @@ func NewMemoryStore(saveCallback func() error) *MemoryStore {
 		WithheldGroupSessions: make(map[id.RoomID]map[id.SessionID]*event.RoomKeyWithheldEventContent),
 		OutGroupSessions:      make(map[id.RoomID]*OutboundGroupSession),
 		SharedGroupSessions:   make(map[id.UserID]map[id.IdentityKey]map[id.SessionID]struct{}),
+		SessionRecipients:     make(map[id.SessionID]map[UserDevice]*SessionRecipient),
 		MessageIndices:        make(map[messageIndexKey]messageIndexValue),
 		Devices:               make(map[id.UserID]map[id.DeviceID]*id.Device),
 		CrossSigningKeys:      make(map[id.UserID]map[id.CrossSigningUsage]id.CrossSigningKey),
 		KeySignatures:         make(map[id.UserID]map[id.Ed25519]map[id.UserID]map[id.Ed25519]string),
+		IdentityStates:        make(map[id.UserID]IdentityState),
 		OutdatedUsers:         make(map[id.UserID]struct{}),
 		Secrets:               make(map[id.Secret]string),
 		OlmHashes:             exsync.NewSet[[32]byte](),
+		UndecryptableEvents:   make(map[id.RoomID]map[id.EventID]*UndecryptableEvent),
 	}
 }
 
@@ -516,6 +546,41 @@ func (gs *MemoryStore) IsOutboundGroupSessionShared(_ context.Context, userID id
 	return
 }
 
+func (gs *MemoryStore) PutSessionRecipients(_ context.Context, recipients []*SessionRecipient) error {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	for _, rec := range recipients {
+		session, ok := gs.SessionRecipients[rec.SessionID]
+		if !ok {
+			session = make(map[UserDevice]*SessionRecipient)
+			gs.SessionRecipients[rec.SessionID] = session
+		}
+		key := UserDevice{UserID: rec.UserID, DeviceID: rec.DeviceID}
+		if existing, ok := session[key]; ok && existing.Shared && (!rec.Shared || rec.FirstIndex >= existing.FirstIndex) {
+			continue
+		}
+		copied := *rec
+		session[key] = &copied
+	}
+	return gs.save()
+}
+
+func (gs *MemoryStore) GetSessionRecipients(_ context.Context, roomID id.RoomID, sessionID id.SessionID) ([]*SessionRecipient, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	var result []*SessionRecipient
+	for _, rec := range gs.SessionRecipients[sessionID] {
+		if rec.RoomID == roomID {
+			copied := *rec
+			result = append(result, &copied)
+		}
+	}
+	slices.SortFunc(result, func(a, b *SessionRecipient) int {
+		return cmp.Or(strings.Compare(a.UserID.String(), b.UserID.String()), strings.Compare(a.DeviceID.String(), b.DeviceID.String()))
+	})
+	return result, nil
+}
+
 func (gs *MemoryStore) ValidateMessageIndex(_ context.Context, sessionID id.SessionID, eventID id.EventID, index uint, timestamp int64) (bool, error) {
 	gs.lock.Lock()
 	defer gs.lock.Unlock()
@@ -688,6 +753,19 @@ func (gs *MemoryStore) ResetMasterKeyTOFU(_ context.Context, userID id.UserID, k
 	return gs.save()
 }
 
+func (gs *MemoryStore) PutIdentityState(_ context.Context, userID id.UserID, state IdentityState) error {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	gs.IdentityStates[userID] = state
+	return gs.save()
+}
+
+func (gs *MemoryStore) GetIdentityState(_ context.Context, userID id.UserID) (IdentityState, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	return gs.IdentityStates[userID], nil
+}
+
 func (gs *MemoryStore) PutSignature(_ context.Context, signedUserID id.UserID, signedKey id.Ed25519, signerUserID id.UserID, signerKey id.Ed25519, signature string) error {
 	gs.lock.RLock()
 	defer gs.lock.RUnlock()
@@ -773,3 +851,72 @@ func (gs *MemoryStore) DeleteSecret(_ context.Context, name id.Secret) error {
 	delete(gs.Secrets, name)
 	return nil
 }
+
+func (gs *MemoryStore) PutUndecryptableEvent(_ context.Context, utd *UndecryptableEvent) error {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	room, ok := gs.UndecryptableEvents[utd.RoomID]
+	if !ok {
+		room = make(map[id.EventID]*UndecryptableEvent)
+		gs.UndecryptableEvents[utd.RoomID] = room
+	}
+	stored := *utd
+	if existing, ok := room[utd.EventID]; ok {
+		stored.FirstSeen = existing.FirstSeen
+	}
+	room[utd.EventID] = &stored
+	return gs.save()
+}
+
+func (gs *MemoryStore) GetUndecryptableEvents(_ context.Context, roomID id.RoomID, sessionID id.SessionID) ([]*UndecryptableEvent, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	var result []*UndecryptableEvent
+	for _, utd := range gs.UndecryptableEvents[roomID] {
+		if utd.SessionID == sessionID {
+			copied := *utd
+			result = append(result, &copied)
+		}
+	}
+	slices.SortFunc(result, func(a, b *UndecryptableEvent) int {
+		return a.FirstSeen.Compare(b.FirstSeen)
+	})
+	return result, nil
+}
+
+func (gs *MemoryStore) DeleteUndecryptableEvent(_ context.Context, roomID id.RoomID, eventID id.EventID) error {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	delete(gs.UndecryptableEvents[roomID], eventID)
+	return gs.save()
+}
+
+func (gs *MemoryStore) PruneUndecryptableEvents(_ context.Context, olderThan time.Time) (int64, error) {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+	var count int64
+	for _, room := range gs.UndecryptableEvents {
+		for eventID, utd := range room {
+			if utd.FirstSeen.Before(olderThan) {
+				delete(room, eventID)
+				count++
+			}
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return count, gs.save()
+}
+
+func (gs *MemoryStore) CountUndecryptableEvents(_ context.Context) (map[UTDReason]int, error) {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+	counts := make(map[UTDReason]int)
+	for _, room := range gs.UndecryptableEvents {
+		for _, utd := range room {
+			counts[utd.Reason]++
+		}
+	}
+	return counts, nil
+}
@@ -11,6 +11,7 @@ import (
 	"database/sql"
 	"strconv"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
@@ -18,6 +19,7 @@ import (
 	"go.mau.fi/util/dbutil"
 
 	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -297,3 +299,135 @@ func TestStoreSecrets(t *testing.T) {
 		})
 	}
 }
+
+func TestStoreUndecryptableEvents(t *testing.T) {
+	stores := getCryptoStores(t)
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			ctx := context.TODO()
+			evt := &event.Event{
+				Type:    event.EventEncrypted,
+				ID:      "$event1",
+				RoomID:  "!room:example.com",
+				Sender:  "@user:example.com",
+				Content: event.Content{Parsed: &event.EncryptedEventContent{Algorithm: id.AlgorithmMegolmV1, SessionID: "sess1"}},
+			}
+			firstSeen := time.UnixMilli(time.Now().UnixMilli())
+			utd := &UndecryptableEvent{
+				RoomID:      evt.RoomID,
+				EventID:     evt.ID,
+				SessionID:   "sess1",
+				Sender:      evt.Sender,
+				Reason:      UTDReasonMissingSession,
+				Error:       ErrNoSessionFound.Error(),
+				Event:       evt,
+				FirstSeen:   firstSeen,
+				LastAttempt: firstSeen,
+				Attempts:    1,
+			}
+			require.NoError(t, store.PutUndecryptableEvent(ctx, utd))
+
+			updated := *utd
+			updated.FirstSeen = firstSeen.Add(time.Hour)
+			updated.Reason = UTDReasonWithheld
+			updated.WithheldCode = event.RoomKeyWithheldUnverified
+			updated.Attempts = 2
+			require.NoError(t, store.PutUndecryptableEvent(ctx, &updated))
+
+			utds, err := store.GetUndecryptableEvents(ctx, evt.RoomID, "sess1")
+			require.NoError(t, err)
+			require.Len(t, utds, 1)
+			assert.Equal(t, UTDReasonWithheld, utds[0].Reason)
+			assert.Equal(t, event.RoomKeyWithheldUnverified, utds[0].WithheldCode)
+			assert.Equal(t, 2, utds[0].Attempts)
+			assert.Equal(t, firstSeen, utds[0].FirstSeen, "First seen time should not change")
+			assert.Equal(t, id.SessionID("sess1"), utds[0].Event.Content.AsEncrypted().SessionID)
+
+			counts, err := store.CountUndecryptableEvents(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, map[UTDReason]int{UTDReasonWithheld: 1}, counts)
+
+			require.NoError(t, store.DeleteUndecryptableEvent(ctx, evt.RoomID, evt.ID))
+			utds, err = store.GetUndecryptableEvents(ctx, evt.RoomID, "sess1")
+			require.NoError(t, err)
+			assert.Empty(t, utds)
+
+			require.NoError(t, store.PutUndecryptableEvent(ctx, utd))
+			pruned, err := store.PruneUndecryptableEvents(ctx, firstSeen)
+			require.NoError(t, err)
+			assert.EqualValues(t, 0, pruned)
+			pruned, err = store.PruneUndecryptableEvents(ctx, firstSeen.Add(time.Millisecond))
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, pruned)
+			utds, err = store.GetUndecryptableEvents(ctx, evt.RoomID, "sess1")
+			require.NoError(t, err)
+			assert.Empty(t, utds)
+		})
+	}
+}
+
+func TestStoreIdentityStateAccountIsolation(t *testing.T) {
+	ctx := context.TODO()
+	store := getCryptoStores(t)["sql"].(*SQLCryptoStore)
+	otherStore := NewSQLCryptoStore(store.DB, nil, "otheraccid", "otherdev", []byte("test"))
+	require.NoError(t, store.PutIdentityState(ctx, "@user:example.com", IdentityStateVerificationViolation))
+	state, err := otherStore.GetIdentityState(ctx, "@user:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, state)
+	require.NoError(t, otherStore.PutIdentityState(ctx, "@user:example.com", IdentityStatePinned))
+	state, err = store.GetIdentityState(ctx, "@user:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, IdentityStateVerificationViolation, state)
+}
+
+func TestStoreSessionRecipients(t *testing.T) {
+	stores := getCryptoStores(t)
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			ctx := context.TODO()
+			acc := NewOlmAccount()
+			device := &id.Device{UserID: "@user:example.com", DeviceID: "DEVICE", IdentityKey: acc.IdentityKey()}
+			withheld := newWithheldRecipient("!room:example.com", "sess1", device, id.TrustStateUnset, &event.RoomKeyWithheldEventContent{
+				Code:   event.RoomKeyWithheldUnverified,
+				Reason: "Device is not trusted",
+			})
+			require.NoError(t, store.PutSessionRecipients(ctx, []*SessionRecipient{withheld}))
+			recipients, err := store.GetSessionRecipients(ctx, "!room:example.com", "sess1")
+			require.NoError(t, err)
+			require.Len(t, recipients, 1)
+			assert.False(t, recipients[0].Shared)
+			assert.Equal(t, event.RoomKeyWithheldUnverified, recipients[0].WithheldCode)
+
+			// Sharing the session later replaces the withheld record
+			require.NoError(t, store.PutSessionRecipients(ctx, []*SessionRecipient{
+				newSharedRecipient("!room:example.com", "sess1", device, id.TrustStateCrossSignedTOFU, 5),
+			}))
+			// A device that already has the session can't be un-shared, and a higher index doesn't replace a lower one
+			require.NoError(t, store.PutSessionRecipients(ctx, []*SessionRecipient{
+				withheld,
+				newSharedRecipient("!room:example.com", "sess1", device, id.TrustStateCrossSignedTOFU, 8),
+			}))
+			recipients, err = store.GetSessionRecipients(ctx, "!room:example.com", "sess1")
+			require.NoError(t, err)
+			require.Len(t, recipients, 1)
+			assert.True(t, recipients[0].Shared)
+			assert.Equal(t, uint32(5), recipients[0].FirstIndex)
+			assert.Equal(t, id.TrustStateCrossSignedTOFU, recipients[0].TrustState)
+			assert.Empty(t, recipients[0].WithheldCode)
+
+			// A forwarded key with an earlier index extends the readable range
+			forwarded := newSharedRecipient("!room:example.com", "sess1", device, id.TrustStateCrossSignedTOFU, 0)
+			forwarded.Forwarded = true
+			require.NoError(t, store.PutSessionRecipients(ctx, []*SessionRecipient{forwarded}))
+			recipients, err = store.GetSessionRecipients(ctx, "!room:example.com", "sess1")
+			require.NoError(t, err)
+			require.Len(t, recipients, 1)
+			assert.True(t, recipients[0].Forwarded)
+			assert.Equal(t, uint32(0), recipients[0].FirstIndex)
+
+			recipients, err = store.GetSessionRecipients(ctx, "!otherroom:example.com", "sess1")
+			require.NoError(t, err)
+			assert.Empty(t, recipients)
+		})
+	}
+}
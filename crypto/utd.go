@@ -0,0 +1,359 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exsync"
+
+	"maunium.net/go/mautrix/crypto/olm"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrUnverifiedSender can be wrapped by callers that refuse to handle a successfully decrypted event
+// because the sender's device isn't trusted enough, so that [UTDTracker.Record] classifies it correctly.
+var ErrUnverifiedSender = errors.New("sender device is not trusted")
+
+// UTDReason describes why an event couldn't be decrypted.
+type UTDReason string
+
+const (
+	// UTDReasonMissingSession means the Megolm session wasn't received (yet).
+	UTDReasonMissingSession UTDReason = "missing_session"
+	// UTDReasonWithheld means the sender explicitly refused to share the session. The withheld code is stored separately.
+	UTDReasonWithheld UTDReason = "withheld"
+	// UTDReasonUnknownIndex means the session was received, but it has already been ratcheted past the message.
+	UTDReasonUnknownIndex UTDReason = "unknown_message_index"
+	// UTDReasonUnverifiedSender means the event was decrypted, but the sender's device isn't trusted enough.
+	UTDReasonUnverifiedSender UTDReason = "unverified_sender"
+	// UTDReasonHistorical means the session is missing, but the event was sent before [UTDTracker.HistoricalBefore],
+	// so the session was most likely never meant for this device.
+	UTDReasonHistorical UTDReason = "historical"
+	// UTDReasonOther is used for all other errors, like duplicate message indices or corrupted payloads.
+	UTDReasonOther UTDReason = "other"
+)
+
+// IsExpected returns true if the reason is something that's expected to happen occasionally
+// and doesn't indicate a bug in the sender or receiver.
+func (reason UTDReason) IsExpected() bool {
+	return reason == UTDReasonHistorical || reason == UTDReasonWithheld || reason == UTDReasonUnverifiedSender
+}
+
+// UndecryptableEvent is a record of an event that failed to decrypt.
+type UndecryptableEvent struct {
+	RoomID       id.RoomID
+	EventID      id.EventID
+	SessionID    id.SessionID
+	Sender       id.UserID
+	Reason       UTDReason
+	WithheldCode event.RoomKeyWithheldCode
+	Error        string
+	// Event is the original encrypted event, which is used to retry decryption.
+	Event       *event.Event
+	FirstSeen   time.Time
+	LastAttempt time.Time
+	Attempts    int
+}
+
+// UTDStats contains statistics about events that failed to decrypt.
+type UTDStats struct {
+	// Pending is the number of stored events that are still undecryptable, grouped by reason.
+	Pending map[UTDReason]int
+	// Recorded is the number of new undecryptable events recorded since the tracker was created.
+	Recorded int64
+	// LateDecrypted is the number of recorded events that were decrypted later since the tracker was created.
+	LateDecrypted int64
+}
+
+// UTDTracker keeps track of events that failed to decrypt, and tries to decrypt them again
+// when new keys for the session arrive (e.g. via to-device events, key backup or room key bundles).
+//
+// To use the tracker, set it as [OlmMachine.UTDTracker] and call [UTDTracker.Record]
+// for events that couldn't be decrypted.
+type UTDTracker struct {
+	mach *OlmMachine
+
+	// HistoricalBefore is used to classify events with missing sessions as historical.
+	// It should usually be set to the time when the device was logged in.
+	HistoricalBefore time.Time
+	// MinTrust is the minimum trust state of the sender device for retried events to be considered decrypted.
+	// Events that decrypt successfully with a lower trust state stay in the store as unverified sender UTDs.
+	MinTrust id.TrustState
+	// MaxAge is the maximum age of stored events. If set, events older than this are pruned
+	// at most once per [UTDPruneInterval] when new events are recorded. See also [UTDTracker.Prune].
+	MaxAge time.Duration
+
+	// OnUTD is called when a new undecryptable event is recorded, or when the reason for an existing one changes.
+	OnUTD func(ctx context.Context, utd *UndecryptableEvent)
+	// OnLateDecrypt is called when a recorded event is successfully decrypted. The record has already been
+	// removed from the store when this is called.
+	OnLateDecrypt func(ctx context.Context, utd *UndecryptableEvent, decrypted *event.Event)
+
+	recorded      atomic.Int64
+	lateDecrypted atomic.Int64
+	lastPrune     atomic.Int64
+	retryLock     *exsync.KeyedMutex[id.SessionID]
+
+	retryQueueLock sync.Mutex
+	retryQueue     []queuedRetry
+	retryQueued    map[queuedRetry]struct{}
+	retryRunning   bool
+}
+
+type queuedRetry struct {
+	roomID    id.RoomID
+	sessionID id.SessionID
+}
+
+// NewUTDTracker creates a new UTD tracker. The tracker must be set as [OlmMachine.UTDTracker]
+// to automatically retry decryption when keys arrive.
+func NewUTDTracker(mach *OlmMachine) *UTDTracker {
+	return &UTDTracker{
+		mach:        mach,
+		retryLock:   exsync.NewKeyedMutex[id.SessionID](),
+		retryQueued: make(map[queuedRetry]struct{}),
+	}
+}
+
+// Classify finds the reason for a decryption error.
+func (tracker *UTDTracker) Classify(ctx context.Context, evt *event.Event, err error) (UTDReason, event.RoomKeyWithheldCode) {
+	var withheld *event.RoomKeyWithheldEventContent
+	switch {
+	case errors.As(err, &withheld):
+		code := withheld.Code
+		if code == "" {
+			// The memory store doesn't include the code in the error
+			content, ok := evt.Content.Parsed.(*event.EncryptedEventContent)
+			if ok {
+				if stored, _ := tracker.mach.CryptoStore.GetWithheldGroupSession(ctx, evt.RoomID, content.SessionID); stored != nil {
+					code = stored.Code
+				}
+			}
+		}
+		return UTDReasonWithheld, code
+	case errors.Is(err, ErrNoSessionFound):
+		if !tracker.HistoricalBefore.IsZero() && evt.Timestamp < tracker.HistoricalBefore.UnixMilli() {
+			return UTDReasonHistorical, ""
+		}
+		return UTDReasonMissingSession, ""
+	case errors.Is(err, olm.ErrUnknownMessageIndex):
+		return UTDReasonUnknownIndex, ""
+	case errors.Is(err, ErrUnverifiedSender):
+		return UTDReasonUnverifiedSender, ""
+	default:
+		return UTDReasonOther, ""
+	}
+}
+
+func (tracker *UTDTracker) findExisting(ctx context.Context, evt *event.Event, sessionID id.SessionID) (*UndecryptableEvent, error) {
+	utds, err := tracker.mach.CryptoStore.GetUndecryptableEvents(ctx, evt.RoomID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	for _, utd := range utds {
+		if utd.EventID == evt.ID {
+			return utd, nil
+		}
+	}
+	return nil, nil
+}
+
+// Record stores the given event as undecryptable. If the event has already been recorded,
+// the existing record is updated with the new error.
+func (tracker *UTDTracker) Record(ctx context.Context, evt *event.Event, decryptErr error) (*UndecryptableEvent, error) {
+	content, ok := evt.Content.Parsed.(*event.EncryptedEventContent)
+	if !ok {
+		return nil, ErrIncorrectEncryptedContentType
+	}
+	utd, err := tracker.findExisting(ctx, evt, content.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for existing record: %w", err)
+	} else if utd == nil {
+		utd = &UndecryptableEvent{
+			RoomID:    evt.RoomID,
+			EventID:   evt.ID,
+			SessionID: content.SessionID,
+			Sender:    evt.Sender,
+			Event:     evt,
+			FirstSeen: time.Now(),
+		}
+	}
+	isNew := utd.Attempts == 0
+	changed, err := tracker.update(ctx, utd, decryptErr)
+	if err != nil {
+		return nil, err
+	}
+	if isNew {
+		tracker.recorded.Add(1)
+		zerolog.Ctx(ctx).Debug().
+			Stringer("event_id", evt.ID).
+			Stringer("session_id", content.SessionID).
+			Str("utd_reason", string(utd.Reason)).
+			Msg("Recorded undecryptable event")
+		tracker.maybePrune(ctx)
+	}
+	if (isNew || changed) && tracker.OnUTD != nil {
+		tracker.OnUTD(ctx, utd)
+	}
+	if utd.Reason == UTDReasonMissingSession || utd.Reason == UTDReasonHistorical {
+		// Handle race conditions where the session arrived between the decryption attempt and storing the record.
+		sess, _ := tracker.mach.CryptoStore.GetGroupSession(ctx, evt.RoomID, content.SessionID)
+		if sess != nil {
+			tracker.QueueRetry(tracker.mach.backgroundCtx, evt.RoomID, content.SessionID)
+		}
+	}
+	return utd, nil
+}
+
+// UTDPruneInterval is the minimum interval between automatic prunes when [UTDTracker.MaxAge] is set.
+const UTDPruneInterval = 1 * time.Hour
+
+func (tracker *UTDTracker) maybePrune(ctx context.Context) {
+	if tracker.MaxAge <= 0 {
+		return
+	}
+	lastPrune := tracker.lastPrune.Load()
+	now := time.Now()
+	if now.Sub(time.UnixMilli(lastPrune)) < UTDPruneInterval || !tracker.lastPrune.CompareAndSwap(lastPrune, now.UnixMilli()) {
+		return
+	}
+	_, err := tracker.Prune(ctx, now.Add(-tracker.MaxAge))
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to prune old undecryptable events")
+	}
+}
+
+// Prune removes all recorded events that were first seen before the given time.
+func (tracker *UTDTracker) Prune(ctx context.Context, olderThan time.Time) (int64, error) {
+	count, err := tracker.mach.CryptoStore.PruneUndecryptableEvents(ctx, olderThan)
+	if err != nil {
+		return 0, err
+	} else if count > 0 {
+		zerolog.Ctx(ctx).Debug().
+			Int64("pruned_count", count).
+			Time("older_than", olderThan).
+			Msg("Pruned old undecryptable events")
+	}
+	return count, nil
+}
+
+func (tracker *UTDTracker) update(ctx context.Context, utd *UndecryptableEvent, decryptErr error) (changed bool, err error) {
+	reason, withheldCode := tracker.Classify(ctx, utd.Event, decryptErr)
+	changed = reason != utd.Reason || withheldCode != utd.WithheldCode
+	utd.Reason = reason
+	utd.WithheldCode = withheldCode
+	utd.Error = decryptErr.Error()
+	utd.LastAttempt = time.Now()
+	utd.Attempts++
+	err = tracker.mach.CryptoStore.PutUndecryptableEvent(ctx, utd)
+	if err != nil {
+		err = fmt.Errorf("failed to store undecryptable event: %w", err)
+	}
+	return
+}
+
+// QueueRetry queues the given session for [UTDTracker.RetrySession]. Queued sessions are retried one at a time
+// in a single background goroutine, and sessions that are already in the queue are not added again.
+func (tracker *UTDTracker) QueueRetry(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) {
+	item := queuedRetry{roomID: roomID, sessionID: sessionID}
+	tracker.retryQueueLock.Lock()
+	defer tracker.retryQueueLock.Unlock()
+	if _, alreadyQueued := tracker.retryQueued[item]; alreadyQueued {
+		return
+	}
+	tracker.retryQueued[item] = struct{}{}
+	tracker.retryQueue = append(tracker.retryQueue, item)
+	if !tracker.retryRunning {
+		tracker.retryRunning = true
+		go tracker.retryLoop(ctx)
+	}
+}
+
+func (tracker *UTDTracker) retryLoop(ctx context.Context) {
+	for {
+		tracker.retryQueueLock.Lock()
+		if len(tracker.retryQueue) == 0 || ctx.Err() != nil {
+			clear(tracker.retryQueued)
+			tracker.retryQueue = nil
+			tracker.retryRunning = false
+			tracker.retryQueueLock.Unlock()
+			return
+		}
+		item := tracker.retryQueue[0]
+		tracker.retryQueue = tracker.retryQueue[1:]
+		delete(tracker.retryQueued, item)
+		tracker.retryQueueLock.Unlock()
+		tracker.RetrySession(ctx, item.roomID, item.sessionID)
+	}
+}
+
+// RetrySession tries to decrypt all recorded events that were encrypted with the given session.
+// This is called automatically in the background (via [UTDTracker.QueueRetry]) when keys for a session are received.
+func (tracker *UTDTracker) RetrySession(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) {
+	defer tracker.retryLock.WithLock(sessionID)()
+	log := tracker.mach.machOrContextLog(ctx).With().
+		Str("action", "retry undecryptable events").
+		Stringer("room_id", roomID).
+		Stringer("session_id", sessionID).
+		Logger()
+	ctx = log.WithContext(ctx)
+	utds, err := tracker.mach.CryptoStore.GetUndecryptableEvents(ctx, roomID, sessionID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get undecryptable events for session")
+		return
+	}
+	for _, utd := range utds {
+		decrypted, err := tracker.mach.DecryptMegolmEvent(ctx, utd.Event)
+		if err == nil && decrypted.Mautrix.TrustState < tracker.MinTrust {
+			err = fmt.Errorf("%w (%s)", ErrUnverifiedSender, decrypted.Mautrix.TrustState)
+		}
+		if err != nil {
+			log.Debug().Err(err).Stringer("event_id", utd.EventID).Msg("Event is still undecryptable")
+			changed, err := tracker.update(ctx, utd, err)
+			if err != nil {
+				log.Err(err).Stringer("event_id", utd.EventID).Msg("Failed to update undecryptable event")
+			} else if changed && tracker.OnUTD != nil {
+				tracker.OnUTD(ctx, utd)
+			}
+			continue
+		}
+		err = tracker.mach.CryptoStore.DeleteUndecryptableEvent(ctx, utd.RoomID, utd.EventID)
+		if err != nil {
+			log.Err(err).Stringer("event_id", utd.EventID).Msg("Failed to delete decrypted event from undecryptable event store")
+		}
+		tracker.lateDecrypted.Add(1)
+		log.Debug().
+			Stringer("event_id", utd.EventID).
+			Str("prev_utd_reason", string(utd.Reason)).
+			Int("attempts", utd.Attempts).
+			Msg("Decrypted previously undecryptable event")
+		if tracker.OnLateDecrypt != nil {
+			tracker.OnLateDecrypt(ctx, utd, decrypted)
+		}
+	}
+}
+
+// Stats returns statistics about undecryptable events.
+func (tracker *UTDTracker) Stats(ctx context.Context) (*UTDStats, error) {
+	pending, err := tracker.mach.CryptoStore.CountUndecryptableEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &UTDStats{
+		Pending:       pending,
+		Recorded:      tracker.recorded.Load(),
+		LateDecrypted: tracker.lateDecrypted.Load(),
+	}, nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crypto
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func encryptTestEvent(t *testing.T, mach *OlmMachine, eventID id.EventID) (*event.Event, *InboundGroupSession) {
+	ctx := context.Background()
+	outSess, err := mach.newOutboundGroupSession(ctx, "room1")
+	require.NoError(t, err)
+	outSess.Shared = true
+	require.NoError(t, mach.CryptoStore.AddOutboundGroupSession(ctx, outSess))
+	signingKey, senderKey := mach.account.Keys()
+	igs, err := NewInboundGroupSession(senderKey, signingKey, "room1", outSess.Internal.Key(), 0, 0, nil, false)
+	require.NoError(t, err)
+	content, err := mach.EncryptMegolmEvent(ctx, "room1", event.EventMessage, map[string]string{"body": "hello"})
+	require.NoError(t, err)
+	return &event.Event{
+		Content:   event.Content{Parsed: content},
+		Type:      event.EventEncrypted,
+		ID:        eventID,
+		RoomID:    "room1",
+		Sender:    "user1",
+		Timestamp: time.Now().UnixMilli(),
+	}, igs
+}
+
+func TestUTDTracker_LateDecrypt(t *testing.T) {
+	ctx := context.Background()
+	machineOut := newMachine(t, "user1")
+	machineIn := newMachine(t, "user2")
+	machineIn.DisableDecryptKeyFetching = true
+	tracker := NewUTDTracker(machineIn)
+	machineIn.UTDTracker = tracker
+	var utds []*UndecryptableEvent
+	tracker.OnUTD = func(ctx context.Context, utd *UndecryptableEvent) {
+		utds = append(utds, utd)
+	}
+	lateDecrypted := make(chan *event.Event, 1)
+	tracker.OnLateDecrypt = func(ctx context.Context, utd *UndecryptableEvent, decrypted *event.Event) {
+		lateDecrypted <- decrypted
+	}
+
+	evt, igs := encryptTestEvent(t, machineOut, "$event1")
+	_, err := machineIn.DecryptMegolmEvent(ctx, evt)
+	require.ErrorIs(t, err, ErrNoSessionFound)
+	utd, err := tracker.Record(ctx, evt, err)
+	require.NoError(t, err)
+	assert.Equal(t, UTDReasonMissingSession, utd.Reason)
+	assert.Equal(t, igs.ID(), utd.SessionID)
+	// Recording the same event again only updates the existing record
+	_, err = tracker.Record(ctx, evt, ErrNoSessionFound)
+	require.NoError(t, err)
+	require.Len(t, utds, 1)
+	stats, err := tracker.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[UTDReason]int{UTDReasonMissingSession: 1}, stats.Pending)
+	assert.Equal(t, int64(1), stats.Recorded)
+
+	require.NoError(t, machineIn.StoreGroupSession(ctx, igs))
+	select {
+	case decrypted := <-lateDecrypted:
+		assert.Equal(t, id.EventID("$event1"), decrypted.ID)
+		assert.Equal(t, "hello", decrypted.Content.Raw["body"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("event wasn't decrypted after receiving session")
+	}
+	stats, err = tracker.Stats(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, stats.Pending)
+	assert.Equal(t, int64(1), stats.LateDecrypted)
+}
+
+func TestUTDTracker_Classify(t *testing.T) {
+	ctx := context.Background()
+	machineOut := newMachine(t, "user1")
+	machineIn := newMachine(t, "user2")
+	tracker := NewUTDTracker(machineIn)
+	machineIn.UTDTracker = tracker
+	reclassified := make(chan *UndecryptableEvent, 1)
+	tracker.OnUTD = func(ctx context.Context, utd *UndecryptableEvent) {
+		if utd.Attempts > 1 {
+			reclassified <- utd
+		}
+	}
+
+	evt, igs := encryptTestEvent(t, machineOut, "$event1")
+	reason, _ := tracker.Classify(ctx, evt, ErrNoSessionFound)
+	assert.Equal(t, UTDReasonMissingSession, reason)
+	tracker.HistoricalBefore = time.Now().Add(time.Minute)
+	reason, _ = tracker.Classify(ctx, evt, ErrNoSessionFound)
+	assert.Equal(t, UTDReasonHistorical, reason)
+	reason, _ = tracker.Classify(ctx, evt, ErrUnverifiedSender)
+	assert.Equal(t, UTDReasonUnverifiedSender, reason)
+	assert.True(t, reason.IsExpected())
+	reason, _ = tracker.Classify(ctx, evt, ErrDuplicateMessageIndex)
+	assert.Equal(t, UTDReasonOther, reason)
+	tracker.HistoricalBefore = time.Time{}
+
+	_, err := tracker.Record(ctx, evt, ErrNoSessionFound)
+	require.NoError(t, err)
+	machineIn.HandleRoomKeyWithheld(ctx, &event.RoomKeyWithheldEventContent{
+		RoomID:    "room1",
+		Algorithm: id.AlgorithmMegolmV1,
+		SessionID: igs.ID(),
+		SenderKey: machineOut.account.IdentityKey(),
+		Code:      event.RoomKeyWithheldUnverified,
+	})
+	select {
+	case utd := <-reclassified:
+		assert.Equal(t, UTDReasonWithheld, utd.Reason)
+		assert.Equal(t, event.RoomKeyWithheldUnverified, utd.WithheldCode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event wasn't reclassified after receiving withheld event")
+	}
+}
@@ -0,0 +1,15 @@
+-- v0 -> v1: Latest revision
+CREATE TABLE verification_transaction (
+	account_id      TEXT    NOT NULL,
+	transaction_id  TEXT    NOT NULL,
+	their_user_id   TEXT    NOT NULL,
+	their_device_id TEXT    NOT NULL,
+	room_id         TEXT,
+	state           INTEGER NOT NULL,
+	expiration_time BIGINT  NOT NULL,
+	data            jsonb   NOT NULL,
+
+	PRIMARY KEY (account_id, transaction_id)
+);
+
+CREATE INDEX verification_transaction_user_device_idx ON verification_transaction (account_id, their_user_id, their_device_id);
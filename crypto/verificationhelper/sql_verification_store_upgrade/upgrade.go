@@ -0,0 +1,22 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sql_verification_store_upgrade
+
+import (
+	"embed"
+
+	"go.mau.fi/util/dbutil"
+)
+
+const VersionTableName = "verification_store_version"
+
+//go:embed *.sql
+var fs embed.FS
+
+var Table = dbutil.BuildUpgradeTable().
+	WithFS(fs).
+	Finish()
@@ -0,0 +1,105 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package verificationhelper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix/crypto/verificationhelper/sql_verification_store_upgrade"
+	"maunium.net/go/mautrix/id"
+)
+
+// SQLVerificationStore is a [VerificationStore] that persists verification transactions in a database,
+// so that in-progress verifications (including the ephemeral ECDH keys) survive restarts.
+//
+// Pending timeouts are resumed from the stored expiration times when [VerificationHelper.Init] is called.
+type SQLVerificationStore struct {
+	DB        *dbutil.Database
+	AccountID string
+}
+
+var _ VerificationStore = (*SQLVerificationStore)(nil)
+
+// NewSQLVerificationStore creates a new SQL verification store. The account ID is used to separate
+// transactions of different accounts in the same database.
+func NewSQLVerificationStore(db *dbutil.Database, log dbutil.DatabaseLogger, accountID string) *SQLVerificationStore {
+	return &SQLVerificationStore{
+		DB:        db.Child(sql_verification_store_upgrade.VersionTableName, sql_verification_store_upgrade.Table, log),
+		AccountID: accountID,
+	}
+}
+
+const (
+	getVerificationBaseQuery         = `SELECT data FROM verification_transaction WHERE account_id=$1`
+	getAllVerificationsQuery         = getVerificationBaseQuery + ` ORDER BY expiration_time`
+	getVerificationByTxnIDQuery      = getVerificationBaseQuery + ` AND transaction_id=$2`
+	getVerificationByUserDeviceQuery = getVerificationBaseQuery + ` AND their_user_id=$2 AND their_device_id=$3`
+	putVerificationQuery             = `
+		INSERT INTO verification_transaction (
+			account_id, transaction_id, their_user_id, their_device_id, room_id, state, expiration_time, data
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (account_id, transaction_id) DO UPDATE
+			SET their_user_id=excluded.their_user_id,
+			    their_device_id=excluded.their_device_id,
+			    room_id=excluded.room_id,
+			    state=excluded.state,
+			    expiration_time=excluded.expiration_time,
+			    data=excluded.data
+	`
+	deleteVerificationQuery = `DELETE FROM verification_transaction WHERE account_id=$1 AND transaction_id=$2`
+)
+
+func scanVerificationTransaction(row dbutil.Scannable) (txn VerificationTransaction, err error) {
+	err = row.Scan(&dbutil.JSON{Data: &txn})
+	return
+}
+
+func (store *SQLVerificationStore) getOne(ctx context.Context, query string, args ...any) (VerificationTransaction, error) {
+	txn, err := scanVerificationTransaction(store.DB.QueryRow(ctx, query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrUnknownVerificationTransaction
+	}
+	return txn, err
+}
+
+func (store *SQLVerificationStore) DeleteVerification(ctx context.Context, txnID id.VerificationTransactionID) error {
+	res, err := store.DB.Exec(ctx, deleteVerificationQuery, store.AccountID, txnID)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		err = ErrUnknownVerificationTransaction
+	}
+	return err
+}
+
+func (store *SQLVerificationStore) GetVerificationTransaction(ctx context.Context, txnID id.VerificationTransactionID) (VerificationTransaction, error) {
+	return store.getOne(ctx, getVerificationByTxnIDQuery, store.AccountID, txnID)
+}
+
+func (store *SQLVerificationStore) SaveVerificationTransaction(ctx context.Context, txn VerificationTransaction) error {
+	_, err := store.DB.Exec(
+		ctx, putVerificationQuery,
+		store.AccountID, txn.TransactionID, txn.TheirUserID, txn.TheirDeviceID, dbutil.StrPtr(txn.RoomID),
+		txn.VerificationState, txn.ExpirationTime.UnixMilli(), &dbutil.JSON{Data: &txn},
+	)
+	return err
+}
+
+func (store *SQLVerificationStore) FindVerificationTransactionForUserDevice(ctx context.Context, userID id.UserID, deviceID id.DeviceID) (VerificationTransaction, error) {
+	return store.getOne(ctx, getVerificationByUserDeviceQuery, store.AccountID, userID, deviceID)
+}
+
+func (store *SQLVerificationStore) GetAllVerificationTransactions(ctx context.Context) ([]VerificationTransaction, error) {
+	rows, err := store.DB.Query(ctx, getAllVerificationsQuery, store.AccountID)
+	return dbutil.NewRowIterWithError(rows, scanVerificationTransaction, err).AsList()
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package verificationhelper_test
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+
+	"maunium.net/go/mautrix/crypto/verificationhelper"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSQLVerificationStore(t *testing.T) {
+	ctx := context.Background()
+	rawDB, err := sql.Open("sqlite3", ":memory:?_busy_timeout=5000")
+	require.NoError(t, err)
+	db, err := dbutil.NewWithDB(rawDB, "sqlite3")
+	require.NoError(t, err)
+	store := verificationhelper.NewSQLVerificationStore(db, dbutil.NoopLogger, "account1")
+	require.NoError(t, store.DB.Upgrade(ctx))
+	otherStore := verificationhelper.NewSQLVerificationStore(db, dbutil.NoopLogger, "account2")
+
+	ephemeralKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	txn := verificationhelper.VerificationTransaction{
+		ExpirationTime:    jsontime.UM(time.Now().Add(10 * time.Minute).Truncate(time.Millisecond)),
+		VerificationState: verificationhelper.VerificationStateSASStarted,
+		TransactionID:     "txn1",
+		TheirUserID:       "@alice:example.com",
+		TheirDeviceID:     "DEVICE",
+		EphemeralKey:      &verificationhelper.ECDHPrivateKey{PrivateKey: ephemeralKey},
+		OtherPublicKey:    &verificationhelper.ECDHPublicKey{PublicKey: ephemeralKey.PublicKey()},
+	}
+	require.NoError(t, store.SaveVerificationTransaction(ctx, txn))
+
+	loaded, err := store.GetVerificationTransaction(ctx, "txn1")
+	require.NoError(t, err)
+	assert.Equal(t, txn.VerificationState, loaded.VerificationState)
+	assert.True(t, txn.ExpirationTime.Equal(loaded.ExpirationTime.Time))
+	require.NotNil(t, loaded.EphemeralKey)
+	assert.Equal(t, ephemeralKey.Bytes(), loaded.EphemeralKey.Bytes())
+	assert.Equal(t, ephemeralKey.PublicKey().Bytes(), loaded.OtherPublicKey.Bytes())
+
+	found, err := store.FindVerificationTransactionForUserDevice(ctx, "@alice:example.com", "DEVICE")
+	require.NoError(t, err)
+	assert.Equal(t, id.VerificationTransactionID("txn1"), found.TransactionID)
+
+	// Transactions are separated by account
+	_, err = otherStore.GetVerificationTransaction(ctx, "txn1")
+	assert.ErrorIs(t, err, verificationhelper.ErrUnknownVerificationTransaction)
+
+	txn.VerificationState = verificationhelper.VerificationStateSASKeysExchanged
+	require.NoError(t, store.SaveVerificationTransaction(ctx, txn))
+	all, err := store.GetAllVerificationTransactions(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Equal(t, verificationhelper.VerificationStateSASKeysExchanged, all[0].VerificationState)
+
+	require.NoError(t, store.DeleteVerification(ctx, "txn1"))
+	_, err = store.GetVerificationTransaction(ctx, "txn1")
+	assert.ErrorIs(t, err, verificationhelper.ErrUnknownVerificationTransaction)
+	assert.ErrorIs(t, store.DeleteVerification(ctx, "txn1"), verificationhelper.ErrUnknownVerificationTransaction)
+}
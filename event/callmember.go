@@ -0,0 +1,149 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package event
+
+import (
+	"strings"
+	"time"
+
+	"go.mau.fi/util/jsonbytes"
+	"go.mau.fi/util/jsontime"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type CallScope string
+
+const (
+	CallScopeRoom CallScope = "m.room"
+	CallScopeUser CallScope = "m.user"
+)
+
+const (
+	CallApplicationCall = "m.call"
+
+	CallFocusTypeLivekit = "livekit"
+
+	CallFocusSelectionOldestMembership = "oldest_membership"
+)
+
+// DefaultCallMemberExpiry is the expiry used for call memberships that don't specify one.
+// It matches the default used by Element Call.
+const DefaultCallMemberExpiry = 4 * time.Hour
+
+// CallFocus describes a MatrixRTC focus (i.e. an SFU) that a participant is using or would prefer to use.
+type CallFocus struct {
+	Type string `json:"type"`
+
+	// Fields for foci_preferred
+	LivekitServiceURL string `json:"livekit_service_url,omitempty"`
+	LivekitAlias      string `json:"livekit_alias,omitempty"`
+
+	// Fields for focus_active
+	FocusSelection string `json:"focus_selection,omitempty"`
+}
+
+// CallMemberEventContent represents the content of a MatrixRTC session membership event
+// (m.rtc.member or org.matrix.msc3401.call.member). An empty content means the device has left the session.
+//
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4143
+type CallMemberEventContent struct {
+	Application string    `json:"application,omitempty"`
+	CallID      string    `json:"call_id"`
+	Scope       CallScope `json:"scope,omitempty"`
+
+	DeviceID id.DeviceID `json:"device_id,omitempty"`
+	// Expires is the duration after CreatedTS (or the event timestamp if unset) after which the membership
+	// should be considered stale even if no leave event was sent.
+	Expires   jsontime.Milliseconds `json:"expires,omitzero"`
+	CreatedTS jsontime.UnixMilli    `json:"created_ts,omitzero"`
+
+	FocusActive   *CallFocus  `json:"focus_active,omitempty"`
+	FociPreferred []CallFocus `json:"foci_preferred,omitempty"`
+}
+
+// IsActive returns true if the content describes a membership rather than a leave.
+func (cm *CallMemberEventContent) IsActive() bool {
+	return cm != nil && cm.Application != "" && cm.DeviceID != ""
+}
+
+// GetCreatedTS returns the creation time of the membership, falling back to the timestamp of the event.
+func (cm *CallMemberEventContent) GetCreatedTS(evt *Event) time.Time {
+	if !cm.CreatedTS.IsZero() {
+		return cm.CreatedTS.Time
+	} else if evt != nil {
+		return time.UnixMilli(evt.Timestamp)
+	}
+	return time.Time{}
+}
+
+// GetExpiry returns the time when the membership expires.
+func (cm *CallMemberEventContent) GetExpiry(evt *Event) time.Time {
+	expires := cm.Expires.Duration
+	if expires <= 0 {
+		expires = DefaultCallMemberExpiry
+	}
+	return cm.GetCreatedTS(evt).Add(expires)
+}
+
+// CallMemberStateKey returns the state key used for the membership of the given device.
+//
+// The underscore prefix prevents the key from being treated as an owned state key on servers that
+// don't support MSC3757, as those would only allow the user to send events with their user ID as the state key.
+func CallMemberStateKey(userID id.UserID, deviceID id.DeviceID) string {
+	return "_" + string(userID) + "_" + string(deviceID)
+}
+
+// ParseCallMemberStateKey extracts the user and device ID from a call membership state key.
+// Both the underscore-prefixed and plain formats are supported. The device ID is empty for
+// legacy per-user state keys.
+func ParseCallMemberStateKey(stateKey string) (userID id.UserID, deviceID id.DeviceID) {
+	stateKey = strings.TrimPrefix(stateKey, "_")
+	stateKey = strings.TrimSuffix(stateKey, "_"+CallApplicationCall)
+	if !strings.HasPrefix(stateKey, "@") {
+		return "", ""
+	}
+	// User IDs can't contain underscores in the server name, so the last underscore after
+	// the colon separates the device ID.
+	colonIdx := strings.IndexByte(stateKey, ':')
+	if colonIdx == -1 {
+		return "", ""
+	}
+	sepIdx := strings.LastIndexByte(stateKey[colonIdx:], '_')
+	if sepIdx == -1 {
+		return id.UserID(stateKey), ""
+	}
+	return id.UserID(stateKey[:colonIdx+sepIdx]), id.DeviceID(stateKey[colonIdx+sepIdx+1:])
+}
+
+// CallEncryptionKey is a single MatrixRTC media encryption key.
+type CallEncryptionKey struct {
+	Index int                     `json:"index"`
+	Key   jsonbytes.UnpaddedBytes `json:"key"`
+}
+
+type CallEncryptionKeysMember struct {
+	ID              string      `json:"id,omitempty"`
+	ClaimedDeviceID id.DeviceID `json:"claimed_device_id"`
+}
+
+type CallEncryptionKeysSession struct {
+	Application string    `json:"application"`
+	CallID      string    `json:"call_id"`
+	Scope       CallScope `json:"scope,omitempty"`
+}
+
+// CallEncryptionKeysEventContent represents the content of an io.element.call.encryption_keys to-device event,
+// which is used to distribute the sender's media key for an end-to-end encrypted MatrixRTC session.
+// The event must always be sent encrypted with Olm.
+type CallEncryptionKeysEventContent struct {
+	Keys    CallEncryptionKey         `json:"keys"`
+	Member  CallEncryptionKeysMember  `json:"member"`
+	RoomID  id.RoomID                 `json:"room_id"`
+	Session CallEncryptionKeysSession `json:"session"`
+	SentTS  jsontime.UnixMilli        `json:"sent_ts,omitzero"`
+}
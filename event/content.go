@@ -57,6 +57,9 @@ var TypeMap = map[Type]reflect.Type{
 	StateBeeperRoomFeatures:       reflect.TypeOf(RoomFeatures{}),
 	StateBeeperDisappearingTimer:  reflect.TypeOf(BeeperDisappearingTimer{}),
 
+	StateCallMember:         reflect.TypeOf(CallMemberEventContent{}),
+	StateUnstableCallMember: reflect.TypeOf(CallMemberEventContent{}),
+
 	EventMessage:   reflect.TypeOf(MessageEventContent{}),
 	EventSticker:   reflect.TypeOf(MessageEventContent{}),
 	EventEncrypted: reflect.TypeOf(EncryptedEventContent{}),
@@ -123,6 +126,8 @@ var TypeMap = map[Type]reflect.Type{
 	ToDeviceBeeperStreamSubscribe: reflect.TypeOf(BeeperStreamSubscribeEventContent{}),
 	ToDeviceBeeperStreamUpdate:    reflect.TypeOf(BeeperStreamUpdateEventContent{}),
 
+	ToDeviceCallEncryptionKeys: reflect.TypeOf(CallEncryptionKeysEventContent{}),
+
 	CallInvite:       reflect.TypeOf(CallInviteEventContent{}),
 	CallCandidates:   reflect.TypeOf(CallCandidatesEventContent{}),
 	CallAnswer:       reflect.TypeOf(CallAnswerEventContent{}),
@@ -304,6 +309,13 @@ func (content *Content) AsTombstone() *TombstoneEventContent {
 	}
 	return casted
 }
+func (content *Content) AsCallMember() *CallMemberEventContent {
+	casted, ok := content.Parsed.(*CallMemberEventContent)
+	if !ok {
+		return &CallMemberEventContent{}
+	}
+	return casted
+}
 func (content *Content) AsCreate() *CreateEventContent {
 	casted, ok := content.Parsed.(*CreateEventContent)
 	if !ok {
@@ -204,12 +204,21 @@ func (ec *EventIDChunk) Serialize(typ RelationType) RelationChunk {
 	return ec.RelationChunk
 }
 
+// ThreadAggregation is the bundled aggregation of m.thread relations.
+// https://spec.matrix.org/v1.15/client-server-api/#server-side-aggregation-of-mthread-relationships
+type ThreadAggregation struct {
+	LatestEvent             *Event `json:"latest_event,omitempty"`
+	Count                   int    `json:"count"`
+	CurrentUserParticipated bool   `json:"current_user_participated"`
+}
+
 type Relations struct {
 	Raw map[RelationType]RelationChunk `json:"-"`
 
-	Annotations AnnotationChunk `json:"m.annotation,omitempty"`
-	References  EventIDChunk    `json:"m.reference,omitempty"`
-	Replaces    EventIDChunk    `json:"m.replace,omitempty"`
+	Annotations AnnotationChunk    `json:"m.annotation,omitempty"`
+	References  EventIDChunk       `json:"m.reference,omitempty"`
+	Replaces    EventIDChunk       `json:"m.replace,omitempty"`
+	Thread      *ThreadAggregation `json:"m.thread,omitempty"`
 }
 
 type serializableRelations Relations
@@ -228,13 +237,17 @@ func (relations *Relations) MarshalJSON() ([]byte, error) {
 	relations.Raw[RelAnnotation] = relations.Annotations.Serialize()
 	relations.Raw[RelReference] = relations.References.Serialize(RelReference)
 	relations.Raw[RelReplace] = relations.Replaces.Serialize(RelReplace)
+	output := make(map[RelationType]any, len(relations.Raw)+1)
 	for key, item := range relations.Raw {
 		if !item.Limited {
 			item.Count = len(item.Chunk)
 		}
-		if item.Count == 0 {
-			delete(relations.Raw, key)
+		if item.Count != 0 && key != RelThread {
+			output[key] = item
 		}
 	}
-	return json.Marshal(relations.Raw)
+	if relations.Thread != nil {
+		output[RelThread] = relations.Thread
+	}
+	return json.Marshal(output)
 }
@@ -45,6 +45,19 @@ type ServerACLEventContent struct {
 	Deny            []string `json:"deny,omitempty"`
 }
 
+type serverACLEventContentAlias ServerACLEventContent
+
+// UnmarshalJSON unmarshals the ACL content, defaulting allow_ip_literals to true if it's not present as per the spec.
+func (acl *ServerACLEventContent) UnmarshalJSON(data []byte) error {
+	alias := serverACLEventContentAlias{AllowIPLiterals: true}
+	err := json.Unmarshal(data, &alias)
+	if err != nil {
+		return err
+	}
+	*acl = ServerACLEventContent(alias)
+	return nil
+}
+
 // TopicEventContent represents the content of a m.room.topic state event.
 // https://spec.matrix.org/v1.2/client-server-api/#mroomtopic
 type TopicEventContent struct {
@@ -114,7 +114,7 @@ func (et *Type) GuessClass() TypeClass {
 		StateSpaceParent.Type, StateSpaceChild.Type, StatePolicyRoom.Type, StatePolicyServer.Type, StatePolicyUser.Type,
 		StateElementFunctionalMembers.Type, StateBeeperRoomFeatures.Type, StateBeeperDisappearingTimer.Type,
 		StateMSC4391BotCommand.Type, StateRoomPolicy.Type, StateUnstableRoomPolicy.Type, StateImagePack.Type,
-		StateUnstableImagePack.Type:
+		StateUnstableImagePack.Type, StateCallMember.Type, StateUnstableCallMember.Type:
 		return StateEventType
 	case EphemeralEventReceipt.Type, EphemeralEventTyping.Type, EphemeralEventPresence.Type:
 		return EphemeralEventType
@@ -123,7 +123,7 @@ func (et *Type) GuessClass() TypeClass {
 		AccountDataPerMessageProfiles.Type, AccountDataBeeperMute.Type, AccountDataSpaceOrder.Type,
 		AccountDataSecretStorageKey.Type, AccountDataSecretStorageDefaultKey.Type,
 		AccountDataCrossSigningMaster.Type, AccountDataCrossSigningSelf.Type, AccountDataCrossSigningUser.Type,
-		AccountDataMegolmBackupKey.Type, AccountDataImagePackRooms.Type, AccountDataUnstableImagePackRooms.Type:
+		AccountDataMegolmBackupKey.Type, AccountDataDehydratedDeviceKey.Type, AccountDataImagePackRooms.Type, AccountDataUnstableImagePackRooms.Type:
 		return AccountDataEventType
 	case EventRedaction.Type, EventMessage.Type, EventEncrypted.Type, EventReaction.Type, EventSticker.Type,
 		InRoomVerificationStart.Type, InRoomVerificationReady.Type, InRoomVerificationAccept.Type,
@@ -133,7 +133,8 @@ func (et *Type) GuessClass() TypeClass {
 		EventUnstablePollEnd.Type, BeeperTranscription.Type, BeeperDeleteChat.Type, BeeperAcceptMessageRequest.Type:
 		return MessageEventType
 	case ToDeviceRoomKey.Type, ToDeviceRoomKeyRequest.Type, ToDeviceForwardedRoomKey.Type, ToDeviceRoomKeyWithheld.Type,
-		ToDeviceBeeperRoomKeyAck.Type, ToDeviceBeeperStreamSubscribe.Type, ToDeviceBeeperStreamUpdate.Type:
+		ToDeviceBeeperRoomKeyAck.Type, ToDeviceBeeperStreamSubscribe.Type, ToDeviceBeeperStreamUpdate.Type,
+		ToDeviceCallEncryptionKeys.Type:
 		return ToDeviceEventType
 	default:
 		return UnknownEventType
@@ -214,6 +215,9 @@ var (
 	StateBeeperRoomFeatures       = Type{"com.beeper.room_features", StateEventType}
 	StateBeeperDisappearingTimer  = Type{"com.beeper.disappearing_timer", StateEventType}
 	StateMSC4391BotCommand        = Type{"org.matrix.msc4391.command_description", StateEventType}
+
+	StateCallMember         = Type{"m.rtc.member", StateEventType}
+	StateUnstableCallMember = Type{"org.matrix.msc3401.call.member", StateEventType}
 )
 
 // Message events
@@ -281,6 +285,7 @@ var (
 	AccountDataCrossSigningUser        = Type{string(id.SecretXSUserSigning), AccountDataEventType}
 	AccountDataCrossSigningSelf        = Type{string(id.SecretXSSelfSigning), AccountDataEventType}
 	AccountDataMegolmBackupKey         = Type{string(id.SecretMegolmBackupV1), AccountDataEventType}
+	AccountDataDehydratedDeviceKey     = Type{string(id.SecretDehydratedDevice), AccountDataEventType}
 )
 
 // Device-to-device events
@@ -312,4 +317,6 @@ var (
 	ToDeviceBeeperRoomKeyAck      = Type{"com.beeper.room_key.ack", ToDeviceEventType}
 	ToDeviceBeeperStreamSubscribe = Type{"com.beeper.stream.subscribe", ToDeviceEventType}
 	ToDeviceBeeperStreamUpdate    = Type{"com.beeper.stream.update", ToDeviceEventType}
+
+	ToDeviceCallEncryptionKeys = Type{"io.element.call.encryption_keys", ToDeviceEventType}
 )
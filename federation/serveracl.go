@@ -0,0 +1,218 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package federation
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.mau.fi/util/glob"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ServerACL is a compiled m.room.server_acl event.
+//
+// See https://spec.matrix.org/v1.15/client-server-api/#server-access-control-lists-acls-for-rooms
+type ServerACL struct {
+	allow           []glob.Glob
+	deny            []glob.Glob
+	allowIPLiterals bool
+}
+
+func compileACLGlobs(patterns []string) []glob.Glob {
+	globs := make([]glob.Glob, 0, len(patterns))
+	for _, pattern := range patterns {
+		if compiled := glob.Compile(strings.ToLower(pattern)); compiled != nil {
+			globs = append(globs, compiled)
+		}
+	}
+	return globs
+}
+
+// NewServerACL compiles the given server ACL content. A nil content results in an ACL that allows all servers.
+//
+// Note that allow_ip_literals defaults to true when the content is parsed from JSON,
+// but the zero value of [event.ServerACLEventContent.AllowIPLiterals] denies IP literals.
+func NewServerACL(content *event.ServerACLEventContent) *ServerACL {
+	if content == nil {
+		return &ServerACL{allow: []glob.Glob{glob.Compile("*")}, allowIPLiterals: true}
+	}
+	return &ServerACL{
+		allow:           compileACLGlobs(content.Allow),
+		deny:            compileACLGlobs(content.Deny),
+		allowIPLiterals: content.AllowIPLiterals,
+	}
+}
+
+func matchesAny(globs []glob.Glob, host string) bool {
+	for _, g := range globs {
+		if g.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows checks if the given server name is allowed to participate in the room.
+// The port is not considered when matching, and invalid server names are never allowed.
+func (acl *ServerACL) Allows(serverName string) bool {
+	host, _, ok := ParseServerName(serverName)
+	if !ok {
+		return false
+	}
+	if !acl.allowIPLiterals && net.ParseIP(host) != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	return !matchesAny(acl.deny, host) && matchesAny(acl.allow, host)
+}
+
+// ServerACLChecker caches compiled server ACLs of rooms.
+type ServerACLChecker struct {
+	// GetACL is called to fetch the ACL of a room that isn't cached.
+	// It should return nil content if the room doesn't have an ACL.
+	GetACL func(ctx context.Context, roomID id.RoomID) (*event.ServerACLEventContent, error)
+
+	cache map[id.RoomID]*ServerACL
+	lock  sync.RWMutex
+}
+
+// NewServerACLChecker creates a new ACL checker with the given ACL fetcher.
+func NewServerACLChecker(getACL func(ctx context.Context, roomID id.RoomID) (*event.ServerACLEventContent, error)) *ServerACLChecker {
+	return &ServerACLChecker{
+		GetACL: getACL,
+		cache:  make(map[id.RoomID]*ServerACL),
+	}
+}
+
+// Update replaces the cached ACL of the given room.
+func (sac *ServerACLChecker) Update(roomID id.RoomID, content *event.ServerACLEventContent) {
+	acl := NewServerACL(content)
+	sac.lock.Lock()
+	sac.cache[roomID] = acl
+	sac.lock.Unlock()
+}
+
+// HandleEvent updates the cache if the given event is a m.room.server_acl event.
+// It can be registered as an event handler on a syncer or appservice event processor.
+func (sac *ServerACLChecker) HandleEvent(ctx context.Context, evt *event.Event) {
+	if evt.Type.Type != event.StateServerACL.Type || evt.GetStateKey() != "" {
+		return
+	}
+	if evt.Content.Parsed == nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	content, ok := evt.Content.Parsed.(*event.ServerACLEventContent)
+	if !ok {
+		return
+	}
+	sac.Update(evt.RoomID, content)
+}
+
+// Get returns the compiled ACL of the given room, fetching it if it isn't cached.
+func (sac *ServerACLChecker) Get(ctx context.Context, roomID id.RoomID) (*ServerACL, error) {
+	sac.lock.RLock()
+	acl, ok := sac.cache[roomID]
+	sac.lock.RUnlock()
+	if ok {
+		return acl, nil
+	}
+	content, err := sac.GetACL(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server ACL of %s: %w", roomID, err)
+	}
+	acl = NewServerACL(content)
+	sac.lock.Lock()
+	sac.cache[roomID] = acl
+	sac.lock.Unlock()
+	return acl, nil
+}
+
+// Allows checks if the given server is allowed by the ACL of the given room.
+func (sac *ServerACLChecker) Allows(ctx context.Context, roomID id.RoomID, serverName string) (bool, error) {
+	acl, err := sac.Get(ctx, roomID)
+	if err != nil {
+		return false, err
+	}
+	return acl.Allows(serverName), nil
+}
+
+// CheckRequest checks the origin server of a request authenticated with [ServerAuth] against the ACL of the given room.
+// It returns a M_FORBIDDEN error if the server is denied.
+func (sac *ServerACLChecker) CheckRequest(r *http.Request, roomID id.RoomID) *mautrix.RespError {
+	allowed, err := sac.Allows(r.Context(), roomID, OriginServerNameFromRequest(r))
+	var respErr mautrix.RespError
+	if err != nil {
+		respErr = mautrix.MUnknown.WithMessage("Failed to check server ACL")
+	} else if !allowed {
+		respErr = mautrix.MForbidden.WithMessage("Server is banned from this room")
+	} else {
+		return nil
+	}
+	return &respErr
+}
+
+// ServerACLImpact describes which room members would be affected by a server ACL change.
+type ServerACLImpact struct {
+	// DeniedServers are the servers of current members that would not be allowed by the new ACL.
+	DeniedServers []string
+	// NewlyDeniedServers is the subset of DeniedServers that are allowed by the current ACL.
+	NewlyDeniedServers []string
+	// AffectedMembers are the joined or invited members on the denied servers.
+	AffectedMembers map[string][]id.UserID
+}
+
+// Denies checks if the given server is denied by the proposed ACL.
+func (impact *ServerACLImpact) Denies(serverName string) bool {
+	return slices.Contains(impact.DeniedServers, serverName)
+}
+
+// CalculateServerACLImpact computes which servers of the room members in the state store would be denied
+// by the proposed ACL. The current ACL is used to find servers that are newly denied and may be nil.
+func CalculateServerACLImpact(
+	ctx context.Context,
+	store mautrix.StateStore,
+	roomID id.RoomID,
+	current, proposed *event.ServerACLEventContent,
+) (*ServerACLImpact, error) {
+	members, err := store.GetAllMembers(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room members: %w", err)
+	}
+	currentACL := NewServerACL(current)
+	proposedACL := NewServerACL(proposed)
+	impact := &ServerACLImpact{
+		AffectedMembers: make(map[string][]id.UserID),
+	}
+	for userID, member := range members {
+		if member.Membership != event.MembershipJoin && member.Membership != event.MembershipInvite {
+			continue
+		}
+		server := userID.Homeserver()
+		if proposedACL.Allows(server) {
+			continue
+		}
+		if _, alreadyAdded := impact.AffectedMembers[server]; !alreadyAdded {
+			impact.DeniedServers = append(impact.DeniedServers, server)
+			if currentACL.Allows(server) {
+				impact.NewlyDeniedServers = append(impact.NewlyDeniedServers, server)
+			}
+		}
+		impact.AffectedMembers[server] = append(impact.AffectedMembers[server], userID)
+	}
+	slices.Sort(impact.DeniedServers)
+	slices.Sort(impact.NewlyDeniedServers)
+	return impact, nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package federation_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/federation"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestServerACL_Allows(t *testing.T) {
+	acl := federation.NewServerACL(&event.ServerACLEventContent{
+		Allow:           []string{"*"},
+		Deny:            []string{"*.evil.com", "evil.com", "bad?.org"},
+		AllowIPLiterals: false,
+	})
+	assert.True(t, acl.Allows("matrix.org"))
+	assert.True(t, acl.Allows("matrix.org:8448"))
+	assert.False(t, acl.Allows("evil.com"))
+	assert.False(t, acl.Allows("EVIL.com:443"))
+	assert.False(t, acl.Allows("matrix.evil.com"))
+	assert.True(t, acl.Allows("notevil.com"))
+	assert.False(t, acl.Allows("bad1.org"))
+	assert.True(t, acl.Allows("bad12.org"))
+	assert.False(t, acl.Allows("1.2.3.4"))
+	assert.False(t, acl.Allows("[1234:5678::abcd]:8448"))
+	assert.False(t, acl.Allows("invalid_server!"))
+
+	allowOnly := federation.NewServerACL(&event.ServerACLEventContent{
+		Allow:           []string{"example.com"},
+		AllowIPLiterals: true,
+	})
+	assert.True(t, allowOnly.Allows("example.com"))
+	assert.False(t, allowOnly.Allows("matrix.org"))
+	assert.False(t, allowOnly.Allows("1.2.3.4"))
+
+	assert.True(t, federation.NewServerACL(nil).Allows("1.2.3.4"))
+	var defaultIPLiterals event.ServerACLEventContent
+	require.NoError(t, json.Unmarshal([]byte(`{"allow": ["*"]}`), &defaultIPLiterals))
+	assert.True(t, federation.NewServerACL(&defaultIPLiterals).Allows("1.2.3.4"))
+	assert.False(t, federation.NewServerACL(&event.ServerACLEventContent{}).Allows("matrix.org"))
+}
+
+func TestCalculateServerACLImpact(t *testing.T) {
+	ctx := context.Background()
+	roomID := id.RoomID("!room:example.com")
+	store := mautrix.NewMemoryStateStore()
+	for _, userID := range []id.UserID{"@a:example.com", "@b:evil.com", "@c:evil.com", "@d:meh.org", "@e:1.2.3.4"} {
+		require.NoError(t, store.SetMembership(ctx, roomID, userID, event.MembershipJoin))
+	}
+	require.NoError(t, store.SetMembership(ctx, roomID, "@f:left.org", event.MembershipLeave))
+
+	var current, proposed event.ServerACLEventContent
+	require.NoError(t, json.Unmarshal([]byte(`{"allow": ["*"], "deny": ["meh.org"]}`), &current))
+	require.NoError(t, json.Unmarshal([]byte(`{"allow": ["*"], "deny": ["evil.com", "meh.org", "left.org", "1.2.3.4"], "allow_ip_literals": false}`), &proposed))
+	impact, err := federation.CalculateServerACLImpact(ctx, store, roomID, &current, &proposed)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.4", "evil.com", "meh.org"}, impact.DeniedServers)
+	// IP literals are allowed by the current ACL, as allow_ip_literals defaults to true when it's missing
+	assert.Equal(t, []string{"1.2.3.4", "evil.com"}, impact.NewlyDeniedServers)
+	assert.ElementsMatch(t, []id.UserID{"@b:evil.com", "@c:evil.com"}, impact.AffectedMembers["evil.com"])
+	assert.True(t, impact.Denies("meh.org"))
+	assert.False(t, impact.Denies("left.org"))
+}
@@ -10,6 +10,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -77,6 +78,7 @@ type ColorConverter func(text, fg, bg string, ctx Context) string
 type CodeBlockConverter func(code, language string, ctx Context) string
 type PillConverter func(displayname, mxid, eventID string, ctx Context) string
 type ImageConverter func(src, alt, title, width, height string, isEmoji bool) string
+type TableConverter func(header []string, rows [][]string, ctx Context) string
 
 const contextKeyMentions = "_mentions"
 
@@ -125,6 +127,36 @@ func DefaultMonospaceBlockConverter(code, language string, ctx Context) string {
 	return fmt.Sprintf("%s%s\n%s%s", fence, language, code, fence)
 }
 
+// MarkdownTableConverter converts tables into GitHub-flavored markdown tables.
+func MarkdownTableConverter(header []string, rows [][]string, ctx Context) string {
+	columns := len(header)
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+	var buf strings.Builder
+	writeRow := func(cells []string) {
+		buf.WriteByte('|')
+		for i := 0; i < columns; i++ {
+			var cell string
+			if i < len(cells) {
+				// Table rows can't contain newlines, so use HTML line breaks instead
+				cell = strings.ReplaceAll(cells[i], "\n", "<br>")
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(cell)
+			buf.WriteString(" |")
+		}
+		buf.WriteByte('\n')
+	}
+	writeRow(header)
+	buf.WriteString(strings.Repeat("| --- ", columns))
+	buf.WriteString("|\n")
+	for _, row := range rows {
+		writeRow(row)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
 // HTMLParser is a somewhat customizable Matrix HTML parser.
 type HTMLParser struct {
 	PillConverter           PillConverter
@@ -144,6 +176,13 @@ type HTMLParser struct {
 	MonospaceConverter      TextConverter
 	TextConverter           TextConverter
 	ImageConverter          ImageConverter
+	TableConverter          TableConverter
+
+	// StrictMarkdown makes the parser output markdown that renders back into equivalent HTML:
+	// special characters in text are escaped, loose lists are separated with blank lines and
+	// reply fallbacks are removed. It should be combined with the markdown converters
+	// in [StrictMarkdownHTMLParser] rather than used alone.
+	StrictMarkdown bool
 }
 
 // TaggedString is a string that also contains a HTML tag.
@@ -217,9 +256,76 @@ func (parser *HTMLParser) listToString(node *html.Node, ctx Context) string {
 		str = strings.Join(parts, "\n")
 		children = append(children, str)
 	}
+	if parser.StrictMarkdown && parser.isLooseList(node) {
+		return strings.Join(children, "\n\n")
+	}
 	return strings.Join(children, "\n")
 }
 
+// isLooseList checks if any item in the given list contains a paragraph.
+// Markdown renderers only wrap list items in paragraphs if the items are separated by blank lines.
+func (parser *HTMLParser) isLooseList(node *html.Node) bool {
+	for item := node.FirstChild; item != nil; item = item.NextSibling {
+		if item.Type != html.ElementNode || item.Data != "li" {
+			continue
+		}
+		for child := item.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == html.ElementNode && child.Data == "p" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (parser *HTMLParser) tableToString(node *html.Node, ctx Context) string {
+	var header []string
+	var rows [][]string
+	var collectRows func(node *html.Node, inHeader bool)
+	collectRows = func(node *html.Node, inHeader bool) {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			switch child.Data {
+			case "thead":
+				collectRows(child, true)
+			case "tbody", "tfoot":
+				collectRows(child, false)
+			case "tr":
+				var cells []string
+				allHeaders := true
+				for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type != html.ElementNode || (cell.Data != "td" && cell.Data != "th") {
+						continue
+					}
+					allHeaders = allHeaders && cell.Data == "th"
+					cells = append(cells, parser.nodeToTagAwareString(cell.FirstChild, ctx.WithTag(cell.Data)))
+				}
+				if header == nil && len(rows) == 0 && (inHeader || allHeaders) {
+					header = cells
+				} else {
+					rows = append(rows, cells)
+				}
+			}
+		}
+	}
+	collectRows(node, false)
+	if header == nil && len(rows) > 0 {
+		// Markdown tables always have a header row, so use the first row if there wasn't one
+		header, rows = rows[0], rows[1:]
+	}
+	return parser.TableConverter(header, rows, ctx)
+}
+
+func (parser *HTMLParser) wrapFormatting(str, marker string) string {
+	if parser.StrictMarkdown && str == "" {
+		// Empty emphasis would be parsed as literal asterisks or even a horizontal line
+		return ""
+	}
+	return fmt.Sprintf("%s%s%s", marker, str, marker)
+}
+
 func (parser *HTMLParser) basicFormatToString(node *html.Node, ctx Context) string {
 	str := parser.nodeToTagAwareString(node.FirstChild, ctx)
 	switch node.Data {
@@ -227,17 +333,17 @@ func (parser *HTMLParser) basicFormatToString(node *html.Node, ctx Context) stri
 		if parser.BoldConverter != nil {
 			return parser.BoldConverter(str, ctx)
 		}
-		return fmt.Sprintf("**%s**", str)
+		return parser.wrapFormatting(str, "**")
 	case "i", "em":
 		if parser.ItalicConverter != nil {
 			return parser.ItalicConverter(str, ctx)
 		}
-		return fmt.Sprintf("_%s_", str)
+		return parser.wrapFormatting(str, "_")
 	case "s", "del", "strike":
 		if parser.StrikethroughConverter != nil {
 			return parser.StrikethroughConverter(str, ctx)
 		}
-		return fmt.Sprintf("~~%s~~", str)
+		return parser.wrapFormatting(str, "~~")
 	case "u", "ins":
 		if parser.UnderlineConverter != nil {
 			return parser.UnderlineConverter(str, ctx)
@@ -364,6 +470,16 @@ func (parser *HTMLParser) tagToString(node *html.Node, ctx Context) string {
 		return parser.imgToString(node, ctx)
 	case "hr":
 		return parser.HorizontalLine
+	case "table":
+		if parser.TableConverter != nil {
+			return parser.tableToString(node, ctx)
+		}
+		return parser.nodeToTagAwareString(node.FirstChild, ctx)
+	case "mx-reply":
+		if parser.StrictMarkdown {
+			return ""
+		}
+		return parser.nodeToTagAwareString(node.FirstChild, ctx)
 	case "input":
 		return parser.inputToString(node, ctx)
 	case "pre":
@@ -403,6 +519,9 @@ func (parser *HTMLParser) singleNodeToString(node *html.Node, ctx Context) Tagge
 		if !ctx.PreserveWhitespace {
 			node.Data = exstrings.CollapseSpaces(strings.ReplaceAll(node.Data, "\n", ""))
 		}
+		if parser.StrictMarkdown && !ctx.TagStack.Has("code") && !ctx.TagStack.Has("pre") {
+			node.Data = escapeMarkdownText(node.Data, parser.isAtLineStart(node))
+		}
 		if parser.TextConverter != nil {
 			node.Data = parser.TextConverter(node.Data, ctx)
 		}
@@ -416,6 +535,29 @@ func (parser *HTMLParser) singleNodeToString(node *html.Node, ctx Context) Tagge
 	}
 }
 
+var markdownEscapeRegex = regexp.MustCompile("([\\\\`*_[\\]~|$<])")
+var markdownEntityRegex = regexp.MustCompile(`&(#?[0-9A-Za-z]+;)`)
+var markdownBlockStartRegex = regexp.MustCompile(`^(\s*)([#>+=-])`)
+var markdownOrderedListStartRegex = regexp.MustCompile(`^(\s*\d{1,9})([.)])`)
+
+func escapeMarkdownText(text string, atLineStart bool) string {
+	text = markdownEscapeRegex.ReplaceAllString(text, "\\$1")
+	text = markdownEntityRegex.ReplaceAllString(text, "\\&$1")
+	if atLineStart {
+		text = markdownBlockStartRegex.ReplaceAllString(text, "$1\\$2")
+		text = markdownOrderedListStartRegex.ReplaceAllString(text, "$1\\$2")
+	}
+	return text
+}
+
+func (parser *HTMLParser) isAtLineStart(node *html.Node) bool {
+	prev := node.PrevSibling
+	for prev != nil && prev.Type == html.TextNode && strings.TrimSpace(prev.Data) == "" {
+		prev = prev.PrevSibling
+	}
+	return prev == nil || (prev.Type == html.ElementNode && (prev.Data == "br" || parser.isBlockTag(prev.Data)))
+}
+
 func (parser *HTMLParser) nodeToTaggedStrings(node *html.Node, ctx Context) (strs []TaggedString) {
 	for ; node != nil; node = node.NextSibling {
 		strs = append(strs, parser.singleNodeToString(node, ctx))
@@ -496,6 +638,66 @@ var MarkdownHTMLParser = &HTMLParser{
 	},
 }
 
+// StrictMarkdownHTMLParser is a parser that outputs markdown which renders back into equivalent HTML
+// when using the goldmark extensions in [Extensions] along with [mdext.Math] and [mdext.CustomEmoji].
+var StrictMarkdownHTMLParser = &HTMLParser{
+	TabsToSpaces:   4,
+	Newline:        "\n",
+	HorizontalLine: "\n---\n",
+	StrictMarkdown: true,
+	LinkConverter:  strictMarkdownLinkConverter,
+	TableConverter: MarkdownTableConverter,
+	ImageConverter: func(src, alt, title, width, height string, isEmoji bool) string {
+		if isEmoji {
+			title = "Emoji: " + title
+		}
+		alt = markdownEscapeRegex.ReplaceAllString(alt, "\\$1")
+		if title != "" {
+			return fmt.Sprintf(`![%s](%s "%s")`, alt, markdownLinkDestination(src), strings.ReplaceAll(title, `"`, `\"`))
+		}
+		return fmt.Sprintf("![%s](%s)", alt, markdownLinkDestination(src))
+	},
+	MathConverter: func(s string, c Context) string {
+		return fmt.Sprintf("$%s$", s)
+	},
+	MathBlockConverter: func(s string, c Context) string {
+		return fmt.Sprintf("$$\n%s\n$$", s)
+	},
+	UnderlineConverter: func(s string, c Context) string {
+		return fmt.Sprintf("<u>%s</u>", s)
+	},
+	ColorConverter: func(text, fg, bg string, ctx Context) string {
+		var attrs strings.Builder
+		if fg != "" {
+			_, _ = fmt.Fprintf(&attrs, ` data-mx-color="%s"`, html.EscapeString(fg))
+		}
+		if bg != "" {
+			_, _ = fmt.Fprintf(&attrs, ` data-mx-bg-color="%s"`, html.EscapeString(bg))
+		}
+		return fmt.Sprintf("<span%s>%s</span>", attrs.String(), text)
+	},
+}
+
+func markdownLinkDestination(href string) string {
+	if strings.ContainsAny(href, " ()<>\\") {
+		return "<" + strings.NewReplacer(`\`, `\\`, "<", `\<`, ">", `\>`).Replace(href) + ">"
+	}
+	return href
+}
+
+var autolinkRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^\s<>]*$`)
+
+func strictMarkdownLinkConverter(text, href string, ctx Context) string {
+	parsedMatrix, err := id.ParseMatrixURIOrMatrixToURL(href)
+	if err == nil && parsedMatrix != nil && parsedMatrix.Sigil1 == '@' {
+		ctx.Mentions().Add(parsedMatrix.UserID())
+	}
+	if text == href && autolinkRegex.MatchString(href) {
+		return fmt.Sprintf("<%s>", href)
+	}
+	return fmt.Sprintf("[%s](%s)", text, markdownLinkDestination(href))
+}
+
 // HTMLToText converts Matrix HTML into text with the default settings.
 func HTMLToText(html string) string {
 	return (&HTMLParser{
@@ -520,7 +722,17 @@ func HTMLToMarkdownFull(parser *HTMLParser, html string) (parsed string, mention
 // HTMLToMarkdown converts Matrix HTML into markdown with the default settings.
 //
 // Currently, the only difference to HTMLToText is how links are formatted.
+// Use [HTMLToStrictMarkdown] if the output will be parsed as markdown again.
 func HTMLToMarkdown(html string) string {
 	parsed, _ := HTMLToMarkdownFull(nil, html)
 	return parsed
 }
+
+// HTMLToStrictMarkdown converts Matrix HTML into markdown using [StrictMarkdownHTMLParser].
+//
+// Rendering the output with the same extensions as [RenderMarkdown] plus [mdext.Math] and [mdext.CustomEmoji]
+// produces HTML equivalent to the input, which makes it suitable for bridging to markdown-based networks.
+func HTMLToStrictMarkdown(html string) string {
+	parsed, _ := HTMLToMarkdownFull(StrictMarkdownHTMLParser, html)
+	return parsed
+}
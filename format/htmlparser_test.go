@@ -0,0 +1,86 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuin/goldmark"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/format/mdext"
+	"maunium.net/go/mautrix/id"
+)
+
+var roundTripRenderer = goldmark.New(format.Extensions, format.HTMLOptions, goldmark.WithExtensions(mdext.Math, mdext.CustomEmoji))
+
+func renderRoundTrip(markdown string) string {
+	return format.SanitizeHTML(format.UnwrapSingleParagraph(render(roundTripRenderer, markdown)))
+}
+
+var roundTripTests = []string{
+	"hello world",
+	"**bold** _italic_ ~~strike~~ `code` <u>underline</u>",
+	"***bold italic*** and **bold _nested_ italic**",
+	"line 1\nline 2",
+	"paragraph 1\n\nparagraph 2",
+	"# heading\n\n### smaller heading",
+	"> quote\n> > nested quote\n\nafter",
+	"* item 1\n* item 2\n  * nested 1\n  * nested 2\n    1. deep\n    2. deeper\n* item 3",
+	"3. three\n4. four\n5. five",
+	"* loose 1\n\n* loose 2\n\n  with paragraph",
+	"1. first\n   ```go\n   code\n   ```\n2. second",
+	"```python\nprint(\"**not bold**\")\n```",
+	"``code with ` backtick``",
+	"[link](https://example.com) and <https://example.com/autolink>",
+	"[weird link](<https://example.com/a b(c)>)",
+	"[mention](https://matrix.to/#/@user:example.com) and [room](https://matrix.to/#/#room:example.com)",
+	"![image](mxc://example.com/image \"title\") and ![:emoji:](mxc://example.com/emoji \"Emoji: emoji\")",
+	"||spoiler|| and ||reason|spoiler with reason|| and ||**bold** spoiler||",
+	"inline $x^2$ math\n\n$$\n\\sum_{i=0}^n i\n$$",
+	"| a | b |\n| --- | --- |\n| 1 | **2** |\n| \\| | `x` |",
+	"text\n\n---\n\nmore text",
+	"<span data-mx-color=\"#ff0000\">red</span> text",
+	"special characters: \\* \\_ \\` \\[x\\] \\~ \\| \\$5 \\< &amp;amp; \\\\",
+	"\\# not a heading\n\n\\- not a list\n\n1\\. not a list either\n\n\\> not a quote",
+	"text with trailing **bold **and* spaced italic *words",
+}
+
+func TestHTMLToStrictMarkdown_RoundTrip(t *testing.T) {
+	for _, markdown := range roundTripTests {
+		original := renderRoundTrip(markdown)
+		converted := format.HTMLToStrictMarkdown(original)
+		assert.Equal(t, original, renderRoundTrip(converted), "with input %q converted to %q", markdown, converted)
+		// The converted markdown should also be stable
+		assert.Equal(t, converted, format.HTMLToStrictMarkdown(renderRoundTrip(converted)), "with input %q", markdown)
+	}
+}
+
+var strictMarkdownTests = map[string]string{
+	`<mx-reply><blockquote>In reply to <a href="https://matrix.to/#/@user:example.com">user</a></blockquote></mx-reply>hello`: "hello",
+	`<table><tr><td>a</td><td>b</td></tr><tr><td>c</td></tr></table>`:                                                         "| a | b |\n| --- | --- |\n| c |  |",
+	`<table><thead><tr><th>h</th></tr></thead><tbody><tr><td>line<br>break</td></tr></tbody></table>`:                         "| h |\n| --- |\n| line<br>break |",
+	`<p>1. not a list</p>`:                          `1\. not a list`,
+	`<b> spaced </b>`:                               `**spaced**`,
+	`<b></b>empty`:                                  `empty`,
+	`<span data-mx-spoiler="why">||</span>`:         `||why|\|\|||`,
+	`<span data-mx-maths="5 or 10">5 or 10</span>$`: `$5 or 10$\$`,
+}
+
+func TestHTMLToStrictMarkdown(t *testing.T) {
+	for html, markdown := range strictMarkdownTests {
+		assert.Equal(t, markdown, format.HTMLToStrictMarkdown(html), "with input %q", html)
+	}
+}
+
+func TestHTMLToStrictMarkdown_Mentions(t *testing.T) {
+	parsed, mentions := format.HTMLToMarkdownFull(format.StrictMarkdownHTMLParser, `hi <a href="https://matrix.to/#/@user:example.com">user</a>`)
+	assert.Equal(t, "hi [user](https://matrix.to/#/@user:example.com)", parsed)
+	assert.Equal(t, &event.Mentions{UserIDs: []id.UserID{"@user:example.com"}}, mentions)
+}
@@ -91,14 +91,17 @@ func SafeMarkdownCode[T ~string](textInput T) string {
 	return fmt.Sprintf("%s%s%s", quotes, text, quotes)
 }
 
-func RenderMarkdownCustom(text string, renderer goldmark.Markdown) event.MessageEventContent {
+func renderMarkdownToHTML(text string, renderer goldmark.Markdown) string {
 	var buf strings.Builder
 	err := renderer.Convert([]byte(text), &buf)
 	if err != nil {
 		panic(fmt.Errorf("markdown parser errored: %w", err))
 	}
-	htmlBody := UnwrapSingleParagraph(buf.String())
-	return HTMLToContent(htmlBody)
+	return UnwrapSingleParagraph(buf.String())
+}
+
+func RenderMarkdownCustom(text string, renderer goldmark.Markdown) event.MessageEventContent {
+	return HTMLToContent(renderMarkdownToHTML(text, renderer))
 }
 
 func TextToContent(text string) event.MessageEventContent {
@@ -127,6 +130,8 @@ func HTMLToContent(html string) event.MessageEventContent {
 	return HTMLToContentFull(nil, html)
 }
 
+// RenderMarkdown renders the given text into message content. If either markdown or HTML is allowed,
+// the resulting HTML is passed through [SanitizeHTML] to remove tags and attributes not allowed by the spec.
 func RenderMarkdown(text string, allowMarkdown, allowHTML bool) event.MessageEventContent {
 	var htmlBody string
 
@@ -135,10 +140,11 @@ func RenderMarkdown(text string, allowMarkdown, allowHTML bool) event.MessageEve
 		if !allowHTML {
 			rndr = noHTML
 		}
-		return RenderMarkdownCustom(text, rndr)
+		// Links are rendered unsafely even when HTML is not allowed, so the output is always sanitized
+		return HTMLToContent(SanitizeHTML(renderMarkdownToHTML(text, rndr)))
 	} else if allowHTML {
 		htmlBody = strings.Replace(text, "\n", "<br>", -1)
-		return HTMLToContent(htmlBody)
+		return HTMLToContent(SanitizeHTML(htmlBody))
 	} else {
 		return TextToContent(text)
 	}
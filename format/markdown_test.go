@@ -7,6 +7,7 @@
 package format_test
 
 import (
+	"context"
 	"strings"
 	"testing"
 
@@ -211,3 +212,51 @@ func TestSafeMarkdownCode(t *testing.T) {
 		assert.Equal(t, expected, format.SafeMarkdownCode(input), "with input %q", input)
 	}
 }
+
+type fakeMemberGetter map[id.UserID]*event.MemberEventContent
+
+func (fmg fakeMemberGetter) GetAllMembers(_ context.Context, _ id.RoomID) (map[id.UserID]*event.MemberEventContent, error) {
+	return fmg, nil
+}
+
+var mentionMembers = fakeMemberGetter{
+	"@alice:example.com":   {Membership: event.MembershipJoin, Displayname: "Alice"},
+	"@smith:example.com":   {Membership: event.MembershipJoin, Displayname: "Alice Smith"},
+	"@bob:example.com":     {Membership: event.MembershipJoin, Displayname: "Bob"},
+	"@bob:example.org":     {Membership: event.MembershipJoin, Displayname: "Robert"},
+	"@carol:example.com":   {Membership: event.MembershipJoin},
+	"@dave:example.com":    {Membership: event.MembershipJoin, Displayname: "Twin"},
+	"@eve:example.com":     {Membership: event.MembershipJoin, Displayname: "Twin"},
+	"@mallory:example.com": {Membership: event.MembershipLeave, Displayname: "Mallory"},
+}
+
+var mentionTests = map[string]string{
+	"hi @Alice":                `hi <a href="https://matrix.to/#/@alice:example.com">Alice</a>`,
+	"hi @alice smith!":         `hi <a href="https://matrix.to/#/@smith:example.com">Alice Smith</a>!`,
+	"@Alice: hello":            `<a href="https://matrix.to/#/@alice:example.com">Alice</a>: hello`,
+	"ping @carol.":             `ping <a href="https://matrix.to/#/@carol:example.com">@carol:example.com</a>.`,
+	"ping @robert":             `ping <a href="https://matrix.to/#/@bob:example.org">Robert</a>`,
+	"ping @bob:example.org":    `ping <a href="https://matrix.to/#/@bob:example.org">Robert</a>`,
+	"ping @alice:example.org":  `ping @alice:example.org`,
+	"ambiguous @bob and @twin": `ambiguous <a href="https://matrix.to/#/@bob:example.com">Bob</a> and @twin`,
+	"left @mallory":            `left @mallory`,
+	"unknown @nobody":          `unknown @nobody`,
+	"prefix @Alicex":           `prefix @Alicex`,
+	"email alice@example.com":  `email alice@example.com`,
+	"code `@alice`":            `code <code>@alice</code>`,
+	"[link @alice](https://x)": `<a href="https://x">link Alice</a>`,
+}
+
+func TestRenderMarkdown_MentionResolver(t *testing.T) {
+	renderer := goldmark.New(format.Extensions, format.HTMLOptions, goldmark.WithExtensions(
+		mdext.NewMentionResolver(context.Background(), mentionMembers, "!room:example.com"),
+	))
+	for markdown, html := range mentionTests {
+		rendered := format.UnwrapSingleParagraph(render(renderer, markdown))
+		assert.Equal(t, html, rendered, "with input %q", markdown)
+	}
+
+	content := format.RenderMarkdownCustom("@alice and @bob:example.org", renderer)
+	assert.Equal(t, "Alice and Robert", content.Body)
+	assert.ElementsMatch(t, []id.UserID{"@alice:example.com", "@bob:example.org"}, content.Mentions.UserIDs)
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mdext
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	stdhtml "html"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomMemberGetter is the subset of the mautrix.StateStore interface that is needed for resolving mentions.
+type RoomMemberGetter interface {
+	GetAllMembers(ctx context.Context, roomID id.RoomID) (map[id.UserID]*event.MemberEventContent, error)
+}
+
+type extMentionResolver struct {
+	parser *mentionParser
+}
+
+// NewMentionResolver returns an extension that converts @displayname and @localpart mentions of joined
+// room members into matrix.to links. Full user IDs are also converted if the user is in the room.
+//
+// The room members are fetched from the store once per rendered message. Tokens that don't match exactly
+// one member are left as plain text. When rendering with format.RenderMarkdownCustom, the resolved
+// mentions are also included in m.mentions.
+func NewMentionResolver(ctx context.Context, store RoomMemberGetter, roomID id.RoomID) goldmark.Extender {
+	return &extMentionResolver{parser: &mentionParser{ctx: ctx, store: store, roomID: roomID}}
+}
+
+func (emr *extMentionResolver) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(
+		util.Prioritized(emr.parser, 500),
+	), parser.WithASTTransformers(
+		util.Prioritized(emr.parser, 500),
+	))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(defaultMentionRenderer, 500),
+	))
+}
+
+var astKindMention = ast.NewNodeKind("Mention")
+
+type astMention struct {
+	ast.BaseInline
+	userID id.UserID
+	name   string
+}
+
+func (n *astMention) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"UserID": n.userID.String()}, nil)
+}
+
+func (n *astMention) Kind() ast.NodeKind {
+	return astKindMention
+}
+
+type mentionCandidate struct {
+	userID      id.UserID
+	localpart   string
+	displayname string
+}
+
+func (mc *mentionCandidate) name() string {
+	if mc.displayname != "" {
+		return mc.displayname
+	}
+	return mc.userID.String()
+}
+
+type mentionParser struct {
+	ctx    context.Context
+	store  RoomMemberGetter
+	roomID id.RoomID
+}
+
+var (
+	mentionCandidatesKey = parser.NewContextKey()
+	mentionNodesKey      = parser.NewContextKey()
+)
+
+func (mp *mentionParser) Trigger() []byte {
+	return []byte{'@'}
+}
+
+func (mp *mentionParser) getCandidates(pc parser.Context) []*mentionCandidate {
+	if candidates, ok := pc.Get(mentionCandidatesKey).([]*mentionCandidate); ok {
+		return candidates
+	}
+	members, err := mp.store.GetAllMembers(mp.ctx, mp.roomID)
+	if err != nil {
+		zerolog.Ctx(mp.ctx).Err(err).Stringer("room_id", mp.roomID).Msg("Failed to get room members to resolve mentions")
+	}
+	candidates := make([]*mentionCandidate, 0, len(members))
+	for userID, member := range members {
+		if member == nil || member.Membership != event.MembershipJoin {
+			continue
+		}
+		candidates = append(candidates, &mentionCandidate{
+			userID:      userID,
+			localpart:   strings.ToLower(userID.Localpart()),
+			displayname: strings.TrimSpace(member.Displayname),
+		})
+	}
+	// Prefer the longest matching displayname, so that e.g. "@Alice Smith" isn't resolved as "@Alice"
+	slices.SortFunc(candidates, func(a, b *mentionCandidate) int {
+		return cmp.Or(cmp.Compare(len(b.displayname), len(a.displayname)), cmp.Compare(a.userID, b.userID))
+	})
+	pc.Set(mentionCandidatesKey, candidates)
+	return candidates
+}
+
+func isMentionWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+func isMentionBoundary(rest []byte) bool {
+	r, _ := utf8.DecodeRune(rest)
+	return len(rest) == 0 || !isMentionWordChar(r)
+}
+
+var mentionUserIDRegex = regexp.MustCompile(`^@[^\s:@]+:[a-zA-Z0-9.-]+(?::[0-9]+)?`)
+var mentionLocalpartRegex = regexp.MustCompile(`^@([a-zA-Z0-9._=/+-]+)`)
+
+func findMentionCandidate(line []byte, candidates []*mentionCandidate) (*mentionCandidate, int) {
+	if match := mentionUserIDRegex.Find(line); match != nil {
+		// Allow sentences to end with a mention
+		match = bytes.TrimRight(match, ".")
+		for _, cand := range candidates {
+			if string(cand.userID) == string(match) {
+				return cand, len(match)
+			}
+		}
+		// Don't fall back to matching the localpart, it might belong to a different user
+		return nil, 0
+	}
+	var found *mentionCandidate
+	var foundLength int
+	for _, cand := range candidates {
+		nameLen := len(cand.displayname)
+		if nameLen == 0 || len(line) < nameLen+1 || (found != nil && nameLen < foundLength-1) {
+			continue
+		} else if !strings.EqualFold(string(line[1:nameLen+1]), cand.displayname) || !isMentionBoundary(line[nameLen+1:]) {
+			continue
+		} else if found != nil {
+			// Multiple members have the same displayname, so it's ambiguous
+			found = nil
+			break
+		}
+		found, foundLength = cand, nameLen+1
+	}
+	if found != nil {
+		return found, foundLength
+	}
+	match := mentionLocalpartRegex.FindSubmatch(line)
+	if match == nil {
+		return nil, 0
+	}
+	localpart := strings.ToLower(strings.TrimRight(string(match[1]), "."))
+	if localpart == "" || !isMentionBoundary(line[len(localpart)+1:]) {
+		return nil, 0
+	}
+	for _, cand := range candidates {
+		if cand.localpart != localpart {
+			continue
+		} else if found != nil {
+			// Multiple members on different servers have the same localpart
+			return nil, 0
+		}
+		found = cand
+	}
+	if found == nil {
+		return nil, 0
+	}
+	return found, len(localpart) + 1
+}
+
+func (mp *mentionParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	// Don't match email addresses or other text where the @ is in the middle of a word
+	if before := block.PrecendingCharacter(); isMentionWordChar(before) || before == '.' {
+		return nil
+	}
+	line, _ := block.PeekLine()
+	cand, length := findMentionCandidate(line, mp.getCandidates(pc))
+	if cand == nil {
+		return nil
+	}
+	block.Advance(length)
+	mention := &astMention{userID: cand.userID, name: cand.name()}
+	mentions, _ := pc.Get(mentionNodesKey).([]*astMention)
+	pc.Set(mentionNodesKey, append(mentions, mention))
+	return mention
+}
+
+// Transform replaces mentions inside links with plain text, as links can't be nested.
+func (mp *mentionParser) Transform(_ *ast.Document, _ text.Reader, pc parser.Context) {
+	mentions, _ := pc.Get(mentionNodesKey).([]*astMention)
+	for _, mention := range mentions {
+		for parent := mention.Parent(); parent != nil; parent = parent.Parent() {
+			if parent.Kind() == ast.KindLink {
+				mention.Parent().ReplaceChild(mention.Parent(), mention, ast.NewString([]byte(mention.name)))
+				break
+			}
+		}
+	}
+}
+
+type mentionRenderer struct{}
+
+var defaultMentionRenderer = &mentionRenderer{}
+
+func (mr *mentionRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(astKindMention, mr.renderMention)
+}
+
+func (mr *mentionRenderer) renderMention(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		mention := n.(*astMention)
+		_, _ = fmt.Fprintf(w, `<a href="%s">%s</a>`, stdhtml.EscapeString(mention.userID.URI().MatrixToURL()), stdhtml.EscapeString(mention.name))
+	}
+	return ast.WalkSkipChildren, nil
+}
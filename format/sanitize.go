@@ -0,0 +1,168 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLSanitizer removes tags and attributes that aren't allowed in Matrix formatted bodies.
+//
+// Disallowed tags are unwrapped (i.e. their contents are kept), except for tags like <script> and <style>
+// whose contents are removed entirely. Disallowed attributes are dropped.
+type HTMLSanitizer struct {
+	// AllowedTags maps allowed tag names to the attributes allowed on that tag.
+	AllowedTags map[string][]string
+	// DroppedTags are tags whose contents are removed along with the tag itself.
+	DroppedTags []string
+	// AllowedSchemes are the URL schemes allowed in the href attribute of links.
+	AllowedSchemes []string
+	// MaxDepth is the maximum tag nesting depth. Tags nested deeper than this are unwrapped.
+	MaxDepth int
+}
+
+// DefaultHTMLSanitizer contains the tags and attributes recommended by the spec.
+// See https://spec.matrix.org/v1.16/client-server-api/#mroommessage-msgtypes
+var DefaultHTMLSanitizer = &HTMLSanitizer{
+	AllowedTags: map[string][]string{
+		"del": nil, "s": nil, "h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+		"blockquote": nil, "p": nil, "ul": nil, "li": nil, "sup": nil, "sub": nil, "b": nil, "i": nil,
+		"u": nil, "strong": nil, "em": nil, "hr": nil, "br": nil, "table": nil, "thead": nil, "tbody": nil,
+		"tr": nil, "th": nil, "td": nil, "caption": nil, "pre": nil, "details": nil, "summary": nil,
+		"mx-reply": nil,
+
+		"a":    {"target", "href"},
+		"ol":   {"start"},
+		"code": {"class"},
+		"div":  {"data-mx-maths"},
+		"font": {"data-mx-bg-color", "data-mx-color", "color"},
+		"span": {"data-mx-bg-color", "data-mx-color", "data-mx-spoiler", "data-mx-maths"},
+		"img":  {"width", "height", "alt", "title", "src", "data-mx-emoticon"},
+	},
+	DroppedTags:    []string{"script", "style", "head", "title", "iframe", "object", "embed", "noscript", "template", "textarea", "select"},
+	AllowedSchemes: []string{"https", "http", "ftp", "mailto", "magnet", "matrix"},
+	MaxDepth:       100,
+}
+
+// SanitizeHTML sanitizes the given HTML using [DefaultHTMLSanitizer].
+func SanitizeHTML(input string) string {
+	return DefaultHTMLSanitizer.Sanitize(input)
+}
+
+var colorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+var schemeRegex = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*):`)
+
+var bodyContext = &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+
+// Sanitize returns a sanitized version of the given HTML.
+func (hs *HTMLSanitizer) Sanitize(input string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(input), bodyContext)
+	if err != nil {
+		// The parser only returns errors from the reader, which can't fail here
+		return html.EscapeString(input)
+	}
+	var buf strings.Builder
+	for _, node := range nodes {
+		hs.writeNode(&buf, node, 0)
+	}
+	return buf.String()
+}
+
+func (hs *HTMLSanitizer) isAttributeValueAllowed(tag, key, value string) bool {
+	switch key {
+	case "href":
+		match := schemeRegex.FindStringSubmatch(value)
+		// Relative links don't make sense in Matrix, so a scheme is always required
+		return match != nil && slices.Contains(hs.AllowedSchemes, strings.ToLower(match[1]))
+	case "src":
+		return tag == "img" && strings.HasPrefix(value, "mxc://")
+	case "color", "data-mx-color", "data-mx-bg-color":
+		return colorRegex.MatchString(value)
+	case "class":
+		return tag == "code" && strings.HasPrefix(value, "language-") && !strings.ContainsAny(value, " \t\n")
+	case "target":
+		return value == "_blank"
+	default:
+		return true
+	}
+}
+
+func (hs *HTMLSanitizer) writeNode(buf *strings.Builder, node *html.Node, depth int) {
+	switch node.Type {
+	case html.TextNode:
+		buf.WriteString(escapeHTMLText(node.Data))
+	case html.ElementNode:
+		allowedAttrs, isAllowed := hs.AllowedTags[node.Data]
+		if slices.Contains(hs.DroppedTags, node.Data) {
+			return
+		} else if node.Data == "img" && !slices.ContainsFunc(node.Attr, func(attr html.Attribute) bool {
+			return attr.Key == "src" && strings.HasPrefix(attr.Val, "mxc://")
+		}) {
+			// Images without a valid source are useless, so drop them entirely
+			return
+		}
+		if !isAllowed || (hs.MaxDepth > 0 && depth >= hs.MaxDepth) {
+			hs.writeChildren(buf, node, depth)
+			return
+		}
+		buf.WriteByte('<')
+		buf.WriteString(node.Data)
+		for _, attr := range node.Attr {
+			if attr.Namespace != "" || !slices.Contains(allowedAttrs, attr.Key) || !hs.isAttributeValueAllowed(node.Data, attr.Key, attr.Val) {
+				continue
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(attr.Key)
+			if attr.Val != "" {
+				buf.WriteString(`="`)
+				buf.WriteString(escapeHTMLAttribute(attr.Val))
+				buf.WriteByte('"')
+			}
+		}
+		buf.WriteByte('>')
+		if isVoidElement(node.Data) {
+			return
+		}
+		hs.writeChildren(buf, node, depth+1)
+		buf.WriteString("</")
+		buf.WriteString(node.Data)
+		buf.WriteByte('>')
+	case html.DocumentNode:
+		hs.writeChildren(buf, node, depth)
+	}
+}
+
+func (hs *HTMLSanitizer) writeChildren(buf *strings.Builder, node *html.Node, depth int) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		hs.writeNode(buf, child, depth)
+	}
+}
+
+func isVoidElement(tag string) bool {
+	switch tag {
+	case "br", "hr", "img":
+		return true
+	default:
+		return false
+	}
+}
+
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+var attributeEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+func escapeHTMLText(text string) string {
+	return textEscaper.Replace(text)
+}
+
+func escapeHTMLAttribute(text string) string {
+	return attributeEscaper.Replace(text)
+}
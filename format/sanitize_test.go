@@ -0,0 +1,56 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package format_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/format"
+)
+
+var sanitizeTests = map[string]string{
+	"plain <b>bold</b> & text":                                 "plain <b>bold</b> &amp; text",
+	`<script>alert(1)</script>hello`:                           "hello",
+	`<marquee>hello <i>world</i></marquee>`:                    "hello <i>world</i>",
+	`<a href="javascript:alert(1)">link</a>`:                   "<a>link</a>",
+	`<a href="https://example.com" onclick="x()">link</a>`:     `<a href="https://example.com">link</a>`,
+	`<a href="matrix:u/user:example.com">mention</a>`:          `<a href="matrix:u/user:example.com">mention</a>`,
+	`<img src="https://example.com/cat.png" alt="cat">`:        "",
+	`<img src="mxc://example.com/cat" alt="cat" onerror="x">`:  `<img src="mxc://example.com/cat" alt="cat">`,
+	`<span data-mx-spoiler>secret</span>`:                      "<span data-mx-spoiler>secret</span>",
+	`<font color="#ff0000" style="x">red</font>`:               `<font color="#ff0000">red</font>`,
+	`<font data-mx-color="red">red</font>`:                     "<font>red</font>",
+	`<pre><code class="language-go">x := "y"</code></pre>`:     `<pre><code class="language-go">x := "y"</code></pre>`,
+	`<code class="evil language-go">x</code>`:                  "<code>x</code>",
+	`<p title="&quot;quoted&quot;">text</p>`:                   "<p>text</p>",
+	`<mx-reply><blockquote>quote</blockquote></mx-reply>reply`: "<mx-reply><blockquote>quote</blockquote></mx-reply>reply",
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	for input, expected := range sanitizeTests {
+		t.Run(input, func(t *testing.T) {
+			assert.Equal(t, expected, format.SanitizeHTML(input))
+		})
+	}
+}
+
+func TestSanitizeHTML_MaxDepth(t *testing.T) {
+	sanitizer := *format.DefaultHTMLSanitizer
+	sanitizer.MaxDepth = 3
+	input := strings.Repeat("<b>", 5) + "deep" + strings.Repeat("</b>", 5)
+	assert.Equal(t, "<b><b><b>deep</b></b></b>", sanitizer.Sanitize(input))
+}
+
+func TestRenderMarkdown_Sanitize(t *testing.T) {
+	content := format.RenderMarkdown(`[click](javascript:alert(1)) <iframe src="x"></iframe>`, true, true)
+	assert.Equal(t, "<a>click</a> ", content.FormattedBody)
+	content = format.RenderMarkdown(`<b onclick="x()">hi</b>`, false, true)
+	assert.Equal(t, "<b>hi</b>", content.FormattedBody)
+}
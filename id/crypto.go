@@ -217,6 +217,8 @@ const (
 	SecretXSSelfSigning  Secret = "m.cross_signing.self_signing"
 	SecretXSUserSigning  Secret = "m.cross_signing.user_signing"
 	SecretMegolmBackupV1 Secret = "m.megolm_backup.v1"
+	// SecretDehydratedDevice is the key used to encrypt dehydrated devices (MSC3814).
+	SecretDehydratedDevice Secret = "org.matrix.msc3814"
 )
 
 // VerificationTransactionID is a unique identifier for a verification
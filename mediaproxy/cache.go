@@ -0,0 +1,394 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mediaproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// MediaCache is a size-bounded on-disk cache for media and generated thumbnails.
+//
+// Each entry is stored as a single file named after the hash of the cache key. The file contains the media
+// data followed by the content type and a 2-byte length of the content type. When the total size of the
+// cache exceeds MaxSize, the least recently used entries are deleted.
+type MediaCache struct {
+	Dir     string
+	MaxSize int64
+
+	lock       sync.Mutex
+	entries    map[string]*cacheEntry
+	totalSize  int64
+	fetchLocks map[string]*fetchLock
+}
+
+type cacheEntry struct {
+	size       int64
+	lastAccess time.Time
+}
+
+type fetchLock struct {
+	sync.Mutex
+	users int
+}
+
+const cacheTempFilePrefix = ".tmp-"
+
+// NewMediaCache creates a media cache in the given directory, creating the directory if it doesn't exist.
+// Existing entries in the directory are reused.
+func NewMediaCache(dir string, maxSize int64) (*MediaCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	mc := &MediaCache{
+		Dir:        dir,
+		MaxSize:    maxSize,
+		entries:    make(map[string]*cacheEntry),
+		fetchLocks: make(map[string]*fetchLock),
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), cacheTempFilePrefix) {
+			// Leftover from an interrupted write
+			_ = os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		} else if len(file.Name()) != sha256.Size*2 || !file.Type().IsRegular() {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		mc.entries[file.Name()] = &cacheEntry{size: info.Size(), lastAccess: info.ModTime()}
+		mc.totalSize += info.Size()
+	}
+	mc.lock.Lock()
+	mc.evict()
+	mc.lock.Unlock()
+	return mc, nil
+}
+
+func hashCacheKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// lockKey prevents the same media from being fetched multiple times concurrently.
+func (mc *MediaCache) lockKey(key string) (unlock func()) {
+	mc.lock.Lock()
+	fl, ok := mc.fetchLocks[key]
+	if !ok {
+		fl = &fetchLock{}
+		mc.fetchLocks[key] = fl
+	}
+	fl.users++
+	mc.lock.Unlock()
+	fl.Lock()
+	return func() {
+		fl.Unlock()
+		mc.lock.Lock()
+		fl.users--
+		if fl.users == 0 {
+			delete(mc.fetchLocks, key)
+		}
+		mc.lock.Unlock()
+	}
+}
+
+// Get returns the cached media with the given key, or nil if it's not cached.
+func (mc *MediaCache) Get(key string) (*cachedMediaResponse, error) {
+	hash := hashCacheKey(key)
+	mc.lock.Lock()
+	entry, ok := mc.entries[hash]
+	if ok {
+		entry.lastAccess = time.Now()
+	}
+	mc.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	path := filepath.Join(mc.Dir, hash)
+	cached, err := openCachedMedia(path, hash)
+	if errors.Is(err, os.ErrNotExist) {
+		mc.lock.Lock()
+		if mc.entries[hash] == entry {
+			delete(mc.entries, hash)
+			mc.totalSize -= entry.size
+		}
+		mc.lock.Unlock()
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// Store the access time on disk too, so that it's used for eviction after restarts
+	_ = os.Chtimes(path, time.Time{}, entry.lastAccess)
+	return cached, nil
+}
+
+// Put stores the given data in the cache and returns the stored entry.
+func (mc *MediaCache) Put(key, contentType string, data io.Reader) (*cachedMediaResponse, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	} else if len(contentType) > 1024 {
+		return nil, fmt.Errorf("content type is too long")
+	}
+	hash := hashCacheKey(key)
+	tempFile, err := os.CreateTemp(mc.Dir, cacheTempFilePrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+	size, err := io.Copy(tempFile, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write data to cache: %w", err)
+	}
+	trailer := append([]byte(contentType), 0, 0)
+	binary.BigEndian.PutUint16(trailer[len(contentType):], uint16(len(contentType)))
+	if _, err = tempFile.Write(trailer); err != nil {
+		return nil, fmt.Errorf("failed to write metadata to cache: %w", err)
+	} else if err = tempFile.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close cache file: %w", err)
+	}
+	path := filepath.Join(mc.Dir, hash)
+	if err = os.Rename(tempFile.Name(), path); err != nil {
+		return nil, fmt.Errorf("failed to move cache file: %w", err)
+	}
+	// Open the file before evicting, so that the response can be served even if the entry is evicted immediately
+	cached, err := openCachedMedia(path, hash)
+	if err != nil {
+		return nil, err
+	}
+	mc.lock.Lock()
+	if existing, ok := mc.entries[hash]; ok {
+		mc.totalSize -= existing.size
+	}
+	fileSize := size + int64(len(trailer))
+	mc.entries[hash] = &cacheEntry{size: fileSize, lastAccess: time.Now()}
+	mc.totalSize += fileSize
+	mc.evict()
+	mc.lock.Unlock()
+	return cached, nil
+}
+
+func (mc *MediaCache) evict() {
+	if mc.MaxSize <= 0 || mc.totalSize <= mc.MaxSize {
+		return
+	}
+	hashes := make([]string, 0, len(mc.entries))
+	for hash := range mc.entries {
+		hashes = append(hashes, hash)
+	}
+	slices.SortFunc(hashes, func(a, b string) int {
+		return mc.entries[a].lastAccess.Compare(mc.entries[b].lastAccess)
+	})
+	for _, hash := range hashes {
+		if mc.totalSize <= mc.MaxSize {
+			break
+		}
+		err := os.Remove(filepath.Join(mc.Dir, hash))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		mc.totalSize -= mc.entries[hash].size
+		delete(mc.entries, hash)
+	}
+}
+
+type cachedMediaResponse struct {
+	file        *os.File
+	size        int64
+	contentType string
+	etag        string
+}
+
+var _ GetMediaResponseWriter = (*cachedMediaResponse)(nil)
+
+func (*cachedMediaResponse) isGetMediaResponse() {}
+
+func openCachedMedia(path, hash string) (*cachedMediaResponse, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := readCachedMediaMeta(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to read cached media metadata: %w", err)
+	}
+	cached.etag = fmt.Sprintf(`"%s"`, hash[:32])
+	return cached, nil
+}
+
+func readCachedMediaMeta(file *os.File) (*cachedMediaResponse, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	} else if info.Size() < 2 {
+		return nil, fmt.Errorf("file is too short")
+	}
+	var lengthBuf [2]byte
+	if _, err = file.ReadAt(lengthBuf[:], info.Size()-2); err != nil {
+		return nil, err
+	}
+	contentTypeLength := int64(binary.BigEndian.Uint16(lengthBuf[:]))
+	dataSize := info.Size() - 2 - contentTypeLength
+	if dataSize < 0 {
+		return nil, fmt.Errorf("invalid content type length")
+	}
+	contentType := make([]byte, contentTypeLength)
+	if _, err = file.ReadAt(contentType, dataSize); err != nil {
+		return nil, err
+	}
+	return &cachedMediaResponse{
+		file:        file,
+		size:        dataSize,
+		contentType: string(contentType),
+	}, nil
+}
+
+func (cmr *cachedMediaResponse) content() *io.SectionReader {
+	return io.NewSectionReader(cmr.file, 0, cmr.size)
+}
+
+func (cmr *cachedMediaResponse) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, cmr.content())
+}
+
+func (cmr *cachedMediaResponse) GetContentType() string {
+	return cmr.contentType
+}
+
+func (cmr *cachedMediaResponse) GetContentLength() int64 {
+	return cmr.size
+}
+
+func (cmr *cachedMediaResponse) Close() error {
+	return cmr.file.Close()
+}
+
+func downloadCacheKey(mediaID string) string {
+	return "download:" + mediaID
+}
+
+func (mp *MediaProxy) getCachedMedia(ctx context.Context, key, mediaID string, params map[string]string) (GetMediaResponse, error) {
+	unlock := mp.Cache.lockKey(key)
+	defer unlock()
+	cached, err := mp.Cache.Get(key)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("media_id", mediaID).Msg("Failed to read media from cache")
+	} else if cached != nil {
+		return cached, nil
+	}
+	resp, err := mp.GetMedia(ctx, mediaID, params)
+	if err != nil {
+		return nil, err
+	}
+	err = mp.readMediaResponse(ctx, resp, func(data io.Reader, contentType string) (err error) {
+		cached, err = mp.Cache.Put(key, contentType, data)
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache media: %w", err)
+	}
+	return cached, nil
+}
+
+func (mp *MediaProxy) getHTTPClient() *http.Client {
+	if mp.HTTPClient != nil {
+		return mp.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// readMediaResponse calls the given function with a reader for the data of the given media response,
+// downloading the data first if the response is a URL.
+func (mp *MediaProxy) readMediaResponse(ctx context.Context, resp GetMediaResponse, fn func(data io.Reader, contentType string) error) error {
+	switch typedResp := resp.(type) {
+	case *GetMediaResponseURL:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, typedResp.URL, nil)
+		if err != nil {
+			return fmt.Errorf("failed to prepare request: %w", err)
+		}
+		httpResp, err := mp.getHTTPClient().Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to download media: %w", err)
+		}
+		defer httpResp.Body.Close()
+		if httpResp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status code %d downloading media", httpResp.StatusCode)
+		}
+		return detectContentType(httpResp.Body, httpResp.Header.Get("Content-Type"), fn)
+	case *GetMediaResponseFile:
+		_, err := doTempFileDownload(typedResp, func(wt io.WriterTo, size int64, mimeType string) error {
+			return writerToReader(wt, func(data io.Reader) error {
+				return fn(data, mimeType)
+			})
+		})
+		return err
+	case *cachedMediaResponse:
+		defer typedResp.Close()
+		return fn(typedResp.content(), typedResp.contentType)
+	case *GetMediaResponseData:
+		defer typedResp.Reader.Close()
+		return detectContentType(typedResp.Reader, typedResp.ContentType, fn)
+	case GetMediaResponseWriter:
+		return writerToReader(typedResp, func(data io.Reader) error {
+			return detectContentType(data, typedResp.GetContentType(), fn)
+		})
+	default:
+		panic(fmt.Errorf("unknown GetMediaResponse type %T", resp))
+	}
+}
+
+func detectContentType(data io.Reader, contentType string, fn func(data io.Reader, contentType string) error) error {
+	if contentType != "" {
+		return fn(data, contentType)
+	}
+	bufReader := bufio.NewReaderSize(data, 512)
+	// Peek returns an error if there's less than 512 bytes of data, but the data can still be used
+	header, _ := bufReader.Peek(512)
+	return fn(bufReader, http.DetectContentType(header))
+}
+
+func writerToReader(wt io.WriterTo, fn func(data io.Reader) error) error {
+	if reader, ok := wt.(io.Reader); ok {
+		return fn(reader)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := wt.WriteTo(pw)
+		_ = pw.CloseWithError(err)
+	}()
+	err := fn(pr)
+	_ = pr.Close()
+	<-done
+	return err
+}
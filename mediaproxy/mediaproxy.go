@@ -122,6 +122,24 @@ type MediaProxy struct {
 	GetMedia            GetMediaFunc
 	PrepareProxyRequest func(*http.Request)
 
+	// ServerACL and GetMediaRoom can be set to deny federation media requests from servers
+	// that are banned by the server ACL of the room that the media belongs to.
+	// They're only used when ServerAuth is enabled.
+	ServerACL    *federation.ServerACLChecker
+	GetMediaRoom func(ctx context.Context, mediaID string) (id.RoomID, error)
+
+	// Thumbnails enables generating thumbnails of images in the proxy.
+	// If nil, thumbnail requests are passed to GetMedia the same way as downloads.
+	Thumbnails *ThumbnailConfig
+	// Cache is an optional on-disk cache for media and thumbnails. When it's set, media is always proxied
+	// and cached, even if GetMedia returns a URL that would otherwise be used for a redirect.
+	Cache *MediaCache
+	// HTTPClient is used to download media from URLs returned by GetMedia for caching and thumbnailing.
+	HTTPClient *http.Client
+	// URLPreviewer enables the preview_url endpoint. Note that the media proxy doesn't authenticate
+	// client requests, so enabling previews allows anyone who can reach the proxy to make it fetch URLs.
+	URLPreviewer *URLPreviewer
+
 	serverName string
 	serverKey  *federation.SigningKey
 
@@ -162,15 +180,18 @@ func New(serverName string, serverKey string, getMedia GetMediaFunc) (*MediaProx
 	mp.ClientMediaRouter.HandleFunc("POST /upload", mp.UploadNotSupported)
 	mp.ClientMediaRouter.HandleFunc("POST /create", mp.UploadNotSupported)
 	mp.ClientMediaRouter.HandleFunc("GET /config", mp.UploadNotSupported)
-	mp.ClientMediaRouter.HandleFunc("GET /preview_url", mp.PreviewURLNotSupported)
+	mp.ClientMediaRouter.HandleFunc("GET /preview_url", mp.PreviewURL)
 	return mp, nil
 }
 
 type BasicConfig struct {
-	ServerName        string `yaml:"server_name" json:"server_name"`
-	ServerKey         string `yaml:"server_key" json:"server_key"`
-	FederationAuth    bool   `yaml:"federation_auth" json:"federation_auth"`
-	WellKnownResponse string `yaml:"well_known_response" json:"well_known_response"`
+	ServerName         string `yaml:"server_name" json:"server_name"`
+	ServerKey          string `yaml:"server_key" json:"server_key"`
+	FederationAuth     bool   `yaml:"federation_auth" json:"federation_auth"`
+	WellKnownResponse  string `yaml:"well_known_response" json:"well_known_response"`
+	GenerateThumbnails bool   `yaml:"generate_thumbnails" json:"generate_thumbnails"`
+	CacheDir           string `yaml:"cache_dir" json:"cache_dir"`
+	CacheMaxSizeMB     int64  `yaml:"cache_max_size_mb" json:"cache_max_size_mb"`
 }
 
 func NewFromConfig(cfg BasicConfig, getMedia GetMediaFunc) (*MediaProxy, error) {
@@ -184,6 +205,15 @@ func NewFromConfig(cfg BasicConfig, getMedia GetMediaFunc) (*MediaProxy, error)
 	if cfg.FederationAuth {
 		mp.EnableServerAuth(nil, nil)
 	}
+	if cfg.GenerateThumbnails {
+		mp.Thumbnails = ptr.Clone(&DefaultThumbnailConfig)
+	}
+	if cfg.CacheDir != "" {
+		mp.Cache, err = NewMediaCache(cfg.CacheDir, cfg.CacheMaxSizeMB*1024*1024)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return mp, nil
 }
 
@@ -260,7 +290,16 @@ func (mp *MediaProxy) getMedia(w http.ResponseWriter, r *http.Request) GetMediaR
 		mautrix.MNotFound.WithMessage("Media ID %q is not valid", mediaID).Write(w)
 		return nil
 	}
-	resp, err := mp.GetMedia(r.Context(), mediaID, queryToMap(r.URL.Query()))
+	params := queryToMap(r.URL.Query())
+	var resp GetMediaResponse
+	var err error
+	if strings.Contains(r.Pattern, "/thumbnail/") && (mp.Thumbnails != nil || mp.Cache != nil) {
+		resp, err = mp.getThumbnail(r.Context(), mediaID, params)
+	} else if mp.Cache != nil {
+		resp, err = mp.getCachedMedia(r.Context(), downloadCacheKey(mediaID), mediaID, params)
+	} else {
+		resp, err = mp.GetMedia(r.Context(), mediaID, params)
+	}
 	if err != nil {
 		var mautrixRespError mautrix.RespError
 		if errors.Is(err, ErrInvalidMediaIDSyntax) {
@@ -295,6 +334,20 @@ func startMultipart(ctx context.Context, w http.ResponseWriter) *multipart.Write
 	return mpw
 }
 
+func (mp *MediaProxy) checkServerACL(r *http.Request) *mautrix.RespError {
+	if mp.ServerACL == nil || mp.GetMediaRoom == nil {
+		return nil
+	}
+	roomID, err := mp.GetMediaRoom(r.Context(), r.PathValue("mediaID"))
+	if err != nil {
+		zerolog.Ctx(r.Context()).Err(err).Msg("Failed to get room of media for server ACL check")
+		return ptr.Ptr(mautrix.MUnknown.WithMessage("Failed to check server ACL"))
+	} else if roomID == "" {
+		return nil
+	}
+	return mp.ServerACL.CheckRequest(r, roomID)
+}
+
 func (mp *MediaProxy) DownloadMediaFederation(w http.ResponseWriter, r *http.Request) {
 	if mp.ServerAuth != nil {
 		var err *mautrix.RespError
@@ -302,6 +355,9 @@ func (mp *MediaProxy) DownloadMediaFederation(w http.ResponseWriter, r *http.Req
 		if err != nil {
 			err.Write(w)
 			return
+		} else if err = mp.checkServerACL(r); err != nil {
+			err.Write(w)
+			return
 		}
 	}
 	ctx := r.Context()
@@ -353,6 +409,9 @@ func (mp *MediaProxy) DownloadMediaFederation(w http.ResponseWriter, r *http.Req
 			return
 		}
 	} else if dataResp, ok := resp.(GetMediaResponseWriter); ok {
+		if cachedResp, ok := dataResp.(*cachedMediaResponse); ok {
+			defer cachedResp.Close()
+		}
 		mpw = startMultipart(ctx, w)
 		if mpw == nil {
 			return
@@ -441,6 +500,12 @@ func (mp *MediaProxy) DownloadMedia(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
+	} else if cachedResp, ok := resp.(*cachedMediaResponse); ok {
+		defer cachedResp.Close()
+		mp.addHeaders(w, cachedResp.contentType, r.PathValue("fileName"))
+		w.Header().Set("ETag", cachedResp.etag)
+		// ServeContent handles range requests and conditional requests using the ETag
+		http.ServeContent(w, r, "", time.Time{}, cachedResp.content())
 	} else if writerResp, ok := resp.(GetMediaResponseWriter); ok {
 		if dataResp, ok := writerResp.(*GetMediaResponseData); ok {
 			defer dataResp.Reader.Close()
@@ -532,3 +597,19 @@ func (mp *MediaProxy) UploadNotSupported(w http.ResponseWriter, r *http.Request)
 func (mp *MediaProxy) PreviewURLNotSupported(w http.ResponseWriter, r *http.Request) {
 	ErrPreviewURLNotSupported.Write(w)
 }
+
+func (mp *MediaProxy) PreviewURL(w http.ResponseWriter, r *http.Request) {
+	if mp.URLPreviewer == nil {
+		mp.PreviewURLNotSupported(w, r)
+		return
+	}
+	preview, err := mp.URLPreviewer.GetPreview(r.Context(), r.URL.Query().Get("url"))
+	if errors.Is(err, ErrInvalidPreviewURL) {
+		mautrix.MInvalidParam.WithMessage(err.Error()).Write(w)
+	} else if err != nil {
+		zerolog.Ctx(r.Context()).Debug().Err(err).Msg("Failed to generate URL preview")
+		mautrix.MUnknown.WithMessage("Failed to generate URL preview").WithStatus(http.StatusBadGateway).Write(w)
+	} else {
+		exhttp.WriteJSONResponse(w, http.StatusOK, preview)
+	}
+}
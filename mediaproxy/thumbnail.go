@@ -0,0 +1,372 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mediaproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+)
+
+type ThumbnailMethod string
+
+const (
+	ThumbnailMethodScale ThumbnailMethod = "scale"
+	ThumbnailMethodCrop  ThumbnailMethod = "crop"
+)
+
+// ThumbnailParams contains the parameters of a thumbnail request.
+type ThumbnailParams struct {
+	Width    int
+	Height   int
+	Method   ThumbnailMethod
+	Animated bool
+}
+
+var ErrInvalidThumbnailParams = errors.New("invalid thumbnail parameters")
+
+// ParseThumbnailParams parses the query parameters of a thumbnail request.
+func ParseThumbnailParams(params map[string]string) (*ThumbnailParams, error) {
+	width, err := strconv.Atoi(params["width"])
+	if err != nil || width <= 0 {
+		return nil, fmt.Errorf("%w: width must be a positive integer", ErrInvalidThumbnailParams)
+	}
+	height, err := strconv.Atoi(params["height"])
+	if err != nil || height <= 0 {
+		return nil, fmt.Errorf("%w: height must be a positive integer", ErrInvalidThumbnailParams)
+	}
+	method := ThumbnailMethod(params["method"])
+	switch method {
+	case "":
+		method = ThumbnailMethodScale
+	case ThumbnailMethodScale, ThumbnailMethodCrop:
+	default:
+		return nil, fmt.Errorf("%w: unknown method %q", ErrInvalidThumbnailParams, method)
+	}
+	return &ThumbnailParams{
+		Width:    width,
+		Height:   height,
+		Method:   method,
+		Animated: params["animated"] == "true",
+	}, nil
+}
+
+func (tp *ThumbnailParams) cacheKey() string {
+	// Animated thumbnails aren't supported, so the animated flag doesn't affect the output
+	return fmt.Sprintf("thumbnail:%dx%d:%s", tp.Width, tp.Height, tp.Method)
+}
+
+// ThumbnailConfig contains settings for generating thumbnails in the media proxy.
+//
+// Only JPEG, PNG and GIF images are supported. Thumbnails of other files are not generated,
+// and the original file is returned instead.
+type ThumbnailConfig struct {
+	// MaxSourceSize is the maximum size of images to generate thumbnails for in bytes.
+	MaxSourceSize int64
+	// MaxSourcePixels is the maximum number of pixels in images to generate thumbnails for.
+	MaxSourcePixels int
+	// MaxWidth and MaxHeight limit the size of generated thumbnails. Larger requests are clamped.
+	MaxWidth  int
+	MaxHeight int
+	// JPEGQuality is the quality to use when encoding JPEG thumbnails.
+	JPEGQuality int
+}
+
+var DefaultThumbnailConfig = ThumbnailConfig{
+	MaxSourceSize:   50 * 1024 * 1024,
+	MaxSourcePixels: 32 * 1024 * 1024,
+	MaxWidth:        1920,
+	MaxHeight:       1920,
+	JPEGQuality:     85,
+}
+
+var errThumbnailNotSupported = errors.New("thumbnailing not supported for file")
+
+func isThumbnailableMimeType(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	default:
+		return false
+	}
+}
+
+// thumbnailSize calculates the area of the source image to use and the size of the output image.
+func thumbnailSize(srcWidth, srcHeight int, params *ThumbnailParams) (crop image.Rectangle, width, height int) {
+	crop = image.Rect(0, 0, srcWidth, srcHeight)
+	if params.Method == ThumbnailMethodCrop {
+		// Cut off the edges of the source image so that it has the requested aspect ratio
+		if srcWidth*params.Height > srcHeight*params.Width {
+			cropWidth := max(srcHeight*params.Width/params.Height, 1)
+			crop.Min.X = (srcWidth - cropWidth) / 2
+			crop.Max.X = crop.Min.X + cropWidth
+		} else {
+			cropHeight := max(srcWidth*params.Height/params.Width, 1)
+			crop.Min.Y = (srcHeight - cropHeight) / 2
+			crop.Max.Y = crop.Min.Y + cropHeight
+		}
+		if crop.Dx() <= params.Width {
+			// Never upscale images
+			return crop, crop.Dx(), crop.Dy()
+		}
+		return crop, params.Width, params.Height
+	}
+	if srcWidth <= params.Width && srcHeight <= params.Height {
+		return crop, srcWidth, srcHeight
+	}
+	// Scale the image to fit within the requested size while preserving the aspect ratio
+	if srcWidth*params.Height > srcHeight*params.Width {
+		width = params.Width
+		height = max(srcHeight*params.Width/srcWidth, 1)
+	} else {
+		height = params.Height
+		width = max(srcWidth*params.Height/srcHeight, 1)
+	}
+	return crop, width, height
+}
+
+// resizeImage scales the given area of the source image to the given size using a box filter.
+func resizeImage(src *image.RGBA, crop image.Rectangle, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	cropWidth, cropHeight := crop.Dx(), crop.Dy()
+	for y := 0; y < height; y++ {
+		srcY0 := crop.Min.Y + y*cropHeight/height
+		srcY1 := max(crop.Min.Y+(y+1)*cropHeight/height, srcY0+1)
+		for x := 0; x < width; x++ {
+			srcX0 := crop.Min.X + x*cropWidth/width
+			srcX1 := max(crop.Min.X+(x+1)*cropWidth/width, srcX0+1)
+			var r, g, b, a, count uint64
+			for sy := srcY0; sy < srcY1; sy++ {
+				row := src.Pix[src.PixOffset(srcX0, sy):src.PixOffset(srcX1, sy)]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					b += uint64(row[i+2])
+					a += uint64(row[i+3])
+					count++
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / count)
+			dst.Pix[offset+1] = uint8(g / count)
+			dst.Pix[offset+2] = uint8(b / count)
+			dst.Pix[offset+3] = uint8(a / count)
+		}
+	}
+	return dst
+}
+
+// GenerateThumbnail generates a thumbnail of the given image. The source must be a JPEG, PNG or GIF image.
+// PNG and GIF thumbnails are encoded as PNG to preserve transparency, JPEGs are encoded as JPEG.
+func (cfg *ThumbnailConfig) GenerateThumbnail(data []byte, params *ThumbnailParams) ([]byte, string, error) {
+	imgConfig, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", errThumbnailNotSupported, err)
+	} else if cfg.MaxSourcePixels > 0 && imgConfig.Width*imgConfig.Height > cfg.MaxSourcePixels {
+		return nil, "", fmt.Errorf("%w: image is too large (%dx%d)", errThumbnailNotSupported, imgConfig.Width, imgConfig.Height)
+	}
+	params = cfg.clampParams(params)
+	crop, width, height := thumbnailSize(imgConfig.Width, imgConfig.Height, params)
+	var img image.Image
+	switch format {
+	case "jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	case "png":
+		img, err = png.Decode(bytes.NewReader(data))
+	case "gif":
+		// Only the first frame is used, animated thumbnails aren't supported
+		img, err = gif.Decode(bytes.NewReader(data))
+	default:
+		return nil, "", fmt.Errorf("%w: unsupported image format %q", errThumbnailNotSupported, format)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, imgConfig.Width, imgConfig.Height))
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	thumbnail := rgba
+	if crop != rgba.Bounds() || width != imgConfig.Width || height != imgConfig.Height {
+		thumbnail = resizeImage(rgba, crop, width, height)
+	}
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: cfg.JPEGQuality})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, thumbnail)
+	return buf.Bytes(), "image/png", err
+}
+
+func (cfg *ThumbnailConfig) clampParams(params *ThumbnailParams) *ThumbnailParams {
+	if (cfg.MaxWidth <= 0 || params.Width <= cfg.MaxWidth) && (cfg.MaxHeight <= 0 || params.Height <= cfg.MaxHeight) {
+		return params
+	}
+	clamped := *params
+	if cfg.MaxWidth > 0 && clamped.Width > cfg.MaxWidth {
+		clamped.Width = cfg.MaxWidth
+	}
+	if cfg.MaxHeight > 0 && clamped.Height > cfg.MaxHeight {
+		clamped.Height = cfg.MaxHeight
+	}
+	return &clamped
+}
+
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) > limit {
+		// Return the data that was read, so that the caller can still use it
+		return data, fmt.Errorf("%w: file is larger than %d bytes", errThumbnailNotSupported, limit)
+	}
+	return data, nil
+}
+
+type tempFileReader struct {
+	*os.File
+}
+
+func (tfr *tempFileReader) Close() error {
+	_ = tfr.File.Close()
+	return os.Remove(tfr.File.Name())
+}
+
+// spoolSourceMedia writes the already read part of a file and the rest of the reader to a temporary file,
+// so that the original file can be returned without downloading it again. The file is deleted when the reader is closed.
+func spoolSourceMedia(prefix []byte, rest io.Reader, contentType string) (*GetMediaResponseData, error) {
+	tempFile, err := os.CreateTemp("", "mautrix-mediaproxy-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	reader := &tempFileReader{File: tempFile}
+	size, err := io.Copy(tempFile, io.MultiReader(bytes.NewReader(prefix), rest))
+	if err != nil {
+		_ = reader.Close()
+		return nil, fmt.Errorf("failed to write temp file: %w", err)
+	}
+	_, err = tempFile.Seek(0, io.SeekStart)
+	if err != nil {
+		_ = reader.Close()
+		return nil, fmt.Errorf("failed to seek to start of temp file: %w", err)
+	}
+	return &GetMediaResponseData{
+		Reader:        reader,
+		ContentType:   contentType,
+		ContentLength: size,
+	}, nil
+}
+
+// getSourceMedia gets the original file for generating a thumbnail.
+func (mp *MediaProxy) getSourceMedia(ctx context.Context, mediaID string, params map[string]string) (GetMediaResponse, error) {
+	params = maps.Clone(params)
+	delete(params, "width")
+	delete(params, "height")
+	delete(params, "method")
+	delete(params, "animated")
+	if mp.Cache != nil {
+		return mp.getCachedMedia(ctx, downloadCacheKey(mediaID), mediaID, params)
+	}
+	return mp.GetMedia(ctx, mediaID, params)
+}
+
+func (mp *MediaProxy) getThumbnail(ctx context.Context, mediaID string, params map[string]string) (GetMediaResponse, error) {
+	thumbParams, err := ParseThumbnailParams(params)
+	if err != nil {
+		return nil, mautrix.MInvalidParam.WithMessage(err.Error())
+	}
+	key := mediaID + ":" + thumbParams.cacheKey()
+	if mp.Thumbnails == nil {
+		// Thumbnail generation is disabled, but the thumbnails returned by GetMedia can still be cached
+		return mp.getCachedMedia(ctx, key, mediaID, params)
+	} else if mp.Cache != nil {
+		unlock := mp.Cache.lockKey(key)
+		defer unlock()
+		cached, err := mp.Cache.Get(key)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("media_id", mediaID).Msg("Failed to read thumbnail from cache")
+		} else if cached != nil {
+			return cached, nil
+		}
+	}
+	source, err := mp.getSourceMedia(ctx, mediaID, params)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	var sourceType, mimeType string
+	// fallback is the original file, which is returned if a thumbnail can't be generated
+	var fallback GetMediaResponse
+	err = mp.readMediaResponse(ctx, source, func(reader io.Reader, contentType string) (err error) {
+		sourceType = contentType
+		if !isThumbnailableMimeType(strings.TrimSpace(strings.Split(contentType, ";")[0])) {
+			err = fmt.Errorf("%w: unsupported content type %q", errThumbnailNotSupported, contentType)
+		} else {
+			data, err = readLimited(reader, mp.Thumbnails.MaxSourceSize)
+		}
+		if errors.Is(err, errThumbnailNotSupported) && mp.Cache == nil {
+			// The source can only be read once, so keep the rest of it to avoid downloading it again.
+			// Cached files are cheap to read again, so there's no need to copy them.
+			var spoolErr error
+			fallback, spoolErr = spoolSourceMedia(data, reader, contentType)
+			if spoolErr != nil {
+				return spoolErr
+			}
+		}
+		return
+	})
+	if err == nil {
+		var thumbnail []byte
+		thumbnail, mimeType, err = mp.Thumbnails.GenerateThumbnail(data, thumbParams)
+		if errors.Is(err, errThumbnailNotSupported) {
+			fallback = &GetMediaResponseData{
+				Reader:        io.NopCloser(bytes.NewReader(data)),
+				ContentType:   sourceType,
+				ContentLength: int64(len(data)),
+			}
+		}
+		data = thumbnail
+	}
+	if errors.Is(err, errThumbnailNotSupported) {
+		zerolog.Ctx(ctx).Debug().Err(err).Str("media_id", mediaID).Msg("Can't generate thumbnail, returning original file")
+		if fallback != nil {
+			return fallback, nil
+		}
+		return mp.getSourceMedia(ctx, mediaID, params)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to generate thumbnail: %w", err)
+	}
+	if mp.Cache != nil {
+		cached, err := mp.Cache.Put(key, mimeType, bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to cache thumbnail: %w", err)
+		}
+		return cached, nil
+	}
+	return &GetMediaResponseData{
+		Reader:        io.NopCloser(bytes.NewReader(data)),
+		ContentType:   mimeType,
+		ContentLength: int64(len(data)),
+	}, nil
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mediaproxy
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/federation"
+)
+
+func TestThumbnailSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		srcW, srcH    int
+		params        ThumbnailParams
+		crop          image.Rectangle
+		width, height int
+	}{
+		{"scale landscape", 1000, 500, ThumbnailParams{Width: 100, Height: 100, Method: ThumbnailMethodScale}, image.Rect(0, 0, 1000, 500), 100, 50},
+		{"scale portrait", 500, 1000, ThumbnailParams{Width: 100, Height: 100, Method: ThumbnailMethodScale}, image.Rect(0, 0, 500, 1000), 50, 100},
+		{"scale no upscale", 50, 40, ThumbnailParams{Width: 100, Height: 100, Method: ThumbnailMethodScale}, image.Rect(0, 0, 50, 40), 50, 40},
+		{"crop landscape", 1000, 500, ThumbnailParams{Width: 100, Height: 100, Method: ThumbnailMethodCrop}, image.Rect(250, 0, 750, 500), 100, 100},
+		{"crop portrait", 500, 1000, ThumbnailParams{Width: 200, Height: 100, Method: ThumbnailMethodCrop}, image.Rect(0, 375, 500, 625), 200, 100},
+		{"crop no upscale", 80, 40, ThumbnailParams{Width: 100, Height: 100, Method: ThumbnailMethodCrop}, image.Rect(20, 0, 60, 40), 40, 40},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crop, width, height := thumbnailSize(test.srcW, test.srcH, &test.params)
+			assert.Equal(t, test.crop, crop)
+			assert.Equal(t, test.width, width)
+			assert.Equal(t, test.height, height)
+		})
+	}
+}
+
+func makeTestPNG(t *testing.T, width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestGenerateThumbnail(t *testing.T) {
+	data := makeTestPNG(t, 200, 100)
+	thumb, mimeType, err := DefaultThumbnailConfig.GenerateThumbnail(data, &ThumbnailParams{Width: 32, Height: 32, Method: ThumbnailMethodCrop})
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", mimeType)
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(thumb))
+	require.NoError(t, err)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, 32, cfg.Width)
+	assert.Equal(t, 32, cfg.Height)
+
+	_, _, err = DefaultThumbnailConfig.GenerateThumbnail([]byte("not an image"), &ThumbnailParams{Width: 32, Height: 32})
+	assert.ErrorIs(t, err, errThumbnailNotSupported)
+}
+
+func TestMediaCache_Eviction(t *testing.T) {
+	cache, err := NewMediaCache(t.TempDir(), 120)
+	require.NoError(t, err)
+	first, err := cache.Put("first", "text/plain", strings.NewReader(strings.Repeat("a", 40)))
+	require.NoError(t, err)
+	data, err := io.ReadAll(first.content())
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 40), string(data))
+	assert.Equal(t, "text/plain", first.GetContentType())
+	_ = first.Close()
+
+	second, err := cache.Put("second", "text/plain", strings.NewReader(strings.Repeat("b", 40)))
+	require.NoError(t, err)
+	_ = second.Close()
+	// Access the first entry so that the second one is the least recently used
+	first, err = cache.Get("first")
+	require.NoError(t, err)
+	require.NotNil(t, first)
+	_ = first.Close()
+
+	third, err := cache.Put("third", "text/plain", strings.NewReader(strings.Repeat("c", 40)))
+	require.NoError(t, err)
+	_ = third.Close()
+
+	evicted, err := cache.Get("second")
+	require.NoError(t, err)
+	assert.Nil(t, evicted)
+	kept, err := cache.Get("first")
+	require.NoError(t, err)
+	require.NotNil(t, kept)
+	_ = kept.Close()
+
+	reopened, err := NewMediaCache(cache.Dir, 120)
+	require.NoError(t, err)
+	assert.Equal(t, cache.totalSize, reopened.totalSize)
+	assert.Len(t, reopened.entries, 2)
+}
+
+func TestMediaProxy_CachedDownload(t *testing.T) {
+	imageData := makeTestPNG(t, 64, 64)
+	fetches := 0
+	mp, err := New("example.com", federation.GenerateSigningKey().SynapseString(), func(ctx context.Context, mediaID string, params map[string]string) (GetMediaResponse, error) {
+		fetches++
+		return GetMediaResponseRawData(imageData), nil
+	})
+	require.NoError(t, err)
+	mp.Thumbnails = &DefaultThumbnailConfig
+	mp.Cache, err = NewMediaCache(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	doRequest := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		mp.ClientMediaRouter.ServeHTTP(w, req)
+		return w
+	}
+
+	resp := doRequest("/download/example.com/media", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, imageData, resp.Body.Bytes())
+	etag := resp.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	resp = doRequest("/download/example.com/media", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.Code)
+	resp = doRequest("/download/example.com/media", map[string]string{"Range": "bytes=0-9"})
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, imageData[:10], resp.Body.Bytes())
+
+	resp = doRequest("/thumbnail/example.com/media?width=16&height=16&method=scale", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "image/png", resp.Header().Get("Content-Type"))
+	cfg, _, err := image.DecodeConfig(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 16, cfg.Width)
+	resp = doRequest("/thumbnail/example.com/media?width=16&height=16&method=scale", nil)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	resp = doRequest("/thumbnail/example.com/media?width=abc&height=16", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// The original was only fetched once, everything else was served from the cache
+	assert.Equal(t, 1, fetches)
+}
+
+func TestMediaProxy_ThumbnailFallbackWithoutCache(t *testing.T) {
+	imageData := makeTestPNG(t, 64, 64)
+	textData := []byte(strings.Repeat("not an image ", 100))
+	fetches := 0
+	mp, err := New("example.com", federation.GenerateSigningKey().SynapseString(), func(ctx context.Context, mediaID string, params map[string]string) (GetMediaResponse, error) {
+		fetches++
+		if mediaID == "text" {
+			return &GetMediaResponseData{
+				Reader:        io.NopCloser(bytes.NewReader(textData)),
+				ContentType:   "text/plain",
+				ContentLength: int64(len(textData)),
+			}, nil
+		}
+		return GetMediaResponseRawData(imageData), nil
+	})
+	require.NoError(t, err)
+	thumbCfg := DefaultThumbnailConfig
+	thumbCfg.MaxSourceSize = 100
+	mp.Thumbnails = &thumbCfg
+
+	for mediaID, expected := range map[string][]byte{"text": textData, "image": imageData} {
+		fetches = 0
+		req := httptest.NewRequest(http.MethodGet, "/thumbnail/example.com/"+mediaID+"?width=16&height=16&method=scale", nil)
+		w := httptest.NewRecorder()
+		mp.ClientMediaRouter.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, expected, w.Body.Bytes())
+		assert.Equal(t, 1, fetches, "original file of %s should only be fetched once", mediaID)
+	}
+}
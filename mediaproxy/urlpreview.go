@@ -0,0 +1,476 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mediaproxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/exhttp"
+	"golang.org/x/net/html"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/federation"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	ErrInvalidPreviewURL         = errors.New("invalid URL")
+	ErrUnsupportedPreviewContent = errors.New("unsupported content type for URL preview")
+	ErrNoPreviewMetadata         = errors.New("page doesn't have any preview metadata")
+	ErrPreviewTooLarge           = errors.New("response is too large")
+)
+
+// UploadPreviewImageFunc uploads a preview image to Matrix.
+// It may either return a plain content URI, or encryption info for an encrypted file.
+type UploadPreviewImageFunc = func(ctx context.Context, data []byte, fileName, mimeType string) (id.ContentURIString, *event.EncryptedFileInfo, error)
+
+// URLPreviewer generates link previews for arbitrary URLs using OpenGraph tags and oEmbed.
+//
+// All connections are filtered using AllowIP, so the previewer is safe to use with untrusted URLs as long as
+// the filter blocks internal addresses. The filter is applied at dial time, which means redirects and DNS
+// names pointing at internal addresses are blocked too.
+type URLPreviewer struct {
+	HTTP   *http.Client
+	Dialer *net.Dialer
+	// AllowIP is called for every IP address the previewer connects to.
+	// Defaults to federation.DefaultAllowIP, which only allows public addresses.
+	AllowIP   func(net.IP) bool
+	UserAgent string
+
+	// MaxPageSize is the maximum number of bytes of HTML to read when looking for metadata.
+	// Pages larger than this are truncated rather than rejected.
+	MaxPageSize int64
+	// MaxImageSize is the maximum size of preview images. Larger images are ignored.
+	MaxImageSize int64
+	MaxRedirects int
+
+	CacheTTL        time.Duration
+	MaxCacheEntries int
+
+	// UploadImage is used to reupload preview images to Matrix. If nil, previews won't include images.
+	// Uploaded images are cached along with the rest of the preview, so the function shouldn't
+	// produce results that are only valid in a specific room.
+	UploadImage UploadPreviewImageFunc
+
+	cache     map[string]*cachedURLPreview
+	cacheLock sync.Mutex
+}
+
+type cachedURLPreview struct {
+	preview *event.BeeperLinkPreview
+	expires time.Time
+}
+
+// NewURLPreviewer creates a new URL previewer with the given HTTP settings.
+//
+// Proxy settings are ignored, as connecting through a proxy would bypass the IP filter.
+func NewURLPreviewer(httpSettings exhttp.ClientSettings) *URLPreviewer {
+	up := &URLPreviewer{
+		AllowIP:         federation.DefaultAllowIP,
+		UserAgent:       mautrix.DefaultUserAgent,
+		MaxPageSize:     1 * 1024 * 1024,
+		MaxImageSize:    10 * 1024 * 1024,
+		MaxRedirects:    10,
+		CacheTTL:        1 * time.Hour,
+		MaxCacheEntries: 1000,
+
+		cache: make(map[string]*cachedURLPreview),
+	}
+	up.Dialer = &net.Dialer{Timeout: httpSettings.DialTimeout, ControlContext: up.controlConn}
+	httpSettings.ProxyAddress = ""
+	httpSettings.TransportOverride = nil
+	up.HTTP = httpSettings.WithDial(up.Dialer.DialContext).Compile()
+	up.HTTP.CheckRedirect = up.checkRedirect
+	return up
+}
+
+func (up *URLPreviewer) controlConn(_ context.Context, network, address string, _ syscall.RawConn) error {
+	switch network {
+	case "tcp4", "tcp6":
+		// ok
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address %q", host)
+	} else if up.AllowIP != nil && !up.AllowIP(ip) {
+		return fmt.Errorf("%w to %s", federation.ErrIPFiltered, host)
+	}
+	return nil
+}
+
+func (up *URLPreviewer) checkRedirect(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("attempted to redirect to unsupported URL scheme %q", req.URL.Scheme)
+	} else if len(via) >= up.MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+	return nil
+}
+
+func parsePreviewURL(rawURL string) (*url.URL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPreviewURL, err)
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrInvalidPreviewURL, parsed.Scheme)
+	} else if parsed.Host == "" {
+		return nil, fmt.Errorf("%w: missing host", ErrInvalidPreviewURL)
+	}
+	parsed.Fragment = ""
+	return parsed, nil
+}
+
+// GetPreview generates a preview for the given URL. The image, if any, is always unencrypted,
+// so UploadImage must return a plain content URI for it to be included.
+func (up *URLPreviewer) GetPreview(ctx context.Context, rawURL string) (*event.LinkPreview, error) {
+	preview, err := up.GetBeeperPreview(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &preview.LinkPreview, nil
+}
+
+// GetBeeperPreview generates a preview for the given URL, including the matched URL and image encryption info.
+// Results are cached for CacheTTL.
+func (up *URLPreviewer) GetBeeperPreview(ctx context.Context, rawURL string) (*event.BeeperLinkPreview, error) {
+	parsed, err := parsePreviewURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := parsed.String()
+	preview := up.getCached(cacheKey)
+	if preview == nil {
+		preview, err = up.generatePreview(ctx, parsed)
+		if err != nil {
+			return nil, err
+		}
+		up.putCached(cacheKey, preview)
+	}
+	copied := *preview
+	copied.MatchedURL = rawURL
+	return &copied, nil
+}
+
+func (up *URLPreviewer) getCached(key string) *event.BeeperLinkPreview {
+	up.cacheLock.Lock()
+	defer up.cacheLock.Unlock()
+	cached, ok := up.cache[key]
+	if !ok {
+		return nil
+	} else if time.Now().After(cached.expires) {
+		delete(up.cache, key)
+		return nil
+	}
+	return cached.preview
+}
+
+func (up *URLPreviewer) putCached(key string, preview *event.BeeperLinkPreview) {
+	if up.CacheTTL <= 0 {
+		return
+	}
+	up.cacheLock.Lock()
+	defer up.cacheLock.Unlock()
+	if up.cache == nil {
+		up.cache = make(map[string]*cachedURLPreview)
+	}
+	if up.MaxCacheEntries > 0 && len(up.cache) >= up.MaxCacheEntries {
+		now := time.Now()
+		var oldestKey string
+		var oldestExpiry time.Time
+		for cachedKey, cached := range up.cache {
+			if now.After(cached.expires) {
+				delete(up.cache, cachedKey)
+			} else if oldestKey == "" || cached.expires.Before(oldestExpiry) {
+				oldestKey, oldestExpiry = cachedKey, cached.expires
+			}
+		}
+		if len(up.cache) >= up.MaxCacheEntries {
+			delete(up.cache, oldestKey)
+		}
+	}
+	up.cache[key] = &cachedURLPreview{preview: preview, expires: time.Now().Add(up.CacheTTL)}
+}
+
+func (up *URLPreviewer) get(ctx context.Context, targetURL, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("User-Agent", up.UserAgent)
+	req.Header.Set("Accept", accept)
+	resp, err := up.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func readPreviewBody(r io.Reader, limit int64, truncate bool) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) > limit {
+		if !truncate {
+			return nil, fmt.Errorf("%w (over %d bytes)", ErrPreviewTooLarge, limit)
+		}
+		data = data[:limit]
+	}
+	return data, nil
+}
+
+func (up *URLPreviewer) generatePreview(ctx context.Context, target *url.URL) (*event.BeeperLinkPreview, error) {
+	resp, err := up.get(ctx, target.String(), "text/html,application/xhtml+xml;q=0.9,image/*;q=0.8")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch page: %w", err)
+	}
+	defer resp.Body.Close()
+	finalURL := resp.Request.URL
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		data, err := readPreviewBody(resp.Body, up.MaxImageSize, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image: %w", err)
+		}
+		preview := &event.BeeperLinkPreview{LinkPreview: event.LinkPreview{
+			CanonicalURL: finalURL.String(),
+			Title:        path.Base(finalURL.Path),
+		}}
+		err = up.setImage(ctx, preview, data, mimeType, path.Base(finalURL.Path))
+		if err != nil {
+			return nil, err
+		}
+		return preview, nil
+	case mimeType == "text/html", mimeType == "application/xhtml+xml":
+		data, err := readPreviewBody(resp.Body, up.MaxPageSize, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read page: %w", err)
+		}
+		return up.previewFromMeta(ctx, finalURL, parsePageMeta(data))
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedPreviewContent, mimeType)
+	}
+}
+
+type pageMeta struct {
+	props     map[string]string
+	title     string
+	oEmbedURL string
+}
+
+func (pm *pageMeta) get(keys ...string) string {
+	for _, key := range keys {
+		if val := pm.props[key]; val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+func getAttr(tok html.Token, key string) string {
+	for _, attr := range tok.Attr {
+		if attr.Key == key {
+			return strings.TrimSpace(attr.Val)
+		}
+	}
+	return ""
+}
+
+// parsePageMeta finds OpenGraph and other meta tags, the page title and the oEmbed discovery link in an HTML page.
+// If a property is specified multiple times, only the first value is used.
+func parsePageMeta(data []byte) *pageMeta {
+	meta := &pageMeta{props: make(map[string]string)}
+	z := html.NewTokenizer(bytes.NewReader(data))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return meta
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "meta":
+				key := getAttr(tok, "property")
+				if key == "" {
+					key = getAttr(tok, "name")
+				}
+				key = strings.ToLower(key)
+				content := getAttr(tok, "content")
+				if _, alreadySet := meta.props[key]; key != "" && content != "" && !alreadySet {
+					meta.props[key] = content
+				}
+			case "link":
+				if meta.oEmbedURL == "" && getAttr(tok, "type") == "application/json+oembed" &&
+					strings.Contains(strings.ToLower(getAttr(tok, "rel")), "alternate") {
+					meta.oEmbedURL = getAttr(tok, "href")
+				}
+			case "title":
+				if tt == html.StartTagToken && meta.title == "" && z.Next() == html.TextToken {
+					meta.title = strings.TrimSpace(string(z.Text()))
+				}
+			}
+		}
+	}
+}
+
+type oEmbedResponse struct {
+	Type            string `json:"type"`
+	Title           string `json:"title"`
+	AuthorName      string `json:"author_name"`
+	ProviderName    string `json:"provider_name"`
+	URL             string `json:"url"`
+	ThumbnailURL    string `json:"thumbnail_url"`
+	ThumbnailWidth  int    `json:"thumbnail_width"`
+	ThumbnailHeight int    `json:"thumbnail_height"`
+}
+
+func (up *URLPreviewer) fetchOEmbed(ctx context.Context, oEmbedURL *url.URL) (*oEmbedResponse, error) {
+	resp, err := up.get(ctx, oEmbedURL.String(), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := readPreviewBody(resp.Body, up.MaxPageSize, false)
+	if err != nil {
+		return nil, err
+	}
+	var oEmbed oEmbedResponse
+	err = json.Unmarshal(data, &oEmbed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse oEmbed response: %w", err)
+	}
+	return &oEmbed, nil
+}
+
+func resolvePreviewURL(base *url.URL, ref string) *url.URL {
+	if ref == "" {
+		return nil
+	}
+	parsed, err := base.Parse(ref)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil
+	}
+	return parsed
+}
+
+func (up *URLPreviewer) previewFromMeta(ctx context.Context, pageURL *url.URL, meta *pageMeta) (*event.BeeperLinkPreview, error) {
+	log := zerolog.Ctx(ctx)
+	preview := &event.BeeperLinkPreview{LinkPreview: event.LinkPreview{
+		CanonicalURL: pageURL.String(),
+		Title:        meta.get("og:title", "twitter:title"),
+		Type:         meta.get("og:type"),
+		Description:  meta.get("og:description", "twitter:description", "description"),
+		SiteName:     meta.get("og:site_name"),
+	}}
+	if canonicalURL := resolvePreviewURL(pageURL, meta.get("og:url")); canonicalURL != nil {
+		preview.CanonicalURL = canonicalURL.String()
+	}
+	imageURL := resolvePreviewURL(pageURL, meta.get("og:image", "og:image:url", "og:image:secure_url", "twitter:image", "twitter:image:src"))
+	oEmbedURL := resolvePreviewURL(pageURL, meta.oEmbedURL)
+	if oEmbedURL != nil && (preview.Title == "" || imageURL == nil) {
+		oEmbed, err := up.fetchOEmbed(ctx, oEmbedURL)
+		if err != nil {
+			log.Debug().Err(err).Stringer("oembed_url", oEmbedURL).Msg("Failed to fetch oEmbed data for URL preview")
+		} else {
+			preview.Title = cmp.Or(preview.Title, oEmbed.Title, oEmbed.AuthorName)
+			preview.SiteName = cmp.Or(preview.SiteName, oEmbed.ProviderName)
+			if imageURL == nil {
+				if oEmbed.Type == "photo" {
+					imageURL = resolvePreviewURL(oEmbedURL, oEmbed.URL)
+				} else {
+					imageURL = resolvePreviewURL(oEmbedURL, oEmbed.ThumbnailURL)
+				}
+			}
+		}
+	}
+	preview.Title = cmp.Or(preview.Title, meta.title)
+	if preview.Title == "" && preview.Description == "" && imageURL == nil {
+		return nil, ErrNoPreviewMetadata
+	}
+	if imageURL != nil && up.UploadImage != nil {
+		err := up.fetchImage(ctx, preview, imageURL)
+		if err != nil {
+			log.Debug().Err(err).Stringer("image_url", imageURL).Msg("Failed to fetch image for URL preview")
+		} else if preview.ImageWidth == 0 {
+			preview.ImageWidth = parseIntOrString(meta.get("og:image:width"))
+			preview.ImageHeight = parseIntOrString(meta.get("og:image:height"))
+		}
+	}
+	return preview, nil
+}
+
+func parseIntOrString(val string) event.IntOrString {
+	parsed, _ := strconv.Atoi(val)
+	return event.IntOrString(parsed)
+}
+
+func (up *URLPreviewer) fetchImage(ctx context.Context, preview *event.BeeperLinkPreview, imageURL *url.URL) error {
+	resp, err := up.get(ctx, imageURL.String(), "image/*")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mimeType, "image/") {
+		return fmt.Errorf("%w %q", ErrUnsupportedPreviewContent, mimeType)
+	}
+	data, err := readPreviewBody(resp.Body, up.MaxImageSize, false)
+	if err != nil {
+		return err
+	}
+	return up.setImage(ctx, preview, data, mimeType, path.Base(imageURL.Path))
+}
+
+func (up *URLPreviewer) setImage(ctx context.Context, preview *event.BeeperLinkPreview, data []byte, mimeType, fileName string) error {
+	if up.UploadImage == nil {
+		return nil
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		preview.ImageWidth = event.IntOrString(cfg.Width)
+		preview.ImageHeight = event.IntOrString(cfg.Height)
+	}
+	if fileName == "" || fileName == "." || fileName == "/" {
+		fileName = "image"
+	}
+	mxc, file, err := up.UploadImage(ctx, data, fileName, mimeType)
+	if err != nil {
+		return fmt.Errorf("failed to upload image: %w", err)
+	}
+	preview.ImageURL = mxc
+	preview.ImageEncryption = file
+	preview.ImageSize = event.IntOrString(len(data))
+	preview.ImageType = mimeType
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mediaproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/exhttp"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/federation"
+	"maunium.net/go/mautrix/id"
+)
+
+const testPreviewPage = `<!DOCTYPE html>
+<html><head>
+<title>Fallback &amp; title</title>
+<meta property="og:title" content="OpenGraph title">
+<meta property="og:description" content="A description">
+<meta property="og:site_name" content="Example">
+<meta property="og:image" content="/image.png">
+<meta property="og:image" content="/second.png">
+<link rel="alternate" type="application/json+oembed" href="/oembed.json">
+</head><body>hello</body></html>`
+
+const testOEmbedPage = `<html><head>
+<title>Page title</title>
+<link rel="alternate" type="application/json+oembed" href="/oembed.json">
+</head></html>`
+
+func newTestPreviewServer(t *testing.T) *httptest.Server {
+	imageData := makeTestPNG(t, 40, 30)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(testPreviewPage))
+	})
+	mux.HandleFunc("GET /oembed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(testOEmbedPage))
+	})
+	mux.HandleFunc("GET /oembed.json", func(w http.ResponseWriter, r *http.Request) {
+		exhttp.WriteJSONResponse(w, http.StatusOK, map[string]any{
+			"type":          "video",
+			"title":         "oEmbed title",
+			"provider_name": "Provider",
+			"thumbnail_url": "/image.png",
+		})
+	})
+	mux.HandleFunc("GET /image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(imageData)
+	})
+	mux.HandleFunc("GET /redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/page", http.StatusFound)
+	})
+	mux.HandleFunc("GET /empty", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>nothing here</body></html>"))
+	})
+	mux.HandleFunc("GET /file.zip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestPreviewer() (*URLPreviewer, *int) {
+	up := NewURLPreviewer(exhttp.SensibleClientSettings)
+	up.AllowIP = func(ip net.IP) bool {
+		return ip.IsLoopback()
+	}
+	uploads := 0
+	up.UploadImage = func(ctx context.Context, data []byte, fileName, mimeType string) (id.ContentURIString, *event.EncryptedFileInfo, error) {
+		uploads++
+		return id.ContentURIString(fmt.Sprintf("mxc://example.com/%s", fileName)), nil, nil
+	}
+	return up, &uploads
+}
+
+func TestURLPreviewer_OpenGraph(t *testing.T) {
+	srv := newTestPreviewServer(t)
+	up, uploads := newTestPreviewer()
+	preview, err := up.GetBeeperPreview(context.Background(), srv.URL+"/redirect#fragment")
+	require.NoError(t, err)
+	assert.Equal(t, srv.URL+"/redirect#fragment", preview.MatchedURL)
+	assert.Equal(t, srv.URL+"/page", preview.CanonicalURL)
+	assert.Equal(t, "OpenGraph title", preview.Title)
+	assert.Equal(t, "A description", preview.Description)
+	assert.Equal(t, "Example", preview.SiteName)
+	assert.Equal(t, id.ContentURIString("mxc://example.com/image.png"), preview.ImageURL)
+	assert.Equal(t, "image/png", preview.ImageType)
+	assert.EqualValues(t, 40, preview.ImageWidth)
+	assert.EqualValues(t, 30, preview.ImageHeight)
+	assert.NotZero(t, preview.ImageSize)
+
+	// The second request should come from the cache
+	cached, err := up.GetBeeperPreview(context.Background(), srv.URL+"/redirect")
+	require.NoError(t, err)
+	assert.Equal(t, srv.URL+"/redirect", cached.MatchedURL)
+	assert.Equal(t, preview.Title, cached.Title)
+	assert.Equal(t, 1, *uploads)
+}
+
+func TestURLPreviewer_OEmbed(t *testing.T) {
+	srv := newTestPreviewServer(t)
+	up, _ := newTestPreviewer()
+	preview, err := up.GetPreview(context.Background(), srv.URL+"/oembed")
+	require.NoError(t, err)
+	assert.Equal(t, "oEmbed title", preview.Title)
+	assert.Equal(t, "Provider", preview.SiteName)
+	assert.Equal(t, id.ContentURIString("mxc://example.com/image.png"), preview.ImageURL)
+}
+
+func TestURLPreviewer_DirectImage(t *testing.T) {
+	srv := newTestPreviewServer(t)
+	up, _ := newTestPreviewer()
+	preview, err := up.GetPreview(context.Background(), srv.URL+"/image.png")
+	require.NoError(t, err)
+	assert.Equal(t, "image.png", preview.Title)
+	assert.Equal(t, id.ContentURIString("mxc://example.com/image.png"), preview.ImageURL)
+	assert.EqualValues(t, 40, preview.ImageWidth)
+}
+
+func TestURLPreviewer_Errors(t *testing.T) {
+	srv := newTestPreviewServer(t)
+	up, _ := newTestPreviewer()
+	ctx := context.Background()
+	_, err := up.GetPreview(ctx, "file:///etc/passwd")
+	assert.ErrorIs(t, err, ErrInvalidPreviewURL)
+	_, err = up.GetPreview(ctx, srv.URL+"/empty")
+	assert.ErrorIs(t, err, ErrNoPreviewMetadata)
+	_, err = up.GetPreview(ctx, srv.URL+"/file.zip")
+	assert.ErrorIs(t, err, ErrUnsupportedPreviewContent)
+
+	blocked := NewURLPreviewer(exhttp.SensibleClientSettings)
+	_, err = blocked.GetPreview(ctx, srv.URL+"/page")
+	assert.ErrorIs(t, err, federation.ErrIPFiltered)
+}
+
+func TestMediaProxy_PreviewURL(t *testing.T) {
+	srv := newTestPreviewServer(t)
+	mp, err := New("example.com", federation.GenerateSigningKey().SynapseString(), nil)
+	require.NoError(t, err)
+	doRequest := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/preview_url?url="+url.QueryEscape(target), nil)
+		w := httptest.NewRecorder()
+		mp.ClientMediaRouter.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusNotImplemented, doRequest(srv.URL+"/page").Code)
+
+	mp.URLPreviewer, _ = newTestPreviewer()
+	resp := doRequest(srv.URL + "/page")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var preview event.LinkPreview
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &preview))
+	assert.Equal(t, "OpenGraph title", preview.Title)
+	assert.Equal(t, http.StatusBadRequest, doRequest("not a url").Code)
+}
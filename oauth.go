@@ -204,6 +204,50 @@ func (cli *Client) OAuthPollDeviceCode(ctx context.Context, params oauth.PollDev
 	return
 }
 
+// OAuthLoadTokens loads tokens from [Client.OAuthTokenStore] into the client.
+// The returned bool is false if there's no token store or it doesn't contain tokens.
+func (cli *Client) OAuthLoadTokens(ctx context.Context) (bool, error) {
+	if cli.OAuthTokenStore == nil {
+		return false, nil
+	}
+	tokens, err := cli.OAuthTokenStore.LoadTokens(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to load OAuth tokens: %w", err)
+	} else if tokens == nil {
+		return false, nil
+	}
+	cli.OAuthSetTokens(tokens.ClientID, tokens.RefreshToken, tokens.AccessToken, tokens.Expiry)
+	if tokens.UserID != "" {
+		cli.UserID = tokens.UserID
+	}
+	if tokens.DeviceID != "" {
+		cli.DeviceID = tokens.DeviceID
+	}
+	return true, nil
+}
+
+func (cli *Client) saveOAuthTokens(ctx context.Context, refreshToken, accessToken string, expiry time.Time) error {
+	if cli.SaveNewToken != nil {
+		if err := cli.SaveNewToken(ctx, refreshToken, accessToken, expiry); err != nil {
+			return err
+		}
+	}
+	if cli.OAuthTokenStore != nil {
+		err := cli.OAuthTokenStore.SaveTokens(ctx, &oauth.Tokens{
+			ClientID:     cli.oauthClientID,
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+			Expiry:       expiry,
+			UserID:       cli.UserID,
+			DeviceID:     cli.DeviceID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save OAuth tokens: %w", err)
+		}
+	}
+	return nil
+}
+
 const (
 	tokenRefreshBuffer     = 10 * time.Second
 	syncTokenRefreshBuffer = 60 * time.Second
@@ -285,7 +329,7 @@ func (cli *Client) OAuthRefreshToken(ctx context.Context, buffer time.Duration)
 			resp.RefreshToken = cli.refreshToken
 		}
 		expiry := start.Add(resp.ExpiresIn.Duration)
-		err = cli.SaveNewToken(ctx, resp.RefreshToken, resp.AccessToken, expiry)
+		err = cli.saveOAuthTokens(ctx, resp.RefreshToken, resp.AccessToken, expiry)
 		if err == nil {
 			cli.refreshToken = resp.RefreshToken
 			cli.AccessToken = resp.AccessToken
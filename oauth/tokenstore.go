@@ -0,0 +1,112 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// Tokens are the persisted credentials of an OAuth session.
+type Tokens struct {
+	ClientID     string      `json:"client_id"`
+	AccessToken  string      `json:"access_token"`
+	RefreshToken string      `json:"refresh_token,omitempty"`
+	Expiry       time.Time   `json:"expiry,omitzero"`
+	UserID       id.UserID   `json:"user_id,omitempty"`
+	DeviceID     id.DeviceID `json:"device_id,omitempty"`
+}
+
+// TokenStore persists OAuth tokens, so that refreshed tokens survive restarts.
+type TokenStore interface {
+	// LoadTokens returns the stored tokens, or nil if there are none.
+	LoadTokens(ctx context.Context) (*Tokens, error)
+	// SaveTokens replaces the stored tokens.
+	SaveTokens(ctx context.Context, tokens *Tokens) error
+}
+
+// MemoryTokenStore is a [TokenStore] that only keeps tokens in memory.
+type MemoryTokenStore struct {
+	lock   sync.RWMutex
+	tokens *Tokens
+}
+
+var _ TokenStore = (*MemoryTokenStore)(nil)
+
+func (mts *MemoryTokenStore) LoadTokens(_ context.Context) (*Tokens, error) {
+	mts.lock.RLock()
+	defer mts.lock.RUnlock()
+	if mts.tokens == nil {
+		return nil, nil
+	}
+	tokens := *mts.tokens
+	return &tokens, nil
+}
+
+func (mts *MemoryTokenStore) SaveTokens(_ context.Context, tokens *Tokens) error {
+	mts.lock.Lock()
+	defer mts.lock.Unlock()
+	saved := *tokens
+	mts.tokens = &saved
+	return nil
+}
+
+// FileTokenStore is a [TokenStore] that stores tokens in a JSON file which is only readable by the current user.
+type FileTokenStore struct {
+	Path string
+	lock sync.Mutex
+}
+
+var _ TokenStore = (*FileTokenStore)(nil)
+
+// NewFileTokenStore creates a token store that saves tokens to the given path.
+func NewFileTokenStore(path string) *FileTokenStore {
+	return &FileTokenStore{Path: path}
+}
+
+func (fts *FileTokenStore) LoadTokens(_ context.Context) (*Tokens, error) {
+	fts.lock.Lock()
+	defer fts.lock.Unlock()
+	data, err := os.ReadFile(fts.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	var tokens Tokens
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse token file: %w", err)
+	}
+	return &tokens, nil
+}
+
+func (fts *FileTokenStore) SaveTokens(_ context.Context, tokens *Tokens) error {
+	fts.lock.Lock()
+	defer fts.lock.Unlock()
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tokens: %w", err)
+	}
+	// Write to a temporary file first so that a crash doesn't leave a truncated token file behind
+	tempPath := fts.Path + ".tmp"
+	if err = os.MkdirAll(filepath.Dir(fts.Path), 0700); err != nil {
+		return fmt.Errorf("failed to create token directory: %w", err)
+	} else if err = os.WriteFile(tempPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write token file: %w", err)
+	} else if err = os.Rename(tempPath, fts.Path); err != nil {
+		return fmt.Errorf("failed to replace token file: %w", err)
+	}
+	return nil
+}
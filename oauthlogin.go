@@ -0,0 +1,194 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/random"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/oauth"
+)
+
+var ErrOAuthStateMismatch = errors.New("OAuth callback state doesn't match")
+
+// OAuthLoginParams are the parameters for [Client.OAuthLogin].
+type OAuthLoginParams struct {
+	// ClientID is an already registered client ID. If empty, the client ID set in the client is used,
+	// and if that's empty too, the client is registered dynamically using ClientMetadata.
+	ClientID string
+	// ClientMetadata is the metadata used for dynamic client registration. Redirect URIs, grant types,
+	// response types, application type and token endpoint auth method are filled automatically.
+	ClientMetadata oauth.ClientMetadata
+	// DeviceID is the device ID to request. A random one is generated if empty.
+	DeviceID id.DeviceID
+	// ExtraScopes are requested in addition to the client API and device scopes.
+	ExtraScopes oauth.ScopeList
+	UserIDHint  id.UserID
+
+	// ListenAddress is the loopback address for the redirect listener. Defaults to 127.0.0.1 with a random port.
+	ListenAddress string
+	// OpenURL is called with the authorization URL. It should open the URL in a browser.
+	// If nil, the URL is printed to stdout.
+	OpenURL func(ctx context.Context, url string) error
+	// CallbackResponse is the plain text shown in the browser after the redirect.
+	CallbackResponse string
+}
+
+const oauthCallbackPath = "/oauth/callback"
+
+type oauthCallbackResult struct {
+	code string
+	err  error
+}
+
+func printOAuthURL(_ context.Context, url string) error {
+	_, err := fmt.Printf("Open the following URL in your browser to log in:\n%s\n", url)
+	return err
+}
+
+// OAuthLogin logs in using the OAuth authorization code grant with PKCE, receiving the authorization code
+// through a temporary HTTP server on a loopback address as described in RFC 8252.
+//
+// After a successful login, the client's user ID, device ID and tokens are set, and the tokens are saved
+// to [Client.OAuthTokenStore] if one is set.
+func (cli *Client) OAuthLogin(ctx context.Context, params OAuthLoginParams) (*oauth.TokenResponse, error) {
+	log := zerolog.Ctx(ctx)
+	listener, err := net.Listen("tcp", cmp.Or(params.ListenAddress, "127.0.0.1:0"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start redirect listener: %w", err)
+	}
+	defer listener.Close()
+	// RFC 8252 section 7.3: authorization servers must allow any port for loopback redirect URIs
+	port := listener.Addr().(*net.TCPAddr).Port
+	redirectHost := "127.0.0.1"
+	if ip := listener.Addr().(*net.TCPAddr).IP; ip.To4() == nil && !ip.IsUnspecified() {
+		redirectHost = "[::1]"
+	}
+	registeredRedirectURI := fmt.Sprintf("http://%s%s", redirectHost, oauthCallbackPath)
+	redirectURI := fmt.Sprintf("http://%s:%d%s", redirectHost, port, oauthCallbackPath)
+
+	clientID := cmp.Or(params.ClientID, cli.oauthClientID)
+	if clientID == "" {
+		clientMeta := params.ClientMetadata
+		clientMeta.ApplicationType = oauth.ApplicationTypeNative
+		clientMeta.RedirectURIs = []string{registeredRedirectURI}
+		clientMeta.GrantTypes = []oauth.GrantType{oauth.GrantTypeAuthorizationCode, oauth.GrantTypeRefreshToken}
+		clientMeta.ResponseTypes = []oauth.ResponseType{oauth.ResponseTypeCode}
+		clientMeta.TokenEndpointAuthMethod = oauth.AuthMethodNone
+		registered, err := cli.OAuthRegisterClient(ctx, &clientMeta)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register client: %w", err)
+		}
+		clientID = registered.ClientID
+	}
+	cli.refreshLock.Lock()
+	cli.oauthClientID = clientID
+	cli.refreshLock.Unlock()
+
+	deviceID := params.DeviceID
+	if deviceID == "" {
+		deviceID = id.DeviceID(strings.ToUpper(random.String(10)))
+	}
+	authReq, err := cli.OAuthGetAuthorizationURL(ctx, oauth.GetAuthorizationURLParams{
+		RedirectURI:  redirectURI,
+		Scopes:       append(oauth.ScopeList{oauth.ScopeClientAPI, oauth.ScopeDevice(deviceID)}, params.ExtraScopes...),
+		UserIDHint:   params.UserIDHint,
+		ClientID:     clientID,
+		ResponseMode: oauth.ResponseModeQuery,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build authorization URL: %w", err)
+	}
+
+	resultChan := make(chan oauthCallbackResult, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+oauthCallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("state") != authReq.State {
+			// Don't abort the login, the request may not have come from the authorization server
+			log.Warn().Msg("Received OAuth callback with mismatching state")
+			http.Error(w, ErrOAuthStateMismatch.Error(), http.StatusBadRequest)
+			return
+		}
+		var result oauthCallbackResult
+		if errCode := query.Get("error"); errCode != "" {
+			result.err = RespError{ErrCode: errCode, Err: query.Get("error_description"), OAuth: true}
+			http.Error(w, "Login failed: "+result.err.Error(), http.StatusBadRequest)
+		} else if result.code = query.Get("code"); result.code == "" {
+			http.Error(w, "Missing authorization code", http.StatusBadRequest)
+			return
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write([]byte(cmp.Or(params.CallbackResponse, "Login successful, you can close this window.")))
+		}
+		select {
+		case resultChan <- result:
+		default:
+		}
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			resultChan <- oauthCallbackResult{err: fmt.Errorf("redirect listener failed: %w", err)}
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	openURL := params.OpenURL
+	if openURL == nil {
+		openURL = printOAuthURL
+	}
+	if err = openURL(ctx, authReq.URL); err != nil {
+		return nil, fmt.Errorf("failed to open authorization URL: %w", err)
+	}
+	var result oauthCallbackResult
+	select {
+	case result = <-resultChan:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	resp, err := cli.OAuthExchangeToken(ctx, oauth.ExchangeTokenParams{
+		CodeVerifier:     authReq.CodeVerifier,
+		RedirectURI:      redirectURI,
+		Code:             result.code,
+		ClientID:         clientID,
+		StoreCredentials: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange authorization code: %w", err)
+	}
+	cli.refreshLock.Lock()
+	cli.longTokenLifetime = resp.ExpiresIn.Duration > 1*time.Hour
+	expiry := cli.accessTokenExpiry
+	cli.refreshLock.Unlock()
+	whoami, err := cli.Whoami(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get own user ID: %w", err)
+	}
+	cli.UserID = whoami.UserID
+	cli.DeviceID = cmp.Or(whoami.DeviceID, deviceID)
+	err = cli.saveOAuthTokens(ctx, resp.RefreshToken, resp.AccessToken, expiry)
+	return resp, err
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/oauth"
+)
+
+func TestClient_OAuthLogin(t *testing.T) {
+	var codeChallenge string
+	refreshCount := 0
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	writeJSON := func(w http.ResponseWriter, data any) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(data)
+	}
+	mux.HandleFunc("GET /_matrix/client/v1/auth_metadata", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/oauth/authorize",
+			"registration_endpoint":  server.URL + "/oauth/register",
+			"token_endpoint":         server.URL + "/oauth/token",
+		})
+	})
+	mux.HandleFunc("POST /oauth/register", func(w http.ResponseWriter, r *http.Request) {
+		var meta oauth.ClientMetadata
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&meta))
+		assert.Equal(t, oauth.ApplicationTypeNative, meta.ApplicationType)
+		assert.Equal(t, []string{"http://127.0.0.1/oauth/callback"}, meta.RedirectURIs)
+		assert.Equal(t, "Test client", meta.ClientName)
+		meta.ClientID = "registered-client"
+		writeJSON(w, meta)
+	})
+	mux.HandleFunc("POST /oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "registered-client", r.PostForm.Get("client_id"))
+		switch r.PostForm.Get("grant_type") {
+		case string(oauth.GrantTypeAuthorizationCode):
+			assert.Equal(t, "authcode", r.PostForm.Get("code"))
+			verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			assert.Equal(t, codeChallenge, base64.RawURLEncoding.EncodeToString(verifierHash[:]))
+			writeJSON(w, map[string]any{"access_token": "access1", "refresh_token": "refresh1", "token_type": "Bearer", "expires_in": 300})
+		case string(oauth.GrantTypeRefreshToken):
+			refreshCount++
+			assert.Equal(t, "refresh1", r.PostForm.Get("refresh_token"))
+			writeJSON(w, map[string]any{"access_token": "access2", "refresh_token": "refresh2", "token_type": "Bearer", "expires_in": 300})
+		}
+	})
+	mux.HandleFunc("GET /_matrix/client/v3/account/whoami", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer access1", r.Header.Get("Authorization"))
+		writeJSON(w, map[string]any{"user_id": "@alice:example.com", "device_id": "DEVICE"})
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cli := newTestClient(t, server.URL)
+	store := &oauth.MemoryTokenStore{}
+	cli.OAuthTokenStore = store
+	_, err := cli.OAuthLogin(ctx, OAuthLoginParams{
+		ClientMetadata: oauth.ClientMetadata{ClientName: "Test client"},
+		DeviceID:       "DEVICE",
+		OpenURL: func(ctx context.Context, authURL string) error {
+			parsed, err := url.Parse(authURL)
+			require.NoError(t, err)
+			q := parsed.Query()
+			assert.Equal(t, "S256", q.Get("code_challenge_method"))
+			assert.Contains(t, q.Get("scope"), "urn:matrix:client:device:DEVICE")
+			codeChallenge = q.Get("code_challenge")
+			redirectURI := q.Get("redirect_uri")
+			// Simulate the browser being redirected back, first with a forged state
+			resp, err := http.Get(redirectURI + "?code=evil&state=wrong")
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			go func() {
+				resp, err := http.Get(redirectURI + "?code=authcode&state=" + url.QueryEscape(q.Get("state")))
+				if err == nil {
+					_ = resp.Body.Close()
+				}
+			}()
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@alice:example.com"), cli.UserID)
+	assert.Equal(t, id.DeviceID("DEVICE"), cli.DeviceID)
+	assert.Equal(t, "access1", cli.AccessToken)
+
+	saved, err := store.LoadTokens(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, saved)
+	assert.Equal(t, "registered-client", saved.ClientID)
+	assert.Equal(t, "refresh1", saved.RefreshToken)
+	assert.Equal(t, id.UserID("@alice:example.com"), saved.UserID)
+
+	// Refreshed tokens are persisted to the same store
+	require.NoError(t, cli.OAuthRefreshToken(ctx, 10*time.Minute))
+	assert.Equal(t, 1, refreshCount)
+	saved, err = store.LoadTokens(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "access2", saved.AccessToken)
+	assert.Equal(t, "refresh2", saved.RefreshToken)
+
+	restored := newTestClient(t, server.URL)
+	restored.OAuthTokenStore = store
+	found, err := restored.OAuthLoadTokens(ctx)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "access2", restored.AccessToken)
+	assert.Equal(t, id.DeviceID("DEVICE"), restored.DeviceID)
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package policylist
+
+import (
+	"crypto/sha256"
+	"strings"
+
+	"go.mau.fi/util/glob"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// EntityType is the type of entity that a policy applies to.
+type EntityType string
+
+const (
+	EntityTypeUser   EntityType = "user"
+	EntityTypeRoom   EntityType = "room"
+	EntityTypeServer EntityType = "server"
+)
+
+// EntityTypeOf returns the entity type of the given policy event type, or an empty string if the type is not a policy.
+// The stable, legacy and mjolnir variants of the event types are all supported.
+func EntityTypeOf(evtType event.Type) EntityType {
+	switch evtType.Type {
+	case event.StatePolicyUser.Type, event.StateLegacyPolicyUser.Type, event.StateUnstablePolicyUser.Type:
+		return EntityTypeUser
+	case event.StatePolicyRoom.Type, event.StateLegacyPolicyRoom.Type, event.StateUnstablePolicyRoom.Type:
+		return EntityTypeRoom
+	case event.StatePolicyServer.Type, event.StateLegacyPolicyServer.Type, event.StateUnstablePolicyServer.Type:
+		return EntityTypeServer
+	default:
+		return ""
+	}
+}
+
+// NormalizeRecommendation converts unstable recommendations to their stable equivalents.
+func NormalizeRecommendation(recommendation event.PolicyRecommendation) event.PolicyRecommendation {
+	switch recommendation {
+	case event.PolicyRecommendationUnstableBan:
+		return event.PolicyRecommendationBan
+	default:
+		return recommendation
+	}
+}
+
+func isKnownRecommendation(recommendation event.PolicyRecommendation) bool {
+	switch recommendation {
+	case event.PolicyRecommendationBan, event.PolicyRecommendationUnstableTakedown, event.PolicyRecommendationUnban:
+		return true
+	default:
+		return false
+	}
+}
+
+// Policy is a single parsed policy rule from a policy list room.
+type Policy struct {
+	*event.ModPolicyContent
+	RoomID     id.RoomID
+	EventID    id.EventID
+	Type       event.Type
+	StateKey   string
+	Sender     id.UserID
+	Timestamp  int64
+	EntityType EntityType
+	// Recommendation is the normalized recommendation of the policy.
+	Recommendation event.PolicyRecommendation
+
+	// EntityHash is set instead of Pattern for hashed policies.
+	EntityHash *[32]byte
+	// Pattern is the compiled glob pattern of the entity.
+	Pattern glob.Glob
+}
+
+// ParsePolicy parses a policy state event. It returns nil if the event isn't a valid policy,
+// which includes events that remove a policy (i.e. have empty content).
+func ParsePolicy(evt *event.Event) *Policy {
+	entityType := EntityTypeOf(evt.Type)
+	if entityType == "" || evt.StateKey == nil {
+		return nil
+	}
+	if evt.Content.Parsed == nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	content, ok := evt.Content.Parsed.(*event.ModPolicyContent)
+	if !ok {
+		return nil
+	}
+	policy := &Policy{
+		ModPolicyContent: content,
+		RoomID:           evt.RoomID,
+		EventID:          evt.ID,
+		Type:             evt.Type,
+		StateKey:         *evt.StateKey,
+		Sender:           evt.Sender,
+		Timestamp:        evt.Timestamp,
+		EntityType:       entityType,
+		Recommendation:   NormalizeRecommendation(content.Recommendation),
+	}
+	if !isKnownRecommendation(policy.Recommendation) {
+		return nil
+	}
+	if hash := content.UnstableHashes.DecodeSHA256(); hash != nil {
+		policy.EntityHash = hash
+	} else if content.Entity != "" {
+		policy.Pattern = glob.Compile(content.Entity)
+		if policy.Pattern == nil {
+			return nil
+		}
+	} else {
+		return nil
+	}
+	return policy
+}
+
+// IsExact returns true if the policy matches exactly one entity (i.e. it's hashed or has no wildcards).
+func (p *Policy) IsExact() bool {
+	if p.EntityHash != nil {
+		return true
+	}
+	_, isExact := p.Pattern.(glob.ExactGlob)
+	return isExact
+}
+
+// Match checks if the policy applies to the given entity.
+func (p *Policy) Match(entity string) bool {
+	if p.EntityHash != nil {
+		return sha256.Sum256([]byte(entity)) == *p.EntityHash
+	}
+	return p.Pattern.Match(entity)
+}
+
+// Match is the list of policies that matched an entity.
+type Match []*Policy
+
+// Recommendation returns the effective recommendation of the matched policies.
+//
+// Unban recommendations override all other recommendations, and takedowns take precedence over bans.
+// If there are no matches, an empty string is returned.
+func (m Match) Recommendation() event.PolicyRecommendation {
+	var output event.PolicyRecommendation
+	for _, policy := range m {
+		switch policy.Recommendation {
+		case event.PolicyRecommendationUnban:
+			return ""
+		case event.PolicyRecommendationUnstableTakedown:
+			output = policy.Recommendation
+		case event.PolicyRecommendationBan:
+			if output == "" {
+				output = policy.Recommendation
+			}
+		}
+	}
+	return output
+}
+
+// Reasons returns the non-empty reasons of all matched policies.
+func (m Match) Reasons() []string {
+	reasons := make([]string, 0, len(m))
+	for _, policy := range m {
+		if strings.TrimSpace(policy.Reason) != "" {
+			reasons = append(reasons, policy.Reason)
+		}
+	}
+	return reasons
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package policylist implements evaluation of moderation policy lists (m.policy.rule.* state events).
+//
+// See https://spec.matrix.org/v1.15/client-server-api/#moderation-policy-lists
+package policylist
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ChangeHandler is called when a policy is added, changed or removed.
+// The previous policy is nil for new policies and the new policy is nil for removed policies.
+type ChangeHandler func(ctx context.Context, prev, new *Policy)
+
+type policyKey struct {
+	Type     string
+	StateKey string
+}
+
+type ruleSet struct {
+	byKey  map[policyKey]*Policy
+	exact  map[string][]*Policy
+	hashes map[[32]byte][]*Policy
+	globs  []*Policy
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{
+		byKey:  make(map[policyKey]*Policy),
+		exact:  make(map[string][]*Policy),
+		hashes: make(map[[32]byte][]*Policy),
+	}
+}
+
+func removePolicy(list []*Policy, policy *Policy) []*Policy {
+	return slices.DeleteFunc(list, func(item *Policy) bool {
+		return item == policy
+	})
+}
+
+func (rs *ruleSet) add(policy *Policy) {
+	rs.byKey[policyKey{policy.Type.Type, policy.StateKey}] = policy
+	if policy.EntityHash != nil {
+		rs.hashes[*policy.EntityHash] = append(rs.hashes[*policy.EntityHash], policy)
+	} else if policy.IsExact() {
+		rs.exact[policy.Entity] = append(rs.exact[policy.Entity], policy)
+	} else {
+		rs.globs = append(rs.globs, policy)
+	}
+}
+
+func (rs *ruleSet) remove(key policyKey) *Policy {
+	policy, ok := rs.byKey[key]
+	if !ok {
+		return nil
+	}
+	delete(rs.byKey, key)
+	if policy.EntityHash != nil {
+		rs.hashes[*policy.EntityHash] = removePolicy(rs.hashes[*policy.EntityHash], policy)
+		if len(rs.hashes[*policy.EntityHash]) == 0 {
+			delete(rs.hashes, *policy.EntityHash)
+		}
+	} else if policy.IsExact() {
+		rs.exact[policy.Entity] = removePolicy(rs.exact[policy.Entity], policy)
+		if len(rs.exact[policy.Entity]) == 0 {
+			delete(rs.exact, policy.Entity)
+		}
+	} else {
+		rs.globs = removePolicy(rs.globs, policy)
+	}
+	return policy
+}
+
+func (rs *ruleSet) match(entity string, output Match) Match {
+	output = append(output, rs.exact[entity]...)
+	if len(rs.hashes) > 0 {
+		output = append(output, rs.hashes[sha256.Sum256([]byte(entity))]...)
+	}
+	for _, policy := range rs.globs {
+		if policy.Match(entity) {
+			output = append(output, policy)
+		}
+	}
+	return output
+}
+
+type policyRoom struct {
+	users   *ruleSet
+	rooms   *ruleSet
+	servers *ruleSet
+}
+
+func newPolicyRoom() *policyRoom {
+	return &policyRoom{
+		users:   newRuleSet(),
+		rooms:   newRuleSet(),
+		servers: newRuleSet(),
+	}
+}
+
+func (pr *policyRoom) get(entityType EntityType) *ruleSet {
+	switch entityType {
+	case EntityTypeUser:
+		return pr.users
+	case EntityTypeRoom:
+		return pr.rooms
+	case EntityTypeServer:
+		return pr.servers
+	default:
+		return nil
+	}
+}
+
+// Store contains the policies of all watched policy list rooms.
+type Store struct {
+	rooms map[id.RoomID]*policyRoom
+	// order is the order in which rooms were watched, which is also the order of match results.
+	order    []id.RoomID
+	lock     sync.RWMutex
+	handlers []ChangeHandler
+}
+
+// NewStore creates a new empty policy store.
+func NewStore() *Store {
+	return &Store{
+		rooms: make(map[id.RoomID]*policyRoom),
+	}
+}
+
+// Register adds the store's event handler to the given syncer, so that policy events in watched rooms
+// are applied automatically.
+func (s *Store) Register(syncer mautrix.ExtensibleSyncer) {
+	syncer.OnEvent(s.HandleEvent)
+}
+
+// OnChange adds a handler that is called whenever a policy in a watched room changes.
+func (s *Store) OnChange(handler ChangeHandler) {
+	s.lock.Lock()
+	s.handlers = append(s.handlers, handler)
+	s.lock.Unlock()
+}
+
+// Watch starts tracking policies in the given room. Events in rooms that aren't watched are ignored.
+func (s *Store) Watch(roomID id.RoomID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.rooms[roomID]; !ok {
+		s.rooms[roomID] = newPolicyRoom()
+		s.order = append(s.order, roomID)
+	}
+}
+
+// Unwatch stops tracking policies in the given room and removes all of its policies.
+// Change handlers are not called for the removed policies.
+func (s *Store) Unwatch(roomID id.RoomID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.rooms, roomID)
+	s.order = slices.DeleteFunc(s.order, func(item id.RoomID) bool {
+		return item == roomID
+	})
+}
+
+// IsWatched returns true if the given room is being tracked.
+func (s *Store) IsWatched(roomID id.RoomID) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.rooms[roomID]
+	return ok
+}
+
+// Load fetches the full state of the given room and starts watching it, replacing any policies already in the store.
+func (s *Store) Load(ctx context.Context, cli *mautrix.Client, roomID id.RoomID) error {
+	state, err := cli.State(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get room state: %w", err)
+	}
+	s.LoadState(ctx, roomID, state)
+	return nil
+}
+
+// LoadState replaces the policies of the given room with the policies in the given room state and starts watching the room.
+func (s *Store) LoadState(ctx context.Context, roomID id.RoomID, state mautrix.RoomStateMap) {
+	s.lock.Lock()
+	room, ok := s.rooms[roomID]
+	if !ok {
+		s.order = append(s.order, roomID)
+	}
+	oldRoom := room
+	room = newPolicyRoom()
+	s.rooms[roomID] = room
+	var changes [][2]*Policy
+	for evtType, events := range state {
+		entityType := EntityTypeOf(evtType)
+		if entityType == "" {
+			continue
+		}
+		for _, evt := range events {
+			evt.RoomID = roomID
+			policy := ParsePolicy(evt)
+			if policy == nil {
+				continue
+			}
+			room.get(entityType).add(policy)
+			var prev *Policy
+			if oldRoom != nil {
+				prev = oldRoom.get(entityType).remove(policyKey{policy.Type.Type, policy.StateKey})
+			}
+			if prev == nil || prev.EventID != policy.EventID {
+				changes = append(changes, [2]*Policy{prev, policy})
+			}
+		}
+	}
+	if oldRoom != nil {
+		for _, rs := range []*ruleSet{oldRoom.users, oldRoom.rooms, oldRoom.servers} {
+			for _, removed := range rs.byKey {
+				changes = append(changes, [2]*Policy{removed, nil})
+			}
+		}
+	}
+	handlers := s.handlers
+	s.lock.Unlock()
+	for _, change := range changes {
+		for _, handler := range handlers {
+			handler(ctx, change[0], change[1])
+		}
+	}
+}
+
+// HandleEvent applies a policy state event to the store. Events that aren't policies or are in rooms
+// that aren't watched are ignored.
+func (s *Store) HandleEvent(ctx context.Context, evt *event.Event) {
+	entityType := EntityTypeOf(evt.Type)
+	if entityType == "" || evt.StateKey == nil {
+		return
+	}
+	s.lock.Lock()
+	room, ok := s.rooms[evt.RoomID]
+	if !ok {
+		s.lock.Unlock()
+		return
+	}
+	rs := room.get(entityType)
+	prev := rs.remove(policyKey{evt.Type.Type, *evt.StateKey})
+	policy := ParsePolicy(evt)
+	if policy != nil {
+		rs.add(policy)
+	}
+	handlers := s.handlers
+	s.lock.Unlock()
+	if prev == nil && policy == nil {
+		return
+	}
+	for _, handler := range handlers {
+		handler(ctx, prev, policy)
+	}
+}
+
+func (s *Store) match(entityType EntityType, entity string) Match {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var output Match
+	for _, roomID := range s.order {
+		output = s.rooms[roomID].get(entityType).match(entity, output)
+	}
+	return output
+}
+
+// MatchUser returns all user policies that match the given user ID.
+//
+// Server policies are not checked, use [Store.MatchServer] with the user's server name to check them.
+func (s *Store) MatchUser(userID id.UserID) Match {
+	return s.match(EntityTypeUser, string(userID))
+}
+
+// MatchRoom returns all room policies that match the given room ID.
+func (s *Store) MatchRoom(roomID id.RoomID) Match {
+	return s.match(EntityTypeRoom, string(roomID))
+}
+
+// MatchServer returns all server policies that match the given server name.
+func (s *Store) MatchServer(serverName string) Match {
+	return s.match(EntityTypeServer, serverName)
+}
+
+// ListPolicies returns all policies of the given entity type in the given room.
+func (s *Store) ListPolicies(roomID id.RoomID, entityType EntityType) []*Policy {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	room, ok := s.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	rs := room.get(entityType)
+	if rs == nil {
+		return nil
+	}
+	output := make([]*Policy, 0, len(rs.byKey))
+	for _, policy := range rs.byKey {
+		output = append(output, policy)
+	}
+	return output
+}
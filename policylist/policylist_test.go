@@ -0,0 +1,133 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package policylist_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/policylist"
+)
+
+const testPolicyRoom = id.RoomID("!policies:example.com")
+
+func makePolicyEvent(evtType event.Type, stateKey string, content *event.ModPolicyContent) *event.Event {
+	evt := &event.Event{
+		Type:     evtType,
+		RoomID:   testPolicyRoom,
+		ID:       id.EventID("$" + evtType.Type + stateKey),
+		StateKey: &stateKey,
+	}
+	if content != nil {
+		evt.Content.Parsed = content
+	} else {
+		evt.Content.Parsed = &event.ModPolicyContent{}
+	}
+	return evt
+}
+
+func TestStore_Match(t *testing.T) {
+	ctx := context.Background()
+	store := policylist.NewStore()
+	var changes int
+	store.OnChange(func(ctx context.Context, prev, new *policylist.Policy) {
+		changes++
+	})
+
+	// Events in rooms that aren't watched are ignored
+	store.HandleEvent(ctx, makePolicyEvent(event.StatePolicyUser, "spam", &event.ModPolicyContent{
+		Entity:         "@spam:example.com",
+		Recommendation: event.PolicyRecommendationBan,
+	}))
+	assert.Empty(t, store.MatchUser("@spam:example.com"))
+
+	store.Watch(testPolicyRoom)
+	store.HandleEvent(ctx, makePolicyEvent(event.StatePolicyUser, "spam", &event.ModPolicyContent{
+		Entity:         "@spam:example.com",
+		Recommendation: event.PolicyRecommendationBan,
+		Reason:         "spam",
+	}))
+	store.HandleEvent(ctx, makePolicyEvent(event.StateUnstablePolicyUser, "bots", &event.ModPolicyContent{
+		Entity:         "@*bot:evil.com",
+		Recommendation: event.PolicyRecommendationUnstableBan,
+	}))
+	store.HandleEvent(ctx, makePolicyEvent(event.StatePolicyServer, "evil", &event.ModPolicyContent{
+		Entity:         "*.evil.com",
+		Recommendation: event.PolicyRecommendationUnstableTakedown,
+	}))
+	hash := sha256.Sum256([]byte("!secret:example.com"))
+	store.HandleEvent(ctx, makePolicyEvent(event.StatePolicyRoom, "hashed", &event.ModPolicyContent{
+		Recommendation: event.PolicyRecommendationBan,
+		UnstableHashes: &event.PolicyHashes{SHA256: base64.StdEncoding.EncodeToString(hash[:])},
+	}))
+	store.HandleEvent(ctx, makePolicyEvent(event.StatePolicyRoom, "unknown", &event.ModPolicyContent{
+		Entity:         "!unknown:example.com",
+		Recommendation: "com.example.unknown",
+	}))
+	assert.Equal(t, 4, changes)
+
+	match := store.MatchUser("@spam:example.com")
+	require.Len(t, match, 1)
+	assert.Equal(t, event.PolicyRecommendationBan, match.Recommendation())
+	assert.Equal(t, []string{"spam"}, match.Reasons())
+	assert.Equal(t, event.PolicyRecommendationBan, store.MatchUser("@spambot:evil.com").Recommendation())
+	assert.Empty(t, store.MatchUser("@user:evil.com"))
+	assert.Equal(t, event.PolicyRecommendationUnstableTakedown, store.MatchServer("matrix.evil.com").Recommendation())
+	assert.Empty(t, store.MatchServer("evil.com"))
+	assert.Len(t, store.MatchRoom("!secret:example.com"), 1)
+	assert.Empty(t, store.MatchRoom("!unknown:example.com"))
+
+	// Unban policies override bans
+	store.HandleEvent(ctx, makePolicyEvent(event.StatePolicyUser, "unban", &event.ModPolicyContent{
+		Entity:         "@goodbot:evil.com",
+		Recommendation: event.PolicyRecommendationUnban,
+	}))
+	assert.Len(t, store.MatchUser("@goodbot:evil.com"), 2)
+	assert.Equal(t, event.PolicyRecommendation(""), store.MatchUser("@goodbot:evil.com").Recommendation())
+
+	// Empty content removes the policy
+	store.HandleEvent(ctx, makePolicyEvent(event.StatePolicyUser, "spam", nil))
+	assert.Empty(t, store.MatchUser("@spam:example.com"))
+	assert.Equal(t, 6, changes)
+}
+
+func TestStore_LoadState(t *testing.T) {
+	ctx := context.Background()
+	store := policylist.NewStore()
+	store.Watch(testPolicyRoom)
+	store.HandleEvent(ctx, makePolicyEvent(event.StatePolicyUser, "old", &event.ModPolicyContent{
+		Entity:         "@old:example.com",
+		Recommendation: event.PolicyRecommendationBan,
+	}))
+	var added, removed int
+	store.OnChange(func(ctx context.Context, prev, new *policylist.Policy) {
+		if new == nil {
+			removed++
+		} else {
+			added++
+		}
+	})
+	store.LoadState(ctx, testPolicyRoom, map[event.Type]map[string]*event.Event{
+		event.StatePolicyUser: {
+			"new": makePolicyEvent(event.StatePolicyUser, "new", &event.ModPolicyContent{
+				Entity:         "@new:example.com",
+				Recommendation: event.PolicyRecommendationBan,
+			}),
+		},
+	})
+	assert.Equal(t, 1, added)
+	assert.Equal(t, 1, removed)
+	assert.Empty(t, store.MatchUser("@old:example.com"))
+	assert.Len(t, store.MatchUser("@new:example.com"), 1)
+}
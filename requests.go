@@ -181,6 +181,13 @@ type ReqJoinRoom struct {
 	ThirdPartySigned any      `json:"third_party_signed,omitempty"`
 }
 
+// ReqUpgradeRoom is the JSON request for https://spec.matrix.org/v1.15/client-server-api/#post_matrixclientv3roomsroomidupgrade
+type ReqUpgradeRoom struct {
+	NewVersion id.RoomVersion `json:"new_version"`
+	// Room v12+ only
+	AdditionalCreators []id.UserID `json:"additional_creators,omitempty"`
+}
+
 type ReqKnockRoom struct {
 	Via    []string `json:"-"`
 	Reason string   `json:"reason,omitempty"`
@@ -289,6 +296,26 @@ type ReqUploadKeys struct {
 	OneTimeKeys map[id.KeyID]OneTimeKey `json:"one_time_keys,omitempty"`
 }
 
+// DehydratedDeviceData is the encrypted device data of a dehydrated device (MSC3814).
+type DehydratedDeviceData struct {
+	Algorithm    string `json:"algorithm"`
+	DevicePickle string `json:"device_pickle"`
+	Nonce        string `json:"nonce,omitempty"`
+}
+
+type ReqPutDehydratedDevice struct {
+	DeviceID                 id.DeviceID             `json:"device_id"`
+	DeviceData               DehydratedDeviceData    `json:"device_data"`
+	InitialDeviceDisplayName string                  `json:"initial_device_display_name,omitempty"`
+	DeviceKeys               *DeviceKeys             `json:"device_keys"`
+	OneTimeKeys              map[id.KeyID]OneTimeKey `json:"one_time_keys,omitempty"`
+	FallbackKeys             map[id.KeyID]OneTimeKey `json:"fallback_keys,omitempty"`
+}
+
+type ReqDehydratedDeviceEvents struct {
+	NextBatch string `json:"next_batch,omitempty"`
+}
+
 type ReqKeysSignatures struct {
 	UserID     id.UserID              `json:"user_id"`
 	DeviceID   id.DeviceID            `json:"device_id,omitempty"`
@@ -651,6 +678,14 @@ func (rgr *ReqGetRelations) Query() map[string]string {
 	return query
 }
 
+// ThreadListInclude is the include parameter for https://spec.matrix.org/v1.15/client-server-api/#get_matrixclientv1roomsroomidthreads
+type ThreadListInclude string
+
+const (
+	ThreadListIncludeAll          ThreadListInclude = "all"
+	ThreadListIncludeParticipated ThreadListInclude = "participated"
+)
+
 // ReqSuspend is the request body for https://github.com/matrix-org/matrix-spec-proposals/pull/4323
 type ReqSuspend struct {
 	Suspended bool `json:"suspended"`
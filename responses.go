@@ -33,6 +33,11 @@ type RespJoinRoom struct {
 	RoomID id.RoomID `json:"room_id"`
 }
 
+// RespUpgradeRoom is the JSON response for https://spec.matrix.org/v1.15/client-server-api/#post_matrixclientv3roomsroomidupgrade
+type RespUpgradeRoom struct {
+	ReplacementRoom id.RoomID `json:"replacement_room"`
+}
+
 // RespKnockRoom is the JSON response for https://spec.matrix.org/v1.13/client-server-api/#post_matrixclientv3knockroomidoralias
 type RespKnockRoom struct {
 	RoomID id.RoomID `json:"room_id"`
@@ -150,6 +155,13 @@ type RespCreateMXC struct {
 	BeeperCompletedAt jsontime.UnixMilli `json:"com.beeper.completed_at,omitempty"`
 }
 
+// RespCreateResumableUpload is the JSON response for creating a resumable upload with [Client.CreateResumableUpload].
+type RespCreateResumableUpload struct {
+	ContentURI      id.ContentURI      `json:"content_uri"`
+	UploadID        string             `json:"upload_id"`
+	UnusedExpiresAt jsontime.UnixMilli `json:"unused_expires_at,omitempty"`
+}
+
 // RespPreviewURL is the JSON response for https://spec.matrix.org/v1.2/client-server-api/#get_matrixmediav3preview_url
 type RespPreviewURL = event.LinkPreview
 
@@ -507,6 +519,16 @@ type RespUploadKeys struct {
 	OneTimeKeyCounts OTKCount `json:"one_time_key_counts"`
 }
 
+type RespDehydratedDevice struct {
+	DeviceID   id.DeviceID          `json:"device_id"`
+	DeviceData DehydratedDeviceData `json:"device_data,omitzero"`
+}
+
+type RespDehydratedDeviceEvents struct {
+	Events    []*event.Event `json:"events"`
+	NextBatch string         `json:"next_batch"`
+}
+
 type RespQueryKeys struct {
 	Failures        map[string]interface{}                   `json:"failures,omitempty"`
 	DeviceKeys      map[id.UserID]map[id.DeviceID]DeviceKeys `json:"device_keys"`
@@ -783,6 +805,12 @@ type RespGetRelations struct {
 	RecursionDepth int            `json:"recursion_depth,omitempty"`
 }
 
+// RespThreads is the response body for https://spec.matrix.org/v1.15/client-server-api/#get_matrixclientv1roomsroomidthreads
+type RespThreads struct {
+	Chunk     []*event.Event `json:"chunk"`
+	NextBatch string         `json:"next_batch,omitempty"`
+}
+
 // RespSuspended is the response body for https://github.com/matrix-org/matrix-spec-proposals/pull/4323
 type RespSuspended struct {
 	Suspended bool `json:"suspended"`
@@ -0,0 +1,273 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// TusResumableVersion is the version of the tus protocol used for resumable uploads.
+//
+// See https://tus.io/protocols/resumable-upload for the protocol itself. The Matrix variant differs by
+// returning the content URI and an upload ID in a JSON body when creating the upload, so that the
+// content URI can be used before the upload is complete (like with [Client.CreateMXC]).
+const TusResumableVersion = "1.0.0"
+
+// DefaultResumableChunkSize is the chunk size used for resumable uploads if no size is specified.
+const DefaultResumableChunkSize = 8 * 1024 * 1024
+
+// DefaultResumableUploadRetries is the number of consecutive failures allowed in resumable uploads
+// if [Client.ResumableUploadRetries] is not set.
+const DefaultResumableUploadRetries = 5
+
+var (
+	ErrUnexpectedUploadOffset = errors.New("unexpected upload offset from server")
+	ErrNoUploadContent        = errors.New("no content to upload")
+)
+
+// ResumableUpload contains the state of a resumable upload. It can be stored to continue the upload
+// later, e.g. after a restart, using [Client.ContinueResumableUpload].
+type ResumableUpload struct {
+	ID         string        `json:"upload_id"`
+	ContentURI id.ContentURI `json:"content_uri"`
+	Length     int64         `json:"length"`
+	Offset     int64         `json:"offset"`
+}
+
+func (cli *Client) resumableUploadURL(upload *ResumableUpload) string {
+	return cli.BuildURL(MediaURLPath{"unstable", "fi.mau.tus", "session", upload.ID})
+}
+
+// CreateResumableUpload creates a new resumable upload. If mxc is set, the upload will fill that
+// content URI (which must have been created with [Client.CreateMXC]), otherwise a new one is allocated.
+func (cli *Client) CreateResumableUpload(ctx context.Context, length int64, contentType, fileName string, mxc id.ContentURI) (*ResumableUpload, error) {
+	path := MediaURLPath{"unstable", "fi.mau.tus", "upload"}
+	if !mxc.IsEmpty() {
+		path = append(path, mxc.Homeserver, mxc.FileID)
+	}
+	headers := http.Header{
+		"Tus-Resumable": {TusResumableVersion},
+		"Upload-Length": {strconv.FormatInt(length, 10)},
+	}
+	var metadata []string
+	if fileName != "" {
+		metadata = append(metadata, "filename "+base64.StdEncoding.EncodeToString([]byte(fileName)))
+	}
+	if contentType != "" {
+		metadata = append(metadata, "content_type "+base64.StdEncoding.EncodeToString([]byte(contentType)))
+	}
+	if len(metadata) > 0 {
+		headers.Set("Upload-Metadata", strings.Join(metadata, ","))
+	}
+	var resp RespCreateResumableUpload
+	_, err := cli.MakeFullRequest(ctx, FullRequest{
+		Method:       http.MethodPost,
+		URL:          cli.BuildURL(path),
+		Headers:      headers,
+		RequestBytes: []byte{},
+		ResponseJSON: &resp,
+	})
+	if err != nil {
+		return nil, err
+	} else if resp.UploadID == "" {
+		return nil, fmt.Errorf("server didn't return an upload ID")
+	}
+	if mxc.IsEmpty() {
+		mxc = resp.ContentURI
+	}
+	return &ResumableUpload{
+		ID:         resp.UploadID,
+		ContentURI: mxc,
+		Length:     length,
+	}, nil
+}
+
+func parseUploadOffset(resp *http.Response) (int64, error) {
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid Upload-Offset header: %w", ErrUnexpectedUploadOffset, err)
+	}
+	return offset, nil
+}
+
+// GetResumableUploadOffset asks the server how much of the upload it has received and updates upload.Offset.
+func (cli *Client) GetResumableUploadOffset(ctx context.Context, upload *ResumableUpload) (int64, error) {
+	_, resp, err := cli.MakeFullRequestWithResp(ctx, FullRequest{
+		Method:  http.MethodHead,
+		URL:     cli.resumableUploadURL(upload),
+		Headers: http.Header{"Tus-Resumable": {TusResumableVersion}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	offset, err := parseUploadOffset(resp)
+	if err != nil {
+		return 0, err
+	}
+	upload.Offset = offset
+	return offset, nil
+}
+
+// UploadResumableChunk sends the given data to the server at upload.Offset and updates the offset.
+// The request is not retried, as a partially received chunk would make the retry fail.
+func (cli *Client) UploadResumableChunk(ctx context.Context, upload *ResumableUpload, chunk []byte) error {
+	_, resp, err := cli.MakeFullRequestWithResp(ctx, FullRequest{
+		Method: http.MethodPatch,
+		URL:    cli.resumableUploadURL(upload),
+		Headers: http.Header{
+			"Tus-Resumable": {TusResumableVersion},
+			"Upload-Offset": {strconv.FormatInt(upload.Offset, 10)},
+			"Content-Type":  {"application/offset+octet-stream"},
+		},
+		RequestBytes: chunk,
+		MaxAttempts:  1,
+	})
+	if err != nil {
+		return err
+	}
+	offset, err := parseUploadOffset(resp)
+	if err != nil {
+		return err
+	} else if offset != upload.Offset+int64(len(chunk)) {
+		return fmt.Errorf("%w: expected %d, got %d", ErrUnexpectedUploadOffset, upload.Offset+int64(len(chunk)), offset)
+	}
+	upload.Offset = offset
+	return nil
+}
+
+// ContinueResumableUpload reads the rest of the content from the given reader and uploads it in chunks.
+// The reader must be positioned at upload.Offset. At most one chunk is buffered in memory at a time.
+//
+// If a chunk fails to upload, the current offset is fetched from the server and the upload continues
+// from there. [Client.ResumableUploadRetries] is the number of consecutive failures allowed without any progress.
+func (cli *Client) ContinueResumableUpload(ctx context.Context, upload *ResumableUpload, content io.Reader, chunkSize int64) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultResumableChunkSize
+	}
+	log := cli.cliOrContextLog(ctx).With().
+		Str("upload_id", upload.ID).
+		Stringer("mxc", upload.ContentURI).
+		Logger()
+	backoff := cli.DefaultHTTPBackoff
+	if backoff == 0 {
+		backoff = 4 * time.Second
+	}
+	maxBackoff := cli.MaxHTTPBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Minute
+	}
+	maxRetries := cli.ResumableUploadRetries
+	if maxRetries <= 0 {
+		maxRetries = DefaultResumableUploadRetries
+	}
+	buf := make([]byte, min(chunkSize, upload.Length-upload.Offset))
+	failures := 0
+	for upload.Offset < upload.Length {
+		chunkStart := upload.Offset
+		chunk := buf[:min(int64(len(buf)), upload.Length-chunkStart)]
+		_, err := io.ReadFull(content, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to read content at offset %d: %w", chunkStart, err)
+		}
+		chunkEnd := chunkStart + int64(len(chunk))
+		for upload.Offset < chunkEnd {
+			err = cli.UploadResumableChunk(ctx, upload, chunk[upload.Offset-chunkStart:])
+			if err == nil {
+				failures = 0
+				continue
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failures++
+			if failures > maxRetries {
+				return fmt.Errorf("failed to upload chunk at offset %d: %w", upload.Offset, err)
+			}
+			retryIn := min(backoff<<(failures-1), maxBackoff)
+			log.Warn().Err(err).
+				Int64("offset", upload.Offset).
+				Int("retry_in_seconds", int(retryIn.Seconds())).
+				Msg("Failed to upload chunk, resuming upload")
+			select {
+			case <-time.After(retryIn):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			prevOffset := upload.Offset
+			_, err = cli.GetResumableUploadOffset(ctx, upload)
+			if err != nil {
+				return fmt.Errorf("failed to get offset to resume upload: %w", err)
+			} else if upload.Offset < chunkStart || upload.Offset > chunkEnd {
+				// The reader can't be rewound, so the upload can only continue from within the current chunk
+				return fmt.Errorf("%w: server is at %d, current chunk is %d-%d", ErrUnexpectedUploadOffset, upload.Offset, chunkStart, chunkEnd)
+			} else if upload.Offset > prevOffset {
+				failures = 0
+			}
+		}
+	}
+	return nil
+}
+
+func (cli *Client) uploadMediaResumable(ctx context.Context, data ReqUploadMedia) (*RespMediaUpload, error) {
+	reader := data.Content
+	if data.ContentBytes != nil {
+		data.ContentLength = int64(len(data.ContentBytes))
+		reader = bytes.NewReader(data.ContentBytes)
+	}
+	upload, err := cli.CreateResumableUpload(ctx, data.ContentLength, data.ContentType, data.FileName, data.MXC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resumable upload: %w", err)
+	}
+	err = cli.ContinueResumableUpload(ctx, upload, reader, data.ResumableChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return &RespMediaUpload{ContentURI: upload.ContentURI}, nil
+}
+
+// UploadEncryptedMedia encrypts the content while uploading it and returns the encryption info
+// with the URL filled. The content is encrypted as a stream, so it's never fully buffered in memory
+// unless ContentBytes is used. The content type and file name are removed from the request,
+// as they would leak metadata about the encrypted file.
+//
+// If the content is an io.Closer, it will be closed after the upload.
+func (cli *Client) UploadEncryptedMedia(ctx context.Context, data ReqUploadMedia) (*event.EncryptedFileInfo, error) {
+	if data.ContentBytes != nil {
+		data.Content = bytes.NewReader(data.ContentBytes)
+		data.ContentLength = int64(len(data.ContentBytes))
+		data.ContentBytes = nil
+	} else if data.Content == nil {
+		return nil, ErrNoUploadContent
+	}
+	file := &event.EncryptedFileInfo{EncryptedFile: *attachment.NewEncryptedFile()}
+	stream := file.EncryptStream(data.Content)
+	data.Content = stream
+	data.ContentType = "application/octet-stream"
+	data.FileName = ""
+	resp, err := cli.UploadMedia(ctx, data)
+	// Closing the stream finalizes the hash
+	closeErr := stream.Close()
+	if err != nil {
+		return nil, err
+	} else if closeErr != nil {
+		return nil, fmt.Errorf("failed to finish encrypting: %w", closeErr)
+	}
+	file.URL = resp.ContentURI.CUString()
+	return file, nil
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/exerrors"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// testTusServer is a minimal stand-in for a homeserver that supports resumable uploads.
+type testTusServer struct {
+	lock     sync.Mutex
+	data     bytes.Buffer
+	length   int64
+	metadata map[string]string
+	// failAfter makes the next PATCH request abort the connection after reading this many bytes.
+	failAfter int
+	patches   int
+}
+
+func (tts *testTusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tts.lock.Lock()
+	defer tts.lock.Unlock()
+	if r.Header.Get("Tus-Resumable") != TusResumableVersion {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/_matrix/media/unstable/fi.mau.tus/upload":
+		tts.length, _ = strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		tts.metadata = make(map[string]string)
+		for _, pair := range strings.Split(r.Header.Get("Upload-Metadata"), ",") {
+			key, val, _ := strings.Cut(pair, " ")
+			decoded, _ := base64.StdEncoding.DecodeString(val)
+			tts.metadata[key] = string(decoded)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"content_uri": "mxc://example.com/resumable", "upload_id": "upload1"}`))
+	case r.Method == http.MethodHead && r.URL.Path == "/_matrix/media/unstable/fi.mau.tus/session/upload1":
+		w.Header().Set("Upload-Offset", strconv.Itoa(tts.data.Len()))
+		w.Header().Set("Upload-Length", strconv.FormatInt(tts.length, 10))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPatch && r.URL.Path == "/_matrix/media/unstable/fi.mau.tus/session/upload1":
+		tts.patches++
+		if r.Header.Get("Upload-Offset") != strconv.Itoa(tts.data.Len()) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if tts.failAfter > 0 {
+			_, _ = io.CopyN(&tts.data, r.Body, int64(tts.failAfter))
+			tts.failAfter = 0
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = io.Copy(&tts.data, r.Body)
+		w.Header().Set("Upload-Offset", strconv.Itoa(tts.data.Len()))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestResumableClient(t *testing.T) (*Client, *testTusServer) {
+	tts := &testTusServer{}
+	server := httptest.NewServer(tts)
+	t.Cleanup(server.Close)
+	cli := newTestClient(t, server.URL)
+	cli.DefaultHTTPBackoff = time.Millisecond
+	cli.SpecVersions = &RespVersions{UnstableFeatures: map[string]bool{FeatureResumableUploads.UnstableFlag: true}}
+	return cli, tts
+}
+
+func TestClient_UploadMedia_Resumable(t *testing.T) {
+	cli, tts := newTestResumableClient(t)
+	data := make([]byte, 1000)
+	_, _ = rand.Read(data)
+	tts.failAfter = 150
+
+	resp, err := cli.UploadMedia(context.Background(), ReqUploadMedia{
+		// Wrap the reader to make sure it isn't rewound
+		Content:            io.MultiReader(bytes.NewReader(data)),
+		ContentLength:      int64(len(data)),
+		ContentType:        "video/mp4",
+		FileName:           "video.mp4",
+		ResumableChunkSize: 300,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, id.ContentURI{Homeserver: "example.com", FileID: "resumable"}, resp.ContentURI)
+	assert.Equal(t, data, tts.data.Bytes())
+	assert.Equal(t, map[string]string{"filename": "video.mp4", "content_type": "video/mp4"}, tts.metadata)
+	// 4 chunks + 1 retry of the rest of the first chunk
+	assert.Equal(t, 5, tts.patches)
+}
+
+func TestClient_ContinueResumableUpload_Expired(t *testing.T) {
+	cli, tts := newTestResumableClient(t)
+	upload := &ResumableUpload{ID: "expired", Length: 10}
+	err := cli.ContinueResumableUpload(context.Background(), upload, bytes.NewReader(make([]byte, 10)), 0)
+	require.Error(t, err)
+	assert.Equal(t, 0, tts.patches)
+}
+
+func TestClient_UploadEncryptedMedia(t *testing.T) {
+	cli, tts := newTestResumableClient(t)
+	data := make([]byte, 1000)
+	_, _ = rand.Read(data)
+
+	file, err := cli.UploadEncryptedMedia(context.Background(), ReqUploadMedia{
+		ContentBytes:       data,
+		ContentType:        "image/png",
+		FileName:           "secret.png",
+		ResumableChunkSize: 256,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, id.ContentURIString("mxc://example.com/resumable"), file.URL)
+	assert.Equal(t, map[string]string{"content_type": "application/octet-stream"}, tts.metadata)
+	assert.NotEqual(t, data, tts.data.Bytes())
+	// Round-trip the file info through JSON like a receiving client would
+	var received event.EncryptedFileInfo
+	require.NoError(t, json.Unmarshal(exerrors.Must(json.Marshal(file)), &received))
+	decrypted := bytes.Clone(tts.data.Bytes())
+	require.NoError(t, received.DecryptInPlace(decrypted))
+	assert.Equal(t, data, decrypted)
+}
+
+func TestClient_UploadMedia_ResumableDefaultRetries(t *testing.T) {
+	tts := &testTusServer{}
+	server := httptest.NewServer(tts)
+	t.Cleanup(server.Close)
+	cli, err := NewClient(server.URL, "", "")
+	require.NoError(t, err)
+	cli.DefaultHTTPBackoff = time.Millisecond
+	cli.SpecVersions = &RespVersions{UnstableFeatures: map[string]bool{FeatureResumableUploads.UnstableFlag: true}}
+	require.Zero(t, cli.DefaultHTTPRetries)
+	data := make([]byte, 1000)
+	_, _ = rand.Read(data)
+	tts.failAfter = 150
+
+	_, err = cli.UploadMedia(context.Background(), ReqUploadMedia{
+		ContentBytes:       data,
+		ResumableChunkSize: 300,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, data, tts.data.Bytes())
+}
+
+func TestClient_UploadEncryptedMedia_NoContent(t *testing.T) {
+	cli, _ := newTestResumableClient(t)
+	_, err := cli.UploadEncryptedMedia(context.Background(), ReqUploadMedia{})
+	assert.ErrorIs(t, err, ErrNoUploadContent)
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrNotUpgradeSuccessor = errors.New("replacement room doesn't have the old room as its predecessor")
+
+// RoomUpgradeFollower follows m.room.tombstone events to the replacement room, so that bots
+// don't get left behind in the old room when a room is upgraded.
+type RoomUpgradeFollower struct {
+	Client *Client
+
+	// AccountDataTypes are the room account data types that are copied from the old room to the new one.
+	// Tags are always migrated.
+	AccountDataTypes []event.Type
+	// MigratePowerLevels copies user power levels from the old room to the new room for users whose
+	// level is missing in the new room, if the client has permission to change power levels.
+	MigratePowerLevels bool
+	// LeaveOldRoom makes the client leave the old room after successfully joining the new one.
+	LeaveOldRoom bool
+	// OnUpgrade is called after the client has joined the replacement room and migrated data.
+	OnUpgrade func(ctx context.Context, oldRoomID, newRoomID id.RoomID)
+	// JoinRoom can be set to override how the replacement room is joined, e.g. to use appservice intents.
+	// If nil, [Client.JoinRoom] is used.
+	JoinRoom func(ctx context.Context, roomID id.RoomID, via []string) error
+}
+
+// NewRoomUpgradeFollower creates a new room upgrade follower with the default settings.
+func NewRoomUpgradeFollower(cli *Client) *RoomUpgradeFollower {
+	return &RoomUpgradeFollower{
+		Client:             cli,
+		MigratePowerLevels: true,
+	}
+}
+
+// Register adds the tombstone handler to the given syncer.
+func (ruf *RoomUpgradeFollower) Register(syncer ExtensibleSyncer) {
+	syncer.OnEventType(event.StateTombstone, ruf.HandleTombstone)
+}
+
+// HandleTombstone follows the given tombstone event. Errors are logged rather than returned,
+// which makes this suitable as an event handler.
+func (ruf *RoomUpgradeFollower) HandleTombstone(ctx context.Context, evt *event.Event) {
+	if evt.GetStateKey() != "" {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().
+		Str("action", "follow room upgrade").
+		Stringer("old_room_id", evt.RoomID).
+		Stringer("tombstone_event_id", evt.ID).
+		Logger()
+	content, ok := evt.Content.Parsed.(*event.TombstoneEventContent)
+	if !ok {
+		log.Warn().Type("content_type", evt.Content.Parsed).Msg("Unexpected parsed content type in tombstone event")
+		return
+	} else if content.ReplacementRoom == "" {
+		log.Debug().Msg("Tombstone has no replacement room")
+		return
+	}
+	var via []string
+	if senderHS := evt.Sender.Homeserver(); senderHS != "" {
+		via = []string{senderHS}
+	}
+	err := ruf.FollowUpgrade(log.WithContext(ctx), evt.RoomID, content.ReplacementRoom, via)
+	if err != nil {
+		log.Err(err).Stringer("new_room_id", content.ReplacementRoom).Msg("Failed to follow room upgrade")
+	}
+}
+
+// FollowUpgrade joins the replacement room of an upgraded room and migrates room-scoped data to it.
+//
+// After joining, the create event of the new room is checked to make sure it points at the old room
+// as its predecessor. If it doesn't, the new room is left and [ErrNotUpgradeSuccessor] is returned.
+func (ruf *RoomUpgradeFollower) FollowUpgrade(ctx context.Context, oldRoomID, newRoomID id.RoomID, via []string) error {
+	log := zerolog.Ctx(ctx)
+	wasJoined := ruf.Client.StateStore != nil && ruf.Client.StateStore.IsInRoom(ctx, newRoomID, ruf.Client.UserID)
+	var err error
+	if ruf.JoinRoom != nil {
+		err = ruf.JoinRoom(ctx, newRoomID, via)
+	} else {
+		_, err = ruf.Client.JoinRoom(ctx, newRoomID.String(), &ReqJoinRoom{Via: via})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to join replacement room: %w", err)
+	}
+	var createContent event.CreateEventContent
+	err = ruf.Client.StateEvent(ctx, newRoomID, event.StateCreate, "", &createContent)
+	if err != nil {
+		return fmt.Errorf("failed to get create event of replacement room: %w", err)
+	}
+	if createContent.GetPredecessor().RoomID != oldRoomID {
+		if !wasJoined {
+			_, leaveErr := ruf.Client.LeaveRoom(ctx, newRoomID, &ReqLeave{Reason: "Room is not a successor of " + oldRoomID.String()})
+			if leaveErr != nil {
+				log.Warn().Err(leaveErr).Msg("Failed to leave invalid replacement room")
+			}
+		}
+		return ErrNotUpgradeSuccessor
+	}
+	if err = ruf.migrateTags(ctx, oldRoomID, newRoomID); err != nil {
+		log.Warn().Err(err).Msg("Failed to migrate room tags")
+	}
+	for _, evtType := range ruf.AccountDataTypes {
+		if err = ruf.migrateAccountData(ctx, oldRoomID, newRoomID, evtType); err != nil {
+			log.Warn().Err(err).Str("account_data_type", evtType.Type).Msg("Failed to migrate room account data")
+		}
+	}
+	if ruf.MigratePowerLevels {
+		if err = ruf.migratePowerLevels(ctx, oldRoomID, newRoomID); err != nil {
+			log.Warn().Err(err).Msg("Failed to migrate power levels")
+		}
+	}
+	if ruf.LeaveOldRoom {
+		_, err = ruf.Client.LeaveRoom(ctx, oldRoomID, &ReqLeave{Reason: "Room was upgraded to " + newRoomID.String()})
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to leave old room")
+		}
+	}
+	if ruf.OnUpgrade != nil {
+		ruf.OnUpgrade(ctx, oldRoomID, newRoomID)
+	}
+	return nil
+}
+
+func (ruf *RoomUpgradeFollower) migrateTags(ctx context.Context, oldRoomID, newRoomID id.RoomID) error {
+	var tags struct {
+		Tags map[event.RoomTag]json.RawMessage `json:"tags"`
+	}
+	err := ruf.Client.GetTagsWithCustomData(ctx, oldRoomID, &tags)
+	if err != nil {
+		return fmt.Errorf("failed to get tags of old room: %w", err)
+	}
+	for tag, data := range tags.Tags {
+		err = ruf.Client.AddTagWithCustomData(ctx, newRoomID, tag, data)
+		if err != nil {
+			return fmt.Errorf("failed to add %s tag to new room: %w", tag, err)
+		}
+	}
+	return nil
+}
+
+func (ruf *RoomUpgradeFollower) migrateAccountData(ctx context.Context, oldRoomID, newRoomID id.RoomID, evtType event.Type) error {
+	var data json.RawMessage
+	err := ruf.Client.GetRoomAccountData(ctx, oldRoomID, evtType.Type, &data)
+	if errors.Is(err, MNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get account data from old room: %w", err)
+	}
+	return ruf.Client.SetRoomAccountData(ctx, newRoomID, evtType.Type, data)
+}
+
+func (ruf *RoomUpgradeFollower) migratePowerLevels(ctx context.Context, oldRoomID, newRoomID id.RoomID) error {
+	var oldPL, newPL event.PowerLevelsEventContent
+	err := ruf.Client.StateEvent(ctx, oldRoomID, event.StatePowerLevels, "", &oldPL)
+	if err != nil {
+		return fmt.Errorf("failed to get power levels of old room: %w", err)
+	}
+	err = ruf.Client.StateEvent(ctx, newRoomID, event.StatePowerLevels, "", &newPL)
+	if err != nil {
+		return fmt.Errorf("failed to get power levels of new room: %w", err)
+	}
+	ownLevel := newPL.GetUserLevel(ruf.Client.UserID)
+	if ownLevel < newPL.GetEventLevel(event.StatePowerLevels) {
+		return nil
+	}
+	changed := false
+	for userID, level := range oldPL.Users {
+		if _, alreadySet := newPL.Users[userID]; alreadySet || level > ownLevel {
+			continue
+		}
+		newPL.SetUserLevel(userID, level)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	_, err = ruf.Client.SendStateEvent(ctx, newRoomID, event.StatePowerLevels, "", &newPL)
+	return err
+}
@@ -0,0 +1,429 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrCallMembersNotSupported = errors.New("state store doesn't support storing call members")
+
+// RTCMembership is a single device's active membership in a MatrixRTC session.
+type RTCMembership struct {
+	UserID    id.UserID
+	DeviceID  id.DeviceID
+	Event     *event.Event
+	Content   *event.CallMemberEventContent
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// RTCSession is the set of active memberships for one call in a room.
+type RTCSession struct {
+	RoomID      id.RoomID
+	Application string
+	CallID      string
+	// Memberships contains the active memberships sorted by creation time, oldest first.
+	Memberships []*RTCMembership
+}
+
+// Participants returns the unique users with at least one active membership in the session.
+func (sess *RTCSession) Participants() []id.UserID {
+	users := make([]id.UserID, 0, len(sess.Memberships))
+	for _, member := range sess.Memberships {
+		if !slices.Contains(users, member.UserID) {
+			users = append(users, member.UserID)
+		}
+	}
+	return users
+}
+
+// OldestMembership returns the oldest active membership, which decides the active focus
+// when the oldest_membership focus selection is used.
+func (sess *RTCSession) OldestMembership() *RTCMembership {
+	if len(sess.Memberships) == 0 {
+		return nil
+	}
+	return sess.Memberships[0]
+}
+
+// NextExpiry returns the earliest expiry time of the active memberships, or zero if there are none.
+func (sess *RTCSession) NextExpiry() time.Time {
+	var next time.Time
+	for _, member := range sess.Memberships {
+		if next.IsZero() || member.ExpiresAt.Before(next) {
+			next = member.ExpiresAt
+		}
+	}
+	return next
+}
+
+func (sess *RTCSession) sameMembers(other *RTCSession) bool {
+	if other == nil || len(sess.Memberships) != len(other.Memberships) {
+		return false
+	}
+	for i, member := range sess.Memberships {
+		otherMember := other.Memberships[i]
+		if member.UserID != otherMember.UserID || member.DeviceID != otherMember.DeviceID {
+			return false
+		}
+	}
+	return true
+}
+
+type rtcSessionKey struct {
+	RoomID      id.RoomID
+	Application string
+	CallID      string
+}
+
+// computeRTCSessions groups the given call membership events into sessions, ignoring left and expired memberships.
+func computeRTCSessions(roomID id.RoomID, evts []*event.Event, now time.Time) map[rtcSessionKey]*RTCSession {
+	sessions := make(map[rtcSessionKey]*RTCSession)
+	for _, evt := range evts {
+		if evt.Content.Parsed == nil {
+			_ = evt.Content.ParseRaw(evt.Type)
+		}
+		content := evt.Content.AsCallMember()
+		if !content.IsActive() {
+			continue
+		}
+		expiresAt := content.GetExpiry(evt)
+		if !expiresAt.After(now) {
+			continue
+		}
+		key := rtcSessionKey{RoomID: roomID, Application: content.Application, CallID: content.CallID}
+		sess, ok := sessions[key]
+		if !ok {
+			sess = &RTCSession{RoomID: roomID, Application: content.Application, CallID: content.CallID}
+			sessions[key] = sess
+		}
+		sess.Memberships = append(sess.Memberships, &RTCMembership{
+			UserID:    evt.Sender,
+			DeviceID:  content.DeviceID,
+			Event:     evt,
+			Content:   content,
+			CreatedAt: content.GetCreatedTS(evt),
+			ExpiresAt: expiresAt,
+		})
+	}
+	for _, sess := range sessions {
+		slices.SortFunc(sess.Memberships, func(a, b *RTCMembership) int {
+			return a.CreatedAt.Compare(b.CreatedAt)
+		})
+	}
+	return sessions
+}
+
+// RTCSessionTracker keeps track of MatrixRTC sessions using the call membership events in the state store.
+//
+// The client's state store must implement [CallMemberStateStore] and be kept up to date,
+// e.g. using [Client.StateStoreSyncHandler].
+type RTCSessionTracker struct {
+	Client *Client
+	// OnSessionChange is called when the set of active memberships in a session changes,
+	// including when memberships expire. The session will have no memberships if the call ended.
+	OnSessionChange func(ctx context.Context, sess *RTCSession)
+
+	sessions    map[rtcSessionKey]*RTCSession
+	expiryTimer *time.Timer
+	lock        sync.Mutex
+}
+
+// NewRTCSessionTracker creates a new MatrixRTC session tracker for the given client.
+func NewRTCSessionTracker(cli *Client) *RTCSessionTracker {
+	return &RTCSessionTracker{
+		Client:   cli,
+		sessions: make(map[rtcSessionKey]*RTCSession),
+	}
+}
+
+// Register adds the session tracker's event handlers to the given syncer.
+// The state store sync handler must be registered before this.
+func (rst *RTCSessionTracker) Register(syncer ExtensibleSyncer) {
+	syncer.OnEventType(event.StateCallMember, rst.HandleEvent)
+	syncer.OnEventType(event.StateUnstableCallMember, rst.HandleEvent)
+}
+
+func (rst *RTCSessionTracker) store() (CallMemberStateStore, error) {
+	store, ok := rst.Client.StateStore.(CallMemberStateStore)
+	if !ok {
+		return nil, ErrCallMembersNotSupported
+	}
+	return store, nil
+}
+
+// GetSessions returns all active sessions in the given room.
+func (rst *RTCSessionTracker) GetSessions(ctx context.Context, roomID id.RoomID) ([]*RTCSession, error) {
+	store, err := rst.store()
+	if err != nil {
+		return nil, err
+	}
+	evts, err := store.GetCallMembers(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get call members: %w", err)
+	}
+	sessions := computeRTCSessions(roomID, evts, time.Now())
+	output := make([]*RTCSession, 0, len(sessions))
+	for _, sess := range sessions {
+		output = append(output, sess)
+	}
+	return output, nil
+}
+
+// GetSession returns the session for the given application and call ID in the room.
+// If there are no active memberships, the returned session has an empty membership list.
+func (rst *RTCSessionTracker) GetSession(ctx context.Context, roomID id.RoomID, application, callID string) (*RTCSession, error) {
+	sessions, err := rst.GetSessions(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, sess := range sessions {
+		if sess.Application == application && sess.CallID == callID {
+			return sess, nil
+		}
+	}
+	return &RTCSession{RoomID: roomID, Application: application, CallID: callID}, nil
+}
+
+// HandleEvent recomputes the sessions in the room of the given call membership event
+// and dispatches change callbacks.
+func (rst *RTCSessionTracker) HandleEvent(ctx context.Context, evt *event.Event) {
+	rst.refreshRoom(ctx, evt.RoomID)
+}
+
+func (rst *RTCSessionTracker) refreshRoom(ctx context.Context, roomID id.RoomID) {
+	sessions, err := rst.GetSessions(ctx, roomID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("room_id", roomID).Msg("Failed to refresh MatrixRTC sessions")
+		return
+	}
+	var changed []*RTCSession
+	rst.lock.Lock()
+	seen := make(map[rtcSessionKey]struct{}, len(sessions))
+	for _, sess := range sessions {
+		key := rtcSessionKey{RoomID: roomID, Application: sess.Application, CallID: sess.CallID}
+		seen[key] = struct{}{}
+		if !sess.sameMembers(rst.sessions[key]) {
+			changed = append(changed, sess)
+		}
+		rst.sessions[key] = sess
+	}
+	for key, sess := range rst.sessions {
+		if _, ok := seen[key]; !ok && key.RoomID == roomID {
+			delete(rst.sessions, key)
+			changed = append(changed, &RTCSession{RoomID: roomID, Application: sess.Application, CallID: sess.CallID})
+		}
+	}
+	rst.scheduleExpiryCheck()
+	rst.lock.Unlock()
+	if rst.OnSessionChange != nil {
+		for _, sess := range changed {
+			rst.OnSessionChange(ctx, sess)
+		}
+	}
+}
+
+func (rst *RTCSessionTracker) scheduleExpiryCheck() {
+	var next time.Time
+	var rooms []id.RoomID
+	for key, sess := range rst.sessions {
+		expiry := sess.NextExpiry()
+		if expiry.IsZero() {
+			continue
+		}
+		if next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+		if !slices.Contains(rooms, key.RoomID) {
+			rooms = append(rooms, key.RoomID)
+		}
+	}
+	if rst.expiryTimer != nil {
+		rst.expiryTimer.Stop()
+		rst.expiryTimer = nil
+	}
+	if next.IsZero() {
+		return
+	}
+	log := rst.Client.Log
+	rst.expiryTimer = time.AfterFunc(time.Until(next), func() {
+		ctx := log.WithContext(context.Background())
+		for _, roomID := range rooms {
+			rst.refreshRoom(ctx, roomID)
+		}
+	})
+}
+
+// RTCJoinParams contains the parameters for joining a MatrixRTC session.
+type RTCJoinParams struct {
+	// EventType is the membership event type to send. Defaults to [event.StateUnstableCallMember].
+	EventType event.Type
+	// Application defaults to [event.CallApplicationCall] and CallID defaults to the room-wide call.
+	Application string
+	CallID      string
+	// Expires defaults to [event.DefaultCallMemberExpiry]. The membership is refreshed automatically before it expires.
+	Expires time.Duration
+	// FociPreferred defaults to the LiveKit transports advertised by the homeserver.
+	FociPreferred []event.CallFocus
+	// LeaveDelay is the delay after which the server automatically sends a leave event unless the membership
+	// is kept alive. Set to a negative value to disable delayed leave events. Defaults to 20 seconds.
+	LeaveDelay time.Duration
+}
+
+// RTCParticipation is an active membership of the current device in a MatrixRTC session.
+type RTCParticipation struct {
+	client   *Client
+	roomID   id.RoomID
+	evtType  event.Type
+	stateKey string
+	content  *event.CallMemberEventContent
+	delayID  id.DelayID
+	stop     context.CancelFunc
+	done     chan struct{}
+}
+
+const defaultRTCLeaveDelay = 20 * time.Second
+
+// JoinRTCSession publishes a call membership for the current device in the given room.
+//
+// If the homeserver supports delayed events, a leave event is scheduled first and kept alive in the background,
+// so the membership disappears automatically if the client stops without calling [RTCParticipation.Leave].
+// Otherwise, the membership is only kept alive and will disappear when it expires.
+func (cli *Client) JoinRTCSession(ctx context.Context, roomID id.RoomID, params RTCJoinParams) (*RTCParticipation, error) {
+	if params.EventType.Type == "" {
+		params.EventType = event.StateUnstableCallMember
+	}
+	if params.Application == "" {
+		params.Application = event.CallApplicationCall
+	}
+	if params.Expires <= 0 {
+		params.Expires = event.DefaultCallMemberExpiry
+	}
+	if params.LeaveDelay == 0 {
+		params.LeaveDelay = defaultRTCLeaveDelay
+	}
+	if params.FociPreferred == nil {
+		transports, err := cli.RTCTransports(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get RTC transports: %w", err)
+		}
+		for _, transport := range transports.RTCTransports {
+			if transport.Type == RTCTransportTypeLivekit {
+				params.FociPreferred = append(params.FociPreferred, event.CallFocus{
+					Type:              event.CallFocusTypeLivekit,
+					LivekitServiceURL: transport.LivekitServiceURL,
+					LivekitAlias:      roomID.String(),
+				})
+			}
+		}
+	}
+	part := &RTCParticipation{
+		client:   cli,
+		roomID:   roomID,
+		evtType:  params.EventType,
+		stateKey: event.CallMemberStateKey(cli.UserID, cli.DeviceID),
+		content: &event.CallMemberEventContent{
+			Application: params.Application,
+			CallID:      params.CallID,
+			Scope:       event.CallScopeRoom,
+			DeviceID:    cli.DeviceID,
+			FocusActive: &event.CallFocus{
+				Type:           event.CallFocusTypeLivekit,
+				FocusSelection: event.CallFocusSelectionOldestMembership,
+			},
+			FociPreferred: params.FociPreferred,
+		},
+		done: make(chan struct{}),
+	}
+	part.content.Expires.Duration = params.Expires
+	if params.LeaveDelay > 0 && (cli.SpecVersions == nil || cli.SpecVersions.Supports(FeatureUnstableDelayedEvents)) {
+		resp, err := cli.SendStateEvent(ctx, roomID, part.evtType, part.stateKey, &struct{}{}, ReqSendEvent{
+			UnstableDelay: params.LeaveDelay,
+		})
+		if errors.Is(err, MUnrecognized) {
+			zerolog.Ctx(ctx).Debug().Err(err).Msg("Server doesn't support delayed events, joining without delayed leave event")
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to schedule delayed leave event: %w", err)
+		} else {
+			part.delayID = resp.UnstableDelayID
+		}
+	}
+	_, err := cli.SendStateEvent(ctx, roomID, part.evtType, part.stateKey, part.content)
+	if err != nil {
+		if part.delayID != "" {
+			_, _ = cli.UpdateDelayedEvent(ctx, &ReqUpdateDelayedEvent{DelayID: part.delayID, Action: event.DelayActionCancel})
+		}
+		return nil, fmt.Errorf("failed to send call membership: %w", err)
+	}
+	loopCtx, cancel := context.WithCancel(cli.Log.WithContext(context.Background()))
+	part.stop = cancel
+	go part.keepAlive(loopCtx, params.LeaveDelay, params.Expires)
+	return part, nil
+}
+
+func (part *RTCParticipation) keepAlive(ctx context.Context, leaveDelay, expires time.Duration) {
+	defer close(part.done)
+	log := zerolog.Ctx(ctx).With().
+		Str("action", "rtc membership keepalive").
+		Stringer("room_id", part.roomID).
+		Logger()
+	refreshMembershipAt := time.Now().Add(expires * 3 / 4)
+	interval := expires / 4
+	if part.delayID != "" {
+		interval = leaveDelay / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if part.delayID != "" {
+			_, err := part.client.UpdateDelayedEvent(ctx, &ReqUpdateDelayedEvent{DelayID: part.delayID, Action: event.DelayActionRestart})
+			if err != nil {
+				log.Err(err).Msg("Failed to restart delayed leave event")
+			}
+		}
+		if time.Now().After(refreshMembershipAt) {
+			_, err := part.client.SendStateEvent(ctx, part.roomID, part.evtType, part.stateKey, part.content)
+			if err != nil {
+				log.Err(err).Msg("Failed to refresh call membership")
+			} else {
+				refreshMembershipAt = time.Now().Add(expires * 3 / 4)
+			}
+		}
+	}
+}
+
+// Leave stops keeping the membership alive and sends a leave event. If a delayed leave event was scheduled,
+// it's sent immediately, otherwise a new empty membership event is sent.
+func (part *RTCParticipation) Leave(ctx context.Context) error {
+	part.stop()
+	<-part.done
+	if part.delayID != "" {
+		_, err := part.client.UpdateDelayedEvent(ctx, &ReqUpdateDelayedEvent{DelayID: part.delayID, Action: event.DelayActionSend})
+		if err == nil {
+			return nil
+		}
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to send delayed leave event, sending leave directly")
+	}
+	_, err := part.client.SendStateEvent(ctx, part.roomID, part.evtType, part.stateKey, &struct{}{})
+	return err
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const testCallRoom = id.RoomID("!call:example.com")
+
+func makeCallMemberEvent(t *testing.T, userID id.UserID, deviceID id.DeviceID, ts time.Time, content map[string]any) *event.Event {
+	raw, err := json.Marshal(content)
+	require.NoError(t, err)
+	stateKey := event.CallMemberStateKey(userID, deviceID)
+	evt := &event.Event{
+		ID:        id.EventID("$" + string(deviceID)),
+		Type:      event.StateUnstableCallMember,
+		RoomID:    testCallRoom,
+		Sender:    userID,
+		StateKey:  &stateKey,
+		Timestamp: ts.UnixMilli(),
+		Content:   event.Content{VeryRaw: raw},
+	}
+	require.NoError(t, json.Unmarshal(raw, &evt.Content.Raw))
+	require.NoError(t, evt.Content.ParseRaw(evt.Type))
+	return evt
+}
+
+func activeCallMember(deviceID id.DeviceID) map[string]any {
+	return map[string]any{
+		"application": "m.call",
+		"call_id":     "",
+		"scope":       "m.room",
+		"device_id":   deviceID,
+	}
+}
+
+func TestParseCallMemberStateKey(t *testing.T) {
+	userID, deviceID := event.ParseCallMemberStateKey("_@user_name:example.com_DEVICE")
+	assert.Equal(t, id.UserID("@user_name:example.com"), userID)
+	assert.Equal(t, id.DeviceID("DEVICE"), deviceID)
+	userID, deviceID = event.ParseCallMemberStateKey("@user:example.com_DEVICE_m.call")
+	assert.Equal(t, id.UserID("@user:example.com"), userID)
+	assert.Equal(t, id.DeviceID("DEVICE"), deviceID)
+	userID, deviceID = event.ParseCallMemberStateKey("@user:example.com")
+	assert.Equal(t, id.UserID("@user:example.com"), userID)
+	assert.Empty(t, deviceID)
+}
+
+func TestRTCSessionTracker(t *testing.T) {
+	ctx := context.Background()
+	cli, err := mautrix.NewClient("https://example.com", "@bot:example.com", "token")
+	require.NoError(t, err)
+	cli.StateStore = mautrix.NewMemoryStateStore()
+	tracker := mautrix.NewRTCSessionTracker(cli)
+	var changes []*mautrix.RTCSession
+	tracker.OnSessionChange = func(ctx context.Context, sess *mautrix.RTCSession) {
+		changes = append(changes, sess)
+	}
+	handle := func(evt *event.Event) {
+		mautrix.UpdateStateStore(ctx, cli.StateStore, evt)
+		tracker.HandleEvent(ctx, evt)
+	}
+
+	now := time.Now()
+	handle(makeCallMemberEvent(t, "@alice:example.com", "ALICE", now.Add(-time.Minute), activeCallMember("ALICE")))
+	handle(makeCallMemberEvent(t, "@bob:example.com", "BOB", now, activeCallMember("BOB")))
+	// Expired membership is ignored
+	expired := activeCallMember("CAROL")
+	expired["expires"] = 1000
+	handle(makeCallMemberEvent(t, "@carol:example.com", "CAROL", now.Add(-time.Hour), expired))
+
+	sess, err := tracker.GetSession(ctx, testCallRoom, event.CallApplicationCall, "")
+	require.NoError(t, err)
+	assert.Equal(t, []id.UserID{"@alice:example.com", "@bob:example.com"}, sess.Participants())
+	assert.Equal(t, id.DeviceID("ALICE"), sess.OldestMembership().DeviceID)
+	require.Len(t, changes, 2)
+	assert.Len(t, changes[1].Memberships, 2)
+
+	// Leaving with empty content removes the membership
+	handle(makeCallMemberEvent(t, "@alice:example.com", "ALICE", now, map[string]any{}))
+	handle(makeCallMemberEvent(t, "@bob:example.com", "BOB", now, map[string]any{}))
+	require.Len(t, changes, 4)
+	assert.Len(t, changes[2].Memberships, 1)
+	assert.Empty(t, changes[3].Memberships)
+	sessions, err := tracker.GetSessions(ctx, testCallRoom)
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestJoinRTCSession_NoDelayedEvents(t *testing.T) {
+	var lock sync.Mutex
+	var delayedRequests int
+	var sentContents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Has("org.matrix.msc4140.delay") {
+			delayedRequests++
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errcode": "M_UNRECOGNIZED", "error": "Unrecognized request"}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		sentContents = append(sentContents, string(body))
+		_, _ = w.Write([]byte(`{"event_id": "$event"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	for _, advertised := range []bool{false, true} {
+		delayedRequests = 0
+		sentContents = nil
+		cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+		require.NoError(t, err)
+		cli.DeviceID = "DEVICE"
+		if advertised {
+			// The server claims support, so the error response is used to detect the lack of support
+			cli.SpecVersions = &mautrix.RespVersions{UnstableFeatures: map[string]bool{mautrix.FeatureUnstableDelayedEvents.UnstableFlag: true}}
+		} else {
+			cli.SpecVersions = &mautrix.RespVersions{}
+		}
+		part, err := cli.JoinRTCSession(context.Background(), testCallRoom, mautrix.RTCJoinParams{FociPreferred: []event.CallFocus{}})
+		require.NoError(t, err)
+		require.NoError(t, part.Leave(context.Background()))
+
+		lock.Lock()
+		if advertised {
+			assert.Equal(t, 1, delayedRequests)
+		} else {
+			assert.Equal(t, 0, delayedRequests)
+		}
+		require.Len(t, sentContents, 2)
+		assert.Contains(t, sentContents[0], `"device_id":"DEVICE"`)
+		assert.Equal(t, "{}", sentContents[1])
+		lock.Unlock()
+	}
+}
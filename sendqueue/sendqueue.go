@@ -0,0 +1,365 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sendqueue contains a persistent queue for sending events from clients and bots.
+//
+// Events are stored in the database with their transaction ID before sending, so that an event
+// isn't lost if the process restarts, and retries always use the same transaction ID, which allows
+// the server to deduplicate them. Events in the same room are sent strictly in order.
+package sendqueue
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//go:embed *.sql
+var rawUpgrades embed.FS
+
+var UpgradeTable = dbutil.BuildUpgradeTable().
+	WithFS(rawUpgrades).
+	Finish()
+
+const VersionTableName = "mx_send_queue_version"
+
+var ErrEventSending = errors.New("event is currently being sent")
+
+// SendQueue sends events in the background and retries on transient errors.
+type SendQueue struct {
+	*dbutil.Database
+	Client *mautrix.Client
+
+	// MaxAttempts is the maximum number of attempts for transient errors (network errors, rate limits
+	// and server errors) before an event is marked as failed. Zero means retrying forever.
+	// Other errors (e.g. M_FORBIDDEN) always fail the event immediately.
+	MaxAttempts     int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// OnLocalEcho is called when an event is added to the queue. [QueuedEvent.LocalEcho] can be used
+	// to get an event to render in the timeline.
+	OnLocalEcho func(ctx context.Context, evt *QueuedEvent)
+	// OnSent is called after an event is sent successfully. The event is removed from the queue before this is called.
+	OnSent func(ctx context.Context, evt *QueuedEvent, eventID id.EventID)
+	// OnFailed is called when an event fails permanently.
+	OnFailed func(ctx context.Context, evt *QueuedEvent, err error)
+
+	lock    sync.Mutex
+	workers map[id.RoomID]*roomWorker
+	ctx     context.Context
+	stop    context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+type roomWorker struct {
+	wake      chan struct{}
+	current   string
+	sending   bool
+	cancelled bool
+}
+
+func NewSendQueue(cli *mautrix.Client, db *dbutil.Database, log dbutil.DatabaseLogger) *SendQueue {
+	return &SendQueue{
+		Database: db.Child(VersionTableName, UpgradeTable, log),
+		Client:   cli,
+
+		RetryBackoff:    2 * time.Second,
+		MaxRetryBackoff: 5 * time.Minute,
+
+		workers: make(map[id.RoomID]*roomWorker),
+	}
+}
+
+// Start starts sending events that were left in the queue, e.g. from before a restart.
+// The context is used for all sending and must stay alive until Stop is called.
+func (sq *SendQueue) Start(ctx context.Context) error {
+	sq.lock.Lock()
+	if sq.ctx != nil {
+		sq.lock.Unlock()
+		return nil
+	}
+	sq.ctx, sq.stop = context.WithCancel(ctx)
+	sq.lock.Unlock()
+	rows, err := sq.Query(ctx, getPendingRoomsQuery)
+	roomIDs, err := dbutil.NewRowIterWithError(rows, dbutil.ScanSingleColumn[id.RoomID], err).AsList()
+	if err != nil {
+		return fmt.Errorf("failed to get rooms with pending events: %w", err)
+	}
+	for _, roomID := range roomIDs {
+		sq.wakeRoom(roomID)
+	}
+	return nil
+}
+
+// Stop stops sending events and waits for in-flight requests to finish or be cancelled.
+// Events that haven't been sent yet stay in the queue and will be sent after the next Start.
+func (sq *SendQueue) Stop() {
+	sq.lock.Lock()
+	stop := sq.stop
+	sq.ctx, sq.stop = nil, nil
+	sq.lock.Unlock()
+	if stop != nil {
+		stop()
+		sq.wg.Wait()
+	}
+}
+
+// Enqueue stores the given event in the queue and starts sending it in the background.
+//
+// The event is sent after all previously queued events in the same room. If the client has
+// a crypto helper, the event is encrypted right before the first send attempt if the room is encrypted.
+func (sq *SendQueue) Enqueue(ctx context.Context, roomID id.RoomID, eventType event.Type, content any) (*QueuedEvent, error) {
+	rawContent, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal content: %w", err)
+	}
+	qe := &QueuedEvent{
+		RoomID:        roomID,
+		TransactionID: sq.Client.TxnID(),
+		Type:          eventType,
+		Content:       rawContent,
+		Timestamp:     time.Now(),
+		Status:        StatusPending,
+	}
+	sq.lock.Lock()
+	// The lock ensures two events in the same room don't get the same order number
+	err = sq.insertEvent(ctx, qe)
+	sq.lock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to store event: %w", err)
+	}
+	if sq.OnLocalEcho != nil {
+		sq.OnLocalEcho(ctx, qe)
+	}
+	sq.wakeRoom(roomID)
+	return qe, nil
+}
+
+// Retry marks a failed event as pending again. The event keeps its place in the queue,
+// which means it'll be sent before any later events that haven't been sent yet.
+func (sq *SendQueue) Retry(ctx context.Context, roomID id.RoomID, txnID string) error {
+	res, err := sq.Exec(ctx, retryEventQuery, roomID, txnID)
+	if err != nil {
+		return err
+	} else if affected, _ := res.RowsAffected(); affected == 0 {
+		return fmt.Errorf("no failed event with transaction ID %s in %s", txnID, roomID)
+	}
+	sq.wakeRoom(roomID)
+	return nil
+}
+
+// Cancel removes an event from the queue. Events that are waiting to be retried can be cancelled,
+// but events with a request in flight can't, as the request may have already reached the server.
+// The returned bool is false if the event wasn't in the queue (e.g. because it was already sent).
+func (sq *SendQueue) Cancel(ctx context.Context, roomID id.RoomID, txnID string) (bool, error) {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	if worker, ok := sq.workers[roomID]; ok && worker.current == txnID {
+		if worker.sending {
+			return false, ErrEventSending
+		}
+		worker.cancelled = true
+		worker.notify()
+	}
+	return sq.deleteEvent(ctx, roomID, txnID)
+}
+
+// RetryNow skips the backoff of all events that are waiting to be retried, e.g. when the network connection comes back.
+func (sq *SendQueue) RetryNow() {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	for _, worker := range sq.workers {
+		worker.notify()
+	}
+}
+
+func (rw *roomWorker) notify() {
+	select {
+	case rw.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sq *SendQueue) wakeRoom(roomID id.RoomID) {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	if sq.ctx == nil {
+		return
+	} else if worker, ok := sq.workers[roomID]; ok {
+		worker.notify()
+		return
+	}
+	worker := &roomWorker{wake: make(chan struct{}, 1)}
+	sq.workers[roomID] = worker
+	sq.wg.Add(1)
+	go sq.runWorker(sq.ctx, roomID, worker)
+}
+
+func (sq *SendQueue) nextEvent(ctx context.Context, roomID id.RoomID, worker *roomWorker) (*QueuedEvent, error) {
+	// The lock is held during the query to make sure events that are being enqueued right now
+	// aren't missed when the worker exits, and that the event isn't cancelled before it's marked as current.
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	qe, err := sq.getNextPending(ctx, roomID)
+	if qe != nil {
+		worker.current = qe.TransactionID
+		worker.cancelled = false
+	} else if err == nil {
+		delete(sq.workers, roomID)
+	}
+	return qe, err
+}
+
+func (sq *SendQueue) startAttempt(worker *roomWorker) bool {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	worker.sending = !worker.cancelled
+	return worker.sending
+}
+
+func (sq *SendQueue) finishAttempt(worker *roomWorker) {
+	sq.lock.Lock()
+	worker.sending = false
+	sq.lock.Unlock()
+}
+
+func (sq *SendQueue) runWorker(ctx context.Context, roomID id.RoomID, worker *roomWorker) {
+	defer sq.wg.Done()
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "send queue").
+		Stringer("room_id", roomID).
+		Logger()
+	ctx = log.WithContext(ctx)
+	defer func() {
+		sq.lock.Lock()
+		if sq.workers[roomID] == worker {
+			delete(sq.workers, roomID)
+		}
+		sq.lock.Unlock()
+	}()
+	for ctx.Err() == nil {
+		qe, err := sq.nextEvent(ctx, roomID, worker)
+		if err != nil {
+			log.Err(err).Msg("Failed to get next event from send queue")
+			select {
+			case <-time.After(sq.RetryBackoff):
+			case <-ctx.Done():
+			}
+			continue
+		} else if qe == nil {
+			return
+		}
+		sq.processEvent(ctx, worker, qe)
+		sq.lock.Lock()
+		worker.current = ""
+		sq.lock.Unlock()
+	}
+}
+
+func isTransientError(err error) bool {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Response == nil {
+		// Network errors and other failures before getting a response
+		return true
+	}
+	code := httpErr.Response.StatusCode
+	return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+}
+
+func (sq *SendQueue) processEvent(ctx context.Context, worker *roomWorker, qe *QueuedEvent) {
+	log := zerolog.Ctx(ctx).With().Str("transaction_id", qe.TransactionID).Logger()
+	for sq.startAttempt(worker) {
+		eventID, err := sq.send(ctx, qe)
+		sq.finishAttempt(worker)
+		if err == nil {
+			_, err = sq.deleteEvent(ctx, qe.RoomID, qe.TransactionID)
+			if err != nil {
+				log.Err(err).Msg("Failed to remove sent event from queue")
+			}
+			log.Debug().Stringer("event_id", eventID).Msg("Sent queued event")
+			if sq.OnSent != nil {
+				sq.OnSent(ctx, qe, eventID)
+			}
+			return
+		} else if ctx.Err() != nil {
+			return
+		}
+		qe.Attempts++
+		qe.LastError = err.Error()
+		if !isTransientError(err) || (sq.MaxAttempts > 0 && qe.Attempts >= sq.MaxAttempts) {
+			qe.Status = StatusFailed
+		}
+		if dbErr := sq.updateStatus(ctx, qe); dbErr != nil {
+			log.Err(dbErr).Msg("Failed to update status of queued event")
+		}
+		if qe.Status == StatusFailed {
+			log.Err(err).Int("attempts", qe.Attempts).Msg("Failed to send queued event")
+			if sq.OnFailed != nil {
+				sq.OnFailed(ctx, qe, err)
+			}
+			return
+		}
+		backoff := min(sq.RetryBackoff<<min(qe.Attempts-1, 16), sq.MaxRetryBackoff)
+		log.Warn().Err(err).
+			Int("attempts", qe.Attempts).
+			Int("retry_in_seconds", int(backoff.Seconds())).
+			Msg("Failed to send queued event, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-worker.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (sq *SendQueue) send(ctx context.Context, qe *QueuedEvent) (id.EventID, error) {
+	eventType, content := qe.Type, qe.Content
+	if qe.Encrypted == nil && sq.Client.Crypto != nil && qe.Type != event.EventReaction && qe.Type != event.EventEncrypted {
+		isEncrypted, err := sq.Client.StateStore.IsEncrypted(ctx, qe.RoomID)
+		if err != nil {
+			return "", fmt.Errorf("failed to check if room is encrypted: %w", err)
+		} else if isEncrypted {
+			encrypted, err := sq.Client.Crypto.Encrypt(ctx, qe.RoomID, qe.Type, qe.Content)
+			if err != nil {
+				return "", fmt.Errorf("failed to encrypt event: %w", err)
+			}
+			qe.Encrypted, err = json.Marshal(encrypted)
+			if err != nil {
+				return "", fmt.Errorf("failed to marshal encrypted content: %w", err)
+			}
+			// Store the encrypted content, so retries after a restart send the exact same event
+			err = sq.setEncrypted(ctx, qe)
+			if err != nil {
+				return "", fmt.Errorf("failed to store encrypted content: %w", err)
+			}
+		}
+	}
+	if qe.Encrypted != nil {
+		eventType, content = event.EventEncrypted, qe.Encrypted
+	}
+	resp, err := sq.Client.SendMessageEvent(ctx, qe.RoomID, eventType, content, mautrix.ReqSendEvent{
+		TransactionID: qe.TransactionID,
+		DontEncrypt:   true,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sendqueue_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/sendqueue"
+)
+
+const roomID = id.RoomID("!room:example.com")
+
+type sentRequest struct {
+	Type    string
+	TxnID   string
+	Content map[string]any
+}
+
+type fakeHomeserver struct {
+	lock     sync.Mutex
+	requests []sentRequest
+	// responses are the status codes to return for the next requests. An empty list means success.
+	responses []int
+}
+
+func (fh *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+	parts := strings.Split(r.URL.Path, "/")
+	var content map[string]any
+	_ = json.NewDecoder(r.Body).Decode(&content)
+	fh.requests = append(fh.requests, sentRequest{Type: parts[len(parts)-2], TxnID: parts[len(parts)-1], Content: content})
+	w.Header().Set("Content-Type", "application/json")
+	if len(fh.responses) > 0 {
+		status := fh.responses[0]
+		fh.responses = fh.responses[1:]
+		errCode := "M_UNKNOWN"
+		if status == http.StatusForbidden {
+			errCode = "M_FORBIDDEN"
+		}
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintf(w, `{"errcode": %q, "error": "HTTP %d"}`, errCode, status)
+		return
+	}
+	_, _ = fmt.Fprintf(w, `{"event_id": "$event%d"}`, len(fh.requests))
+}
+
+func (fh *fakeHomeserver) getRequests() []sentRequest {
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+	return fh.requests
+}
+
+type fakeCrypto struct {
+	mautrix.CryptoHelper
+}
+
+func (fc *fakeCrypto) Encrypt(ctx context.Context, roomID id.RoomID, evtType event.Type, content any) (*event.EncryptedEventContent, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return &event.EncryptedEventContent{
+		Algorithm:        id.AlgorithmMegolmV1,
+		MegolmCiphertext: []byte(base64.RawStdEncoding.EncodeToString(data)),
+	}, nil
+}
+
+type sendResult struct {
+	txnID   string
+	eventID id.EventID
+	err     error
+}
+
+func newTestQueue(t *testing.T) (*sendqueue.SendQueue, *fakeHomeserver, chan sendResult) {
+	fh := &fakeHomeserver{}
+	server := httptest.NewServer(fh)
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@user:example.com", "token")
+	require.NoError(t, err)
+	cli.Log = zerolog.Nop()
+	cli.StateStore = mautrix.NewMemoryStateStore()
+	// Retries are handled by the queue
+	cli.DefaultHTTPRetries = 0
+
+	rawDB, err := sql.Open("sqlite3", ":memory:?_busy_timeout=5000")
+	require.NoError(t, err)
+	rawDB.SetMaxOpenConns(1)
+	db, err := dbutil.NewWithDB(rawDB, "sqlite3")
+	require.NoError(t, err)
+	sq := sendqueue.NewSendQueue(cli, db, nil)
+	require.NoError(t, sq.Upgrade(context.Background()))
+	sq.RetryBackoff = time.Millisecond
+	results := make(chan sendResult, 10)
+	sq.OnSent = func(ctx context.Context, evt *sendqueue.QueuedEvent, eventID id.EventID) {
+		results <- sendResult{txnID: evt.TransactionID, eventID: eventID}
+	}
+	sq.OnFailed = func(ctx context.Context, evt *sendqueue.QueuedEvent, err error) {
+		results <- sendResult{txnID: evt.TransactionID, err: err}
+	}
+	t.Cleanup(sq.Stop)
+	return sq, fh, results
+}
+
+func waitResult(t *testing.T, results chan sendResult) sendResult {
+	select {
+	case res := <-results:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for send result")
+		return sendResult{}
+	}
+}
+
+func textContent(body string) *event.MessageEventContent {
+	return &event.MessageEventContent{MsgType: event.MsgText, Body: body}
+}
+
+func TestSendQueue_OrderAndRetry(t *testing.T) {
+	sq, fh, results := newTestQueue(t)
+	ctx := context.Background()
+	var echoes []*event.Event
+	sq.OnLocalEcho = func(ctx context.Context, evt *sendqueue.QueuedEvent) {
+		echoes = append(echoes, evt.LocalEcho("@user:example.com"))
+	}
+	fh.responses = []int{http.StatusBadGateway, http.StatusTooManyRequests}
+
+	// Events enqueued before starting should stay in the database until the queue is started
+	first, err := sq.Enqueue(ctx, roomID, event.EventMessage, textContent("first"))
+	require.NoError(t, err)
+	second, err := sq.Enqueue(ctx, roomID, event.EventMessage, textContent("second"))
+	require.NoError(t, err)
+	queue, err := sq.GetQueue(ctx, roomID)
+	require.NoError(t, err)
+	require.Len(t, queue, 2)
+	assert.Equal(t, first.TransactionID, queue[0].TransactionID)
+	require.Len(t, echoes, 2)
+	assert.Equal(t, "first", echoes[0].Content.AsMessage().Body)
+	assert.Equal(t, first.TransactionID, echoes[0].Unsigned.TransactionID)
+
+	require.NoError(t, sq.Start(ctx))
+	res := waitResult(t, results)
+	assert.Equal(t, first.TransactionID, res.txnID)
+	assert.NoError(t, res.err)
+	res = waitResult(t, results)
+	assert.Equal(t, second.TransactionID, res.txnID)
+	assert.Equal(t, id.EventID("$event4"), res.eventID)
+
+	reqs := fh.getRequests()
+	require.Len(t, reqs, 4)
+	// All attempts of the first event must use the same transaction ID
+	for _, req := range reqs[:3] {
+		assert.Equal(t, first.TransactionID, req.TxnID)
+		assert.Equal(t, "first", req.Content["body"])
+	}
+	assert.Equal(t, second.TransactionID, reqs[3].TxnID)
+	queue, err = sq.GetQueue(ctx, roomID)
+	require.NoError(t, err)
+	assert.Empty(t, queue)
+}
+
+func TestSendQueue_PermanentFailure(t *testing.T) {
+	sq, fh, results := newTestQueue(t)
+	ctx := context.Background()
+	require.NoError(t, sq.Start(ctx))
+	fh.responses = []int{http.StatusForbidden}
+
+	failed, err := sq.Enqueue(ctx, roomID, event.EventMessage, textContent("forbidden"))
+	require.NoError(t, err)
+	res := waitResult(t, results)
+	assert.Equal(t, failed.TransactionID, res.txnID)
+	assert.ErrorIs(t, res.err, mautrix.MForbidden)
+	queue, err := sq.GetQueue(ctx, roomID)
+	require.NoError(t, err)
+	require.Len(t, queue, 1)
+	assert.Equal(t, sendqueue.StatusFailed, queue[0].Status)
+	assert.Equal(t, 1, queue[0].Attempts)
+
+	// Failed events don't block the rest of the room
+	_, err = sq.Enqueue(ctx, roomID, event.EventMessage, textContent("allowed"))
+	require.NoError(t, err)
+	assert.NoError(t, waitResult(t, results).err)
+
+	require.NoError(t, sq.Retry(ctx, roomID, failed.TransactionID))
+	res = waitResult(t, results)
+	assert.Equal(t, failed.TransactionID, res.txnID)
+	assert.NoError(t, res.err)
+	assert.Len(t, fh.getRequests(), 3)
+}
+
+func TestSendQueue_Encryption(t *testing.T) {
+	sq, fh, results := newTestQueue(t)
+	ctx := context.Background()
+	sq.Client.Crypto = &fakeCrypto{}
+	require.NoError(t, sq.Client.StateStore.SetEncryptionEvent(ctx, roomID, &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}))
+	require.NoError(t, sq.Start(ctx))
+
+	_, err := sq.Enqueue(ctx, roomID, event.EventMessage, textContent("secret"))
+	require.NoError(t, err)
+	_, err = sq.Enqueue(ctx, roomID, event.EventReaction, &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: "$event1", Key: "👍"},
+	})
+	require.NoError(t, err)
+	assert.NoError(t, waitResult(t, results).err)
+	assert.NoError(t, waitResult(t, results).err)
+
+	reqs := fh.getRequests()
+	require.Len(t, reqs, 2)
+	assert.Equal(t, "m.room.encrypted", reqs[0].Type)
+	assert.Equal(t, string(id.AlgorithmMegolmV1), reqs[0].Content["algorithm"])
+	assert.Equal(t, "m.reaction", reqs[1].Type)
+}
+
+func TestSendQueue_Cancel(t *testing.T) {
+	sq, fh, _ := newTestQueue(t)
+	ctx := context.Background()
+	evt, err := sq.Enqueue(ctx, roomID, event.EventMessage, textContent("cancelled"))
+	require.NoError(t, err)
+	cancelled, err := sq.Cancel(ctx, roomID, evt.TransactionID)
+	require.NoError(t, err)
+	assert.True(t, cancelled)
+	require.NoError(t, sq.Start(ctx))
+	sq.Stop()
+	assert.Empty(t, fh.getRequests())
+}
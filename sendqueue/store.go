@@ -0,0 +1,142 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sendqueue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type Status string
+
+const (
+	// StatusPending means the event is waiting to be sent or is currently being sent.
+	StatusPending Status = "pending"
+	// StatusFailed means sending the event failed permanently. Failed events stay in the queue
+	// until they're retried with [SendQueue.Retry] or removed with [SendQueue.Cancel].
+	StatusFailed Status = "failed"
+)
+
+// QueuedEvent is an event in the send queue.
+type QueuedEvent struct {
+	RoomID        id.RoomID
+	TransactionID string
+	Type          event.Type
+	Content       json.RawMessage
+	// Encrypted is the encrypted form of Content. It's only set for events in encrypted rooms
+	// after the first send attempt.
+	Encrypted json.RawMessage
+	Timestamp time.Time
+	Status    Status
+	Attempts  int
+	LastError string
+}
+
+// LocalEcho returns an event that can be displayed in the timeline while the event is being sent.
+// The event doesn't have an ID, but the transaction ID is set in the unsigned data like in
+// the remote echo that will come down sync.
+func (qe *QueuedEvent) LocalEcho(sender id.UserID) *event.Event {
+	evt := &event.Event{
+		Sender:    sender,
+		Type:      qe.Type,
+		Timestamp: qe.Timestamp.UnixMilli(),
+		RoomID:    qe.RoomID,
+		Content:   event.Content{VeryRaw: qe.Content},
+		Unsigned:  event.Unsigned{TransactionID: qe.TransactionID},
+	}
+	_ = evt.Content.ParseRaw(evt.Type)
+	return evt
+}
+
+const queuedEventColumns = "room_id, txn_id, event_type, content, encrypted_content, timestamp, status, attempts, last_error"
+
+const (
+	insertEventQuery = `
+		INSERT INTO mx_send_queue (room_id, txn_id, queue_order, event_type, content, timestamp, status)
+		VALUES ($1, $2, (SELECT COALESCE(MAX(queue_order), 0) + 1 FROM mx_send_queue WHERE room_id=$1), $3, $4, $5, $6)
+	`
+	getNextPendingQuery = `
+		SELECT ` + queuedEventColumns + ` FROM mx_send_queue
+		WHERE room_id=$1 AND status='pending'
+		ORDER BY queue_order LIMIT 1
+	`
+	getRoomQueueQuery    = "SELECT " + queuedEventColumns + " FROM mx_send_queue WHERE room_id=$1 ORDER BY queue_order"
+	getPendingRoomsQuery = "SELECT DISTINCT room_id FROM mx_send_queue WHERE status='pending'"
+	setEncryptedQuery    = "UPDATE mx_send_queue SET encrypted_content=$3 WHERE room_id=$1 AND txn_id=$2"
+	updateStatusQuery    = "UPDATE mx_send_queue SET status=$3, attempts=$4, last_error=$5 WHERE room_id=$1 AND txn_id=$2"
+	retryEventQuery      = "UPDATE mx_send_queue SET status='pending', attempts=0, last_error='' WHERE room_id=$1 AND txn_id=$2 AND status='failed'"
+	deleteEventQuery     = "DELETE FROM mx_send_queue WHERE room_id=$1 AND txn_id=$2"
+	deleteRoomQueueQuery = "DELETE FROM mx_send_queue WHERE room_id=$1"
+)
+
+func scanQueuedEvent(row dbutil.Scannable) (*QueuedEvent, error) {
+	var qe QueuedEvent
+	var timestamp int64
+	err := row.Scan(
+		&qe.RoomID, &qe.TransactionID, &qe.Type.Type, &dbutil.JSON{Data: &qe.Content}, &dbutil.JSON{Data: &qe.Encrypted},
+		&timestamp, &qe.Status, &qe.Attempts, &qe.LastError,
+	)
+	if err != nil {
+		return nil, err
+	}
+	qe.Type.Class = event.MessageEventType
+	qe.Timestamp = time.UnixMilli(timestamp)
+	return &qe, nil
+}
+
+func (sq *SendQueue) insertEvent(ctx context.Context, qe *QueuedEvent) error {
+	_, err := sq.Exec(ctx, insertEventQuery, qe.RoomID, qe.TransactionID, qe.Type.Type, dbutil.JSON{Data: qe.Content}, qe.Timestamp.UnixMilli(), qe.Status)
+	return err
+}
+
+func (sq *SendQueue) getNextPending(ctx context.Context, roomID id.RoomID) (*QueuedEvent, error) {
+	qe, err := scanQueuedEvent(sq.QueryRow(ctx, getNextPendingQuery, roomID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return qe, err
+}
+
+func (sq *SendQueue) setEncrypted(ctx context.Context, qe *QueuedEvent) error {
+	_, err := sq.Exec(ctx, setEncryptedQuery, qe.RoomID, qe.TransactionID, dbutil.JSON{Data: qe.Encrypted})
+	return err
+}
+
+func (sq *SendQueue) updateStatus(ctx context.Context, qe *QueuedEvent) error {
+	_, err := sq.Exec(ctx, updateStatusQuery, qe.RoomID, qe.TransactionID, qe.Status, qe.Attempts, qe.LastError)
+	return err
+}
+
+func (sq *SendQueue) deleteEvent(ctx context.Context, roomID id.RoomID, txnID string) (bool, error) {
+	res, err := sq.Exec(ctx, deleteEventQuery, roomID, txnID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// GetQueue returns all pending and failed events in the given room in the order they will be sent.
+func (sq *SendQueue) GetQueue(ctx context.Context, roomID id.RoomID) ([]*QueuedEvent, error) {
+	rows, err := sq.Query(ctx, getRoomQueueQuery, roomID)
+	return dbutil.NewRowIterWithError(rows, scanQueuedEvent, err).AsList()
+}
+
+// ClearRoom removes all queued events in the given room, e.g. after leaving it.
+// Events that are currently being sent may still be sent.
+func (sq *SendQueue) ClearRoom(ctx context.Context, roomID id.RoomID) error {
+	_, err := sq.Exec(ctx, deleteRoomQueueQuery, roomID)
+	return err
+}
@@ -0,0 +1,20 @@
+-- v0 -> v1: Latest revision
+
+CREATE TABLE mx_send_queue (
+	room_id           TEXT    NOT NULL,
+	txn_id            TEXT    NOT NULL,
+	queue_order       BIGINT  NOT NULL,
+	event_type        TEXT    NOT NULL,
+	content           jsonb   NOT NULL,
+	-- The encrypted content is stored before the first send attempt,
+	-- so that retries after a restart send exactly the same event.
+	encrypted_content jsonb,
+	timestamp         BIGINT  NOT NULL,
+	status            TEXT    NOT NULL,
+	attempts          INTEGER NOT NULL DEFAULT 0,
+	last_error        TEXT    NOT NULL DEFAULT '',
+
+	PRIMARY KEY (room_id, txn_id)
+);
+
+CREATE INDEX mx_send_queue_order_idx ON mx_send_queue (room_id, queue_order);
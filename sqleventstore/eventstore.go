@@ -0,0 +1,448 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sqleventstore contains a SQL-backed cache of room timelines for clients and bots.
+//
+// The store records events from /sync timelines and /messages pages, remembers where the
+// timeline has gaps (e.g. when a sync response is limited), keeps decrypted content next to
+// the encrypted events and applies redactions and edits as they come in.
+package sqleventstore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/tidwall/gjson"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/exgjson"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+//go:embed *.sql
+var rawUpgrades embed.FS
+
+var UpgradeTable = dbutil.BuildUpgradeTable().
+	WithFS(rawUpgrades).
+	Finish()
+
+const VersionTableName = "mx_event_store_version"
+
+// SQLEventStore is a local cache of room timelines.
+type SQLEventStore struct {
+	*dbutil.Database
+
+	// StateStore is used to find the room version when applying redactions
+	// if the create event of the room isn't in the event store. Optional.
+	StateStore mautrix.StateStore
+	// Decrypt is called for encrypted events that are fetched using Paginate.
+	// This should usually be set to [cryptohelper.CryptoHelper.Decrypt]. Optional.
+	Decrypt func(ctx context.Context, evt *event.Event) (*event.Event, error)
+}
+
+func NewSQLEventStore(db *dbutil.Database, log dbutil.DatabaseLogger) *SQLEventStore {
+	return &SQLEventStore{
+		Database: db.Child(VersionTableName, UpgradeTable, log),
+	}
+}
+
+// Event is a single event stored in the event store.
+type Event struct {
+	RoomID  id.RoomID
+	ID      id.EventID
+	SortKey int64
+
+	// Event is the event as received from the server. If the event has been redacted,
+	// the content has already been stripped.
+	Event *event.Event
+	// Decrypted is the decrypted form of the event, if it was encrypted and decryption succeeded.
+	Decrypted *event.Event
+
+	RedactedBy id.EventID
+	LastEditID id.EventID
+}
+
+// Gap is a hole in a room's timeline right before the event with the given sort key.
+type Gap struct {
+	RoomID    id.RoomID
+	SortKey   int64
+	PrevBatch string
+}
+
+// Final returns the decrypted event if available, and the raw event otherwise.
+func (evt *Event) Final() *event.Event {
+	if evt.Decrypted != nil {
+		return evt.Decrypted
+	}
+	return evt.Event
+}
+
+const eventColumns = "room_id, event_id, sort_key, event, decrypted, redacted_by, last_edit_id"
+
+const (
+	getEventQuery        = "SELECT " + eventColumns + " FROM mx_timeline_event WHERE room_id=$1 AND event_id=$2"
+	getEventsBeforeQuery = "SELECT " + eventColumns + " FROM mx_timeline_event WHERE room_id=$1 AND sort_key<$2 ORDER BY sort_key DESC LIMIT $3"
+	getMaxSortKeyQuery   = "SELECT COALESCE(MAX(sort_key), 0) FROM mx_timeline_event WHERE room_id=$1"
+	getPrevSortKeyQuery  = "SELECT COALESCE(MAX(sort_key), $3) FROM mx_timeline_event WHERE room_id=$1 AND sort_key<$2"
+	insertEventQuery     = `
+		INSERT INTO mx_timeline_event (
+			room_id, event_id, sort_key, sender, type, state_key, timestamp, relates_to, relation_type, redacts, event
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (room_id, event_id) DO NOTHING
+	`
+	shiftEventsQuery   = "UPDATE mx_timeline_event SET sort_key=sort_key+$3 WHERE room_id=$1 AND sort_key>=$2"
+	shiftGapsQuery     = "UPDATE mx_timeline_gap SET sort_key=sort_key+$3 WHERE room_id=$1 AND sort_key>$2"
+	putDecryptedQuery  = "UPDATE mx_timeline_event SET decrypted=$3 WHERE room_id=$1 AND event_id=$2 AND redacted_by=''"
+	redactEventQuery   = "UPDATE mx_timeline_event SET event=$3, decrypted=NULL, redacted_by=$4 WHERE room_id=$1 AND event_id=$2"
+	findRedactionQuery = `
+		SELECT event_id FROM mx_timeline_event WHERE room_id=$1 AND redacts=$2 AND type='m.room.redaction' LIMIT 1
+	`
+	setLastEditQuery = `
+		UPDATE mx_timeline_event SET last_edit_id=$3
+		WHERE room_id=$1 AND event_id=$2 AND sender=$4 AND (
+			last_edit_id='' OR
+			(SELECT edit.timestamp FROM mx_timeline_event edit WHERE edit.room_id=$1 AND edit.event_id=mx_timeline_event.last_edit_id) < $5
+		)
+	`
+	forceLastEditQuery = "UPDATE mx_timeline_event SET last_edit_id=$3 WHERE room_id=$1 AND event_id=$2"
+	resetLastEditQuery = `
+		UPDATE mx_timeline_event SET last_edit_id=COALESCE((
+			SELECT edit.event_id FROM mx_timeline_event edit
+			WHERE edit.room_id=$1 AND edit.relates_to=mx_timeline_event.event_id AND edit.relation_type='m.replace'
+			  AND edit.sender=mx_timeline_event.sender AND edit.redacted_by=''
+			ORDER BY edit.timestamp DESC LIMIT 1
+		), '')
+		WHERE room_id=$1 AND last_edit_id=$2
+	`
+	findLatestEditQuery = `
+		SELECT event_id FROM mx_timeline_event
+		WHERE room_id=$1 AND relates_to=$2 AND relation_type='m.replace' AND sender=$3 AND redacted_by=''
+		ORDER BY timestamp DESC LIMIT 1
+	`
+	insertGapQuery      = "INSERT INTO mx_timeline_gap (room_id, sort_key, prev_batch) VALUES ($1, $2, $3)"
+	getGapBeforeQuery   = "SELECT room_id, sort_key, prev_batch FROM mx_timeline_gap WHERE room_id=$1 AND sort_key<=$2 ORDER BY sort_key DESC LIMIT 1"
+	updateGapQuery      = "UPDATE mx_timeline_gap SET prev_batch=$3 WHERE room_id=$1 AND sort_key=$2"
+	moveGapQuery        = "UPDATE mx_timeline_gap SET sort_key=$3, prev_batch=$4 WHERE room_id=$1 AND sort_key=$2"
+	deleteGapQuery      = "DELETE FROM mx_timeline_gap WHERE room_id=$1 AND sort_key=$2"
+	countEventsBetween  = "SELECT COUNT(*) FROM mx_timeline_event WHERE room_id=$1 AND sort_key>=$2 AND sort_key<$3"
+	getCreateEventQuery = "SELECT event FROM mx_timeline_event WHERE room_id=$1 AND type='m.room.create' AND state_key=''"
+	deleteRoomEvents    = "DELETE FROM mx_timeline_event WHERE room_id=$1"
+	deleteRoomGaps      = "DELETE FROM mx_timeline_gap WHERE room_id=$1"
+)
+
+func scanEvent(row dbutil.Scannable) (*Event, error) {
+	var evt Event
+	var decrypted *event.Event
+	err := row.Scan(&evt.RoomID, &evt.ID, &evt.SortKey, &dbutil.JSON{Data: &evt.Event}, &dbutil.JSON{Data: &decrypted}, &evt.RedactedBy, &evt.LastEditID)
+	if err != nil {
+		return nil, err
+	}
+	evt.Decrypted = decrypted
+	evt.Event.RoomID = evt.RoomID
+	if evt.Decrypted != nil {
+		evt.Decrypted.RoomID = evt.RoomID
+		evt.Decrypted.Mautrix.WasEncrypted = true
+	}
+	return &evt, nil
+}
+
+// GetEvent returns a single event from the store, or nil if the event isn't stored.
+func (store *SQLEventStore) GetEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*Event, error) {
+	evt, err := scanEvent(store.QueryRow(ctx, getEventQuery, roomID, eventID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return evt, err
+}
+
+// GetEventsBefore returns up to limit locally stored events that are older than the given sort key,
+// in chronological order. This does not care about gaps: use Paginate to get a contiguous timeline.
+func (store *SQLEventStore) GetEventsBefore(ctx context.Context, roomID id.RoomID, before int64, limit int) ([]*Event, error) {
+	rows, err := store.Query(ctx, getEventsBeforeQuery, roomID, before, limit)
+	evts, err := dbutil.NewRowIterWithError(rows, scanEvent, err).AsList()
+	if err != nil {
+		return nil, err
+	}
+	slices.Reverse(evts)
+	return evts, nil
+}
+
+// GetGapBefore returns the closest gap at or before the given sort key, or nil if there are no gaps.
+func (store *SQLEventStore) GetGapBefore(ctx context.Context, roomID id.RoomID, sortKey int64) (*Gap, error) {
+	var gap Gap
+	err := store.QueryRow(ctx, getGapBeforeQuery, roomID, sortKey).Scan(&gap.RoomID, &gap.SortKey, &gap.PrevBatch)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &gap, nil
+}
+
+// PutDecrypted stores the decrypted form of an event that is already in the store.
+func (store *SQLEventStore) PutDecrypted(ctx context.Context, evt *event.Event) error {
+	_, err := store.Exec(ctx, putDecryptedQuery, evt.RoomID, evt.ID, dbutil.JSON{Data: evt})
+	return err
+}
+
+// ClearRoom deletes all stored events and gaps in the given room.
+func (store *SQLEventStore) ClearRoom(ctx context.Context, roomID id.RoomID) error {
+	return store.DoTxn(ctx, nil, func(ctx context.Context) error {
+		_, err := store.Exec(ctx, deleteRoomEvents, roomID)
+		if err != nil {
+			return err
+		}
+		_, err = store.Exec(ctx, deleteRoomGaps, roomID)
+		return err
+	})
+}
+
+// gapSortKeySpace is the number of sort keys left free before events after a limited sync timeline,
+// so that the gap can be filled later without renumbering existing events.
+const gapSortKeySpace = 1 << 32
+
+// AddSyncTimeline stores the timeline of a room from a sync response.
+//
+// If the timeline is limited, or if this is the first time events are stored for the room,
+// a gap with the prev_batch token is recorded before the new events.
+func (store *SQLEventStore) AddSyncTimeline(ctx context.Context, roomID id.RoomID, timeline *mautrix.SyncTimeline) error {
+	if len(timeline.Events) == 0 {
+		return nil
+	}
+	return store.DoTxn(ctx, nil, func(ctx context.Context) error {
+		var maxSortKey int64
+		err := store.QueryRow(ctx, getMaxSortKeyQuery, roomID).Scan(&maxSortKey)
+		if err != nil {
+			return fmt.Errorf("failed to get last sort key: %w", err)
+		}
+		isFirst := maxSortKey == 0
+		addGap := timeline.PrevBatch != "" && (timeline.Limited || isFirst) &&
+			(!isFirst || timeline.Events[0].Type.Type != event.StateCreate.Type)
+		firstNewKey := maxSortKey + 1
+		if addGap && !isFirst {
+			// Events before the first gap can use negative sort keys, but gaps in the middle need free space
+			firstNewKey = maxSortKey + gapSortKeySpace
+		}
+		nextKey := firstNewKey
+		for _, evt := range timeline.Events {
+			inserted, err := store.insertEvent(ctx, roomID, evt, nextKey)
+			if err != nil {
+				return err
+			} else if inserted {
+				nextKey++
+			}
+		}
+		if addGap && nextKey > firstNewKey {
+			_, err = store.Exec(ctx, insertGapQuery, roomID, firstNewKey, timeline.PrevBatch)
+			if err != nil {
+				return fmt.Errorf("failed to insert gap: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// FillGap stores a page of events fetched with /messages (in the backwards direction)
+// from the given gap's prev_batch token. It returns the number of events that were added.
+//
+// The gap is removed if the page reaches events that are already stored or the start of the room,
+// and otherwise the gap's token is updated to the end token of the page.
+func (store *SQLEventStore) FillGap(ctx context.Context, gap *Gap, resp *mautrix.RespMessages) (inserted int, err error) {
+	err = store.DoTxn(ctx, nil, func(ctx context.Context) error {
+		newEvents := make([]*event.Event, 0, len(resp.Chunk))
+		closed := resp.End == ""
+		for _, evt := range resp.Chunk {
+			existing, err := store.GetEvent(ctx, gap.RoomID, evt.ID)
+			if err != nil {
+				return err
+			} else if existing != nil {
+				closed = true
+				break
+			}
+			newEvents = append(newEvents, evt)
+			if evt.Type.Type == event.StateCreate.Type {
+				closed = true
+				break
+			}
+		}
+		var prevKey int64
+		err := store.QueryRow(ctx, getPrevSortKeyQuery, gap.RoomID, gap.SortKey, int64(math.MinInt64)).Scan(&prevKey)
+		if err != nil {
+			return fmt.Errorf("failed to get sort key before gap: %w", err)
+		}
+		newGapKey := gap.SortKey
+		if gap.SortKey-int64(len(newEvents)) > prevKey {
+			// The new events fit in the free space before the gap, so insert them backwards from the gap
+			// and move the gap to the oldest inserted event.
+			for _, evt := range newEvents {
+				ok, err := store.insertEvent(ctx, gap.RoomID, evt, newGapKey-1)
+				if err != nil {
+					return err
+				} else if ok {
+					newGapKey--
+					inserted++
+				}
+			}
+		} else {
+			inserted, err = store.shiftAndFillGap(ctx, gap, newEvents)
+			if err != nil {
+				return err
+			}
+		}
+		if closed {
+			_, err = store.Exec(ctx, deleteGapQuery, gap.RoomID, gap.SortKey)
+		} else {
+			_, err = store.Exec(ctx, moveGapQuery, gap.RoomID, gap.SortKey, newGapKey, resp.End)
+			gap.SortKey = newGapKey
+			gap.PrevBatch = resp.End
+		}
+		return err
+	})
+	return
+}
+
+// shiftAndFillGap makes room for the given events by renumbering all events after the gap.
+// This is only used if the free space before the gap has run out.
+func (store *SQLEventStore) shiftAndFillGap(ctx context.Context, gap *Gap, newEvents []*event.Event) (inserted int, err error) {
+	if len(newEvents) == 0 {
+		return 0, nil
+	}
+	_, err = store.Exec(ctx, shiftEventsQuery, gap.RoomID, gap.SortKey, len(newEvents))
+	if err != nil {
+		return 0, fmt.Errorf("failed to shift events: %w", err)
+	}
+	_, err = store.Exec(ctx, shiftGapsQuery, gap.RoomID, gap.SortKey, len(newEvents))
+	if err != nil {
+		return 0, fmt.Errorf("failed to shift gaps: %w", err)
+	}
+	nextKey := gap.SortKey
+	for i := len(newEvents) - 1; i >= 0; i-- {
+		ok, err := store.insertEvent(ctx, gap.RoomID, newEvents[i], nextKey)
+		if err != nil {
+			return inserted, err
+		} else if ok {
+			nextKey++
+			inserted++
+		}
+	}
+	return inserted, nil
+}
+
+var (
+	relatesToPath           = exgjson.Path("content", "m.relates_to", "event_id")
+	relationTypePath        = exgjson.Path("content", "m.relates_to", "rel_type")
+	contentRelationTypePath = exgjson.Path("m.relates_to", "rel_type")
+	contentRedacts          = exgjson.Path("content", "redacts")
+)
+
+func (store *SQLEventStore) insertEvent(ctx context.Context, roomID id.RoomID, evt *event.Event, sortKey int64) (bool, error) {
+	// Don't modify the caller's event
+	evtCopy := *evt
+	evtCopy.RoomID = roomID
+	evt = &evtCopy
+	evtJSON, err := json.Marshal(evt)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal event %s: %w", evt.ID, err)
+	}
+	relatesTo := gjson.GetBytes(evtJSON, relatesToPath).Str
+	relationType := gjson.GetBytes(evtJSON, relationTypePath).Str
+	redacts := evt.Redacts
+	if redacts == "" && evt.Type.Type == event.EventRedaction.Type {
+		redacts = id.EventID(gjson.GetBytes(evtJSON, contentRedacts).Str)
+	}
+	res, err := store.Exec(
+		ctx, insertEventQuery,
+		roomID, evt.ID, sortKey, evt.Sender, evt.Type.Type, evt.StateKey, evt.Timestamp,
+		relatesTo, relationType, redacts, evtJSON,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert event %s: %w", evt.ID, err)
+	} else if affected, _ := res.RowsAffected(); affected == 0 {
+		return false, nil
+	}
+	if redacts != "" {
+		err = store.redactEvent(ctx, roomID, redacts, evt)
+		if err != nil {
+			return true, fmt.Errorf("failed to apply redaction %s: %w", evt.ID, err)
+		}
+	}
+	var existingRedaction id.EventID
+	err = store.QueryRow(ctx, findRedactionQuery, roomID, evt.ID).Scan(&existingRedaction)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return true, fmt.Errorf("failed to check for existing redaction of %s: %w", evt.ID, err)
+	} else if existingRedaction != "" {
+		redaction, err := store.GetEvent(ctx, roomID, existingRedaction)
+		if err != nil {
+			return true, err
+		}
+		err = store.redactEvent(ctx, roomID, evt.ID, redaction.Event)
+		if err != nil {
+			return true, fmt.Errorf("failed to apply existing redaction to %s: %w", evt.ID, err)
+		}
+		return true, nil
+	}
+	if relationType == string(event.RelReplace) && relatesTo != "" {
+		_, err = store.Exec(ctx, setLastEditQuery, roomID, relatesTo, evt.ID, evt.Sender, evt.Timestamp)
+		if err != nil {
+			return true, fmt.Errorf("failed to apply edit %s: %w", evt.ID, err)
+		}
+	}
+	var lastEdit id.EventID
+	err = store.QueryRow(ctx, findLatestEditQuery, roomID, evt.ID, evt.Sender).Scan(&lastEdit)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return true, fmt.Errorf("failed to find existing edits of %s: %w", evt.ID, err)
+	} else if lastEdit != "" {
+		_, err = store.Exec(ctx, forceLastEditQuery, roomID, evt.ID, lastEdit)
+		if err != nil {
+			return true, fmt.Errorf("failed to apply existing edit to %s: %w", evt.ID, err)
+		}
+	}
+	return true, nil
+}
+
+func (store *SQLEventStore) getRoomVersion(ctx context.Context, roomID id.RoomID) id.RoomVersion {
+	var createEvt *event.Event
+	err := store.QueryRow(ctx, getCreateEventQuery, roomID).Scan(&dbutil.JSON{Data: &createEvt})
+	if err != nil && store.StateStore != nil {
+		createEvt, _ = store.StateStore.GetCreate(ctx, roomID)
+	}
+	if createEvt == nil {
+		return id.RoomV1
+	}
+	version, _ := createEvt.Content.Raw["room_version"].(string)
+	if version == "" {
+		return id.RoomV1
+	}
+	return id.RoomVersion(version)
+}
+
+func (store *SQLEventStore) redactEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID, redaction *event.Event) error {
+	target, err := store.GetEvent(ctx, roomID, eventID)
+	if err != nil || target == nil || target.RedactedBy != "" {
+		return err
+	}
+	redacted := redactedCopy(target.Event, store.getRoomVersion(ctx, roomID), redaction)
+	_, err = store.Exec(ctx, redactEventQuery, roomID, eventID, dbutil.JSON{Data: redacted}, redaction.ID)
+	if err != nil {
+		return err
+	}
+	if gjson.GetBytes(target.Event.Content.VeryRaw, contentRelationTypePath).Str == string(event.RelReplace) {
+		// If the redacted event was the latest edit of another event, fall back to the previous edit
+		_, err = store.Exec(ctx, resetLastEditQuery, roomID, eventID)
+		if err != nil {
+			return fmt.Errorf("failed to update last edit after redaction: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqleventstore_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/sqleventstore"
+)
+
+const roomID = id.RoomID("!room:example.com")
+
+func newStore(t *testing.T) *sqleventstore.SQLEventStore {
+	rawDB, err := sql.Open("sqlite3", ":memory:?_busy_timeout=5000")
+	require.NoError(t, err)
+	rawDB.SetMaxOpenConns(1)
+	db, err := dbutil.NewWithDB(rawDB, "sqlite3")
+	require.NoError(t, err)
+	store := sqleventstore.NewSQLEventStore(db, nil)
+	require.NoError(t, store.Upgrade(context.Background()))
+	return store
+}
+
+func message(n int, body string) *event.Event {
+	return &event.Event{
+		ID:        id.EventID(fmt.Sprintf("$evt%d", n)),
+		Sender:    "@user:example.com",
+		Type:      event.EventMessage,
+		Timestamp: int64(n),
+		Content:   event.Content{Raw: map[string]any{"msgtype": "m.text", "body": body}},
+	}
+}
+
+func eventIDs(evts []*sqleventstore.Event) (ids []id.EventID) {
+	for _, evt := range evts {
+		ids = append(ids, evt.ID)
+	}
+	return
+}
+
+func TestSQLEventStore_GapFilling(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	err := store.AddSyncTimeline(ctx, roomID, &mautrix.SyncTimeline{
+		SyncEventsList: mautrix.SyncEventsList{Events: []*event.Event{message(1, "a"), message(2, "b")}},
+		PrevBatch:      "start",
+	})
+	require.NoError(t, err)
+	err = store.AddSyncTimeline(ctx, roomID, &mautrix.SyncTimeline{
+		SyncEventsList: mautrix.SyncEventsList{Events: []*event.Event{message(5, "e"), message(6, "f")}},
+		Limited:        true,
+		PrevBatch:      "middle",
+	})
+	require.NoError(t, err)
+
+	gap, err := store.GetGapBefore(ctx, roomID, math.MaxInt64)
+	require.NoError(t, err)
+	require.NotNil(t, gap)
+	assert.Equal(t, "middle", gap.PrevBatch)
+	before, err := store.GetEventsBefore(ctx, roomID, math.MaxInt64, 10)
+	require.NoError(t, err)
+
+	inserted, err := store.FillGap(ctx, gap, &mautrix.RespMessages{
+		Chunk: []*event.Event{message(4, "d"), message(3, "c"), message(2, "b")},
+		End:   "next",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, inserted)
+
+	evts, err := store.GetEventsBefore(ctx, roomID, math.MaxInt64, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []id.EventID{"$evt1", "$evt2", "$evt3", "$evt4", "$evt5", "$evt6"}, eventIDs(evts))
+
+	gap, err = store.GetGapBefore(ctx, roomID, math.MaxInt64)
+	require.NoError(t, err)
+	require.NotNil(t, gap)
+	assert.Equal(t, "start", gap.PrevBatch, "middle gap should be closed after reaching known events")
+	assert.Equal(t, evts[0].SortKey, gap.SortKey)
+	for i, evt := range before {
+		assert.Equal(t, evt.SortKey, evts[slices.Index(eventIDs(evts), evt.ID)].SortKey, "existing event %d shouldn't be renumbered", i)
+	}
+
+	inserted, err = store.FillGap(ctx, gap, &mautrix.RespMessages{
+		Chunk: []*event.Event{message(0, "z")},
+		End:   "older",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, inserted)
+	evts, err = store.GetEventsBefore(ctx, roomID, math.MaxInt64, 10)
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$evt0"), evts[0].ID)
+	assert.Equal(t, "older", gap.PrevBatch)
+	assert.Equal(t, evts[0].SortKey, gap.SortKey, "open gap should move to the oldest inserted event")
+	gap, err = store.GetGapBefore(ctx, roomID, math.MaxInt64)
+	require.NoError(t, err)
+	require.NotNil(t, gap)
+	assert.Equal(t, "older", gap.PrevBatch)
+	assert.Equal(t, evts[0].SortKey, gap.SortKey)
+}
+
+func TestSQLEventStore_RedactionAndEdit(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	edit := message(3, "* edited")
+	edit.Content.Raw["m.relates_to"] = map[string]any{"rel_type": "m.replace", "event_id": "$evt1"}
+	redaction := &event.Event{
+		ID:        "$redact",
+		Sender:    "@user:example.com",
+		Type:      event.EventRedaction,
+		Timestamp: 4,
+		Redacts:   "$evt2",
+		Content:   event.Content{Raw: map[string]any{"redacts": "$evt2"}},
+	}
+	err := store.AddSyncTimeline(ctx, roomID, &mautrix.SyncTimeline{
+		SyncEventsList: mautrix.SyncEventsList{Events: []*event.Event{message(1, "a"), message(2, "b"), edit, redaction}},
+	})
+	require.NoError(t, err)
+
+	evt, err := store.GetEvent(ctx, roomID, "$evt1")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$evt3"), evt.LastEditID)
+
+	evt, err = store.GetEvent(ctx, roomID, "$evt2")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$redact"), evt.RedactedBy)
+	assert.Empty(t, evt.Event.Content.Raw)
+}
+
+func TestSQLEventStore_RedactEdit(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	makeEdit := func(n int) *event.Event {
+		edit := message(n, "* edited")
+		edit.Content.Raw["m.relates_to"] = map[string]any{"rel_type": "m.replace", "event_id": "$evt1"}
+		return edit
+	}
+	makeRedaction := func(n int, target id.EventID) *event.Event {
+		return &event.Event{
+			ID:        id.EventID(fmt.Sprintf("$redact%d", n)),
+			Sender:    "@user:example.com",
+			Type:      event.EventRedaction,
+			Timestamp: int64(n),
+			Redacts:   target,
+			Content:   event.Content{Raw: map[string]any{"redacts": string(target)}},
+		}
+	}
+	evts := []*event.Event{message(1, "a"), makeEdit(2), makeEdit(3)}
+	err := store.AddSyncTimeline(ctx, roomID, &mautrix.SyncTimeline{
+		SyncEventsList: mautrix.SyncEventsList{Events: evts},
+	})
+	require.NoError(t, err)
+	for _, evt := range evts {
+		assert.Empty(t, evt.RoomID, "stored events should not be modified")
+	}
+	evt, err := store.GetEvent(ctx, roomID, "$evt1")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$evt3"), evt.LastEditID)
+
+	err = store.AddSyncTimeline(ctx, roomID, &mautrix.SyncTimeline{
+		SyncEventsList: mautrix.SyncEventsList{Events: []*event.Event{makeRedaction(4, "$evt3")}},
+	})
+	require.NoError(t, err)
+	evt, err = store.GetEvent(ctx, roomID, "$evt1")
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$evt2"), evt.LastEditID)
+
+	err = store.AddSyncTimeline(ctx, roomID, &mautrix.SyncTimeline{
+		SyncEventsList: mautrix.SyncEventsList{Events: []*event.Event{makeRedaction(5, "$evt2")}},
+	})
+	require.NoError(t, err)
+	evt, err = store.GetEvent(ctx, roomID, "$evt1")
+	require.NoError(t, err)
+	assert.Empty(t, evt.LastEditID)
+}
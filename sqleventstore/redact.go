@@ -0,0 +1,70 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqleventstore
+
+import (
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func preservedContentKeys(evtType event.Type, roomVersion id.RoomVersion) []string {
+	switch evtType.Type {
+	case event.StateMember.Type:
+		keys := []string{"membership"}
+		if roomVersion.RestrictedJoinsFix() {
+			keys = append(keys, "join_authorised_via_users_server")
+		}
+		if roomVersion.UpdatedRedactionRules() {
+			keys = append(keys, "third_party_invite")
+		}
+		return keys
+	case event.StateCreate.Type:
+		if !roomVersion.UpdatedRedactionRules() {
+			return []string{"creator"}
+		}
+		return nil
+	case event.StateJoinRules.Type:
+		if roomVersion.RestrictedJoins() {
+			return []string{"join_rule", "allow"}
+		}
+		return []string{"join_rule"}
+	case event.StatePowerLevels.Type:
+		keys := []string{"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"}
+		if roomVersion.UpdatedRedactionRules() {
+			keys = append(keys, "invite")
+		}
+		return keys
+	case event.StateHistoryVisibility.Type:
+		return []string{"history_visibility"}
+	case event.EventRedaction.Type:
+		if roomVersion.RedactsInContent() {
+			return []string{"redacts"}
+		}
+		return []string{}
+	default:
+		return []string{}
+	}
+}
+
+// redactedCopy returns a copy of the event with the content stripped according to the redaction
+// algorithm of the given room version. A nil key list means the whole content is preserved.
+func redactedCopy(evt *event.Event, roomVersion id.RoomVersion, redaction *event.Event) *event.Event {
+	redacted := *evt
+	redacted.Unsigned = event.Unsigned{RedactedBecause: redaction}
+	keys := preservedContentKeys(evt.Type, roomVersion)
+	if keys == nil {
+		return &redacted
+	}
+	raw := make(map[string]any, len(keys))
+	for _, key := range keys {
+		if val, ok := evt.Content.Raw[key]; ok {
+			raw[key] = val
+		}
+	}
+	redacted.Content = event.Content{Raw: raw}
+	return &redacted
+}
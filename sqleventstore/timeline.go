@@ -0,0 +1,134 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqleventstore
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Register adds the sync handlers required to store timeline events and decrypted content to the given syncer.
+//
+// The decrypted content is only stored if the decrypted events are dispatched through the same syncer,
+// which is the default behavior of [cryptohelper.CryptoHelper].
+func (store *SQLEventStore) Register(syncer mautrix.ExtensibleSyncer) {
+	syncer.OnSync(store.HandleSync)
+	syncer.OnEvent(store.handleDecrypted)
+}
+
+// HandleSync is a [mautrix.SyncHandler] that stores the timelines of all rooms in the sync response.
+func (store *SQLEventStore) HandleSync(ctx context.Context, resp *mautrix.RespSync, since string) bool {
+	log := zerolog.Ctx(ctx)
+	for roomID, room := range resp.Rooms.Join {
+		err := store.AddSyncTimeline(ctx, roomID, &room.Timeline)
+		if err != nil {
+			log.Err(err).Stringer("room_id", roomID).Msg("Failed to store sync timeline")
+		}
+	}
+	for roomID, room := range resp.Rooms.Leave {
+		err := store.AddSyncTimeline(ctx, roomID, &room.Timeline)
+		if err != nil {
+			log.Err(err).Stringer("room_id", roomID).Msg("Failed to store sync timeline")
+		}
+	}
+	return true
+}
+
+var _ mautrix.SyncHandler = (*SQLEventStore)(nil).HandleSync
+
+func (store *SQLEventStore) handleDecrypted(ctx context.Context, evt *event.Event) {
+	if evt.Mautrix.EventSource&event.SourceDecrypted == 0 || evt.Mautrix.EventSource&event.SourceTimeline == 0 {
+		return
+	}
+	err := store.PutDecrypted(ctx, evt)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("event_id", evt.ID).Msg("Failed to store decrypted event")
+	}
+}
+
+// Paginate returns up to limit events before the given event (or the latest events if before is empty)
+// in chronological order. If the local timeline has a gap before the requested events, the missing
+// events are fetched from the server using /messages and stored before returning.
+//
+// Fewer than limit events are only returned if the start of the room was reached.
+func (store *SQLEventStore) Paginate(ctx context.Context, cli *mautrix.Client, roomID id.RoomID, before id.EventID, limit int) ([]*Event, error) {
+	for {
+		beforeKey := int64(math.MaxInt64)
+		if before != "" {
+			evt, err := store.GetEvent(ctx, roomID, before)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get pagination anchor event: %w", err)
+			} else if evt == nil {
+				return nil, fmt.Errorf("pagination anchor event %s not found in store", before)
+			}
+			beforeKey = evt.SortKey
+		}
+		gap, err := store.GetGapBefore(ctx, roomID, beforeKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get gap: %w", err)
+		} else if gap == nil {
+			return store.GetEventsBefore(ctx, roomID, beforeKey, limit)
+		}
+		var count int
+		err = store.QueryRow(ctx, countEventsBetween, roomID, gap.SortKey, beforeKey).Scan(&count)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count local events: %w", err)
+		} else if count >= limit {
+			return store.GetEventsBefore(ctx, roomID, beforeKey, limit)
+		}
+		progressed, err := store.fetchGap(ctx, cli, gap, limit-count)
+		if err != nil {
+			return nil, err
+		} else if !progressed {
+			return store.GetEventsBefore(ctx, roomID, beforeKey, limit)
+		}
+	}
+}
+
+func (store *SQLEventStore) fetchGap(ctx context.Context, cli *mautrix.Client, gap *Gap, limit int) (bool, error) {
+	prevToken := gap.PrevBatch
+	resp, err := cli.Messages(ctx, gap.RoomID, gap.PrevBatch, "", mautrix.DirectionBackward, nil, limit)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch messages to fill gap: %w", err)
+	}
+	for _, evt := range resp.Chunk {
+		evt.RoomID = gap.RoomID
+	}
+	inserted, err := store.FillGap(ctx, gap, resp)
+	if err != nil {
+		return false, fmt.Errorf("failed to store messages: %w", err)
+	}
+	if store.Decrypt != nil {
+		for _, evt := range resp.Chunk {
+			if evt.Type.Type != event.EventEncrypted.Type {
+				continue
+			}
+			evt.Type.Class = event.MessageEventType
+			err = evt.Content.ParseRaw(evt.Type)
+			if err != nil {
+				continue
+			}
+			decrypted, err := store.Decrypt(ctx, evt)
+			if err != nil {
+				zerolog.Ctx(ctx).Debug().Err(err).Stringer("event_id", evt.ID).Msg("Failed to decrypt paginated event")
+				continue
+			}
+			err = store.PutDecrypted(ctx, decrypted)
+			if err != nil {
+				return false, fmt.Errorf("failed to store decrypted event: %w", err)
+			}
+		}
+	}
+	return inserted > 0 || resp.End == "" || resp.End != prevToken, nil
+}
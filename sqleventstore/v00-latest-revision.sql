@@ -0,0 +1,34 @@
+-- v0 -> v1: Latest revision
+
+CREATE TABLE mx_timeline_event (
+	room_id       TEXT   NOT NULL,
+	event_id      TEXT   NOT NULL,
+	sort_key      BIGINT NOT NULL,
+	sender        TEXT   NOT NULL,
+	type          TEXT   NOT NULL,
+	state_key     TEXT,
+	timestamp     BIGINT NOT NULL,
+	relates_to    TEXT   NOT NULL DEFAULT '',
+	relation_type TEXT   NOT NULL DEFAULT '',
+	redacts       TEXT   NOT NULL DEFAULT '',
+	event         jsonb  NOT NULL,
+	decrypted     jsonb,
+	redacted_by   TEXT   NOT NULL DEFAULT '',
+	last_edit_id  TEXT   NOT NULL DEFAULT '',
+
+	PRIMARY KEY (room_id, event_id)
+);
+
+CREATE INDEX mx_timeline_event_sort_key_idx ON mx_timeline_event (room_id, sort_key);
+CREATE INDEX mx_timeline_event_relates_to_idx ON mx_timeline_event (room_id, relates_to);
+CREATE INDEX mx_timeline_event_redacts_idx ON mx_timeline_event (room_id, redacts);
+
+-- A gap means that there are events missing right before the event with the given sort key.
+-- The prev_batch token can be used with /messages to fetch the missing events.
+CREATE TABLE mx_timeline_gap (
+	room_id    TEXT   NOT NULL,
+	sort_key   BIGINT NOT NULL,
+	prev_batch TEXT   NOT NULL
+);
+
+CREATE INDEX mx_timeline_gap_room_idx ON mx_timeline_gap (room_id, sort_key);
@@ -516,3 +516,34 @@ func (store *SQLStateStore) GetHistoryVisibility(ctx context.Context, roomID id.
 	}
 	return
 }
+
+func (store *SQLStateStore) SetCallMember(ctx context.Context, evt *event.Event) error {
+	if evt.RoomID == "" {
+		return fmt.Errorf("room ID is empty")
+	}
+	if evt.Content.Parsed == nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	if !evt.Content.AsCallMember().IsActive() {
+		_, err := store.Exec(ctx, "DELETE FROM mx_call_member WHERE room_id=$1 AND event_type=$2 AND state_key=$3", evt.RoomID, evt.Type.Type, evt.GetStateKey())
+		return err
+	}
+	_, err := store.Exec(ctx, `
+		INSERT INTO mx_call_member (room_id, event_type, state_key, event) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id, event_type, state_key) DO UPDATE SET event=excluded.event
+	`, evt.RoomID, evt.Type.Type, evt.GetStateKey(), dbutil.JSON{Data: evt})
+	return err
+}
+
+func scanCallMember(row dbutil.Scannable) (evt *event.Event, err error) {
+	err = row.Scan(&dbutil.JSON{Data: &evt})
+	if err == nil && evt != nil {
+		err = evt.Content.ParseRaw(evt.Type)
+	}
+	return
+}
+
+func (store *SQLStateStore) GetCallMembers(ctx context.Context, roomID id.RoomID) ([]*event.Event, error) {
+	rows, err := store.Query(ctx, "SELECT event FROM mx_call_member WHERE room_id=$1", roomID)
+	return dbutil.NewRowIterWithError(rows, scanCallMember, err).AsList()
+}
@@ -1,4 +1,4 @@
--- v0 -> v11 (compatible with v3+): Latest revision
+-- v0 -> v12 (compatible with v3+): Latest revision
 
 CREATE TABLE mx_registrations (
 	user_id TEXT PRIMARY KEY
@@ -31,3 +31,12 @@ CREATE TABLE mx_room_state (
 	history_visibility jsonb,
 	members_fetched    BOOLEAN NOT NULL DEFAULT false
 );
+
+CREATE TABLE mx_call_member (
+	room_id    TEXT  NOT NULL,
+	event_type TEXT  NOT NULL,
+	state_key  TEXT  NOT NULL,
+	event      jsonb NOT NULL,
+
+	PRIMARY KEY (room_id, event_type, state_key)
+);
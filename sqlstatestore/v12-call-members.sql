@@ -0,0 +1,9 @@
+-- v12 (compatible with v3+): Add table for MatrixRTC call memberships
+CREATE TABLE mx_call_member (
+	room_id    TEXT  NOT NULL,
+	event_type TEXT  NOT NULL,
+	state_key  TEXT  NOT NULL,
+	event      jsonb NOT NULL,
+
+	PRIMARY KEY (room_id, event_type, state_key)
+);
@@ -8,7 +8,9 @@ package mautrix
 
 import (
 	"context"
+	"fmt"
 	"maps"
+	"slices"
 	"sync"
 
 	"github.com/rs/zerolog"
@@ -57,6 +59,15 @@ type StateStoreUpdater interface {
 	UpdateState(ctx context.Context, evt *event.Event)
 }
 
+// CallMemberStateStore is an optional extension to StateStore for storing MatrixRTC call membership events.
+type CallMemberStateStore interface {
+	// SetCallMember stores the given m.rtc.member or org.matrix.msc3401.call.member event.
+	// Events with empty content should remove the stored membership.
+	SetCallMember(ctx context.Context, evt *event.Event) error
+	// GetCallMembers returns all stored call membership events in the given room.
+	GetCallMembers(ctx context.Context, roomID id.RoomID) ([]*event.Event, error)
+}
+
 func UpdateStateStore(ctx context.Context, store StateStore, evt *event.Event) {
 	if store == nil || evt == nil || evt.StateKey == nil {
 		return
@@ -65,6 +76,17 @@ func UpdateStateStore(ctx context.Context, store StateStore, evt *event.Event) {
 		directUpdater.UpdateState(ctx, evt)
 		return
 	}
+	if evt.Type == event.StateCallMember || evt.Type == event.StateUnstableCallMember {
+		if cmStore, ok := store.(CallMemberStateStore); ok {
+			if err := cmStore.SetCallMember(ctx, evt); err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).
+					Stringer("event_id", evt.ID).
+					Str("event_type", evt.Type.Type).
+					Msg("Failed to update call members in state store")
+			}
+		}
+		return
+	}
 	// We only care about events without a state key (power levels, encryption) or member events with state key
 	if evt.Type != event.StateMember && evt.GetStateKey() != "" {
 		return
@@ -101,6 +123,34 @@ func UpdateStateStore(ctx context.Context, store StateStore, evt *event.Event) {
 	}
 }
 
+// GetRoomPredecessors walks the predecessor chain of the given room using the create events in the state store.
+// The returned list starts with the direct predecessor of the room and ends with the oldest known room.
+// The walk stops when a room has no predecessor or its create event isn't in the store.
+func GetRoomPredecessors(ctx context.Context, store StateStore, roomID id.RoomID) ([]event.Predecessor, error) {
+	var chain []event.Predecessor
+	seen := map[id.RoomID]struct{}{roomID: {}}
+	for {
+		createEvt, err := store.GetCreate(ctx, roomID)
+		if err != nil {
+			return chain, fmt.Errorf("failed to get create event of %s: %w", roomID, err)
+		} else if createEvt == nil {
+			return chain, nil
+		}
+		if createEvt.Content.Parsed == nil {
+			_ = createEvt.Content.ParseRaw(event.StateCreate)
+		}
+		predecessor := createEvt.Content.AsCreate().GetPredecessor()
+		if predecessor.RoomID == "" {
+			return chain, nil
+		} else if _, alreadySeen := seen[predecessor.RoomID]; alreadySeen {
+			return chain, fmt.Errorf("predecessor loop detected at %s", predecessor.RoomID)
+		}
+		seen[predecessor.RoomID] = struct{}{}
+		chain = append(chain, predecessor)
+		roomID = predecessor.RoomID
+	}
+}
+
 // StateStoreSyncHandler can be added as an event handler in the syncer to update the state store automatically.
 //
 //	client.Syncer.(mautrix.ExtensibleSyncer).OnEvent(client.StateStoreSyncHandler)
@@ -119,6 +169,7 @@ type MemoryStateStore struct {
 	Create            map[id.RoomID]*event.Event                            `json:"create"`
 	JoinRules         map[id.RoomID]*event.JoinRulesEventContent            `json:"join_rules"`
 	HistoryVisibility map[id.RoomID]*event.HistoryVisibilityEventContent    `json:"history_visibility"`
+	CallMembers       map[id.RoomID]map[string]*event.Event                 `json:"call_members"`
 
 	registrationsLock     sync.RWMutex
 	membersLock           sync.RWMutex
@@ -126,6 +177,7 @@ type MemoryStateStore struct {
 	encryptionLock        sync.RWMutex
 	joinRulesLock         sync.RWMutex
 	historyVisibilityLock sync.RWMutex
+	callMembersLock       sync.RWMutex
 }
 
 func NewMemoryStateStore() StateStore {
@@ -138,6 +190,7 @@ func NewMemoryStateStore() StateStore {
 		Create:            make(map[id.RoomID]*event.Event),
 		JoinRules:         make(map[id.RoomID]*event.JoinRulesEventContent),
 		HistoryVisibility: make(map[id.RoomID]*event.HistoryVisibilityEventContent),
+		CallMembers:       make(map[id.RoomID]map[string]*event.Event),
 	}
 }
 
@@ -396,6 +449,32 @@ func (store *MemoryStateStore) GetHistoryVisibility(ctx context.Context, roomID
 	return store.HistoryVisibility[roomID], nil
 }
 
+func (store *MemoryStateStore) SetCallMember(ctx context.Context, evt *event.Event) error {
+	if evt.Content.Parsed == nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	key := evt.Type.Type + "|" + evt.GetStateKey()
+	store.callMembersLock.Lock()
+	defer store.callMembersLock.Unlock()
+	if !evt.Content.AsCallMember().IsActive() {
+		delete(store.CallMembers[evt.RoomID], key)
+		return nil
+	}
+	roomMembers, ok := store.CallMembers[evt.RoomID]
+	if !ok {
+		roomMembers = make(map[string]*event.Event)
+		store.CallMembers[evt.RoomID] = roomMembers
+	}
+	roomMembers[key] = evt
+	return nil
+}
+
+func (store *MemoryStateStore) GetCallMembers(ctx context.Context, roomID id.RoomID) ([]*event.Event, error) {
+	store.callMembersLock.RLock()
+	defer store.callMembersLock.RUnlock()
+	return slices.Collect(maps.Values(store.CallMembers[roomID])), nil
+}
+
 func (store *MemoryStateStore) IsEncrypted(ctx context.Context, roomID id.RoomID) (bool, error) {
 	cfg, err := store.GetEncryptionEvent(ctx, roomID)
 	return cfg != nil && cfg.Algorithm == id.AlgorithmMegolmV1, err
@@ -0,0 +1,55 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func setTestCreate(t *testing.T, store mautrix.StateStore, roomID, predecessor id.RoomID) {
+	content := &event.CreateEventContent{}
+	if predecessor != "" {
+		content.Predecessor = &event.Predecessor{RoomID: predecessor, EventID: id.EventID("$tombstone-" + predecessor)}
+	}
+	require.NoError(t, store.SetCreate(context.Background(), &event.Event{
+		Type:    event.StateCreate,
+		RoomID:  roomID,
+		Content: event.Content{Parsed: content},
+	}))
+}
+
+func TestGetRoomPredecessors(t *testing.T) {
+	ctx := context.Background()
+	store := mautrix.NewMemoryStateStore()
+	setTestCreate(t, store, "!v3:example.com", "!v2:example.com")
+	setTestCreate(t, store, "!v2:example.com", "!v1:example.com")
+	setTestCreate(t, store, "!v1:example.com", "")
+
+	chain, err := mautrix.GetRoomPredecessors(ctx, store, "!v3:example.com")
+	require.NoError(t, err)
+	require.Len(t, chain, 2)
+	assert.Equal(t, id.RoomID("!v2:example.com"), chain[0].RoomID)
+	assert.Equal(t, id.RoomID("!v1:example.com"), chain[1].RoomID)
+
+	// Unknown rooms end the chain without an error
+	chain, err = mautrix.GetRoomPredecessors(ctx, store, "!unknown:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, chain)
+
+	setTestCreate(t, store, "!loop1:example.com", "!loop2:example.com")
+	setTestCreate(t, store, "!loop2:example.com", "!loop1:example.com")
+	_, err = mautrix.GetRoomPredecessors(ctx, store, "!loop1:example.com")
+	assert.Error(t, err)
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ThreadSummary contains the known state of a single thread.
+type ThreadSummary struct {
+	RoomID id.RoomID
+	RootID id.EventID
+	// Root is the thread root event, if it has been seen.
+	Root *event.Event
+	// LatestEvent is the most recent event in the thread, if it has been seen.
+	LatestEvent *event.Event
+	// Count is the number of events in the thread, not including the root.
+	Count int
+	// Participated is true if the current user has sent an event in the thread (or sent the root).
+	Participated bool
+	// ReadUpTo is the event ID that the current user's threaded read receipt points at.
+	ReadUpTo id.EventID
+
+	seenEvents map[id.EventID]struct{}
+}
+
+func (ts *ThreadSummary) latestTimestamp() int64 {
+	if ts.LatestEvent != nil {
+		return ts.LatestEvent.Timestamp
+	} else if ts.Root != nil {
+		return ts.Root.Timestamp
+	}
+	return 0
+}
+
+// ThreadTracker keeps track of threads in rooms based on events received from sync,
+// bundled m.thread aggregations and the /threads endpoint.
+type ThreadTracker struct {
+	Client *Client
+
+	threads map[id.RoomID]map[id.EventID]*ThreadSummary
+	lock    sync.RWMutex
+}
+
+// NewThreadTracker creates a new thread tracker for the given client.
+func NewThreadTracker(cli *Client) *ThreadTracker {
+	return &ThreadTracker{
+		Client:  cli,
+		threads: make(map[id.RoomID]map[id.EventID]*ThreadSummary),
+	}
+}
+
+// Register adds the thread tracker's event handlers to the given syncer.
+func (tt *ThreadTracker) Register(syncer ExtensibleSyncer) {
+	syncer.OnEvent(tt.HandleEvent)
+}
+
+func (tt *ThreadTracker) getOrCreate(roomID id.RoomID, rootID id.EventID) *ThreadSummary {
+	roomThreads, ok := tt.threads[roomID]
+	if !ok {
+		roomThreads = make(map[id.EventID]*ThreadSummary)
+		tt.threads[roomID] = roomThreads
+	}
+	thread, ok := roomThreads[rootID]
+	if !ok {
+		thread = &ThreadSummary{
+			RoomID:     roomID,
+			RootID:     rootID,
+			seenEvents: make(map[id.EventID]struct{}),
+		}
+		roomThreads[rootID] = thread
+	}
+	return thread
+}
+
+// HandleEvent updates the tracked threads based on the given event.
+//
+// Thread roots with a bundled m.thread aggregation, events in threads and the current user's
+// threaded read receipts are tracked. Other events are ignored.
+func (tt *ThreadTracker) HandleEvent(ctx context.Context, evt *event.Event) {
+	switch evt.Type.Type {
+	case event.EphemeralEventReceipt.Type:
+		tt.handleReceipt(evt)
+		return
+	}
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	tt.handleEvent(evt)
+}
+
+func (tt *ThreadTracker) handleEvent(evt *event.Event) {
+	if evt.Unsigned.Relations != nil && evt.Unsigned.Relations.Thread != nil {
+		tt.handleRoot(evt, evt.Unsigned.Relations.Thread)
+	}
+	rootID := getThreadParent(evt)
+	if rootID == "" {
+		return
+	}
+	thread := tt.getOrCreate(evt.RoomID, rootID)
+	if _, alreadySeen := thread.seenEvents[evt.ID]; alreadySeen {
+		return
+	}
+	thread.seenEvents[evt.ID] = struct{}{}
+	if thread.LatestEvent == nil || thread.LatestEvent.Timestamp <= evt.Timestamp {
+		thread.LatestEvent = evt
+		thread.Count++
+	} else if thread.Count < len(thread.seenEvents) {
+		thread.Count++
+	}
+	if evt.Sender == tt.Client.UserID {
+		thread.Participated = true
+	}
+}
+
+func getThreadParent(evt *event.Event) id.EventID {
+	if evt.Content.Parsed == nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	switch content := evt.Content.Parsed.(type) {
+	case event.Relatable:
+		return content.OptionalGetRelatesTo().GetThreadParent()
+	case *event.EncryptedEventContent:
+		// Relations are not encrypted, so threads can be tracked without decrypting events
+		return content.RelatesTo.GetThreadParent()
+	default:
+		return ""
+	}
+}
+
+func (tt *ThreadTracker) handleRoot(evt *event.Event, agg *event.ThreadAggregation) {
+	thread := tt.getOrCreate(evt.RoomID, evt.ID)
+	thread.Root = evt
+	if agg.Count > thread.Count {
+		thread.Count = agg.Count
+	}
+	if agg.CurrentUserParticipated || evt.Sender == tt.Client.UserID {
+		thread.Participated = true
+	}
+	if agg.LatestEvent != nil {
+		if agg.LatestEvent.RoomID == "" {
+			agg.LatestEvent.RoomID = evt.RoomID
+		}
+		if thread.LatestEvent == nil || thread.LatestEvent.Timestamp < agg.LatestEvent.Timestamp {
+			thread.LatestEvent = agg.LatestEvent
+		}
+		thread.seenEvents[agg.LatestEvent.ID] = struct{}{}
+	}
+}
+
+func (tt *ThreadTracker) handleReceipt(evt *event.Event) {
+	receipts := evt.Content.AsReceipt()
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	for eventID, receiptTypes := range *receipts {
+		for _, receiptType := range []event.ReceiptType{event.ReceiptTypeRead, event.ReceiptTypeReadPrivate} {
+			receipt, ok := receiptTypes[receiptType][tt.Client.UserID]
+			if !ok || receipt.ThreadID == "" || receipt.ThreadID == event.ReadReceiptThreadMain {
+				continue
+			}
+			tt.getOrCreate(evt.RoomID, receipt.ThreadID).ReadUpTo = eventID
+		}
+	}
+}
+
+// LoadThreads fetches all threads in the given room using [Client.Threads] and adds them to the tracker.
+func (tt *ThreadTracker) LoadThreads(ctx context.Context, roomID id.RoomID, include ThreadListInclude) error {
+	var from string
+	for {
+		resp, err := tt.Client.Threads(ctx, roomID, include, from)
+		if err != nil {
+			return fmt.Errorf("failed to fetch threads: %w", err)
+		}
+		tt.lock.Lock()
+		for _, evt := range resp.Chunk {
+			evt.RoomID = roomID
+			if evt.Unsigned.Relations == nil || evt.Unsigned.Relations.Thread == nil {
+				tt.getOrCreate(roomID, evt.ID).Root = evt
+			} else {
+				tt.handleRoot(evt, evt.Unsigned.Relations.Thread)
+			}
+		}
+		tt.lock.Unlock()
+		if resp.NextBatch == "" || resp.NextBatch == from {
+			return nil
+		}
+		from = resp.NextBatch
+	}
+}
+
+// GetThread returns the summary of a single thread, or nil if the thread isn't known.
+func (tt *ThreadTracker) GetThread(roomID id.RoomID, rootID id.EventID) *ThreadSummary {
+	tt.lock.RLock()
+	defer tt.lock.RUnlock()
+	return tt.threads[roomID][rootID]
+}
+
+// GetThreads returns all known threads in the given room, ordered by the latest activity (newest first).
+func (tt *ThreadTracker) GetThreads(roomID id.RoomID) []*ThreadSummary {
+	tt.lock.RLock()
+	output := make([]*ThreadSummary, 0, len(tt.threads[roomID]))
+	for _, thread := range tt.threads[roomID] {
+		output = append(output, thread)
+	}
+	tt.lock.RUnlock()
+	slices.SortFunc(output, func(a, b *ThreadSummary) int {
+		return cmp.Or(
+			cmp.Compare(b.latestTimestamp(), a.latestTimestamp()),
+			cmp.Compare(a.RootID, b.RootID),
+		)
+	})
+	return output
+}
+
+// MarkRead sends a threaded read receipt for the given event.
+//
+// If threadID is empty, the thread is determined from the tracked events: the receipt goes to the thread
+// the event belongs to, or to the main timeline if the event isn't in a thread.
+func (tt *ThreadTracker) MarkRead(ctx context.Context, roomID id.RoomID, eventID, threadID id.EventID) error {
+	if threadID == "" {
+		threadID = tt.findThread(roomID, eventID)
+	}
+	err := tt.Client.SendReceipt(ctx, roomID, eventID, event.ReceiptTypeRead, &ReqSendReceipt{ThreadID: threadID.String()})
+	if err != nil {
+		return err
+	}
+	if threadID != event.ReadReceiptThreadMain {
+		tt.lock.Lock()
+		tt.getOrCreate(roomID, threadID).ReadUpTo = eventID
+		tt.lock.Unlock()
+	}
+	return nil
+}
+
+func (tt *ThreadTracker) findThread(roomID id.RoomID, eventID id.EventID) id.EventID {
+	tt.lock.RLock()
+	defer tt.lock.RUnlock()
+	for rootID, thread := range tt.threads[roomID] {
+		if rootID == eventID {
+			// Thread roots are part of the main timeline
+			break
+		} else if _, ok := thread.seenEvents[eventID]; ok {
+			return rootID
+		}
+	}
+	return event.ReadReceiptThreadMain
+}
+
+// PaginateThread fetches events in the given thread using the relations endpoint.
+// The returned events are also passed through the tracker.
+func (tt *ThreadTracker) PaginateThread(ctx context.Context, roomID id.RoomID, rootID id.EventID, from string, limit int) (*RespGetRelations, error) {
+	resp, err := tt.Client.GetRelations(ctx, roomID, rootID, &ReqGetRelations{
+		RelationType: event.RelThread,
+		Dir:          DirectionBackward,
+		From:         from,
+		Limit:        limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tt.lock.Lock()
+	for _, evt := range resp.Chunk {
+		evt.RoomID = roomID
+		tt.handleEvent(evt)
+	}
+	tt.lock.Unlock()
+	return resp, nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mautrix_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const sampleThreadRoot = `{
+  "type": "m.room.message",
+  "event_id": "$root",
+  "sender": "@alice:example.com",
+  "origin_server_ts": 1000,
+  "content": {"msgtype": "m.text", "body": "root"},
+  "unsigned": {
+    "m.relations": {
+      "m.thread": {
+        "latest_event": {
+          "type": "m.room.message",
+          "event_id": "$reply1",
+          "sender": "@bob:example.com",
+          "origin_server_ts": 2000,
+          "content": {"msgtype": "m.text", "body": "reply", "m.relates_to": {"rel_type": "m.thread", "event_id": "$root"}}
+        },
+        "count": 3,
+        "current_user_participated": true
+      }
+    }
+  }
+}`
+
+func parseTestEvent(t *testing.T, roomID id.RoomID, data string) *event.Event {
+	var evt event.Event
+	require.NoError(t, json.Unmarshal([]byte(data), &evt))
+	evt.RoomID = roomID
+	require.NoError(t, evt.Content.ParseRaw(evt.Type))
+	return &evt
+}
+
+func TestThreadTracker_HandleEvent(t *testing.T) {
+	ctx := context.Background()
+	roomID := id.RoomID("!room:example.com")
+	tracker := mautrix.NewThreadTracker(&mautrix.Client{UserID: "@me:example.com"})
+
+	root := parseTestEvent(t, roomID, sampleThreadRoot)
+	require.NotNil(t, root.Unsigned.Relations.Thread)
+	tracker.HandleEvent(ctx, root)
+	thread := tracker.GetThread(roomID, "$root")
+	require.NotNil(t, thread)
+	assert.Equal(t, 3, thread.Count)
+	assert.True(t, thread.Participated)
+	assert.Equal(t, id.EventID("$reply1"), thread.LatestEvent.ID)
+
+	// The bundled latest event must not be counted twice
+	tracker.HandleEvent(ctx, root.Unsigned.Relations.Thread.LatestEvent)
+	assert.Equal(t, 3, thread.Count)
+
+	reply := parseTestEvent(t, roomID, `{
+		"type": "m.room.message",
+		"event_id": "$reply2",
+		"sender": "@bob:example.com",
+		"origin_server_ts": 3000,
+		"content": {"msgtype": "m.text", "body": "reply 2", "m.relates_to": {"rel_type": "m.thread", "event_id": "$root"}}
+	}`)
+	tracker.HandleEvent(ctx, reply)
+	assert.Equal(t, 4, thread.Count)
+	assert.Equal(t, id.EventID("$reply2"), thread.LatestEvent.ID)
+
+	other := parseTestEvent(t, roomID, `{
+		"type": "m.room.message",
+		"event_id": "$other",
+		"sender": "@me:example.com",
+		"origin_server_ts": 500,
+		"content": {"msgtype": "m.text", "body": "other", "m.relates_to": {"rel_type": "m.thread", "event_id": "$otherroot"}}
+	}`)
+	tracker.HandleEvent(ctx, other)
+	threads := tracker.GetThreads(roomID)
+	require.Len(t, threads, 2)
+	assert.Equal(t, id.EventID("$root"), threads[0].RootID)
+	assert.Equal(t, id.EventID("$otherroot"), threads[1].RootID)
+	assert.True(t, threads[1].Participated)
+	assert.Equal(t, 1, threads[1].Count)
+}
+
+func TestRelations_ThreadRoundtrip(t *testing.T) {
+	root := parseTestEvent(t, "!room:example.com", sampleThreadRoot)
+	data, err := json.Marshal(root.Unsigned.Relations)
+	require.NoError(t, err)
+	var parsed event.Relations
+	require.NoError(t, json.Unmarshal(data, &parsed))
+	require.NotNil(t, parsed.Thread)
+	assert.Equal(t, 3, parsed.Thread.Count)
+	assert.Equal(t, id.EventID("$reply1"), parsed.Thread.LatestEvent.ID)
+}
@@ -62,6 +62,7 @@ type UnstableFeature struct {
 var (
 	FeatureAsyncUploads              = UnstableFeature{UnstableFlag: "fi.mau.msc2246.stable", SpecVersion: SpecV17}
 	FeatureAppservicePing            = UnstableFeature{UnstableFlag: "fi.mau.msc2659.stable", SpecVersion: SpecV17}
+	FeatureResumableUploads          = UnstableFeature{UnstableFlag: "fi.mau.tus"}
 	FeatureAuthenticatedMedia        = UnstableFeature{UnstableFlag: "org.matrix.msc3916.stable", SpecVersion: SpecV111}
 	FeatureUnstableMutualRooms       = UnstableFeature{UnstableFlag: "uk.half-shot.msc2666.query_mutual_rooms"}
 	FeatureStableMutualRooms         = UnstableFeature{UnstableFlag: "uk.half-shot.msc2666.query_mutual_rooms.stable", SpecVersion: SpecV119}
@@ -76,6 +77,7 @@ var (
 	FeatureStableReplaceProfile      = UnstableFeature{UnstableFlag: "com.beeper.msc4437.stable"}
 	FeatureFullyReadBackward         = UnstableFeature{UnstableFlag: "com.beeper.msc4446"}
 	FeatureUnstableMatrixRTC         = UnstableFeature{UnstableFlag: "org.matrix.msc4143"}
+	FeatureUnstableDelayedEvents     = UnstableFeature{UnstableFlag: "org.matrix.msc4140"}
 	FeatureStableMatrixRTC           = UnstableFeature{UnstableFlag: "org.matrix.msc4143.stable" /*, SpecVersion: SpecV20*/}
 
 	BeeperFeatureHungry                = UnstableFeature{UnstableFlag: "com.beeper.hungry"}